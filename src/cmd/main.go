@@ -16,9 +16,11 @@ import (
 func Main() {
 	verbose := false
 	help := false
+	configPath := ""
 
 	flag.BoolVar(&help, "h", false, "show usage and exit")
 	flag.BoolVar(&verbose, "v", false, "enter in verbose mode (optional)")
+	flag.StringVar(&configPath, "u", "", "config file to load instead of ~/.gimrc, or NONE to skip it (optional)")
 	flag.Parse()
 
 	if help {
@@ -28,12 +30,16 @@ func Main() {
 
 	filePath := os.Args[(len(os.Args) - 1)]
 	if len(filePath) == 0 {
-		fmt.Println("file path must be provided as last arg")
+		fmt.Println("file path, or - to read stdin, must be provided as last arg")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	window, _ := gc.Init()
+	window, err := initScreen(filePath == "-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gim: %v\n", err)
+		os.Exit(1)
+	}
 	defer gc.End()
 
 	window.Keypad(true)
@@ -41,9 +47,11 @@ func Main() {
 	gc.CBreak(true)
 	gc.StartColor()
 
-	editor, err := internal.NewEditor(window, filePath, verbose)
+	editor, err := internal.NewEditor(window, filePath, verbose, configPath)
 	if err != nil {
-		panic(err)
+		gc.End()
+		fmt.Fprintf(os.Stderr, "gim: %v\n", err)
+		os.Exit(1)
 	}
 	defer editor.Close()
 
@@ -58,9 +66,47 @@ func Main() {
 	}()
 
 	for {
-		err = editor.Handle(window.GetChar())
+		// GetChar returns 0 if the editor set an input timeout and no key was typed before it.
+		if key := window.GetChar(); key == 0 {
+			err = editor.Idle()
+		} else {
+			err = editor.Handle(key)
+		}
 		if err == io.EOF {
 			break
 		}
+		if err == internal.ErrQuitWithError {
+			editor.Close()
+			gc.End()
+			os.Exit(1)
+		}
+		if err != nil {
+			// The editor shows recoverable errors itself, so anything returned here is fatal. Report it
+			// once the terminal is restored, rather than dropping it.
+			editor.Close()
+			gc.End()
+			fmt.Fprintf(os.Stderr, "gim: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Start ncurses. When the text to edit comes from stdin (readingStdin), or stdout isn't a terminal,
+// e.g. when gim is in a pipeline, the terminal is opened itself, to read keys from and draw on.
+func initScreen(readingStdin bool) (*gc.Window, error) {
+	if info, err := os.Stdout.Stat(); !readingStdin && err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return gc.Init()
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	screen, err := gc.NewTerm("", tty, tty)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := screen.Set(); err != nil {
+		return nil, err
 	}
+	return gc.StdScr(), nil
 }
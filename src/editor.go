@@ -8,5 +8,8 @@ import "github.com/gbin/goncurses"
 // console the new state of the file).
 type Editor interface {
 	Handle(key goncurses.Key) error
+	// Called when no key was typed before the input timeout, e.g. while waiting for the rest of a
+	// mapping.
+	Idle() error
 	Close()
 }
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/omarnabikhan/gim/src/internal/lsp"
+)
+
+// buffer is the in-memory contents of a file, which is shown in a window.
+type buffer struct {
+	file     *os.File
+	filePath string // The path of the file, as it was given.
+
+	fileContents []string // Each element is a line from the source file without ending in '\n'.
+	modified     bool     // Whether there are changes that haven't been written to disc.
+	changedTick  int      // Incremented on every change, so that changes can be detected.
+	lengthBytes  int      // The size of the file when it was read.
+
+	// Undo history. See undo.go.
+	undoSteps      []undoStep // Steps that were done, oldest first, then steps that were undone.
+	undoIndex      int        // The number of steps in undoSteps that are done.
+	pendingUndo    *undoStep  // The step for the command being run, until it's complete.
+	savedUndoIndex int        // undoIndex when the buffer was written, or -1 if it can't be reached.
+
+	// The last VISUAL mode selection, for "gv" and the '< and '> marks. nil if there wasn't one.
+	lastVisual *visualSelection
+
+	// Language server state. See language_server.go.
+	lspVersion  int              // The version of the text the server was last sent.
+	diagnostics []lsp.Diagnostic // As last published by the server.
+
+	// Set for a directory's buffer, which has no file. See directory.go.
+	dir *directoryListing
+	// Set for a terminal buffer, which has no file. See terminal.go.
+	term *terminal
+	// Set for the buffer read from stdin, until it's written to a file. See stdin.go.
+	stdin bool
+	// Set for a buffer that is only shown alongside others, e.g. the diff below a commit message, so
+	// its window doesn't keep a tab page open on its own. See git.go.
+	auxiliary bool
+	// What highlighting found in the buffer. See git.go.
+	syntax syntaxCache
+
+	bufOpts bufferOptions
+}
+
+// Open the file at filePath and read it into a new buffer, starting with the given options. A
+// directory is listed instead.
+func newBuffer(filePath string, opts bufferOptions) (*buffer, error) {
+	if filePath == cStdinPath {
+		return newStdinBuffer(opts)
+	}
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		return newDirectoryBuffer(filePath, opts)
+	}
+	readonly := false
+	file, err := os.OpenFile(filePath, os.O_RDWR, cReadWriteFileMode)
+	if errors.Is(err, fs.ErrPermission) {
+		// We may still be able to view the file, just not write it.
+		readonly = true
+		file, err = os.OpenFile(filePath, os.O_RDONLY, cReadWriteFileMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fileContents, lengthBytes, encoding := getFileContentsAndLen(file)
+	fileContents, fileFormat := detectFileFormat(fileContents)
+	b := &buffer{
+		file:         file,
+		filePath:     filePath,
+		fileContents: fileContents,
+		lengthBytes:  lengthBytes,
+		bufOpts:      opts,
+	}
+	b.bufOpts.readonly = readonly
+	b.bufOpts.filetype = detectFiletype(filePath)
+	if setOptions, ok := filetypeOptions[b.bufOpts.filetype]; ok {
+		setOptions(&b.bufOpts)
+	}
+	b.bufOpts.fileencoding = encoding
+	b.bufOpts.fileformat = fileFormat
+	return b, nil
+}
+
+// Each string is the entire row. The row does NOT contain the ending newline. Also returns the
+// length of the file in bytes, and its encoding.
+func getFileContentsAndLen(file *os.File) ([]string, int, string) {
+	// Make sure file is being read from beginning.
+	file.Seek(0 /*offset*/, io.SeekStart)
+	contents, err := io.ReadAll(file)
+	if err != nil {
+		panic(err)
+	}
+	return splitFileContents(contents)
+}
+
+// Split the contents of a file into its rows, as for getFileContentsAndLen.
+func splitFileContents(contents []byte) ([]string, int, string) {
+	fileContents := []string{}
+	currRow := strings.Builder{}
+	for _, b := range contents {
+		if b == '\n' {
+			// Line break, meaning we update a new row.
+			fileContents = append(fileContents, currRow.String())
+			currRow = strings.Builder{}
+		} else {
+			currRow.WriteByte(b)
+		}
+	}
+	if currRow.Len() > 0 || len(fileContents) == 0 {
+		// The last line isn't terminated by a newline, or the file is empty. Either way, there is
+		// always at least one line to put the cursor on.
+		fileContents = append(fileContents, currRow.String())
+	}
+	encoding := "utf-8"
+	if !utf8.Valid(contents) {
+		encoding = "latin1"
+	}
+	return fileContents, len(contents), encoding
+}
+
+// If every line ends in '\r', the file uses DOS line endings. The '\r' is stripped from each line,
+// and added back when writing to disc.
+func detectFileFormat(fileContents []string) ([]string, string) {
+	for _, line := range fileContents {
+		if !strings.HasSuffix(line, "\r") {
+			return fileContents, "unix"
+		}
+	}
+	for i, line := range fileContents {
+		fileContents[i] = strings.TrimSuffix(line, "\r")
+	}
+	return fileContents, "dos"
+}
+
+// Returns the buffer of the file at filePath, or nil if it isn't open.
+func (e *editorImpl) findBuffer(filePath string) *buffer {
+	if filePath == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil
+	}
+	for _, buf := range e.buffers {
+		if bufAbs, err := filepath.Abs(buf.filePath); err == nil && bufAbs == abs {
+			return buf
+		}
+	}
+	return nil
+}
+
+// Returns the buffer of the file at filePath, reading the file into a new buffer if it isn't open.
+func (e *editorImpl) loadBuffer(filePath string) (*buffer, error) {
+	if buf := e.findBuffer(filePath); buf != nil {
+		return buf, nil
+	}
+	buf, err := newBuffer(filePath, e.defaultBufOpts)
+	if err != nil {
+		return nil, err
+	}
+	e.buffers = append(e.buffers, buf)
+	e.attachLanguageServer(buf)
+	return buf, nil
+}
+
+// Show the file at filePath in the window, for :e. Like Vim with 'hidden', the buffer that was shown
+// is kept, with its changes.
+func (e *editorImpl) editFile(filePath string) error {
+	buf, err := e.loadBuffer(filePath)
+	if err != nil {
+		return err
+	}
+	if buf.dir != nil {
+		// A directory is listed again each time it's opened, since it may have changed.
+		if err := buf.readDirectory(); err != nil {
+			return err
+		}
+	}
+	if buf == e.buffer {
+		e.clampCursor()
+		return nil
+	}
+	e.closeUndoStep()
+	e.window.buffer = buf
+	e.cursorY, e.cursorX, e.fileLineOffset, e.leftCol = 0, 0, 0, 0
+	if buf.dir != nil {
+		// Start on the first entry after the parent.
+		e.moveCursorToLine(min(cDirectoryHeaderLines+1, len(buf.fileContents)-1))
+	}
+	e.infof("%s", buf.openedMessage())
+	return nil
+}
+
+// The message shown when the buffer is opened, e.g. `file "a.go" 10L 200B`.
+func (b *buffer) openedMessage() string {
+	if b.dir != nil {
+		return fmt.Sprintf(`directory "%s" %s`, b.filePath, plural(len(b.dir.entries)-1, "entry", "entries"))
+	}
+	if b.file == nil {
+		// Read from stdin.
+		return fmt.Sprintf(`"%s" %dL %dB`, b.filePath, len(b.fileContents), b.lengthBytes)
+	}
+	return fmt.Sprintf(`file "%s" %dL %dB`, b.file.Name(), len(b.fileContents), b.lengthBytes)
+}
+
+// Run f with buf as the current buffer, e.g. to change a buffer that isn't shown.
+func (e *editorImpl) withBuffer(buf *buffer, f func()) {
+	if buf == e.buffer {
+		f()
+		return
+	}
+	saved := e.window
+	e.window = newWindow(buf, e.winOpts)
+	e.height = saved.height
+	defer func() {
+		e.closeUndoStep()
+		e.window = saved
+	}()
+	f()
+}
@@ -2,7 +2,6 @@ package internal
 
 import (
 	"fmt"
-	"io"
 	"strings"
 
 	gc "github.com/gbin/goncurses"
@@ -45,8 +44,10 @@ func (ce *commandModeEditor) Handle(key gc.Key) error {
 		// Trim the beginning ":"
 		command := ce.commandBuffer.String()
 		ce.commandBuffer.Reset()
-		defer func() { ce.swapToNormalMode() }()
-		return ce.handleCommandEntered(command)
+		// Leave COMMAND mode before running the command, so that any message it shows is kept.
+		ce.userMsg = ""
+		ce.swapToNormalMode()
+		return ce.runCommand(command)
 	default:
 		// Add to command buffer and update user message.
 		ce.commandBuffer.WriteString(ch)
@@ -56,26 +57,14 @@ func (ce *commandModeEditor) Handle(key gc.Key) error {
 }
 
 func (ce *commandModeEditor) GetCursorYX() (int, int) {
-	return ce.getMaxYForContent() + 2, ce.commandBuffer.Len() + 1
+	// The buffer's cursor doesn't move while a command is typed, so report it as NORMAL mode would.
+	return newNormalEditorMode(ce.editorImpl).GetCursorYX()
 }
 
-func (ce *commandModeEditor) handleCommandEntered(command string) error {
-	switch command {
-	case "w":
-		// Write the contents of the in-memory buffer to disc, and s
-		return ce.writeToDisc()
-	case "q":
-		// Quit the program.
-		ce.Close()
-		return io.EOF
-	case "debug":
-		// Toggle debug mode.
-		ce.verbose = !ce.verbose
-		return nil
-	default:
-		ce.userMsg = fmt.Sprintf("unrecognized command: %s", command)
-		return nil
-	}
+func (ce *commandModeEditor) GetScreenCursorYX() (int, int) {
+	// The command is typed on the bottom row.
+	maxY, _ := ce.screen.MaxYX()
+	return maxY - 1, ce.commandBuffer.Len() + 1
 }
 
 func (ce *commandModeEditor) swapToNormalMode() {
@@ -85,6 +74,11 @@ func (ce *commandModeEditor) swapToNormalMode() {
 }
 
 func (ce *commandModeEditor) updateUserMsg() {
+	if ce.silent {
+		// Commands typed by <silent> mappings aren't shown.
+		ce.userMsg = ""
+		return
+	}
 	// Print the command, preceded by ":"
-	ce.userMsg = fmt.Sprintf(":%s\n", ce.commandBuffer.String())
+	ce.userMsg, ce.userMsgSeverity = fmt.Sprintf(":%s", ce.commandBuffer.String()), severityInfo
 }
@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Commands that may be given a range. See ranges.go.
+var rangeCommands = map[string]bool{
+	"":        true,
+	"normal":  true,
+	"norm":    true,
+	"normal!": true,
+	"norm!":   true,
+	"retab":   true,
+	"ret":     true,
+	"retab!":  true,
+	"ret!":    true,
+	"!":       true,
+	"r":       true,
+	"read":    true,
+}
+
+// Commands that need a window, so they aren't allowed in the config file, which is run before there
+// is one. Nor is quitting, which would leave the editor starting up with nothing to show.
+var windowCommands = map[string]bool{
+	"w":             true,
+	"e":             true,
+	"edit":          true,
+	"q":             true,
+	"wq":            true,
+	"x":             true,
+	"cq":            true,
+	"qa":            true,
+	"qall":          true,
+	"split":         true,
+	"sp":            true,
+	"make":          true,
+	"grep":          true,
+	"vimgrep":       true,
+	"vim":           true,
+	"copen":         true,
+	"cope":          true,
+	"cclose":        true,
+	"ccl":           true,
+	"cnext":         true,
+	"cn":            true,
+	"cprevious":     true,
+	"cprev":         true,
+	"cp":            true,
+	"cNext":         true,
+	"cN":            true,
+	"cfirst":        true,
+	"cfir":          true,
+	"clast":         true,
+	"cla":           true,
+	"cc":            true,
+	"clist":         true,
+	"cl":            true,
+	"tabnew":        true,
+	"tabedit":       true,
+	"tabe":          true,
+	"tabclose":      true,
+	"tabc":          true,
+	"tabonly":       true,
+	"tabo":          true,
+	"tabnext":       true,
+	"tabn":          true,
+	"tabprevious":   true,
+	"tabp":          true,
+	"tabNext":       true,
+	"tabN":          true,
+	"Files":         true,
+	"terminal":      true,
+	"term":          true,
+	"!":             true,
+	"r":             true,
+	"read":          true,
+	"close":         true,
+	"clo":           true,
+	"only":          true,
+	"on":            true,
+	"normal":        true,
+	"norm":          true,
+	"normal!":       true,
+	"norm!":         true,
+	"retab":         true,
+	"ret":           true,
+	"retab!":        true,
+	"ret!":          true,
+	"Fmt":           true,
+	"LspRename":     true,
+	"LspCodeAction": true,
+}
+
+// ErrQuitWithError is returned when the program should quit with an error status, for :cq.
+var ErrQuitWithError = errors.New("quit with an error")
+
+// Run an Ex command, as typed after ":" in COMMAND mode (without the ":"). Commands also come from
+// the config file, where there is no buffer yet, so ranges aren't allowed there.
+func (e *editorImpl) runCommand(command string) error {
+	command = strings.TrimSpace(strings.TrimLeft(command, ":"))
+	var rng *lineRange
+	if e.window != nil {
+		var err error
+		if rng, command, err = e.parseRange(command); err != nil {
+			return err
+		}
+	}
+	name, rawArgs, _ := strings.Cut(command, " ")
+	if strings.HasPrefix(command, "!") {
+		// The shell command follows "!" directly, e.g. ":!ls" or ":%!sort".
+		name, rawArgs = "!", command[1:]
+	} else if n, cmd, ok := strings.Cut(name, "!"); ok && (n == "r" || n == "read") {
+		// ":r!ls" is short for ":r !ls".
+		name, rawArgs = n, "!"+cmd+" "+rawArgs
+	}
+	args := strings.TrimSpace(rawArgs)
+	if rng != nil && !rangeCommands[name] {
+		return fmt.Errorf("no range allowed: %s", name)
+	}
+	if e.window == nil && windowCommands[name] {
+		return fmt.Errorf("%s isn't allowed here", name)
+	}
+	switch name {
+	case "":
+		if rng != nil {
+			// Go to the last line of the range.
+			e.moveCursorToLine(rng.end)
+			e.cursorX = len(leadingWhitespace(e.fileContents[rng.end]))
+		}
+		return nil
+	case "w":
+		// Write the contents of the in-memory buffer to disc, or to another file if one is given.
+		if args != "" {
+			return e.writeToFile(args)
+		}
+		return e.writeToDisc()
+	case "e", "edit":
+		// Show another file in the window.
+		if args == "" {
+			return errors.New("argument required")
+		}
+		return e.editFile(args)
+	case "LspServer":
+		// Set the language server for a filetype. See language_server.go.
+		return e.setLanguageServer(args)
+	case "LspRename", "LspCodeAction":
+		if name == "LspRename" {
+			return e.lspRename(args)
+		}
+		return e.lspCodeAction(args)
+	case "Fmt":
+		// Format the buffer with the filetype's formatter, or 'formatprg'.
+		return e.formatBuffer()
+	case "q":
+		return e.quit()
+	case "wq", "x":
+		// Write the buffer and then quit like :q. Like Vim, :x only writes if there are changes.
+		if name == "wq" || e.modified {
+			write := e.writeToDisc
+			if args != "" {
+				write = func() error { return e.writeToFile(args) }
+			}
+			if err := write(); err != nil {
+				return err
+			}
+		}
+		return e.quit()
+	case "cq":
+		// Quit the program with an error status, e.g. so that git doesn't commit the message being
+		// edited.
+		e.stdoutText = nil
+		e.Close()
+		return ErrQuitWithError
+	case "qa", "qall":
+		// Quit the program, whatever windows there are.
+		e.Close()
+		return io.EOF
+	case "split", "sp":
+		// Split the window, showing a file in the new one if one is given.
+		buf := e.buffer
+		if args != "" {
+			var err error
+			if buf, err = e.loadBuffer(args); err != nil {
+				return err
+			}
+		}
+		return e.splitWindow(buf, 0, false)
+	case "make", "grep", "vimgrep", "vim":
+		switch name {
+		case "make":
+			return e.makeCommand(args)
+		case "grep":
+			return e.grepCommand(args)
+		}
+		return e.vimgrepCommand(name, args)
+	case "copen", "cope", "cclose", "ccl", "cnext", "cn", "cprevious", "cprev", "cp", "cNext", "cN",
+		"cfirst", "cfir", "clast", "cla", "cc", "clist", "cl":
+		// Go through the quickfix list. See quickfix.go.
+		return e.quickfixCommand(name, args)
+	case "tabnew", "tabedit", "tabe", "tabclose", "tabc", "tabonly", "tabo", "tabnext", "tabn",
+		"tabprevious", "tabp", "tabNext", "tabN":
+		// Open, close and go through tab pages. See tabs.go.
+		return e.tabPageCommand(name, args)
+	case "Files":
+		// Open the fuzzy finder on the files under a directory. See finder.go.
+		if args == "" {
+			args = "."
+		}
+		return e.openFinder(args)
+	case "terminal", "term":
+		// Run a program in a terminal buffer. See terminal.go.
+		return e.openTerminal(args)
+	case "!":
+		// Run a shell command, or filter the lines of the range through it. See shell.go.
+		return e.bangCommand(rng, args)
+	case "r", "read":
+		// Insert a command's output or a file below the cursor's line, or the range's last.
+		lineInd := e.getCurrLineInd()
+		if rng != nil {
+			lineInd = rng.end
+		}
+		return e.readCommand(lineInd, args)
+	case "close", "clo":
+		return e.closeWindow(e.window)
+	case "only", "on":
+		e.onlyWindow()
+		return nil
+	case "debug":
+		// Toggle debug mode.
+		e.verbose = !e.verbose
+		return nil
+	case "messages", "mes":
+		// Show the message history, or clear it.
+		if args == "clear" {
+			e.messageHistory = nil
+			return nil
+		}
+		e.showMessageHistory()
+		return nil
+	case "normal", "norm", "normal!", "norm!":
+		// Run keys in NORMAL mode, on each line of the range. Unlike other commands, trailing spaces
+		// are kept since they may be part of the keys.
+		return e.runNormal(rng, strings.TrimLeft(rawArgs, " \t"), strings.HasSuffix(name, "!"))
+	case "retab", "ret", "retab!", "ret!":
+		// Redo the whitespace of the lines in the range (default the whole file) for a new
+		// 'tabstop', which is then set.
+		if rng == nil {
+			rng = &lineRange{start: 0, end: len(e.fileContents) - 1}
+		}
+		tabstop := e.bufOpts.tabstop
+		if args != "" {
+			n, err := strconv.Atoi(args)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid argument: %s", args)
+			}
+			tabstop = n
+		}
+		return e.retab(*rng, tabstop, strings.HasSuffix(name, "!"))
+	case "set", "se":
+		return e.setOptions(args, setBoth)
+	case "setlocal", "setl":
+		return e.setOptions(args, setLocal)
+	case "setglobal", "setg":
+		return e.setOptions(args, setGlobal)
+	default:
+		if cmd, ok := mapCommands[name]; ok {
+			return e.runMapCommand(cmd, args)
+		}
+		return fmt.Errorf("unrecognized command: %s", command)
+	}
+}
+
+// Split the args of a command on whitespace. A backslash escapes the char after it, so that "\ " may
+// be used to include a space in an arg.
+func splitCommandArgs(args string) []string {
+	fields := []string{}
+	field := strings.Builder{}
+	inField := false
+	for i := 0; i < len(args); i++ {
+		switch ch := args[i]; {
+		case ch == '\\' && i+1 < len(args):
+			i++
+			field.WriteByte(args[i])
+			inField = true
+		case ch == ' ' || ch == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(ch)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// Close the window, or the tab page if it's its last one, or quit the program if it's the last window
+// of all. The windows of auxiliary buffers, e.g. the diff below a commit message, don't count.
+func (e *editorImpl) quit() error {
+	if e.window != nil && slices.ContainsFunc(e.windows, func(w *window) bool { return w != e.window && !w.auxiliary }) {
+		return e.closeWindow(e.window)
+	}
+	if e.window != nil && len(e.tabs) > 1 {
+		return e.closeTabPage(e.tabIndex)
+	}
+	e.Close()
+	return io.EOF
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The config file in the user's home directory that is loaded on startup.
+	cDefaultConfigName = ".gimrc"
+	// Passed as the config path to skip loading any config.
+	cNoConfig = "NONE"
+)
+
+// Run the Ex commands in the config file at path, one per line. Blank lines and lines starting with
+// '"' are skipped. An empty path loads ~/.gimrc if there is one. Errors are collected with their line
+// numbers, so that one bad line doesn't stop the rest of the config from being applied.
+func (e *editorImpl) loadConfig(path string) error {
+	if path == cNoConfig {
+		return nil
+	}
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, cDefaultConfigName)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			// Having no config is fine.
+			return nil
+		}
+		return err
+	}
+
+	errs := []string{}
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, `"`) {
+			continue
+		}
+		if err := e.runCommand(line); err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", i+1, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error detected while processing %s:\n%s", path, strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+
+	"github.com/omarnabikhan/gim/src/internal/lsp"
+)
+
+// Diagnostics are problems in a buffer's text, e.g. compile errors. They're published by language
+// servers, or found by the editor itself: when a Go buffer without a language server is written, its
+// package is type-checked with go/types in the background, and if that finds nothing it's checked with
+// "go vet". Each diagnostic's text is underlined in its color, its line is marked in the sign column
+// and has the message at its end, and the whole message is shown when the cursor is on the line.
+//
+//	]d    go to the next diagnostic
+//	[d    go to the previous diagnostic
+//
+// 'signcolumn' is "auto" to show the sign column only when the buffer has diagnostics, "yes" to always
+// show it, or "no".
+
+const (
+	// The width of the sign column, including the space after the sign.
+	cSignWidth = 2
+)
+
+// The letter diagnostics are marked with, by severity.
+var diagnosticSigns = map[int]string{
+	lsp.SeverityError:       "E",
+	lsp.SeverityWarning:     "W",
+	lsp.SeverityInformation: "I",
+	lsp.SeverityHint:        "H",
+}
+
+// A line of "go vet" output, e.g. "./main.go:12:2: fmt.Printf format %d has arg x of wrong type".
+var vetLineRegexp = regexp.MustCompile(`^(.+\.go):(\d+):(\d+): (.*)$`)
+
+// The width of the sign column. 0 if it isn't shown.
+func (e *editorImpl) getSignWidth() int {
+	if e.winOpts.signcolumn == "yes" || (e.winOpts.signcolumn == "auto" && len(e.diagnostics) > 0) {
+		return cSignWidth
+	}
+	return 0
+}
+
+// The width of the columns in front of the text: the sign column and the line numbers.
+func (e *editorImpl) getGutterWidth() int {
+	return e.getSignWidth() + e.getNumberWidth()
+}
+
+// Print the sign column in front of a display line of lineInd. Only a line's first display line has
+// its sign.
+func (e *editorImpl) printSign(window *gc.Window, lineInd int, firstRow bool) {
+	d, ok := e.lineDiagnostic(lineInd)
+	if !ok || !firstRow {
+		window.Print(strings.Repeat(" ", e.getSignWidth()))
+		return
+	}
+	window.AttrOn(diagnosticAttrs(d) | gc.A_BOLD)
+	window.Print(diagnosticSigns[diagnosticRank(d)])
+	window.AttrOff(diagnosticAttrs(d) | gc.A_BOLD)
+	window.Print(strings.Repeat(" ", e.getSignWidth()-1))
+}
+
+// The diagnostic to show for a line of the buffer, if there is one.
+func (e *editorImpl) lineDiagnostic(lineInd int) (lsp.Diagnostic, bool) {
+	found, ok := lsp.Diagnostic{}, false
+	for _, d := range e.diagnostics {
+		if d.Range.Start.Line != lineInd {
+			continue
+		}
+		// The most severe diagnostic is shown. A severity of 0 isn't given, and means an error.
+		if !ok || diagnosticRank(d) < diagnosticRank(found) {
+			found, ok = d, true
+		}
+	}
+	return found, ok
+}
+
+// Orders diagnostics by severity, most severe first.
+func diagnosticRank(d lsp.Diagnostic) int {
+	if d.Severity == 0 {
+		return lsp.SeverityError
+	}
+	return d.Severity
+}
+
+// The attributes a diagnostic is shown with, by its severity.
+func diagnosticAttrs(d lsp.Diagnostic) gc.Char {
+	switch diagnosticRank(d) {
+	case lsp.SeverityError:
+		return gc.ColorPair(COLOR_PAIR_ERROR)
+	case lsp.SeverityWarning:
+		return gc.ColorPair(COLOR_PAIR_WARNING)
+	}
+	return gc.A_DIM
+}
+
+// The first line of a diagnostic's message, after its sign.
+func diagnosticText(d lsp.Diagnostic) string {
+	msg, _, _ := strings.Cut(d.Message, "\n")
+	return fmt.Sprintf("%s: %s", diagnosticSigns[diagnosticRank(d)], msg)
+}
+
+// Print the first line of a diagnostic's message, in at most width columns, colored by its severity.
+func printDiagnostic(window *gc.Window, d lsp.Diagnostic, width int) {
+	text := "  " + diagnosticText(d)
+	if width <= 0 {
+		return
+	}
+	window.AttrOn(diagnosticAttrs(d))
+	window.Print(text[:min(len(text), width)])
+	window.AttrOff(diagnosticAttrs(d))
+}
+
+// The most severe diagnostic whose text covers pos, if there is one. A diagnostic with an empty range
+// covers the char it's at.
+func (e *editorImpl) diagnosticAt(pos position) (lsp.Diagnostic, bool) {
+	found, ok := lsp.Diagnostic{}, false
+	for _, d := range e.diagnostics {
+		if pos.line < d.Range.Start.Line || pos.line > d.Range.End.Line {
+			continue
+		}
+		start, end := bufferPosition(e.fileContents, d.Range.Start), bufferPosition(e.fileContents, d.Range.End)
+		if start == end {
+			end.col++
+		}
+		if pos.before(start) || !pos.before(end) {
+			continue
+		}
+		if !ok || diagnosticRank(d) < diagnosticRank(found) {
+			found, ok = d, true
+		}
+	}
+	return found, ok
+}
+
+// Move the cursor to the start of the count'th diagnostic after it, or before it if !forward. Stops at
+// the last one there is.
+func (e *editorImpl) jumpToDiagnostic(count int, forward bool) error {
+	starts := []position{}
+	for _, d := range e.diagnostics {
+		starts = append(starts, bufferPosition(e.fileContents, d.Range.Start))
+	}
+	slices.SortFunc(starts, func(a, b position) int {
+		if a.before(b) {
+			return -1
+		}
+		if b.before(a) {
+			return 1
+		}
+		return 0
+	})
+	starts = slices.Compact(starts)
+	if !forward {
+		slices.Reverse(starts)
+	}
+	from, found := e.cursorPosition(), false
+	for _, start := range starts {
+		if count == 0 {
+			break
+		}
+		if (forward && from.before(start)) || (!forward && start.before(from)) {
+			from, found = start, true
+			count--
+		}
+	}
+	if !found {
+		return errors.New("no more diagnostics")
+	}
+	e.setCursorPosition(from)
+	return nil
+}
+
+// Keep the diagnostics on the lines they were on when lines [start, end) are replaced with n lines.
+// Diagnostics on lines that are removed are dropped. Language servers publish new ones after a change
+// anyway, but the editor's own are only found again when the buffer is written.
+func (e *editorImpl) shiftDiagnostics(start int, end int, n int) {
+	delta := n - (end - start)
+	if delta == 0 {
+		return
+	}
+	kept := e.diagnostics[:0]
+	for _, d := range e.diagnostics {
+		switch {
+		case d.Range.Start.Line >= end:
+			d.Range.Start.Line += delta
+			d.Range.End.Line += delta
+		case d.Range.Start.Line >= start+n:
+			continue
+		case d.Range.End.Line >= end:
+			d.Range.End.Line += delta
+		}
+		kept = append(kept, d)
+	}
+	e.diagnostics = kept
+}
+
+// goDiagnostic is a problem found in a Go package, at the start of the text it's about.
+type goDiagnostic struct {
+	loc      location
+	severity int
+	source   string
+	msg      string
+}
+
+// Check the package of the buffer's Go file in the background, and show what's found in the buffers of
+// the package's files. Nothing is done while a language server serves Go, as it publishes its own.
+func (e *editorImpl) checkGoPackage() {
+	if e.bufOpts.filetype != "go" {
+		return
+	}
+	if _, ok := e.languageServers[e.bufOpts.filetype]; ok {
+		return
+	}
+	path, err := filepath.Abs(e.filePath)
+	if err != nil {
+		return
+	}
+	query := e.newGoPackageQuery(path)
+	e.runInBackground(func() func() {
+		diags, err := query.check()
+		return func() {
+			if err != nil {
+				e.reportError(err)
+				return
+			}
+			e.setGoDiagnostics(filepath.Dir(path), diags)
+		}
+	})
+}
+
+// Replace the diagnostics of the open Go buffers in dir with diags.
+func (e *editorImpl) setGoDiagnostics(dir string, diags []goDiagnostic) {
+	for _, buf := range e.buffers {
+		abs, err := filepath.Abs(buf.filePath)
+		if err != nil || filepath.Dir(abs) != dir || buf.bufOpts.filetype != "go" {
+			continue
+		}
+		buf.diagnostics = nil
+		for _, d := range diags {
+			if d.loc.path == abs {
+				buf.diagnostics = append(buf.diagnostics, d.lspDiagnostic(buf.fileContents))
+			}
+		}
+	}
+}
+
+// The diagnostic in lines, whose range is the word it's at, or the char if it isn't at a word.
+func (d goDiagnostic) lspDiagnostic(lines []string) lsp.Diagnostic {
+	lineInd := max(0, min(d.loc.pos.line, len(lines)-1))
+	line := lines[lineInd]
+	start := min(d.loc.pos.col, len(line))
+	end := start
+	for end < len(line) && charClass(line[end], false) == wordClass {
+		end++
+	}
+	if end == start && end < len(line) {
+		_, size := utf8.DecodeRuneInString(line[end:])
+		end += size
+	}
+	return lsp.Diagnostic{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: lineInd, Character: lsp.UTF16Len(line[:start])},
+			End:   lsp.Position{Line: lineInd, Character: lsp.UTF16Len(line[:end])},
+		},
+		Severity: d.severity,
+		Source:   d.source,
+		Message:  d.msg,
+	}
+}
+
+// Find the problems in the package: its syntax errors if it has any, otherwise its type errors,
+// otherwise what "go vet" finds.
+func (q goPackageQuery) check() ([]goDiagnostic, error) {
+	fset := token.NewFileSet()
+	diags := []goDiagnostic{}
+	files, err := q.parsePackage(fset, func(err error) {
+		var errs scanner.ErrorList
+		if errors.As(err, &errs) {
+			for _, se := range errs {
+				diags = append(diags, goDiagnostic{tokenLocation(se.Pos), lsp.SeverityError, "syntax", se.Msg})
+			}
+		}
+	})
+	if err != nil || len(diags) > 0 {
+		return diags, err
+	}
+	conf := goTypesConfig(fset, func(err error) {
+		if te, ok := err.(types.Error); ok {
+			diags = append(diags, goDiagnostic{tokenLocation(fset.Position(te.Pos)), lsp.SeverityError, "compiler", te.Msg})
+		}
+	})
+	conf.Check(files[0].Name.Name, fset, files, nil)
+	if len(diags) > 0 {
+		return diags, nil
+	}
+	return vetPackage(filepath.Dir(q.path)), nil
+}
+
+// Run "go vet" on the package in dir, and return what it finds as warnings. Nothing is found if go
+// isn't installed or can't vet the package.
+func vetPackage(dir string) []goDiagnostic {
+	cmd := exec.Command("go", "vet", ".")
+	cmd.Dir = dir
+	// go vet exits with an error when it finds problems, so only its output matters.
+	out, _ := cmd.CombinedOutput()
+	diags := []goDiagnostic{}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := vetLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		path := m[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		lineNum, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		loc := tokenLocation(token.Position{Filename: path, Line: lineNum, Column: col})
+		diags = append(diags, goDiagnostic{loc, lsp.SeverityWarning, "vet", m[4]})
+	}
+	return diags
+}
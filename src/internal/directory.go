@@ -0,0 +1,375 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A directory is shown in a buffer that lists its entries, like Vim's netrw, e.g. for `gim .` or
+// `:e src`. The first line names the directory and how it's sorted, and then come the entries,
+// directories first with a trailing "/", starting with "../" for the parent. In the buffer:
+//
+//	<Enter>  open the file, or the directory, under the cursor
+//	-        open the parent directory
+//	s        sort by name, then by time modified (newest first), then by size (largest first)
+//	r        reverse the order
+//	gh       show or hide hidden files, whose names start with "."
+//	%        create a file, and open it
+//	d        create a directory
+//	R        rename or move the entry under the cursor
+//	C        copy the entry under the cursor
+//	D        delete the entry under the cursor, after asking
+//
+// Names are asked for on the bottom row, relative to the directory.
+
+const (
+	cDirectoryFiletype = "directory"
+	// The header line comes before the entries.
+	cDirectoryHeaderLines = 1
+)
+
+var directorySorts = []string{"name", "time", "size"}
+
+// directoryListing is the state of a directory's buffer.
+type directoryListing struct {
+	entries    []directoryEntry // As listed, starting with the parent.
+	sortBy     string           // One of directorySorts.
+	reverse    bool
+	showHidden bool
+}
+
+// directoryEntry is a file or directory in a listing.
+type directoryEntry struct {
+	name  string
+	isDir bool
+	info  fs.FileInfo
+}
+
+// Make a buffer listing the directory at path.
+func newDirectoryBuffer(path string, opts bufferOptions) (*buffer, error) {
+	b := &buffer{filePath: path, bufOpts: opts, dir: &directoryListing{sortBy: "name"}}
+	b.bufOpts.filetype = cDirectoryFiletype
+	// The file commands act on the entry of the cursor's line by its index, so the lines mustn't move.
+	b.bufOpts.readonly, b.bufOpts.modifiable = true, false
+	if err := b.readDirectory(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Read the directory's entries into the buffer. Like the quickfix buffer, the buffer is replaced
+// rather than changed, and has no undo history.
+func (b *buffer) readDirectory() error {
+	dirEntries, err := os.ReadDir(b.filePath)
+	if err != nil {
+		return err
+	}
+	d := b.dir
+	d.entries = d.entries[:0]
+	for _, entry := range dirEntries {
+		if !d.showHidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The entry was removed since the directory was read.
+			continue
+		}
+		d.entries = append(d.entries, directoryEntry{name: entry.Name(), isDir: entry.IsDir(), info: info})
+	}
+	slices.SortFunc(d.entries, func(a, b directoryEntry) int {
+		if a.isDir != b.isDir {
+			if a.isDir {
+				return -1
+			}
+			return 1
+		}
+		order := 0
+		switch d.sortBy {
+		case "time":
+			order = b.info.ModTime().Compare(a.info.ModTime())
+		case "size":
+			order = cmp.Compare(b.info.Size(), a.info.Size())
+		}
+		order = cmp.Or(order, strings.Compare(a.name, b.name))
+		if d.reverse {
+			return -order
+		}
+		return order
+	})
+	d.entries = append([]directoryEntry{{name: "..", isDir: true}}, d.entries...)
+
+	abs, err := filepath.Abs(b.filePath)
+	if err != nil {
+		abs = b.filePath
+	}
+	header := fmt.Sprintf(`" %s  sorted by %s`, abs, d.sortBy)
+	if d.reverse {
+		header += ", reversed"
+	}
+	lines := []string{header}
+	for _, entry := range d.entries {
+		if entry.isDir {
+			lines = append(lines, entry.name+"/")
+		} else {
+			lines = append(lines, entry.name)
+		}
+	}
+	b.fileContents = lines
+	b.undoSteps, b.undoIndex, b.pendingUndo = nil, 0, nil
+	b.changedTick++
+	return nil
+}
+
+// The entry on the line at lineInd of the directory's buffer, and whether there is one.
+func (b *buffer) directoryEntryAt(lineInd int) (directoryEntry, bool) {
+	i := lineInd - cDirectoryHeaderLines
+	if i < 0 || i >= len(b.dir.entries) {
+		return directoryEntry{}, false
+	}
+	return b.dir.entries[i], true
+}
+
+// List the directory again, e.g. after it changed, with the cursor on the entry called name, or on
+// the same line if there isn't one.
+func (e *editorImpl) refreshDirectory(name string) error {
+	if name == "" {
+		if entry, ok := e.directoryEntryAt(e.getCurrLineInd()); ok {
+			name = entry.name
+		}
+	}
+	if err := e.readDirectory(); err != nil {
+		return err
+	}
+	e.gotoDirectoryEntry(name)
+	return nil
+}
+
+// Put the cursor on the entry called name, if there is one.
+func (e *editorImpl) gotoDirectoryEntry(name string) {
+	for i, entry := range e.dir.entries {
+		if entry.name == name {
+			e.moveCursorToLine(i + cDirectoryHeaderLines)
+			e.cursorX = 0
+			return
+		}
+	}
+	e.clampCursor()
+}
+
+// Handle a key in a directory's buffer. Returns false if it isn't one of the directory's keys, so it
+// should be handled as usual.
+func (e *editorImpl) directoryKey(k string) (bool, error) {
+	d := e.dir
+	entry, onEntry := e.directoryEntryAt(e.getCurrLineInd())
+	path := filepath.Join(e.filePath, entry.name)
+	switch k {
+	case "enter":
+		if !onEntry {
+			return true, errBell
+		}
+		return true, e.editFile(path)
+	case "-":
+		return true, e.openParentDirectory()
+	case "s":
+		d.sortBy = directorySorts[(slices.Index(directorySorts, d.sortBy)+1)%len(directorySorts)]
+		return true, e.refreshDirectory("")
+	case "r":
+		d.reverse = !d.reverse
+		return true, e.refreshDirectory("")
+	case "gh":
+		d.showHidden = !d.showHidden
+		return true, e.refreshDirectory("")
+	case "%", "d":
+		prompt := "New file: "
+		if k == "d" {
+			prompt = "New directory: "
+		}
+		e.askInput(prompt, "", func(name string) error { return e.createDirectoryEntry(name, k == "d") })
+		return true, nil
+	}
+	if !onEntry || entry.name == ".." {
+		switch k {
+		case "R", "C", "D":
+			return true, errBell
+		}
+		return false, nil
+	}
+	switch k {
+	case "R":
+		e.askInput("Rename to: ", entry.name, func(name string) error {
+			if name == "" || name == entry.name {
+				return nil
+			}
+			return e.renameDirectoryEntry(entry.name, name)
+		})
+		return true, nil
+	case "C":
+		e.askInput("Copy to: ", entry.name, func(name string) error {
+			if name == "" || name == entry.name {
+				return nil
+			}
+			target := filepath.Join(e.filePath, name)
+			if _, err := os.Lstat(target); err == nil {
+				return fmt.Errorf("already exists: %s", name)
+			}
+			if err := copyPath(path, target); err != nil {
+				return err
+			}
+			e.infof("copied %s to %s", entry.name, name)
+			return e.refreshDirectory(name)
+		})
+		return true, nil
+	case "D":
+		question := fmt.Sprintf("Delete %s?", entry.name)
+		if entry.isDir {
+			question = fmt.Sprintf("Delete %s/ and everything in it?", entry.name)
+		}
+		e.askConfirm(question, func() error {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			e.infof("deleted %s", entry.name)
+			return e.refreshDirectory("")
+		})
+		return true, nil
+	}
+	return false, nil
+}
+
+// Open the parent of the directory shown, with the cursor on the directory.
+func (e *editorImpl) openParentDirectory() error {
+	abs, err := filepath.Abs(e.filePath)
+	if err != nil {
+		return err
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return errBell
+	}
+	if rel, err := filepath.Rel(".", parent); err == nil && !filepath.IsAbs(e.filePath) {
+		// Keep relative paths relative, as they're shown in the status line.
+		parent = rel
+	}
+	if err := e.editFile(parent); err != nil {
+		return err
+	}
+	e.gotoDirectoryEntry(filepath.Base(abs))
+	return nil
+}
+
+// Create a file or directory called name in the directory shown. A new file is opened.
+func (e *editorImpl) createDirectoryEntry(name string, isDir bool) error {
+	if name == "" {
+		return nil
+	}
+	path := filepath.Join(e.filePath, name)
+	if isDir {
+		if err := os.MkdirAll(path, 0777); err != nil {
+			return err
+		}
+		return e.refreshDirectory(strings.Split(name, string(filepath.Separator))[0])
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, cReadWriteFileMode)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return e.editFile(path)
+}
+
+// Rename the entry called from to to, which may be in another directory. Open buffers of the file
+// follow it.
+func (e *editorImpl) renameDirectoryEntry(from string, to string) error {
+	oldPath, newPath := filepath.Join(e.filePath, from), filepath.Join(e.filePath, to)
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("already exists: %s", to)
+	}
+	if buf := e.findBuffer(oldPath); buf != nil {
+		buf.filePath = newPath
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		if buf := e.findBuffer(newPath); buf != nil {
+			buf.filePath = oldPath
+		}
+		return err
+	}
+	e.infof("renamed %s to %s", from, to)
+	return e.refreshDirectory(to)
+}
+
+// Copy the file or directory at from to to, which doesn't exist.
+func copyPath(from string, to string) error {
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		if isWithin(to, from) {
+			// The copy would be copied into itself, forever.
+			return fmt.Errorf("can't copy %s into itself", from)
+		}
+		if err := os.Mkdir(to, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(from)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyPath(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	case !info.Mode().IsRegular():
+		return errors.New("can't copy " + from)
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Whether path, which may not exist, is dir or inside it, with symlinks resolved.
+func isWithin(path string, dir string) bool {
+	resolve := func(p string) string {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		// The path may not exist yet, but its directory does.
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+			p = filepath.Join(parent, filepath.Base(p))
+		}
+		return p
+	}
+	rel, err := filepath.Rel(resolve(dir), resolve(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
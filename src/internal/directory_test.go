@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyPath(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(root, "dst")
+	if err := copyPath(src, dst); err != nil {
+		t.Fatalf("copyPath(%q, %q) = %v", src, dst, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dst, "sub", "a.txt")); err != nil || string(content) != "a\n" {
+		t.Errorf("the copied file has %q, %v", content, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "sub/a.txt" {
+		t.Errorf("the copied symlink points to %q, %v", target, err)
+	}
+
+	// A directory can't be copied into itself, directly or through a symlink to it.
+	if err := os.Symlink(src, filepath.Join(root, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	for _, into := range []string{
+		src,
+		filepath.Join(src, "copy"),
+		filepath.Join(src, "sub", "copy"),
+		filepath.Join(root, "alias", "copy"),
+	} {
+		if err := copyPath(src, into); err == nil {
+			t.Errorf("copyPath(%q, %q) copied a directory into itself", src, into)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(src, "copy")); err == nil {
+		t.Errorf("copying into itself left %s", filepath.Join(src, "copy"))
+	}
+	// A sibling whose name starts with the directory's isn't in it.
+	if err := copyPath(src, src+"2"); err != nil {
+		t.Errorf("copyPath(%q, %q) = %v", src, src+"2", err)
+	}
+}
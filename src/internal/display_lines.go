@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Chars after which a line may be broken when 'linebreak' is set. Mirrors Vim's default 'breakat'.
+	cBreakAt = " \t!@*-+;:,./?"
+)
+
+// displayLine is a single row of the screen. With 'wrap' set, a file line that is wider than the
+// screen spans several display lines. With 'nowrap', each file line maps to exactly one display
+// line which is shifted left by leftCol. Tabs take up to 'tabstop' columns, so the byte offsets and
+// the columns of a row differ when the line has tabs.
+type displayLine struct {
+	lineInd    int    // Index into fileContents.
+	start, end int    // Byte offsets [start, end) of the file line shown on this row.
+	prefix     string // Drawn before the text on continuation rows ('showbreak' and 'breakindent').
+}
+
+// The number of screen columns the prefix takes up. Like the text, each of its chars takes one,
+// however many bytes it is.
+func (dl displayLine) prefixWidth() int {
+	return utf8.RuneCountInString(dl.prefix)
+}
+
+// The index of the row, of the rows of a line, that shows the byte offset x. Offsets past the end
+// are on the last row.
+func displayRowOf(rows []displayLine, x int) int {
+	for i, dl := range rows {
+		if x < dl.end {
+			return i
+		}
+	}
+	return len(rows) - 1
+}
+
+// The number of screen columns available for file contents.
+func (e *editorImpl) getTextWidth() int {
+	_, maxX := e.screen.MaxYX()
+	return max(1, maxX-e.getGutterWidth())
+}
+
+// The width of the line number column, including the space after the numbers. 0 if there are no
+// line numbers.
+func (e *editorImpl) getNumberWidth() int {
+	if !e.winOpts.number && !e.winOpts.relativenumber {
+		return 0
+	}
+	return max(3, len(strconv.Itoa(len(e.fileContents)))) + 1
+}
+
+// The line number to show in front of the first display line of lineInd, as per 'number' and
+// 'relativenumber'.
+func (e *editorImpl) formatLineNumber(lineInd int) string {
+	width := e.getNumberWidth() - 1
+	currLineInd := e.getCurrLineInd()
+	if !e.winOpts.relativenumber {
+		return fmt.Sprintf("%*d ", width, lineInd+1)
+	}
+	if lineInd == currLineInd {
+		if e.winOpts.number {
+			// Like Vim, the cursor's line shows its absolute number aligned to the left.
+			return fmt.Sprintf("%-*d ", width, lineInd+1)
+		}
+		return fmt.Sprintf("%*d ", width, 0)
+	}
+	return fmt.Sprintf("%*d ", width, max(lineInd-currLineInd, currLineInd-lineInd))
+}
+
+// The number of screen rows available for file contents.
+func (e *editorImpl) getTextHeight() int {
+	return e.getMaxYForContent() + 1
+}
+
+// The number of screen columns ch takes up when it starts at the display column col. A tab goes up to
+// the next multiple of 'tabstop'.
+func (e *editorImpl) charWidth(ch rune, col int) int {
+	if ch == '\t' {
+		return e.bufOpts.tabstop - col%e.bufOpts.tabstop
+	}
+	return 1
+}
+
+// The display column that the byte offset x of line starts at. Offsets past the end of the line count
+// one column for each byte past it.
+func (e *editorImpl) displayCol(line string, x int) int {
+	col := 0
+	for i, ch := range line {
+		if i >= x {
+			return col
+		}
+		col += e.charWidth(ch, col)
+	}
+	return col + max(x-len(line), 0)
+}
+
+// The byte offset of the char of line that covers the display column col, or the length of the line
+// if it's past the end.
+func (e *editorImpl) byteColAt(line string, col int) int {
+	c := 0
+	for i, ch := range line {
+		c += e.charWidth(ch, c)
+		if c > col {
+			return i
+		}
+	}
+	return len(line)
+}
+
+// Split the file line at lineInd into the display lines it occupies.
+func (e *editorImpl) wrapLine(lineInd int) []displayLine {
+	line := e.fileContents[lineInd]
+	width := e.getTextWidth()
+	if !e.winOpts.wrap {
+		start := e.byteColAt(line, e.leftCol)
+		end := e.byteColAt(line, e.leftCol+width)
+		return []displayLine{{lineInd: lineInd, start: start, end: end}}
+	}
+
+	rows := []displayLine{}
+	start, prefix := 0, ""
+	for {
+		avail := width - utf8.RuneCountInString(prefix)
+		if avail < 1 {
+			// The prefix alone would fill the row, so drop it rather than never making progress.
+			prefix, avail = "", width
+		}
+		// Find where the row ends: at the first char that doesn't fit.
+		startCol := e.displayCol(line, start)
+		end, col := len(line), startCol
+		for i, ch := range line[start:] {
+			w := e.charWidth(ch, col)
+			if col+w-startCol > avail && i > 0 {
+				end = start + i
+				break
+			}
+			col += w
+		}
+		if end == len(line) {
+			rows = append(rows, displayLine{lineInd: lineInd, start: start, end: len(line), prefix: prefix})
+			return rows
+		}
+		if e.winOpts.linebreak {
+			// Break after the last 'breakat' char that fits, if there is one.
+			for i := end; i > start; i-- {
+				if strings.IndexByte(cBreakAt, line[i-1]) >= 0 {
+					end = i
+					break
+				}
+			}
+		}
+		rows = append(rows, displayLine{lineInd: lineInd, start: start, end: end, prefix: prefix})
+		start = end
+		prefix = e.globalOpts.showbreak
+		if e.winOpts.breakindent {
+			// The indent's tabs are expanded to spaces, so that the prefix is as wide as it is long.
+			prefix += strings.Repeat(" ", e.displayCol(line, len(leadingWhitespace(line))))
+		}
+	}
+}
+
+// Returns the display lines shown on screen, starting from the top of the window. Only file lines
+// that fit entirely are included, unless the very first line alone is taller than the window, when
+// as many of its rows are shown as fit, from topLineSkip. The returned bool is true if a file line
+// was left off because it didn't fit.
+func (e *editorImpl) getDisplayLines() ([]displayLine, bool) {
+	height := e.getTextHeight()
+	rows := []displayLine{}
+	for i := e.fileLineOffset; i < len(e.fileContents) && len(rows) < height; i++ {
+		lineRows := e.wrapLine(i)
+		if len(rows)+len(lineRows) > height {
+			if len(rows) == 0 {
+				skip := e.topLineSkip(lineRows)
+				return lineRows[skip : skip+height], false
+			}
+			return rows, true
+		}
+		rows = append(rows, lineRows...)
+	}
+	return rows, false
+}
+
+// The number of rows of the line at the top of the window, whose rows are rows, that are above the
+// window. That's 0 unless the line is taller than the window, and the cursor is on a row of it that
+// would be below the window, when the view starts so that the cursor is on the last row.
+func (e *editorImpl) topLineSkip(rows []displayLine) int {
+	height := e.getTextHeight()
+	if len(rows) <= height || e.getCurrLineInd() != e.fileLineOffset {
+		return 0
+	}
+	return max(0, displayRowOf(rows, e.cursorX)-height+1)
+}
+
+// Map a cursor position in the file (y relative to fileLineOffset, x a byte offset into the line)
+// to the row and column on screen.
+func (e *editorImpl) bufferToScreenYX(y int, x int) (int, int) {
+	lineInd := e.fileLineOffset + y
+	if lineInd < 0 || lineInd >= len(e.fileContents) {
+		return y, x
+	}
+	row := 0
+	for i := e.fileLineOffset; i < lineInd; i++ {
+		row += len(e.wrapLine(i))
+	}
+	line := e.fileContents[lineInd]
+	rows := e.wrapLine(lineInd)
+	if lineInd == e.fileLineOffset {
+		row -= e.topLineSkip(rows)
+	}
+	r := displayRowOf(rows, x)
+	dl := rows[r]
+	col := dl.prefixWidth() + e.displayCol(line, x) - e.displayCol(line, dl.start)
+	if !e.winOpts.wrap {
+		col = e.displayCol(line, x) - e.leftCol
+	}
+	if e.mode != INSERT_MODE && x < len(line) && line[x] == '\t' {
+		// Like Vim, the cursor is shown at the end of a tab, except when inserting.
+		col += e.charWidth('\t', e.displayCol(line, x)) - 1
+	}
+	return row + r, e.getGutterWidth() + max(0, min(col, e.getTextWidth()-1))
+}
+
+// Map a row and column on screen to the position in the file shown there. Past the end of a line is
+// the end of the line. Returns false if no file line is shown on the row.
+func (e *editorImpl) screenToBuffer(y int, x int) (position, bool) {
+	rows, _ := e.getDisplayLines()
+	if y < 0 || y >= len(rows) {
+		return position{}, false
+	}
+	dl := rows[y]
+	line := e.fileContents[dl.lineInd]
+	startCol := e.displayCol(line, dl.start)
+	if !e.winOpts.wrap {
+		startCol = e.leftCol
+	}
+	col := e.byteColAt(line, startCol+max(0, x-e.getGutterWidth()-dl.prefixWidth()))
+	if col >= dl.end && dl.end < len(line) {
+		// The rest of the line is on the next row.
+		col = max(dl.start, dl.end-1)
+	}
+	return position{dl.lineInd, col}, true
+}
+
+// GetScreenCursorYX - The default implementation maps the mode's cursor through the display lines of
+// the current window.
+func (e *editorImpl) GetScreenCursorYX() (int, int) {
+	y, x := e.bufferToScreenYX(e.activeEditorMode.GetCursorYX())
+	return e.top + y, x
+}
+
+// Adjust fileLineOffset (and leftCol when not wrapping) so that the cursor is visible. Returns true
+// if the view was scrolled vertically.
+func (e *editorImpl) scrollToCursor() bool {
+	scrolled := false
+	lineInd := e.getCurrLineInd()
+	if e.cursorY < 0 {
+		e.fileLineOffset, e.cursorY = lineInd, 0
+		scrolled = true
+	}
+	// Scroll down one file line at a time until every display line of the cursor's line fits.
+	height := e.getTextHeight()
+	for e.fileLineOffset < lineInd {
+		rows := 0
+		for i := e.fileLineOffset; i <= lineInd; i++ {
+			rows += len(e.wrapLine(i))
+		}
+		if rows <= height {
+			break
+		}
+		e.fileLineOffset += 1
+		e.cursorY -= 1
+		scrolled = true
+	}
+	if !e.winOpts.wrap {
+		e.scrollHorizontal()
+	}
+	return scrolled
+}
+
+// With 'nowrap', shift leftCol so that the cursor's column is on screen. The view moves by at least
+// 'sidescroll' columns, or re-centers the cursor when 'sidescroll' is 0.
+func (e *editorImpl) scrollHorizontal() {
+	_, x := e.activeEditorMode.GetCursorYX()
+	x = e.displayCol(e.fileContents[e.getCurrLineInd()], x)
+	width := e.getTextWidth()
+	if x >= e.leftCol && x < e.leftCol+width {
+		return
+	}
+	if e.globalOpts.sidescroll == 0 {
+		e.leftCol = max(0, x-width/2)
+		return
+	}
+	if x < e.leftCol {
+		e.leftCol = max(0, min(x, e.leftCol-e.globalOpts.sidescroll))
+	} else {
+		e.leftCol = max(x-width+1, e.leftCol+e.globalOpts.sidescroll)
+	}
+}
+
+// Move the cursor by dy display lines, rather than file lines. This differs from moveCursorVertical
+// only when long lines are wrapped.
+func (e *editorImpl) moveCursorDisplayVertical(dy int) {
+	if !e.winOpts.wrap {
+		e.moveCursorVertical(dy)
+		return
+	}
+	step := 1
+	if dy < 0 {
+		step = -1
+	}
+	for ; dy != 0; dy -= step {
+		_, x := e.activeEditorMode.GetCursorYX()
+		lineInd := e.getCurrLineInd()
+		rows := e.wrapLine(lineInd)
+		r := displayRowOf(rows, x)
+		line := e.fileContents[lineInd]
+		col := rows[r].prefixWidth() + e.displayCol(line, x) - e.displayCol(line, rows[r].start)
+
+		var target displayLine
+		if r+step >= 0 && r+step < len(rows) {
+			target = rows[r+step]
+		} else {
+			newLineInd := lineInd + step
+			if newLineInd < 0 || newLineInd >= len(e.fileContents) {
+				return
+			}
+			e.moveCursorVertical(step)
+			newRows := e.wrapLine(newLineInd)
+			if step > 0 {
+				target = newRows[0]
+			} else {
+				target = newRows[len(newRows)-1]
+			}
+		}
+		// Keep the same screen column on the target row, as far as its text allows.
+		targetLine := e.fileContents[target.lineInd]
+		newX := e.byteColAt(targetLine, e.displayCol(targetLine, target.start)+max(0, col-target.prefixWidth()))
+		last := target.end
+		if target.end < len(targetLine) {
+			// A row that wraps ends where the next one starts, so its last char is the one before.
+			_, size := utf8.DecodeLastRuneInString(targetLine[target.start:target.end])
+			last -= size
+		}
+		e.cursorX = min(newX, last)
+	}
+}
+
+// Returns the spaces and tabs at the start of line.
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
@@ -2,15 +2,18 @@ package internal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"maps"
 	"strings"
+	"unicode/utf8"
 
 	gc "github.com/gbin/goncurses"
 
 	"github.com/omarnabikhan/gim/src"
 	"github.com/omarnabikhan/gim/src/internal/build_version"
+	"github.com/omarnabikhan/gim/src/internal/lsp"
 )
 
 type Mode string
@@ -23,66 +26,173 @@ const (
 	COLOR_DEFAULT = 100
 	COLOR_DEBUG   = 101
 	COLOR_BG      = 102
+	COLOR_ERROR   = 103
+	COLOR_WARNING = 104
+	COLOR_ADDED   = 105
 
 	// Color pairs.
 	COLOR_PAIR_DEBUG   = 1
 	COLOR_PAIR_DEFAULT = 2
+	COLOR_PAIR_ERROR   = 3
+	COLOR_PAIR_WARNING = 4
+	COLOR_PAIR_ADDED   = 5
 
 	// Editor modes.
 	NORMAL_MODE  Mode = "NORMAL"
 	INSERT_MODE  Mode = "INSERT"
 	COMMAND_MODE Mode = "COMMAND"
 	VISUAL_MODE  Mode = "VISUAL"
+	// Keys go to the program of a terminal buffer. See terminal.go.
+	TERMINAL_MODE Mode = "TERMINAL"
 
 	// Escape sequences.
 	ESC_KEY    = "\x1b"
 	DELETE_KEY = "\x7f"
+	CTRL_C_KEY = "\x03"
+	CTRL_N_KEY = "\x0e"
+	CTRL_P_KEY = "\x10"
+	CTRL_R_KEY = "\x12"
+	CTRL_T_KEY = "\x14"
+	CTRL_U_KEY = "\x15"
+	CTRL_V_KEY = "\x16"
+	CTRL_W_KEY = "\x17"
+	CTRL_X_KEY = "\x18"
+
+	CTRL_BACKSLASH_KEY = "\x1c"
 )
 
-func NewEditor(window *gc.Window, filePath string, verbose bool) (src.Editor, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR, cReadWriteFileMode)
-	if err != nil {
-		return nil, err
+func NewEditor(screen *gc.Window, filePath string, verbose bool, configPath string) (src.Editor, error) {
+	e := &editorImpl{
+		screen:         screen,
+		mode:           NORMAL_MODE,
+		verbose:        verbose,
+		globalOpts:     defaultGlobalOptions(),
+		defaultBufOpts: defaultBufferOptions(),
+		defaultWinOpts: defaultWindowOptions(),
+
+		languageServerCmds: maps.Clone(defaultLanguageServers),
+		languageServers:    map[string]*languageServer{},
+		events:             make(chan func(), cEventsLen),
 	}
+	// The config is loaded before the file, so that the file's buffer and window start with the
+	// configured options.
+	configErr := e.loadConfig(configPath)
 
-	fileContents, lengthBytes := getFileContentsAndLen(file)
-	e := &editorImpl{
-		window:       window,
-		file:         file,
-		fileContents: fileContents,
-		userMsg:      fmt.Sprintf(`file "%s" %dL %dB`, file.Name(), len(fileContents), lengthBytes),
-		mode:         NORMAL_MODE,
-		verbose:      verbose,
+	buf, err := newBuffer(filePath, e.defaultBufOpts)
+	if err != nil {
+		return nil, err
 	}
+	e.window = newWindow(buf, e.defaultWinOpts)
+	e.windows = []*window{e.window}
+	e.tabs = []*tabPage{{}}
+	e.layoutWindows()
+	e.buffers = append(e.buffers, buf)
 
 	// Initialize in NORMAL mode.
 	e.swapEditorMode(NORMAL_MODE)
+	// 'mouse' may have been set by the config, before there was a window to set it for.
+	e.updateMouseMask()
+	setBracketedPaste(true)
+	if buf.dir != nil {
+		e.moveCursorToLine(min(cDirectoryHeaderLines+1, len(buf.fileContents)-1))
+	}
+	e.infof("%s", buf.openedMessage())
+	if configErr != nil {
+		e.reportError(configErr)
+	}
+	e.attachLanguageServer(buf)
+	if buf.bufOpts.filetype == cGitCommitFiletype {
+		// Opened by git as its core.editor. See git.go.
+		e.showCommitDiff()
+	}
+	// Poll for what a language server sends, even before a key is typed.
+	e.updateInputTimeout()
 
 	gc.InitColor(COLOR_DEFAULT, 900, 900, 900)
 	gc.InitColor(COLOR_DEBUG, 887, 113, 63)
 	gc.InitColor(COLOR_BG, 170, 170, 170)
+	gc.InitColor(COLOR_ERROR, 1000, 300, 300)
+	gc.InitColor(COLOR_WARNING, 1000, 800, 200)
+	gc.InitColor(COLOR_ADDED, 400, 900, 400)
 
 	gc.InitPair(COLOR_PAIR_DEBUG, COLOR_DEBUG, COLOR_BG)
 	gc.InitPair(COLOR_PAIR_DEFAULT, COLOR_DEFAULT, COLOR_BG)
+	gc.InitPair(COLOR_PAIR_ERROR, COLOR_ERROR, COLOR_BG)
+	gc.InitPair(COLOR_PAIR_WARNING, COLOR_WARNING, COLOR_BG)
+	gc.InitPair(COLOR_PAIR_ADDED, COLOR_ADDED, COLOR_BG)
 
 	// Initial update of window.
 	e.sync()
 	return e, nil
 }
 
+// The fields of the current window and its buffer (e.g. fileContents and cursorY) are promoted so
+// that modes can use them directly.
 type editorImpl struct {
-	window *gc.Window
-	file   *os.File
+	*window
+	screen *gc.Window
 
-	// Textual elements shown to user.
-	fileContents []string // Each element is a line from the source file without ending in '\n'.
-	userMsg      string   // Shown to user at bottom of screen.
+	// All windows, top to bottom, including the current one. See window.go.
+	windows        []*window
+	previousWindow *window // The window that was current before this one, or nil if it was closed.
 
-	// The cursorX is not necessarily the column which the cursor occupies. See the moveCursorHorizontal
-	// function for more details.
-	// The cursorY does indeed mark which row on the window that the cursor occupies.
-	cursorY, cursorX int
-	fileLineOffset   int // Which line of the file is being shown at the top of the screen.
+	// Tab pages. The current one is tabs[tabIndex], whose windows are the ones above. See tabs.go.
+	tabs     []*tabPage
+	tabIndex int
+
+	// Textual elements shown to user.
+	userMsg         string // Shown to user at bottom of screen.
+	userMsgSeverity severity
+
+	// Messages. See messages.go.
+	messageHistory  []message      // Shown by :messages.
+	pressEnterLines []message      // Output shown over the bottom of the screen until ENTER is pressed.
+	listSelection   *listSelection // Set while pressEnterLines is a list to pick from. See select_list.go.
+	finder          *fileFinder    // Set while the fuzzy finder is open. See finder.go.
+	input           *inputPrompt   // Set while a command is asking for input. See prompt.go.
+
+	// Options. See options.go. Local options of the current buffer and window are in bufOpts and
+	// winOpts, and the global values which new buffers and windows start with are here.
+	globalOpts     globalOptions
+	defaultBufOpts bufferOptions
+	defaultWinOpts windowOptions
+
+	// Key mappings, by map mode. See mappings.go.
+	mappings   map[byte][]*keyMapping
+	inputQueue []queuedKey // Keys that are waiting to be matched against mappings.
+	silent     bool        // Set while handling keys from a <silent> mapping.
+
+	// Registers and macros. See registers.go and macros.go.
+	registers         map[byte]register
+	recordingRegister byte     // The register that typed keys are being recorded into, or 0.
+	recordedKeys      []gc.Key // Keys typed since recording started.
+	lastRunRegister   byte     // The register last run as a macro, for "@@".
+	macroRuns         int      // Macros run since the last typed key.
+
+	mouseState mouseState // See mouse.go.
+	paste      pasteState // See paste.go.
+
+	// Changes, for ".". See repeat.go.
+	lastChange    change // The last complete change.
+	currentChange change // The keys of the command being typed, which may turn out to be a change.
+
+	// All buffers, including ones that aren't shown, e.g. after :e. See buffer.go.
+	buffers []*buffer
+
+	// Language servers. See language_server.go.
+	languageServerCmds map[string][]string        // By filetype, as set by :LspServer.
+	languageServers    map[string]*languageServer // The running servers, by filetype.
+	codeActions        []lsp.CodeAction           // The code actions last listed by :LspCodeAction.
+
+	quickfix quickfixList   // See quickfix.go.
+	search   *projectSearch // The project search that is running, if any. See search.go.
+
+	lastShellCommand string // For "!" in a shell command. See shell.go.
+	stdoutText       []byte // What :w last wrote from the stdin buffer, for stdout. See stdin.go.
+
+	// Results of work done off the editor's goroutine, to handle between keys. See events.go.
+	events         chan func()
+	backgroundJobs int // The number of jobs started by runInBackground that haven't finished.
 
 	// Mode info.
 	mode    Mode
@@ -96,33 +206,143 @@ type editorImpl struct {
 
 var _ src.Editor = (*editorImpl)(nil)
 
+// errBell is returned by commands that fail without a message, e.g. moving the cursor past the end of
+// the file. Like any other error, it stops the rest of a mapping or macro from running.
+var errBell = errors.New("bell")
+
+// errNotModifiable is reported for changes to a buffer whose 'modifiable' option is off.
+var errNotModifiable = errors.New("cannot make changes, 'modifiable' is off")
+
+// Handle a key from the user. Keys are first resolved against the user's mappings, and the resulting
+// keys are passed to the active mode. Errors from the active mode are shown to the user rather than
+// returned, with the exception of io.EOF which signals that the editor should exit, and
+// ErrQuitWithError which signals that it should exit with an error status.
 func (e *editorImpl) Handle(key gc.Key) error {
-	if err := e.activeEditorMode.Handle(key); err != nil {
-		return err
+	e.handleEvents()
+	if key == gc.KEY_MOUSE {
+		return e.handleMouse()
+	}
+	keys := e.filterPaste(key)
+	if len(keys) == 0 {
+		// The key is part of a paste, or may be.
+		e.updateInputTimeout()
+		if e.paste.text == nil {
+			e.sync()
+		}
+		return nil
+	}
+	e.typeKeys(keys)
+	return e.handleInput(false /*timedOut*/)
+}
+
+// Add typed keys to the input queue.
+func (e *editorImpl) typeKeys(keys []gc.Key) {
+	if e.recordingRegister != 0 {
+		// Macros record keys as they were typed, before mappings.
+		e.recordedKeys = append(e.recordedKeys, keys...)
+	}
+	e.macroRuns = 0
+	for _, key := range keys {
+		e.inputQueue = append(e.inputQueue, queuedKey{key: key})
+	}
+}
+
+// Idle is called when no key was typed before the input timeout, so that keys waiting for a longer
+// mapping, or for the rest of a paste, are handled, and so are events from background work.
+func (e *editorImpl) Idle() error {
+	if e.handleEvents() {
+		e.updateInputTimeout()
+		e.sync()
+	}
+	if e.paste.matched != "" {
+		// The keys weren't the start of a paste after all, e.g. <Esc> was typed.
+		e.typeKeys(e.flushPasteKeys())
+		return e.handleInput(false /*timedOut*/)
+	}
+	if len(e.inputQueue) == 0 || !e.globalOpts.timeout {
+		// Without 'timeout', keys wait for the rest of a mapping however long it takes. Idle is still
+		// called then to poll for events.
+		return nil
+	}
+	return e.handleInput(true /*timedOut*/)
+}
+
+func (e *editorImpl) handleInput(timedOut bool) error {
+	buf, lineInd := e.buffer, e.getCurrLineInd()
+	if err := e.processInput(timedOut); err != nil {
+		// Like Vim, the rest of a mapping or macro is dropped once something fails.
+		e.inputQueue = nil
+		switch err {
+		case io.EOF, ErrQuitWithError:
+			return err
+		case errBell:
+			gc.Beep()
+		default:
+			e.reportError(err)
+		}
+	} else if _, ok := e.lineDiagnostic(e.getCurrLineInd()); ok && (e.buffer != buf || e.getCurrLineInd() != lineInd) {
+		// The cursor moved onto a line with a diagnostic, which is shown instead of an older message.
+		e.userMsg = ""
 	}
+	e.updateInputTimeout()
 	e.sync()
 	return nil
 }
 
+// Set how long to wait for the next key before calling Idle.
+func (e *editorImpl) updateInputTimeout() {
+	switch {
+	case e.paste.matched != "":
+		e.screen.Timeout(cPasteStartTimeoutMs)
+	case len(e.inputQueue) > 0 && e.globalOpts.timeout:
+		// Only wait for the rest of a mapping for 'timeoutlen', if 'timeout' is set.
+		e.screen.Timeout(e.globalOpts.timeoutlen)
+	case e.expectingEvents():
+		e.screen.Timeout(cEventPollMs)
+	default:
+		e.screen.Timeout(-1)
+	}
+}
+
+// Swapping modes keeps errors on the bottom row, so that they aren't lost before the user sees them.
+// The mode is shown in the status line, and also on the bottom row while there is no message.
 func (e *editorImpl) swapEditorMode(mode Mode) {
+	if ve, ok := e.activeEditorMode.(*visualModeEditor); ok && mode != VISUAL_MODE {
+		// Keep the selection, for "gv".
+		sel := ve.visualSelection()
+		e.lastVisual = &sel
+	}
+	if (e.mode == TERMINAL_MODE) != (mode == TERMINAL_MODE) {
+		setRawInput(mode == TERMINAL_MODE)
+	}
 	e.mode = mode
+	if (mode == INSERT_MODE || mode == VISUAL_MODE || mode == TERMINAL_MODE) && e.userMsgSeverity != severityError {
+		// Make room for the mode. The message is still in the history.
+		e.userMsg = ""
+	}
 	switch mode {
 	case NORMAL_MODE:
-		e.userMsg = "-- NORMAL --"
-		e.userMsg = "-- NORMAL --"
 		e.activeEditorMode = newNormalEditorMode(e)
 	case INSERT_MODE:
-		e.userMsg = "-- INSERT --"
 		e.activeEditorMode = newInsertEditorMode(e)
 	case COMMAND_MODE:
-		e.userMsg = ":"
 		e.activeEditorMode = newCommandEditorMode(e, e.cursorY, e.cursorX)
 	case VISUAL_MODE:
-		e.userMsg = "-- VISUAL --"
-		e.activeEditorMode = newVisualModeEditor(e, e.cursorY, e.cursorX)
+		e.activeEditorMode = newVisualModeEditor(e, e.cursorPosition())
+	case TERMINAL_MODE:
+		e.activeEditorMode = newTerminalEditorMode(e)
 	}
 }
 
+// Swap to INSERT mode, unless the buffer's 'modifiable' option is off.
+func (e *editorImpl) enterInsertMode() error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	e.swapEditorMode(INSERT_MODE)
+	return nil
+}
+
 func (e *editorImpl) moveCursorVertical(dy int) {
 	newY := e.cursorY + dy
 	numLinesInFile := len(e.fileContents)
@@ -136,20 +356,26 @@ func (e *editorImpl) moveCursorVertical(dy int) {
 		return
 	}
 
+	// Keep the cursor in the same display column, which differs from the byte offset when the lines
+	// have tabs. Past the end of the line, the offset is kept as is.
+	oldLine, newLine := e.fileContents[e.getCurrLineInd()], e.fileContents[newY+e.fileLineOffset]
+	if col := e.displayCol(oldLine, e.cursorX); col < e.displayCol(newLine, len(newLine)) {
+		e.cursorX = e.byteColAt(newLine, col)
+	} else {
+		e.cursorX = len(newLine) + col - e.displayCol(newLine, len(newLine))
+	}
+
 	// Handle valid scrolling. Scrolling also wipes the userMsg.
-	if newY < 0 {
-		// Scroll up one line.
-		e.fileLineOffset -= 1
-		newY = 0
-		e.userMsg = ""
-	} else if newY > e.getMaxYForContent() {
-		e.fileLineOffset += 1
-		// Keep the cursor on the same line (the last line).
-		newY = e.getMaxYForContent()
+	e.cursorY = newY
+	if e.scrollToCursor() {
 		e.userMsg = ""
 	}
-	// Else, we're within the displayed content and can simply update the y-pos.
-	e.cursorY = newY
+}
+
+// Move the cursor to the line at lineInd, scrolling if it's off screen. The x-pos is kept.
+func (e *editorImpl) moveCursorToLine(lineInd int) {
+	e.cursorY = lineInd - e.fileLineOffset
+	e.scrollToCursor()
 }
 
 // The cursor's x-position that is stored here is not the actual position the cursor occupies. Instead,
@@ -192,66 +418,252 @@ func (e *editorImpl) moveCursorHorizontal(dx int, pastLastCharAllowed bool) {
 // TODO(omar): Very simple implementation of clear the file, then overwrite full contents. We can do
 // better if we know that only some small portion of the file needs to change.
 func (e *editorImpl) writeToDisc() error {
+	if e.bufOpts.readonly {
+		return errors.New("'readonly' option is set")
+	}
+	if e.stdin {
+		// The buffer has no file. See stdin.go.
+		return e.writeToStdout()
+	}
+	var fmtErr error
+	if e.bufOpts.formatonsave {
+		// Like gofmt, text that can't be formatted is written as is, so that work isn't lost.
+		fmtErr = e.formatBuffer()
+	}
 	defer e.file.Sync()
 
-	// Clear the contents of the file.
-	if err := os.Truncate(e.file.Name(), 0); err != nil {
+	// Clear the contents of the file. This is done through the open file, which still works if the
+	// file was renamed.
+	if err := e.file.Truncate(0); err != nil {
 		return err
 	}
 
 	// Write the new contents of file to disc.
 	e.file.Seek(0 /*offset*/, io.SeekStart)
 	// We collect in a []byte and do a single write for efficiency.
-	contents := bytes.Buffer{}
-	for _, line := range e.fileContents {
-		contents.WriteString(line)
-		contents.WriteString("\n")
-	}
-	n, err := e.file.Write(contents.Bytes())
+	n, err := e.file.Write(e.bufferBytes())
 	if err != nil {
 		return err
 	}
+	e.markWritten()
+	e.lspDidSave()
+	e.checkGoPackage()
 	// Update the display to say we wrote to disc.
-	e.userMsg = fmt.Sprintf("%d bytes written to disc", n)
+	e.infof("%d bytes written to disc", n)
+	if fmtErr != nil {
+		return fmt.Errorf("written unformatted: %w", fmtErr)
+	}
 	return nil
 }
 
+// Replace the lines [start, end) of the file with lines. All edits to fileContents go through here, so
+// that the buffer is marked as modified, and the change can be undone. The commands that change the
+// buffer check 'modifiable' before they start, so that they don't go on as if the change was made.
+func (e *editorImpl) replaceLines(start int, end int, lines ...string) {
+	e.recordUndo(start, e.fileContents[start:end], lines)
+	e.spliceLines(start, end, lines)
+}
+
+// Replace the lines [start, end) of the file with lines, without keeping the change for undo.
+func (e *editorImpl) spliceLines(start int, end int, lines []string) {
+	e.modified = true
+	e.changedTick++
+	defer e.lspDidChange(start, end, lines)
+	e.shiftDiagnostics(start, end, len(lines))
+	if end-start == len(lines) {
+		// Same number of lines, so they can be replaced in place.
+		copy(e.fileContents[start:end], lines)
+		return
+	}
+	newContents := make([]string, 0, len(e.fileContents)-(end-start)+len(lines))
+	newContents = append(newContents, e.fileContents[:start]...)
+	newContents = append(newContents, lines...)
+	newContents = append(newContents, e.fileContents[end:]...)
+	e.fileContents = newContents
+}
+
+// Replace the lines of the file with lines, as a single change of only the lines that differ. Returns
+// false if no lines differ.
+func (e *editorImpl) replaceChangedLines(lines []string) bool {
+	start := 0
+	for start < len(lines) && start < len(e.fileContents) && lines[start] == e.fileContents[start] {
+		start++
+	}
+	end, newEnd := len(e.fileContents), len(lines)
+	for end > start && newEnd > start && lines[newEnd-1] == e.fileContents[end-1] {
+		end--
+		newEnd--
+	}
+	if start == end && start == newEnd {
+		return false
+	}
+	e.replaceLines(start, end, lines[start:newEnd]...)
+	return true
+}
+
+// The contents of the buffer as they are written, with the line endings of 'fileformat'.
+func (e *editorImpl) bufferBytes() []byte {
+	contents := bytes.Buffer{}
+	lineEnding := "\n"
+	if e.bufOpts.fileformat == "dos" {
+		lineEnding = "\r\n"
+	}
+	for _, line := range e.fileContents {
+		contents.WriteString(line)
+		contents.WriteString(lineEnding)
+	}
+	return contents.Bytes()
+}
+
+// The buffer was written, so it's no longer modified.
+func (e *editorImpl) markWritten() {
+	e.modified = false
+	// Undoing back to here makes the buffer unmodified again.
+	e.closeUndoStep()
+	e.savedUndoIndex = e.undoIndex
+}
+
 func (e *editorImpl) Close() {
-	e.file.Close()
+	setBracketedPaste(false)
+	e.stopLanguageServers()
+	e.stopTerminals()
+	e.flushStdout()
+	for _, buf := range e.buffers {
+		buf.file.Close()
+	}
 }
 
 func (e *editorImpl) sync() {
+	e.layoutWindows()
+	e.resizeTerminals()
+	e.scrollToCursor()
 	e.updateWindow()
 	// Not sure why we have to Refresh before moving the cursor, but this fixes a bug where the window
 	// looked funky when you move the cursor to x-pos=0 and insert a whitespace.
-	e.window.Refresh()
-	e.window.Move(e.activeEditorMode.GetCursorYX())
+	e.screen.Refresh()
+	// A terminal's program may hide the cursor, e.g. while it redraws its screen.
+	if e.mode == TERMINAL_MODE && !e.term.vt.cursorVisible {
+		gc.Cursor(0)
+	} else {
+		gc.Cursor(1)
+	}
+	if e.input != nil {
+		// The cursor is at the end of the input.
+		maxY, maxX := e.screen.MaxYX()
+		e.screen.Move(maxY-1, min(utf8.RuneCountInString(e.input.line()), maxX-1))
+		return
+	}
+	if e.finder != nil {
+		// The cursor is at the end of the finder's query.
+		maxY, maxX := e.screen.MaxYX()
+		e.screen.Move(maxY-1, min(utf8.RuneCountInString(cFinderPrompt+e.finder.query), maxX-1))
+		return
+	}
+	if len(e.pressEnterLines) > 0 {
+		// The cursor waits at the end of the prompt.
+		maxY, maxX := e.screen.MaxYX()
+		e.screen.Move(maxY-1, min(len(e.pressEnterPrompt()), maxX-1))
+		return
+	}
+	e.screen.Move(e.activeEditorMode.GetScreenCursorYX())
 }
 
-func (e *editorImpl) updateWindow() {
-	// Update the window atomically by replacing it. This is more efficient than multiple Print calls
-	// on the user-visible window, which may result in flashes.
-	windowY, windowX := e.window.YX()
-	maxY, maxX := e.window.MaxYX()
-	newWindow, _ := gc.NewWindow(maxY, maxX, windowY, windowX)
-	newWindow.SetBackground(COLOR_PAIR_DEFAULT)
-	for i := 0; i <= e.getMaxYForContent(); i++ {
-		// We reserve the bottom 2 lines for user messages, and debug messages.
-		if i+e.fileLineOffset < len(e.fileContents) {
-			// Print char by char.
-			for j, ch := range e.fileContents[e.fileLineOffset+i] {
-				newWindow.AddChar(e.activeEditorMode.GetChar(ch, i, j))
+// Draw the current window's text and its status line at its place on screen. Only the focused window
+// is drawn by the mode, e.g. with its VISUAL selection. The other windows show their buffers as they
+// were left, which may have changed since.
+func (e *editorImpl) drawWindow(screen *gc.Window, focused bool) {
+	getChar := e.GetChar
+	if focused {
+		getChar = e.activeEditorMode.GetChar
+	} else {
+		e.clampCursor()
+		e.scrollToCursor()
+	}
+	// Each row is positioned explicitly, since a row that fills the full width would otherwise push a
+	// newline onto the next.
+	rows, truncated := e.getDisplayLines()
+	for i := 0; i < e.height; i++ {
+		screen.Move(e.top+i, 0)
+		if i < len(rows) {
+			dl := rows[i]
+			if e.getSignWidth() > 0 {
+				e.printSign(screen, dl.lineInd, !e.winOpts.wrap || dl.start == 0)
+			}
+			if e.getNumberWidth() > 0 {
+				number := strings.Repeat(" ", e.getNumberWidth())
+				if !e.winOpts.wrap || dl.start == 0 {
+					// Only the first display line of each file line is numbered.
+					number = e.formatLineNumber(dl.lineInd)
+				}
+				screen.AttrOn(gc.A_DIM)
+				screen.Print(number)
+				screen.AttrOff(gc.A_DIM)
+			}
+			for _, ch := range dl.prefix {
+				screen.AddChar(gc.A_DIM | gc.Char(ch))
+			}
+			// Print char by char. A tab is printed as spaces up to the next tab stop, and only the
+			// columns that fit on the row are printed.
+			line := e.fileContents[dl.lineInd]
+			col, printed := e.displayCol(line, dl.start), dl.prefixWidth()
+			for j, ch := range line[dl.start:dl.end] {
+				width := e.charWidth(ch, col)
+				if ch == '\t' {
+					ch = ' '
+				}
+				for k := 0; k < width && printed < e.getTextWidth(); k++ {
+					if !e.winOpts.wrap && col+k < e.leftCol {
+						continue
+					}
+					screen.AddChar(getChar(ch, dl.lineInd-e.fileLineOffset, dl.start+j))
+					printed++
+				}
+				col += width
 			}
-			newWindow.AddChar(gc.Char('\n'))
-		} else if (e.verbose && i < maxY-2) || (!e.verbose && i < maxY-1) {
+			if d, ok := e.lineDiagnostic(dl.lineInd); ok && dl.end == len(line) {
+				// The line's diagnostic goes after its last row.
+				printDiagnostic(screen, d, e.getTextWidth()-printed)
+			}
+		} else if truncated {
+			// The next file line doesn't fit in the remaining rows, so mark them rather than show
+			// part of it.
+			screen.AddChar(gc.A_DIM | gc.Char('@'))
+		} else {
 			// There are no more file contents, so use a special UI to denote that these lines are
 			// not present in the file.
-			// We need to reserve either 1 or 2 lines without this UI treatment. 1 if there is no
-			// debug message, 2 otherwise.
-			newWindow.AddChar(gc.A_DIM | gc.Char('~'))
-			newWindow.AddChar(gc.Char('\n'))
+			screen.AddChar(gc.A_DIM | gc.Char('~'))
+		}
+	}
+	if e.hasStatusLine(e.window) {
+		// The other windows' status lines are dimmed.
+		attrs := gc.Char(gc.A_REVERSE)
+		if !focused {
+			attrs |= gc.A_DIM
 		}
+		_, maxX := screen.MaxYX()
+		screen.AttrOn(attrs)
+		screen.MovePrint(e.top+e.height, 0, e.renderStatusLine(maxX))
+		screen.AttrOff(attrs)
+	}
+}
+
+func (e *editorImpl) updateWindow() {
+	// Update the window atomically by replacing it. This is more efficient than multiple Print calls
+	// on the user-visible window, which may result in flashes.
+	windowY, windowX := e.screen.YX()
+	maxY, maxX := e.screen.MaxYX()
+	newWindow, _ := gc.NewWindow(maxY, maxX, windowY, windowX)
+	newWindow.SetBackground(gc.ColorPair(COLOR_PAIR_DEFAULT))
+	// We reserve the bottom 2 lines for user messages, and debug messages.
+	current := e.window
+	for _, w := range e.windows {
+		e.withWindow(w, func() { e.drawWindow(newWindow, w == current) })
 	}
+	if e.tabLineRows() > 0 {
+		e.drawTabLine(newWindow)
+	}
+
+	newWindow.Move(maxY-2, 0)
 	if e.verbose {
 		// Print debug output.
 		newWindow.ColorOn(COLOR_PAIR_DEBUG)
@@ -262,17 +674,56 @@ func (e *editorImpl) updateWindow() {
 		newWindow.Printf("curr line offset=%d lines; ", e.fileLineOffset)
 		newWindow.Printf("cursor=(x=%d,y=%d); ", e.cursorX, e.cursorY)
 		newWindow.Printf("mode=%s", e.mode)
-		newWindow.Println()
 		newWindow.ColorOff(COLOR_PAIR_DEBUG)
+	}
+	// The debug row is left blank when not verbose, so there are no shifts when the user toggles it.
+	if e.input != nil {
+		newWindow.MovePrint(maxY-1, 0, fitWidth(e.input.line(), maxX-1))
+	} else if e.userMsg != "" {
+		e.printMessage(newWindow, maxY-1, message{severity: e.userMsgSeverity, text: e.userMsg})
+	} else if d, ok := e.lineDiagnostic(e.getCurrLineInd()); ok && e.mode == NORMAL_MODE && e.recordingRegister == 0 {
+		// The cursor's line has a diagnostic, whose message may not have fit at the end of the line.
+		text := diagnosticText(d)
+		newWindow.AttrOn(diagnosticAttrs(d))
+		newWindow.MovePrint(maxY-1, 0, text[:min(len(text), maxX-1)])
+		newWindow.AttrOff(diagnosticAttrs(d))
 	} else {
-		// Print a newline anyway so no shifts when user toggles verbosity.
-		newWindow.Println()
+		newWindow.Move(maxY-1, 0)
+		newWindow.AttrOn(gc.A_BOLD)
+		if e.mode == INSERT_MODE || e.mode == VISUAL_MODE || e.mode == TERMINAL_MODE {
+			newWindow.Printf("-- %s --", e.modeName())
+		}
+		if e.recordingRegister != 0 {
+			newWindow.Printf("recording @%c", e.recordingRegister)
+		}
+		newWindow.AttrOff(gc.A_BOLD)
+	}
+	if len(e.pressEnterLines) > 0 {
+		e.drawPressEnter(newWindow)
+	}
+	if e.finder != nil {
+		e.drawFinder(newWindow)
 	}
-	newWindow.Println(e.userMsg)
 
-	e.window.Erase()
-	e.window.SetBackground(gc.ColorPair(COLOR_PAIR_DEFAULT))
-	e.window.Overlay(newWindow)
+	e.screen.Erase()
+	e.screen.SetBackground(gc.ColorPair(COLOR_PAIR_DEFAULT))
+	// Overwrite rather than Overlay, so that blanks are copied too and no stale chars are left behind
+	// from rows that used to be longer.
+	e.screen.Overwrite(newWindow)
+	newWindow.Delete()
+}
+
+// The name of the mode for the message line, e.g. "VISUAL LINE".
+func (e *editorImpl) modeName() string {
+	if ve, ok := e.activeEditorMode.(*visualModeEditor); ok {
+		switch ve.kind {
+		case linewise:
+			return "VISUAL LINE"
+		case blockwise:
+			return "VISUAL BLOCK"
+		}
+	}
+	return string(e.mode)
 }
 
 func (e *editorImpl) normalizeCursorY(y int) int {
@@ -287,37 +738,25 @@ func (e *editorImpl) getCurrLineInd() int {
 	return e.fileLineOffset + e.cursorY
 }
 
+// The last row of the current window's text, relative to its top.
 func (e *editorImpl) getMaxYForContent() int {
-	maxY, _ := e.window.MaxYX()
-	// We reserve the bottom 2 lines for debug and user messages. Then we subtract 1 more since this
-	// is an offset.
-	return maxY - 3
+	return e.height - 1
 }
 
-func (e *editorImpl) GetChar(ch rune, _ int, _ int) gc.Char {
-	// Default implementation: no special UI treatment.
-	return gc.Char(ch)
+func (e *editorImpl) AcceptsMappings() bool {
+	// Default implementation: all keys may be mapped.
+	return true
 }
 
-// Each string is the entire row. The row does NOT contain the ending newline.
-func getFileContentsAndLen(file *os.File) ([]string, int) {
-	// Make sure file is being read from beginning.
-	file.Seek(0 /*offset*/, io.SeekStart)
-	contents, err := io.ReadAll(file)
-	if err != nil {
-		panic(err)
+func (e *editorImpl) GetChar(ch rune, y int, x int) gc.Char {
+	// Default implementation: the text of diagnostics is underlined, in their color, and the rest is
+	// highlighted as per the filetype (see git.go). A terminal buffer's text has the attributes its
+	// program drew it with.
+	if e.term != nil {
+		return e.terminalAttrs(y+e.fileLineOffset, x) | gc.Char(ch)
 	}
-
-	fileContents := []string{}
-	currRow := strings.Builder{}
-	for _, b := range contents {
-		if b == '\n' {
-			// Line break, meaning we update a new row.
-			fileContents = append(fileContents, currRow.String())
-			currRow = strings.Builder{}
-		} else {
-			currRow.WriteByte(b)
-		}
+	if d, ok := e.diagnosticAt(position{y + e.fileLineOffset, x}); ok {
+		return diagnosticAttrs(d) | gc.A_UNDERLINE | gc.Char(ch)
 	}
-	return fileContents, len(contents)
+	return e.syntaxAttrs(y+e.fileLineOffset, x) | gc.Char(ch)
 }
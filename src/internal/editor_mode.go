@@ -12,5 +12,12 @@ type EditorMode interface {
 	// Each mode has a different implementation of how the cursor viewed.
 	GetCursorYX() (int, int)
 
+	// Where the cursor is drawn on screen. Most modes place it over the buffer's cursor, mapped
+	// through the display lines.
+	GetScreenCursorYX() (int, int)
+
 	GetChar(ch rune, y int, x int) gc.Char
+
+	// Whether the next key may be mapped. Keys that complete a command, e.g. the "j" of "gj", aren't.
+	AcceptsMappings() bool
 }
@@ -0,0 +1,40 @@
+package internal
+
+// Work that is done off the editor's goroutine, e.g. talking to language servers or type-checking,
+// hands its results back as funcs sent on e.events. They're run between keys, so they may use the
+// editor's state freely, and the work never holds up typing.
+
+const (
+	// How often to check for events while waiting for a key, when some may come.
+	cEventPollMs = 50
+	// How many events may wait to be run before the goroutines that send them wait.
+	cEventsLen = 64
+)
+
+// Run the events that have been sent, without waiting for more. Returns whether there were any. Only
+// the events that are waiting are run, so work that sends many, e.g. a search, can't hold up keys.
+func (e *editorImpl) handleEvents() bool {
+	n := len(e.events)
+	for range n {
+		event := <-e.events
+		event()
+	}
+	return n > 0
+}
+
+// Run work on another goroutine, and then the func it returns as an event.
+func (e *editorImpl) runInBackground(work func() func()) {
+	e.backgroundJobs++
+	go func() {
+		done := work()
+		e.events <- func() {
+			e.backgroundJobs--
+			done()
+		}
+	}()
+}
+
+// Whether events may be sent, so the input timeout should poll for them.
+func (e *editorImpl) expectingEvents() bool {
+	return len(e.languageServers) > 0 || e.backgroundJobs > 0
+}
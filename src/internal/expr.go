@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A small subset of Vim script expressions, enough for <expr> mappings such as:
+//
+//	inoremap <expr> <Tab> col('.') == 1 ? "\<Tab>" : "  "
+//
+// Values are ints or strings. Supported are string and number literals, &option values, the
+// functions below, parentheses, and the operators (by increasing precedence):
+//
+//	a ? b : c    ||    &&    == != < <= > >=    . ..    + -    ! - (unary)
+//
+// In double quoted strings, "\<CR>" is kept as "<CR>" so that the result is parsed as key notation.
+type exprParser struct {
+	e     *editorImpl
+	input string
+	pos   int
+}
+
+// Evaluate an expression and return its value as a string.
+func (e *editorImpl) evalExpr(input string) (string, error) {
+	p := &exprParser{e: e, input: input}
+	value, err := p.parseTernary()
+	if err != nil {
+		return "", err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return "", fmt.Errorf("trailing characters in expression: %s", p.input[p.pos:])
+	}
+	return exprString(value), nil
+}
+
+// exprFunctions are the functions that may be called in an expression.
+var exprFunctions = map[string]func(e *editorImpl, args []any) (any, error){
+	"mode": func(e *editorImpl, _ []any) (any, error) {
+		return mapModeChar(e.mode), nil
+	},
+	"line": func(e *editorImpl, args []any) (any, error) {
+		if len(args) == 1 && exprString(args[0]) == "$" {
+			return len(e.fileContents), nil
+		}
+		return e.getCurrLineInd() + 1, nil
+	},
+	"col": func(e *editorImpl, args []any) (any, error) {
+		if len(args) == 1 && exprString(args[0]) == "$" {
+			return len(e.fileContents[e.getCurrLineInd()]) + 1, nil
+		}
+		_, x := e.activeEditorMode.GetCursorYX()
+		return x + 1, nil
+	},
+	"getline": func(e *editorImpl, args []any) (any, error) {
+		lineInd := e.getCurrLineInd()
+		if len(args) == 1 && exprString(args[0]) != "." {
+			lineInd = exprInt(args[0]) - 1
+		}
+		if lineInd < 0 || lineInd >= len(e.fileContents) {
+			return "", nil
+		}
+		return e.fileContents[lineInd], nil
+	},
+	"strlen": func(_ *editorImpl, args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("strlen() takes 1 argument")
+		}
+		return len(exprString(args[0])), nil
+	},
+	"pumvisible": func(_ *editorImpl, _ []any) (any, error) {
+		// There is no popup menu.
+		return 0, nil
+	},
+}
+
+func (p *exprParser) parseTernary() (any, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume("?") {
+		return cond, nil
+	}
+	ifTrue, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume(":") {
+		return nil, fmt.Errorf("missing ':' after '?'")
+	}
+	ifFalse, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(cond) {
+		return ifTrue, nil
+	}
+	return ifFalse, nil
+}
+
+// Binary operators, by increasing precedence. Longer operators come first, so that e.g. "<=" isn't
+// parsed as "<".
+var exprBinaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<=", ">=", "<", ">"},
+	{"..", "."},
+	{"+", "-"},
+}
+
+func (p *exprParser) parseBinary(level int) (any, error) {
+	if level == len(exprBinaryOps) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range exprBinaryOps[level] {
+			if p.consume(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = applyExprOp(op, left, right)
+	}
+}
+
+func applyExprOp(op string, left, right any) any {
+	boolInt := func(b bool) any {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	_, leftIsStr := left.(string)
+	_, rightIsStr := right.(string)
+	compareStrings := leftIsStr && rightIsStr
+	switch op {
+	case "||":
+		return boolInt(exprTruthy(left) || exprTruthy(right))
+	case "&&":
+		return boolInt(exprTruthy(left) && exprTruthy(right))
+	case ".", "..":
+		return exprString(left) + exprString(right)
+	case "+":
+		return exprInt(left) + exprInt(right)
+	case "-":
+		return exprInt(left) - exprInt(right)
+	}
+	// Comparisons compare strings if both sides are strings, otherwise numbers.
+	cmp := exprInt(left) - exprInt(right)
+	if compareStrings {
+		cmp = strings.Compare(exprString(left), exprString(right))
+	}
+	switch op {
+	case "==":
+		return boolInt(cmp == 0)
+	case "!=":
+		return boolInt(cmp != 0)
+	case "<":
+		return boolInt(cmp < 0)
+	case "<=":
+		return boolInt(cmp <= 0)
+	case ">":
+		return boolInt(cmp > 0)
+	}
+	return boolInt(cmp >= 0)
+}
+
+func (p *exprParser) parseUnary() (any, error) {
+	if p.consume("!") {
+		value, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(value) {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if p.consume("-") {
+		value, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return -exprInt(value), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("missing value at end of expression")
+	}
+	switch ch := p.input[p.pos]; {
+	case ch == '(':
+		p.pos++
+		value, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return value, nil
+	case ch == '\'':
+		// Single quoted strings are literal, with '' for a quote.
+		value := strings.Builder{}
+		for p.pos++; p.pos < len(p.input); p.pos++ {
+			if p.input[p.pos] == '\'' {
+				if p.pos+1 < len(p.input) && p.input[p.pos+1] == '\'' {
+					value.WriteByte('\'')
+					p.pos++
+					continue
+				}
+				p.pos++
+				return value.String(), nil
+			}
+			value.WriteByte(p.input[p.pos])
+		}
+		return nil, fmt.Errorf("missing quote: %s", p.input)
+	case ch == '"':
+		return p.parseDoubleQuoted()
+	case ch >= '0' && ch <= '9':
+		start := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+			p.pos++
+		}
+		return strconv.Atoi(p.input[start:p.pos])
+	case ch == '&':
+		p.pos++
+		name := p.parseName()
+		def := lookupOption(name)
+		if def == nil {
+			return nil, fmt.Errorf("unknown option: %s", name)
+		}
+		value := optionValue(def.value(p.e, p.e.window != nil))
+		if b, ok := value.(bool); ok {
+			if b {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		return value, nil
+	}
+	name := p.parseName()
+	fn, ok := exprFunctions[name]
+	if name == "" || !ok || !p.consume("(") {
+		return nil, fmt.Errorf("invalid expression: %s", p.input[p.pos-len(name):])
+	}
+	args := []any{}
+	for !p.consume(")") {
+		if len(args) > 0 && !p.consume(",") {
+			return nil, fmt.Errorf("missing ',' or ')' in call to %s()", name)
+		}
+		arg, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return fn(p.e, args)
+}
+
+func (p *exprParser) parseDoubleQuoted() (any, error) {
+	value := strings.Builder{}
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		switch ch := p.input[p.pos]; ch {
+		case '"':
+			p.pos++
+			return value.String(), nil
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.input) {
+				break
+			}
+			switch esc := p.input[p.pos]; esc {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'e':
+				value.WriteByte(27)
+			case '<':
+				// A special key, left in <> notation.
+				value.WriteByte('<')
+			default:
+				value.WriteByte(esc)
+			}
+		default:
+			value.WriteByte(ch)
+		}
+	}
+	return nil, fmt.Errorf("missing quote: %s", p.input)
+}
+
+func (p *exprParser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		ch := p.input[p.pos]
+		if !(ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')) {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// Consume token if it's next in the input, after any whitespace.
+func (p *exprParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func exprString(value any) string {
+	if n, ok := value.(int); ok {
+		return strconv.Itoa(n)
+	}
+	return value.(string)
+}
+
+// Like Vim, strings are converted to the number they start with, or 0.
+func exprInt(value any) int {
+	if n, ok := value.(int); ok {
+		return n
+	}
+	s := value.(string)
+	end := 0
+	for end < len(s) && ((s[end] >= '0' && s[end] <= '9') || (end == 0 && s[end] == '-')) {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+func exprTruthy(value any) bool {
+	return exprInt(value) != 0
+}
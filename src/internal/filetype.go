@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Filetypes keyed by file extension, including the leading ".".
+var filetypesByExtension = map[string]string{
+	".c":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".css":   "css",
+	".diff":  "diff",
+	".go":    "go",
+	".h":     "c",
+	".html":  "html",
+	".java":  "java",
+	".js":    "javascript",
+	".json":  "json",
+	".md":    "markdown",
+	".patch": "diff",
+	".py":    "python",
+	".rs":    "rust",
+	".sh":    "sh",
+	".sql":   "sql",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".txt":   "text",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+}
+
+// Filetypes for files that are recognized by their full name rather than an extension.
+var filetypesByName = map[string]string{
+	"COMMIT_EDITMSG": "gitcommit",
+	"Dockerfile":     "dockerfile",
+	"MERGE_MSG":      "gitcommit",
+	"Makefile":       "make",
+	"go.mod":         "gomod",
+	"go.sum":         "gosum",
+}
+
+// Returns the filetype of the file at filePath, or "" if it isn't recognized.
+func detectFiletype(filePath string) string {
+	base := filepath.Base(filePath)
+	if ft, ok := filetypesByName[base]; ok {
+		return ft
+	}
+	return filetypesByExtension[strings.ToLower(filepath.Ext(base))]
+}
+
+// Buffer options that files of some filetypes start with, like Vim's ftplugins. Go and Makefiles are
+// indented with tabs.
+var filetypeOptions = map[string]func(o *bufferOptions){
+	"go":   func(o *bufferOptions) { o.expandtab = false },
+	"make": func(o *bufferOptions) { o.expandtab = false },
+}
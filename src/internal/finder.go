@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// A fuzzy finder for opening files, like fzf. It covers the screen with the files whose paths match
+// the query as it's typed, best first above the prompt, and a preview of the selected file above
+// them. The files under the directory are indexed in the background, skipping what .gitignore files
+// ignore (see gitignore.go), and the list updates as they're found.
+//
+//	CTRL-P, :Files [dir]    open the finder on the files under dir (default the working directory)
+//
+// In the finder:
+//
+//	<Enter>                 open the selected file in the current window
+//	CTRL-X                  open it in a new split
+//	CTRL-T                  open it in a new tab page
+//	CTRL-P, <Up>            select the match above, the next best one
+//	CTRL-N, <Down>          select the match below
+//	CTRL-U, CTRL-W          delete the query, or its last word
+//	<Esc>                   close the finder
+//
+// A path matches if it has the chars of the query in order, ignoring case unless the query has upper
+// case. Matches are ranked by how many chars are together and at the starts of words, e.g. after "/"
+// or "_", and by the file name rather than the directories matching.
+
+const (
+	cFinderPrompt = "> "
+	// How many files the indexer finds before the finder is updated with them.
+	cFinderIndexBatch = 1000
+	// How much of a file is read to preview it.
+	cFinderPreviewBytes = 64 * 1024
+
+	// Scores of fuzzy matches.
+	cFuzzyCharScore        = 16 // For each char matched.
+	cFuzzyBoundaryBonus    = 8  // For a char at the start of a word, e.g. after "_" or ".".
+	cFuzzyPathBonus        = 10 // For a char at the start of the path or after "/".
+	cFuzzyCamelBonus       = 7  // For an upper case char after a lower case one.
+	cFuzzyConsecutiveBonus = 6  // For a char right after the one matched before it.
+	cFuzzyBaseNameBonus    = 20 // For a match that is all in the file name.
+)
+
+// fileFinder is the state of the finder while it's open.
+type fileFinder struct {
+	files    []string      // The files indexed so far.
+	indexing bool          // Set until all files have been indexed.
+	stop     chan struct{} // Closed to stop indexing once the finder is closed.
+
+	query    string
+	matches  []fuzzyMatch // The files that match the query, best first.
+	selected int          // The index in matches of the selected one.
+	offset   int          // The index in matches of the one shown at the bottom of the list.
+
+	previewPath  string // The file that previewLines are of.
+	previewLines []string
+}
+
+// fuzzyMatch is a path that matches the query of the finder.
+type fuzzyMatch struct {
+	path      string
+	score     int
+	positions []int // The offsets in path of the chars that match the query.
+}
+
+// Open the finder on the files under dir.
+func (e *editorImpl) openFinder(dir string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	f := &fileFinder{indexing: true, stop: make(chan struct{})}
+	e.finder = f
+	e.runInBackground(func() func() {
+		paths := make(chan string, cSearchQueueLen)
+		go func() {
+			defer close(paths)
+			walkFiles(dir, nil, f.stop, paths)
+		}()
+		batch := []string{}
+		for path := range paths {
+			batch = append(batch, path)
+			if len(batch) == cFinderIndexBatch {
+				found := batch
+				e.events <- func() {
+					if e.finder == f {
+						f.addFiles(found)
+					}
+				}
+				batch = []string{}
+			}
+		}
+		return func() {
+			if e.finder == f {
+				f.indexing = false
+				f.addFiles(batch)
+			}
+		}
+	})
+	return nil
+}
+
+// Close the finder, and stop indexing if it hasn't finished.
+func (e *editorImpl) closeFinder() {
+	close(e.finder.stop)
+	e.finder = nil
+}
+
+// Add indexed files, and rank the ones that match the query among the matches.
+func (f *fileFinder) addFiles(files []string) {
+	selected := ""
+	if f.selected < len(f.matches) {
+		selected = f.matches[f.selected].path
+	}
+	f.files = append(f.files, files...)
+	for _, path := range files {
+		if m, ok := fuzzyMatchPath(path, f.query); ok {
+			f.matches = append(f.matches, m)
+		}
+	}
+	f.sortMatches()
+	// The same file stays selected, though it may have moved.
+	f.selected = max(0, slices.IndexFunc(f.matches, func(m fuzzyMatch) bool { return m.path == selected }))
+}
+
+// Rank all files against the query, after it has changed.
+func (f *fileFinder) updateMatches() {
+	f.matches = f.matches[:0]
+	for _, path := range f.files {
+		if m, ok := fuzzyMatchPath(path, f.query); ok {
+			f.matches = append(f.matches, m)
+		}
+	}
+	f.sortMatches()
+	f.selected, f.offset = 0, 0
+}
+
+// Sort the matches best first. Of equally good matches, shorter paths come first.
+func (f *fileFinder) sortMatches() {
+	slices.SortFunc(f.matches, func(a, b fuzzyMatch) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(len(a.path), len(b.path)), strings.Compare(a.path, b.path))
+	})
+}
+
+// Match the chars of query in order in path. Like fzf, the earliest place where they all match is
+// found, and then the shortest match that ends there.
+func fuzzyMatchPath(path string, query string) (fuzzyMatch, bool) {
+	if query == "" {
+		return fuzzyMatch{path: path}, true
+	}
+	ignoreCase := strings.ToLower(query) == query
+	equal := func(a byte, b byte) bool {
+		if ignoreCase && a >= 'A' && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		return a == b
+	}
+	end, qi := -1, 0
+	for i := 0; i < len(path) && end < 0; i++ {
+		if equal(path[i], query[qi]) {
+			qi++
+			if qi == len(query) {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return fuzzyMatch{}, false
+	}
+	start := end
+	for i, qi := end, len(query)-1; qi >= 0; i-- {
+		if equal(path[i], query[qi]) {
+			start = i
+			qi--
+		}
+	}
+	m := fuzzyMatch{path: path}
+	for i, qi := start, 0; qi < len(query); i++ {
+		if !equal(path[i], query[qi]) {
+			// Each char between the matched ones counts against the match.
+			m.score--
+			continue
+		}
+		m.score += cFuzzyCharScore + fuzzyBoundaryBonus(path, i)
+		if len(m.positions) > 0 && m.positions[len(m.positions)-1] == i-1 {
+			m.score += cFuzzyConsecutiveBonus
+		}
+		m.positions = append(m.positions, i)
+		qi++
+	}
+	if start > strings.LastIndexByte(path, '/') {
+		m.score += cFuzzyBaseNameBonus
+	}
+	return m, true
+}
+
+// The bonus for matching the char at i of path, for being at the start of a word.
+func fuzzyBoundaryBonus(path string, i int) int {
+	if i == 0 || path[i-1] == '/' {
+		return cFuzzyPathBonus
+	}
+	switch prev, ch := path[i-1], path[i]; {
+	case prev == '_' || prev == '-' || prev == '.' || prev == ' ':
+		return cFuzzyBoundaryBonus
+	case prev >= 'a' && prev <= 'z' && ch >= 'A' && ch <= 'Z':
+		return cFuzzyCamelBonus
+	}
+	return 0
+}
+
+// Handle a key while the finder is open.
+func (e *editorImpl) handleFinderKey(key gc.Key) error {
+	f := e.finder
+	switch k := gc.KeyString(key); k {
+	case ESC_KEY:
+		e.closeFinder()
+		return nil
+	case "enter", CTRL_X_KEY, CTRL_T_KEY:
+		if len(f.matches) == 0 {
+			return errBell
+		}
+		path := f.matches[f.selected].path
+		e.closeFinder()
+		return e.openFinderFile(path, k)
+	case CTRL_P_KEY, "up":
+		f.selected = min(f.selected+1, max(len(f.matches)-1, 0))
+		return nil
+	case CTRL_N_KEY, "down":
+		f.selected = max(f.selected-1, 0)
+		return nil
+	case CTRL_U_KEY:
+		f.query = ""
+	case CTRL_W_KEY:
+		query := strings.TrimRight(f.query, " /")
+		f.query = query[:strings.LastIndexAny(query, " /")+1]
+	case DELETE_KEY, "backspace":
+		if f.query == "" {
+			return errBell
+		}
+		_, size := utf8.DecodeLastRuneInString(f.query)
+		f.query = f.query[:len(f.query)-size]
+	default:
+		if key < ' ' || key >= 0x100 || key == 0x7f {
+			return errBell
+		}
+		f.query += string(byte(key))
+	}
+	f.updateMatches()
+	return nil
+}
+
+// Open the file at path that was picked in the finder, in the current window for <Enter>, or a new
+// split or tab page for CTRL-X or CTRL-T.
+func (e *editorImpl) openFinderFile(path string, key string) error {
+	if key == "enter" {
+		return e.editFile(path)
+	}
+	buf, err := e.loadBuffer(path)
+	if err != nil {
+		return err
+	}
+	if key == CTRL_X_KEY {
+		return e.splitWindow(buf, 0, false)
+	}
+	e.newTabPage(buf)
+	return nil
+}
+
+// The lines of the file at path, for the preview. An open buffer is shown as it is, rather than as
+// it's on disc.
+func (e *editorImpl) finderPreview(path string) []string {
+	if buf := e.findBuffer(path); buf != nil {
+		return buf.fileContents
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer file.Close()
+	data := make([]byte, cFinderPreviewBytes)
+	n, _ := file.Read(data)
+	data = data[:n]
+	if bytes.IndexByte(data[:min(len(data), cBinaryCheckLen)], 0) >= 0 {
+		return []string{"binary file"}
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// Draw the finder over the whole screen: the preview at the top, then the name of the selected file,
+// the matches and the prompt.
+func (e *editorImpl) drawFinder(screen *gc.Window) {
+	f := e.finder
+	maxY, maxX := screen.MaxYX()
+	for y := range maxY {
+		screen.Move(y, 0)
+		screen.ClearToEOL()
+	}
+
+	// The prompt, with how many files match.
+	screen.MovePrint(maxY-1, 0, fitWidth(cFinderPrompt+f.query, maxX-1))
+	count := fmt.Sprintf("%d/%d", len(f.matches), len(f.files))
+	if f.indexing {
+		count += " (indexing)"
+	}
+	if len(cFinderPrompt+f.query)+len(count)+2 < maxX {
+		screen.AttrOn(gc.A_DIM)
+		screen.MovePrint(maxY-1, maxX-1-len(count), count)
+		screen.AttrOff(gc.A_DIM)
+	}
+
+	// The matches, best first from the bottom, scrolled so that the selected one is shown. A small
+	// screen only has room for them.
+	listRows := maxY - 1
+	if maxY >= 10 {
+		listRows = (maxY - 1) / 2
+	}
+	f.offset = max(min(f.offset, f.selected), f.selected-listRows+1)
+	for row := 0; row < listRows && f.offset+row < len(f.matches); row++ {
+		i := f.offset + row
+		m, y := f.matches[i], maxY-2-row
+		marker, attrs := "  ", gc.Char(0)
+		if i == f.selected {
+			marker, attrs = cFinderPrompt, gc.A_REVERSE
+		}
+		screen.Move(y, 0)
+		screen.AttrOn(attrs)
+		screen.Print(marker)
+		positions := m.positions
+		for j, ch := range fitWidth(m.path, maxX-1-len(marker)) {
+			if len(positions) > 0 && positions[0] == j {
+				screen.AddChar(gc.A_BOLD | gc.A_UNDERLINE | attrs | gc.Char(ch))
+				positions = positions[1:]
+				continue
+			}
+			screen.AddChar(attrs | gc.Char(ch))
+		}
+		screen.AttrOff(attrs)
+	}
+	if listRows == maxY-1 || len(f.matches) == 0 {
+		return
+	}
+
+	// The preview of the selected file, under its name.
+	path := f.matches[f.selected].path
+	if path != f.previewPath {
+		f.previewPath, f.previewLines = path, e.finderPreview(path)
+	}
+	nameRow := maxY - 2 - listRows
+	screen.AttrOn(gc.A_REVERSE)
+	screen.MovePrint(nameRow, 0, fitWidth(" "+displayPath(path)+strings.Repeat(" ", maxX), maxX))
+	screen.AttrOff(gc.A_REVERSE)
+	tabstop := strings.Repeat(" ", e.defaultBufOpts.tabstop)
+	for y := 0; y < nameRow && y < len(f.previewLines); y++ {
+		screen.MovePrint(y, 0, fitWidth(strings.ReplaceAll(f.previewLines[y], "\t", tabstop), maxX-1))
+	}
+}
+
+// The start of s that fits in width columns, counting a column per char.
+func fitWidth(s string, width int) string {
+	for i := range s {
+		if width <= 0 {
+			return s[:i]
+		}
+		width--
+	}
+	return s
+}
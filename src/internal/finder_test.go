@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFuzzyMatchPath(t *testing.T) {
+	tests := []struct {
+		path, query string
+		ok          bool
+		positions   []int
+	}{
+		{"src/main.go", "", true, nil},
+		{"src/main.go", "mgo", true, []int{4, 9, 10}},
+		{"src/main.go", "xyz", false, nil},
+		{"src/main.go", "ogm", false, nil},
+		// Lowercase queries ignore case, and ones with capitals don't.
+		{"README.md", "read", true, []int{0, 1, 2, 3}},
+		{"readme.md", "READ", false, nil},
+		// The shortest match ending at the earliest place.
+		{"a/ab/b", "ab", true, []int{2, 3}},
+	}
+	for _, test := range tests {
+		m, ok := fuzzyMatchPath(test.path, test.query)
+		if ok != test.ok || !slices.Equal(m.positions, test.positions) {
+			t.Errorf("fuzzyMatchPath(%q, %q) = %v, %v, want %v, %v", test.path, test.query, m.positions, ok, test.positions, test.ok)
+		}
+	}
+}
+
+// Matches at the start of words, and in the file's name rather than its directories, rank higher.
+func TestFuzzyMatchRanking(t *testing.T) {
+	f := &fileFinder{files: []string{"internal/options.go", "src/loop_tests.go", "options_test.go"}, query: "opt"}
+	f.updateMatches()
+	var got []string
+	for _, m := range f.matches {
+		got = append(got, m.path)
+	}
+	if want := []string{"options_test.go", "internal/options.go", "src/loop_tests.go"}; !slices.Equal(got, want) {
+		t.Errorf("matches = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/scanner"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// Formatting of whole buffers, for :Fmt and for writing with 'formatonsave'. Each filetype may have a
+// formatter; Go's runs in-process with go/format, like gofmt, and others run an external program.
+// 'formatprg', if set, is run with the shell instead of the filetype's formatter.
+
+// formatter returns src formatted, or an error if it can't be, e.g. because of a syntax error.
+type formatter func(src []byte) ([]byte, error)
+
+// Formatters by filetype.
+var formatters = map[string]formatter{
+	"go":   formatGo,
+	"rust": externalFormatter("rustfmt", "--emit=stdout"),
+	"c":    externalFormatter("clang-format"),
+	"cpp":  externalFormatter("clang-format"),
+}
+
+// Format Go source like gofmt does.
+func formatGo(src []byte) ([]byte, error) {
+	out, err := format.Source(src)
+	var errs scanner.ErrorList
+	if errors.As(err, &errs) && len(errs) > 0 {
+		// Just the first error, which is where the syntax goes wrong. The rest often follow from it.
+		return nil, fmt.Errorf("%d:%d: %s", errs[0].Pos.Line, errs[0].Pos.Column, errs[0].Msg)
+	}
+	return out, err
+}
+
+// Returns a formatter that runs the program name with args, giving it the text on stdin and taking
+// the formatted text from stdout.
+func externalFormatter(name string, args ...string) formatter {
+	return func(src []byte) ([]byte, error) {
+		return runFilter(name, exec.Command(name, args...), src)
+	}
+}
+
+// Run cmd with in on its stdin, and return its stdout. If it fails, the error is from name, with what
+// it wrote to stderr, which is where formatters say what's wrong, before its exit status.
+func runFilter(name string, cmd *exec.Cmd, in []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(in), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s\n%w", name, msg, err)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// The formatter for the buffer, or nil if there isn't one.
+func (e *editorImpl) bufferFormatter() formatter {
+	if prg := e.bufOpts.formatprg; prg != "" {
+		return func(src []byte) ([]byte, error) {
+			// Like :!, with 'shell'.
+			return runFilter("'formatprg'", exec.Command(e.globalOpts.shell, "-c", prg), src)
+		}
+	}
+	return formatters[e.bufOpts.filetype]
+}
+
+// Format the whole buffer, as a single change. The cursor stays on the same char, as far as it can. If
+// the text can't be formatted, it's left as is, and the error says where the problem is.
+func (e *editorImpl) formatBuffer() error {
+	fmtr := e.bufferFormatter()
+	if fmtr == nil {
+		return fmt.Errorf("no formatter for filetype %q", e.bufOpts.filetype)
+	}
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	src := strings.Join(e.fileContents, "\n") + "\n"
+	out, err := fmtr([]byte(src))
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	offset := nonBlankOffset(e.fileContents, e.cursorPosition())
+	if e.replaceChangedLines(lines) {
+		e.setCursorPosition(positionAtNonBlankOffset(e.fileContents, offset))
+	}
+	return nil
+}
+
+// The number of chars that aren't whitespace before pos in lines. Formatting mostly changes only
+// whitespace, so this finds the same char after formatting.
+func nonBlankOffset(lines []string, pos position) int {
+	n := 0
+	for lineInd := 0; lineInd <= pos.line; lineInd++ {
+		line := lines[lineInd]
+		if lineInd == pos.line {
+			line = line[:min(pos.col, len(line))]
+		}
+		for _, ch := range line {
+			if !unicode.IsSpace(ch) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// The position of the char that has n chars that aren't whitespace before it in lines.
+func positionAtNonBlankOffset(lines []string, n int) position {
+	for lineInd, line := range lines {
+		for col, ch := range line {
+			if unicode.IsSpace(ch) {
+				continue
+			}
+			if n == 0 {
+				return position{lineInd, col}
+			}
+			n--
+		}
+	}
+	last := len(lines) - 1
+	return position{last, max(len(lines[last])-1, 0)}
+}
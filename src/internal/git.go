@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"os/exec"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// gim works as git's core.editor. A commit message (COMMIT_EDITMSG) gets the "gitcommit" filetype,
+// and the changes being committed are shown read-only in a window below it, unless `git commit -v`
+// put them in the message already. The window closes along with the message's.
+//
+// The commit message and diffs are highlighted:
+//
+//	gitcommit  the summary line past 50 chars, a second line that isn't blank, and comments, with
+//	           the diff below the scissors line of `git commit -v` highlighted as a diff
+//	diff       file headers, hunk headers, and added and removed lines
+
+const (
+	cGitCommitFiletype = "gitcommit"
+	cDiffFiletype      = "diff"
+
+	cCommitDiffBufferName = "[git diff --cached]"
+	// Like Vim, the summary line is highlighted past the length git's docs recommend.
+	cGitSummaryLen = 50
+	// The line above the diff in the message of `git commit -v`, which git cuts the message at.
+	cGitScissors = "# ------------------------ >8 ------------------------"
+)
+
+// syntaxCache keeps what highlighting found in a buffer, until the buffer changes.
+type syntaxCache struct {
+	tick     int // The buffer's changedTick + 1 when it was found, so the zero value is stale.
+	scissors int // The line of cGitScissors, or -1.
+}
+
+// Open a read-only window below the commit message's, showing the changes that are staged to be
+// committed, which can't be changed. git runs the editor with the environment of the commit, so
+// e.g. `git commit -a` shows what it's about to commit too.
+func (e *editorImpl) showCommitDiff() {
+	if e.gitScissorsLine() >= 0 {
+		return
+	}
+	out, err := exec.Command("git", "diff", "--cached", "--no-color", "--no-ext-diff").Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		// Not in a repository, or e.g. only the message is being amended.
+		return
+	}
+	opts := e.defaultBufOpts
+	opts.filetype, opts.readonly, opts.modifiable = cDiffFiletype, true, false
+	buf := &buffer{
+		filePath:     cCommitDiffBufferName,
+		fileContents: splitOutputLines(string(out)),
+		auxiliary:    true,
+		bufOpts:      opts,
+	}
+	from := e.window
+	if err := e.splitWindow(buf, 0, true); err != nil {
+		return
+	}
+	e.buffers = append(e.buffers, buf)
+	e.setCurrentWindow(from)
+}
+
+// The attributes that highlighting gives the char at the byte offset x of the line at lineInd, as
+// per the buffer's filetype.
+func (e *editorImpl) syntaxAttrs(lineInd int, x int) gc.Char {
+	line := e.fileContents[lineInd]
+	switch e.bufOpts.filetype {
+	case cGitCommitFiletype:
+		if scissors := e.gitScissorsLine(); scissors >= 0 && lineInd > scissors {
+			return diffLineAttrs(line)
+		}
+		switch {
+		case strings.HasPrefix(line, "#"):
+			return gc.A_DIM
+		case lineInd == 0 && utf8.RuneCountInString(line[:min(x, len(line))]) >= cGitSummaryLen:
+			return gc.ColorPair(COLOR_PAIR_WARNING)
+		case lineInd == 1:
+			// The summary is separated from the body by a blank line.
+			return gc.ColorPair(COLOR_PAIR_ERROR)
+		}
+	case cDiffFiletype:
+		return diffLineAttrs(line)
+	}
+	return 0
+}
+
+// The attributes of a line of a diff.
+func diffLineAttrs(line string) gc.Char {
+	switch {
+	case strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "index "),
+		strings.HasPrefix(line, "+++ "), strings.HasPrefix(line, "--- "):
+		return gc.A_BOLD
+	case strings.HasPrefix(line, "@@"):
+		return gc.A_DIM
+	case strings.HasPrefix(line, "+"):
+		return gc.ColorPair(COLOR_PAIR_ADDED)
+	case strings.HasPrefix(line, "-"):
+		return gc.ColorPair(COLOR_PAIR_ERROR)
+	}
+	return 0
+}
+
+// The line of the scissors in a commit message, or -1 if there isn't one.
+func (b *buffer) gitScissorsLine() int {
+	if b.syntax.tick != b.changedTick+1 {
+		b.syntax = syntaxCache{tick: b.changedTick + 1, scissors: slices.Index(b.fileContents, cGitScissors)}
+	}
+	return b.syntax.scissors
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matching of paths against the patterns of .gitignore files, so that searching the project skips what
+// git does. See https://git-scm.com/docs/gitignore. Each directory's .gitignore applies below it, and
+// the last pattern that matches a path decides whether it's ignored.
+
+// ignoreRule is a pattern of a .gitignore file.
+type ignoreRule struct {
+	base    string         // The directory of the .gitignore.
+	re      *regexp.Regexp // Matches paths relative to base, with "/" separators.
+	negate  bool           // The pattern started with "!", so paths it matches aren't ignored.
+	dirOnly bool           // The pattern ended with "/", so it only matches directories.
+}
+
+// The rules of the .gitignore in dir, if there is one.
+func readGitignore(dir string) []ignoreRule {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	rules := []ignoreRule{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rule, ok := parseIgnoreRule(dir, line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Parse a line of a .gitignore in base. Returns false for blank lines and comments.
+func parseIgnoreRule(base string, line string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		rule.negate, line = true, rest
+	}
+	if rest, ok := strings.CutSuffix(line, "/"); ok {
+		rule.dirOnly, line = true, rest
+	}
+	re, err := regexp.Compile(ignorePatternRegexp(line))
+	if err != nil || line == "" {
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// The regexp of a .gitignore pattern, without its "!" and trailing "/". A pattern with a "/" matches
+// paths relative to the .gitignore's directory, and one without matches names at any depth.
+func ignorePatternRegexp(pattern string) string {
+	re := strings.Builder{}
+	re.WriteString("^")
+	if !strings.Contains(pattern, "/") {
+		re.WriteString("(.*/)?")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case ch == '*':
+			re.WriteString("[^/]*")
+		case ch == '?':
+			re.WriteString("[^/]")
+		case ch == '[' && strings.Contains(pattern[i+1:], "]"):
+			end := i + 1 + strings.Index(pattern[i+1:], "]")
+			class := pattern[i+1 : end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// Whether path is ignored by rules, which are in the order they apply.
+func isIgnored(rules []ignoreRule, path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.base, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if rule.re.MatchString(filepath.ToSlash(rel)) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIsIgnored(t *testing.T) {
+	root := filepath.Join("/", "project")
+	var rules []ignoreRule
+	for _, line := range []string{
+		"# a comment",
+		"",
+		"*.o",
+		"build/",
+		"/todo.txt",
+		"docs/**/*.html",
+		"!keep.o",
+		"log?.txt",
+		"[ab].tmp",
+		`\#hash`,
+		"trailing   ",
+	} {
+		if rule, ok := parseIgnoreRule(root, line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) != 9 {
+		t.Fatalf("parsed %d rules, want 9 without the comment and blank line", len(rules))
+	}
+	// Rules of a .gitignore in a subdirectory only apply below it.
+	if rule, ok := parseIgnoreRule(filepath.Join(root, "sub"), "*.go"); ok {
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.o", false, true},
+		{"src/deep/main.o", false, true},
+		{"main.c", false, false},
+		{"keep.o", false, false},
+		{"src/keep.o", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"todo.txt", false, true},
+		{"src/todo.txt", false, false},
+		{"docs/a.html", false, true},
+		{"docs/x/y/a.html", false, true},
+		{"src/docs/a.html", false, false},
+		{"log1.txt", false, true},
+		{"log12.txt", false, false},
+		{"a.tmp", false, true},
+		{"c.tmp", false, false},
+		{"#hash", false, true},
+		{"trailing", false, true},
+		{"sub/a.go", false, true},
+		{"a.go", false, false},
+	}
+	for _, test := range tests {
+		if got := isIgnored(rules, filepath.Join(root, filepath.FromSlash(test.path)), test.isDir); got != test.ignored {
+			t.Errorf("isIgnored(%q, isDir %v) = %v, want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+}
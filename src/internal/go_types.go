@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Go to definition and find references for Go buffers that aren't open in a language server, with
+// go/types. The package in the buffer's directory is type-checked in the background, using the
+// buffers of its files that are open rather than what's on disc, and the identifier under the cursor
+// is resolved. References are only found in that package.
+
+// goPackageQuery is what to resolve: the identifier at offset in the file at path, with the text of
+// the package's files that are open.
+type goPackageQuery struct {
+	path     string
+	offset   int
+	overlays map[string]string // Text of open files, by absolute path.
+}
+
+// goResolution is the result of a goPackageQuery.
+type goResolution struct {
+	name string     // The identifier's name.
+	def  *location  // Where it's defined, or nil if it's built in.
+	refs []location // Uses and the definition in the package, in file order.
+}
+
+// Go to the definition of the identifier under the cursor, for "gd".
+func (e *editorImpl) gotoDefinition() error {
+	if e.serverFor(e.buffer) != nil || e.bufOpts.filetype != "go" {
+		return e.lspDefinition()
+	}
+	return e.resolveGoIdent(func(res *goResolution) error {
+		if res.def == nil {
+			return fmt.Errorf("%s is built in", res.name)
+		}
+		return e.jumpTo(*res.def)
+	})
+}
+
+// List the references to the identifier under the cursor, for "gr".
+func (e *editorImpl) listReferences() error {
+	if e.serverFor(e.buffer) != nil || e.bufOpts.filetype != "go" {
+		return e.lspReferences()
+	}
+	return e.resolveGoIdent(func(res *goResolution) error {
+		if len(res.refs) == 0 {
+			return fmt.Errorf("no references to %s found", res.name)
+		}
+		return e.selectLocation(fmt.Sprintf("References to %s:", res.name), res.refs)
+	})
+}
+
+// Resolve the identifier under the cursor in the background, then call handler with what it is.
+func (e *editorImpl) resolveGoIdent(handler func(res *goResolution) error) error {
+	path, err := filepath.Abs(e.filePath)
+	if err != nil {
+		return err
+	}
+	query := e.newGoPackageQuery(path)
+	pos := e.cursorPosition()
+	query.offset = pos.col
+	for _, line := range e.fileContents[:pos.line] {
+		query.offset += len(line) + 1
+	}
+	e.runInBackground(func() func() {
+		res, err := query.resolve()
+		return func() {
+			if err == nil {
+				err = handler(res)
+			}
+			if err != nil {
+				e.reportError(err)
+			}
+		}
+	})
+	return nil
+}
+
+// A query for the file at path, with the buffers open in its package as overlays.
+func (e *editorImpl) newGoPackageQuery(path string) goPackageQuery {
+	query := goPackageQuery{path: path, overlays: map[string]string{}}
+	for _, buf := range e.buffers {
+		if abs, err := filepath.Abs(buf.filePath); err == nil && filepath.Dir(abs) == filepath.Dir(path) {
+			query.overlays[abs] = bufferText(buf)
+		}
+	}
+	return query
+}
+
+// Parse and type-check the package, and resolve the identifier.
+func (q goPackageQuery) resolve() (*goResolution, error) {
+	fset := token.NewFileSet()
+	files, err := q.parsePackage(fset, nil)
+	if err != nil {
+		return nil, err
+	}
+	var target *ast.File
+	for _, f := range files {
+		if fset.File(f.Pos()).Name() == q.path {
+			target = f
+		}
+	}
+	ident := identAt(fset, target, q.offset)
+	if ident == nil {
+		return nil, errors.New("no identifier under cursor")
+	}
+
+	info := &types.Info{Defs: map[*ast.Ident]types.Object{}, Uses: map[*ast.Ident]types.Object{}}
+	// Keep going after errors, e.g. in code that is being written, so that what can be resolved is.
+	conf := goTypesConfig(fset, func(error) {})
+	conf.Check(target.Name.Name, fset, files, info)
+
+	obj := info.Uses[ident]
+	if obj == nil {
+		obj = info.Defs[ident]
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("can't resolve %s", ident.Name)
+	}
+	res := &goResolution{name: ident.Name}
+	if obj.Pos().IsValid() {
+		loc := tokenLocation(fset.Position(obj.Pos()))
+		res.def = &loc
+	}
+	for _, idents := range []map[*ast.Ident]types.Object{info.Defs, info.Uses} {
+		for id, o := range idents {
+			if o == obj {
+				res.refs = append(res.refs, tokenLocation(fset.Position(id.Pos())))
+			}
+		}
+	}
+	slices.SortFunc(res.refs, func(a, b location) int {
+		if a.path != b.path {
+			return strings.Compare(a.path, b.path)
+		}
+		if a.pos.line != b.pos.line {
+			return a.pos.line - b.pos.line
+		}
+		return a.pos.col - b.pos.col
+	})
+	return res, nil
+}
+
+// The config to type-check with, which calls onError with each error.
+func goTypesConfig(fset *token.FileSet, onError func(error)) types.Config {
+	return types.Config{
+		Importer:    fallbackImporter{importer.ForCompiler(fset, "gc", nil), importer.ForCompiler(fset, "source", nil)},
+		Error:       onError,
+		FakeImportC: true,
+	}
+}
+
+// Parse the files of the package that q.path is in: the files in its directory with the same package
+// name that would be built, and its tests if it's a test. Files with syntax errors are parsed as far
+// as they can be, and onError, if not nil, is called with the errors.
+func (q goPackageQuery) parsePackage(fset *token.FileSet, onError func(error)) ([]*ast.File, error) {
+	dir := filepath.Dir(q.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{q.path}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || path == q.path {
+			continue
+		}
+		if strings.HasSuffix(name, "_test.go") && !strings.HasSuffix(q.path, "_test.go") {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	files := []*ast.File{}
+	for _, path := range paths {
+		var src any
+		if text, ok := q.overlays[path]; ok {
+			src = text
+		}
+		f, err := parser.ParseFile(fset, path, src, parser.SkipObjectResolution)
+		if f == nil {
+			if path == q.path {
+				return nil, err
+			}
+			continue
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			// E.g. an external test package, or a file of another program with a build tag.
+			continue
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// The identifier in f that covers offset, or nil if there isn't one.
+func identAt(fset *token.FileSet, f *ast.File, offset int) *ast.Ident {
+	var found *ast.Ident
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil || found != nil {
+			return false
+		}
+		start, end := fset.Position(n.Pos()).Offset, fset.Position(n.End()).Offset
+		if offset < start || offset > end {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok && offset < end {
+			found = id
+		}
+		return true
+	})
+	return found
+}
+
+// The location of a position from go/token, whose line and column count from 1. Positions from export
+// data have paths in the standard library relative to $GOROOT, and only the line.
+func tokenLocation(p token.Position) location {
+	path := p.Filename
+	if rest, ok := strings.CutPrefix(path, "$GOROOT"); ok {
+		path = filepath.Join(build.Default.GOROOT, rest)
+	}
+	return location{path, position{p.Line - 1, max(p.Column-1, 0)}}
+}
+
+// fallbackImporter imports with its first importer, and its second if that fails. Importing export
+// data is fast but can't always find packages outside the standard library; importing from source
+// can, but type-checks them too.
+type fallbackImporter [2]types.Importer
+
+func (imp fallbackImporter) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, "", 0)
+}
+
+// Import path as imported from dir, so that modules are found from the package's directory rather
+// than the working directory.
+func (imp fallbackImporter) ImportFrom(path string, dir string, mode types.ImportMode) (pkg *types.Package, err error) {
+	for _, i := range imp {
+		if from, ok := i.(types.ImporterFrom); ok && dir != "" {
+			pkg, err = from.ImportFrom(path, dir, mode)
+		} else {
+			pkg, err = i.Import(path)
+		}
+		if err == nil {
+			return pkg, nil
+		}
+	}
+	return nil, err
+}
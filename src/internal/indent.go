@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+)
+
+// Indenting of new lines, for ENTER, "o" and "O" and the "=" operator. With 'autoindent', a new line
+// gets the indent of the line before it. With 'smartindent', filetypes that have an indenter get
+// smarter indenting, e.g. the lines inside a Go block are indented one 'shiftwidth' more.
+
+// indenter returns the indent width that the line at lineInd of lines should have.
+type indenter func(e *editorImpl, lines []string, lineInd int) int
+
+// Indenters by filetype.
+var indenters = map[string]indenter{
+	"go": goIndent,
+}
+
+// The indent width that the line at lineInd of lines should have.
+func (e *editorImpl) computeIndent(lines []string, lineInd int) int {
+	if ind, ok := indenters[e.bufOpts.filetype]; ok && e.bufOpts.smartindent {
+		return ind(e, lines, lineInd)
+	}
+	prev := prevNonBlankLine(lines, lineInd)
+	if prev < 0 {
+		return 0
+	}
+	return e.indentWidth(leadingWhitespace(lines[prev]))
+}
+
+// Whether typing ch may change the indent of the line being typed, e.g. "}" in Go.
+func (e *editorImpl) isIndentKey(ch string) bool {
+	_, ok := indenters[e.bufOpts.filetype]
+	return ok && e.bufOpts.smartindent && (ch == "}" || ch == ")" || ch == "]" || ch == ":")
+}
+
+// The indent for a new line at lineInd, which has just been added. Returns "" without 'autoindent'.
+func (e *editorImpl) newLineIndent(lineInd int) string {
+	if !e.bufOpts.autoindent {
+		return ""
+	}
+	return e.makeIndent(e.computeIndent(e.fileContents, lineInd))
+}
+
+// Reindent the lines [start, end], for "=". Each line is indented after the lines before it are, so
+// that a whole block moves together.
+func (e *editorImpl) reindentLines(start int, end int) {
+	lines := slices.Clone(e.fileContents)
+	for lineInd := start; lineInd <= end; lineInd++ {
+		line := lines[lineInd]
+		text := strings.TrimLeft(line, " \t")
+		if text == "" {
+			// Like Vim, empty lines are left empty.
+			lines[lineInd] = ""
+			continue
+		}
+		lines[lineInd] = e.makeIndent(e.computeIndent(lines, lineInd)) + text
+	}
+	if !slices.Equal(lines[start:end+1], e.fileContents[start:end+1]) {
+		e.replaceLines(start, end+1, lines[start:end+1]...)
+	}
+}
+
+// Reindent the line at lineInd, keeping the cursor on the same char. Used when an indent key is typed.
+func (e *editorImpl) reindentCurrentLine() {
+	lineInd := e.getCurrLineInd()
+	line := e.fileContents[lineInd]
+	indent := leadingWhitespace(line)
+	newIndent := e.makeIndent(e.computeIndent(e.fileContents, lineInd))
+	if newIndent == indent {
+		return
+	}
+	e.replaceLines(lineInd, lineInd+1, newIndent+line[len(indent):])
+	e.cursorX = max(e.cursorX+len(newIndent)-len(indent), len(newIndent))
+}
+
+// The index of the last line before lineInd that isn't blank, or -1 if there isn't one.
+func prevNonBlankLine(lines []string, lineInd int) int {
+	for i := lineInd - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Indent Go like gofmt does: one 'shiftwidth' more after a line that opens a block or a case clause,
+// and one less for a line that closes a block or starts a case clause. A line after one that closes
+// brackets it didn't open gets the indent of the line that opened them, e.g. after the last line of a
+// call's args.
+func goIndent(e *editorImpl, lines []string, lineInd int) int {
+	prev := prevNonBlankLine(lines, lineInd)
+	if prev < 0 {
+		return 0
+	}
+	prevText := strings.TrimSpace(stripGoComment(lines[prev]))
+	// Find the line where the statement that prev is part of starts.
+	start, balance := prev, goBracketBalance(prevText)
+	for balance < 0 && start > 0 {
+		start--
+		balance += goBracketBalance(stripGoComment(lines[start]))
+	}
+	indent := e.indentWidth(leadingWhitespace(lines[start]))
+	if strings.HasSuffix(prevText, "{") || strings.HasSuffix(prevText, "(") || strings.HasSuffix(prevText, "[") ||
+		(isGoCaseClause(prevText) && strings.HasSuffix(prevText, ":")) {
+		indent += e.shiftWidth()
+	}
+	text := strings.TrimSpace(lines[lineInd])
+	if strings.HasPrefix(text, "}") || strings.HasPrefix(text, ")") || strings.HasPrefix(text, "]") ||
+		isGoCaseClause(text) {
+		indent -= e.shiftWidth()
+	}
+	return max(indent, 0)
+}
+
+// Whether text, without its indent, starts a case clause of a switch or select.
+func isGoCaseClause(text string) bool {
+	return strings.HasPrefix(text, "case ") || strings.HasPrefix(text, "default:")
+}
+
+// Remove a "//" comment from the end of a line of Go. "//" in a string or rune literal isn't a comment.
+func stripGoComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0 && ch == '\\' && quote != '`':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '/' && i+1 < len(line) && line[i+1] == '/':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// The number of brackets that a line of Go opens, less the number it closes. Brackets in string and
+// rune literals don't count.
+func goBracketBalance(line string) int {
+	balance := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0 && ch == '\\' && quote != '`':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '{' || ch == '(' || ch == '[':
+			balance++
+		case ch == '}' || ch == ')' || ch == ']':
+			balance--
+		}
+	}
+	return balance
+}
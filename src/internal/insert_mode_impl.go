@@ -12,11 +12,28 @@ func newInsertEditorMode(baseEditor *editorImpl) *insertModeEditor {
 
 type insertModeEditor struct {
 	*editorImpl
+
+	// With a count, e.g. "3ihi<Esc>", the inserted text is repeated when INSERT mode is left.
+	count    int
+	newLine  bool            // Each repeat goes on a new line, for "o" and "O".
+	inserted strings.Builder // The text typed since the cursor last moved.
+	// For "I", "A" and "c" in VISUAL block mode, the block to insert the text on each line of.
+	block *blockInsert
+	// Whether the current line's indent was added by 'autoindent', and nothing has been typed after
+	// it. Like Vim, the indent is removed if the line is left empty.
+	autoIndented bool
 }
 
 func (ie *insertModeEditor) Handle(key gc.Key) error {
 	ch := gc.KeyString(key)
 	switch ch {
+	case "down", "up", "right", "left":
+		// Like Vim, moving the cursor starts a new insert, so only text typed after it is repeated.
+		ie.count = 0
+		ie.inserted.Reset()
+		ie.block = nil
+	}
+	switch ch {
 	case "down":
 		// Move the cursor down.
 		ie.moveCursorVertical(1)
@@ -34,16 +51,42 @@ func (ie *insertModeEditor) Handle(key gc.Key) error {
 		ie.moveCursorHorizontal(-1, true /*pastLastCharAllowed*/)
 		return nil
 	case ESC_KEY:
+		// Repeat the inserted text for a count.
+		text := ie.inserted.String()
+		if ie.newLine {
+			text = "\n" + text
+		}
+		for i := 1; i < ie.count; i++ {
+			ie.insertText(text)
+		}
+		ie.removeAutoIndent()
 		// Swap to NORMAL model
 		// Swapping decrements the x-pos by 1.
 		ie.moveCursorHorizontal(-1, true /*pastLastCharAllowed*/)
+		if ie.block != nil {
+			// Like Vim, the cursor goes back to the start of the block.
+			ie.insertIntoBlock(*ie.block, ie.inserted.String())
+			ie.setCursorPosition(position{ie.block.top, ie.block.col})
+		}
 		ie.userMsg = ""
 		ie.swapEditorMode(NORMAL_MODE)
 		return nil
-	case DELETE_KEY:
-		// Delete the char before the cursor.
+	case DELETE_KEY, "backspace":
+		// Delete the char before the cursor, or the whitespace back to the previous soft tab stop.
 		ie.cursorX = ie.normalizeCursorX()
-		ie.deleteChar()
+		deleted := 1
+		if n, ok := ie.deleteSoftTab(); ok {
+			deleted = n
+		} else {
+			ie.deleteChar()
+		}
+		if inserted := ie.inserted.String(); len(inserted) >= deleted {
+			ie.inserted.Reset()
+			ie.inserted.WriteString(inserted[:len(inserted)-deleted])
+		} else {
+			ie.inserted.Reset()
+			ie.count = 0
+		}
 		return nil
 	default:
 		// Insert a char at the cursor.
@@ -53,6 +96,31 @@ func (ie *insertModeEditor) Handle(key gc.Key) error {
 	}
 }
 
+// Remove the indent that 'autoindent' added to the current line, if nothing was typed after it.
+func (ie *insertModeEditor) removeAutoIndent() {
+	lineInd := ie.getCurrLineInd()
+	if ie.autoIndented && strings.TrimLeft(ie.fileContents[lineInd], " \t") == "" {
+		ie.replaceLines(lineInd, lineInd+1, "")
+		ie.cursorX = 0
+	}
+	ie.autoIndented = false
+}
+
+// Insert text at the cursor as if it was typed.
+func (ie *insertModeEditor) insertText(text string) {
+	for i := 0; i < len(text); i++ {
+		ie.cursorX = ie.normalizeCursorX()
+		switch text[i] {
+		case '\n':
+			ie.insertChar("enter")
+		case '\t':
+			ie.insertChar("tab")
+		default:
+			ie.insertChar(text[i : i+1])
+		}
+	}
+}
+
 func (ie *insertModeEditor) GetCursorYX() (int, int) {
 	return ie.cursorY, ie.normalizeCursorX()
 }
@@ -89,10 +157,8 @@ func (ie *insertModeEditor) deleteChar() {
 		newLine := strings.Builder{}
 		newLine.WriteString(prevLine)
 		newLine.WriteString(currLine)
-		// Replace the previous line.
-		ie.fileContents[currLineInd-1] = newLine.String()
-		// Remove the current line.
-		ie.fileContents = append(ie.fileContents[:currLineInd], ie.fileContents[currLineInd+1:]...)
+		// Replace the previous line, and remove the current line.
+		ie.replaceLines(currLineInd-1, currLineInd+1, newLine.String())
 		ie.moveCursorVertical(-1)
 		ie.cursorX = len(prevLine)
 		return
@@ -100,7 +166,7 @@ func (ie *insertModeEditor) deleteChar() {
 	newLine := strings.Builder{}
 	newLine.WriteString(currLine[:ie.cursorX-1])
 	newLine.WriteString(currLine[ie.cursorX:])
-	ie.fileContents[currLineInd] = newLine.String()
+	ie.replaceLines(currLineInd, currLineInd+1, newLine.String())
 	// No need to call the specialized moveCursorHorizontal since we know that cursorX > 0, and we
 	// want to skip the validations for line length, as the deletion case temporarily introduces
 	// a bad state.
@@ -116,29 +182,93 @@ func (ie *insertModeEditor) insertChar(ch string) {
 		// the cursor, and:
 		// 1. The "before" part stays on the current line.
 		// 2. The "after" part (includes cursor's x-pos) is pushed to a new.
-		// 3. The cursor's x-pos becomes 0.
+		// 3. The cursor's x-pos becomes 0, or the end of the new line's indent with 'autoindent'.
 		// 4. The cursor's y-pos is incremented by 1.
+		ie.inserted.WriteByte('\n')
 		before, after := currLine[:ie.cursorX], currLine[ie.cursorX:]
-		ie.fileContents[currLineInd] = before
-		ie.fileContents = append(
-			ie.fileContents[:currLineInd+1],
-			append([]string{after}, ie.fileContents[currLineInd+1:]...)...,
-		)
-		ie.cursorX = 0
-		ie.moveCursorVertical(1)
+		if ie.autoIndented && strings.TrimLeft(before, " \t") == "" {
+			before = ""
+		}
+		if ie.bufOpts.autoindent {
+			after = strings.TrimLeft(after, " \t")
+		}
+		ie.replaceLines(currLineInd, currLineInd+1, before, after)
+		indent := ie.newLineIndent(currLineInd + 1)
+		if indent != "" {
+			ie.replaceLines(currLineInd+1, currLineInd+2, indent+after)
+		}
+		ie.moveCursorToLine(currLineInd + 1)
+		ie.cursorX = len(indent)
+		ie.autoIndented = indent != ""
 		return
 	}
-	cursorDelta := 1
+	ie.autoIndented = false
 	if ch == "tab" {
-		// Convert tabs to 4 spaces.
-		ch = "    "
-		cursorDelta = 4
+		ie.inserted.WriteByte('\t')
+		ie.insertTab()
+		return
 	}
-	// Convert tabs to 4 spaces.
+	ie.inserted.WriteString(ch)
+	cursorDelta := len(ch)
 	newLine := strings.Builder{}
 	newLine.WriteString(currLine[:ie.cursorX])
 	newLine.WriteString(ch)
 	newLine.WriteString(currLine[ie.cursorX:])
-	ie.fileContents[currLineInd] = newLine.String()
+	ie.replaceLines(currLineInd, currLineInd+1, newLine.String())
 	ie.moveCursorHorizontal(cursorDelta, true /*pastLastCharAllowed*/)
+	if ie.isIndentKey(ch) {
+		// E.g. a "}" that closes a block, or the ":" of a case clause, may need less indent.
+		line := strings.TrimSpace(ie.fileContents[currLineInd][:ie.cursorX])
+		if line == ch || ch == ":" && isGoCaseClause(line) {
+			ie.reindentCurrentLine()
+		}
+	}
+}
+
+// Insert a tab at the cursor. With 'softtabstop', the whitespace before the cursor goes to the next
+// multiple of it, using tabs where it can unless 'expandtab' is set. Otherwise, with 'expandtab',
+// spaces are inserted up to the next tab stop.
+func (ie *insertModeEditor) insertTab() {
+	lineInd := ie.getCurrLineInd()
+	line := ie.fileContents[lineInd]
+	x := ie.cursorX
+	start, ws := x, "\t"
+	if sts := ie.softTabStop(); sts > 0 || ie.bufOpts.expandtab {
+		if sts == 0 {
+			sts = ie.bufOpts.tabstop
+		}
+		col := ie.displayCol(line, x)
+		if !ie.bufOpts.expandtab {
+			// Spaces before the cursor may be turned into a tab.
+			for start > 0 && (line[start-1] == ' ' || line[start-1] == '\t') {
+				start--
+			}
+		}
+		ws = ie.makeWhitespace(ie.displayCol(line, start), (col/sts+1)*sts)
+	}
+	ie.replaceLines(lineInd, lineInd+1, line[:start]+ws+line[x:])
+	ie.cursorX = start + len(ws)
+}
+
+// With 'softtabstop', delete the whitespace before the cursor back to the previous multiple of it.
+// Returns how many chars were deleted, less any that were added, or false if backspace should only
+// delete the char before the cursor.
+func (ie *insertModeEditor) deleteSoftTab() (int, bool) {
+	sts := ie.softTabStop()
+	lineInd := ie.getCurrLineInd()
+	line := ie.fileContents[lineInd]
+	x := ie.cursorX
+	if sts == 0 || x == 0 || line[x-1] != ' ' {
+		return 0, false
+	}
+	target := (ie.displayCol(line, x) - 1) / sts * sts
+	start := x
+	for start > 0 && (line[start-1] == ' ' || line[start-1] == '\t') && ie.displayCol(line, start-1) >= target {
+		start--
+	}
+	// A tab may go from before the target to after it, so whitespace is added back up to the target.
+	ws := ie.makeWhitespace(ie.displayCol(line, start), target)
+	ie.replaceLines(lineInd, lineInd+1, line[:start]+ws+line[x:])
+	ie.cursorX = start + len(ws)
+	return x - start - len(ws), true
 }
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Special keys that may be written in <> notation, e.g. "<CR>", in mappings and macros. Names are
+// matched case-insensitively. The first name for a key is the one it's formatted with.
+var keyNotationNames = []struct {
+	name string
+	key  gc.Key
+}{
+	{"CR", gc.KEY_RETURN},
+	{"Enter", gc.KEY_RETURN},
+	{"Return", gc.KEY_RETURN},
+	{"NL", gc.KEY_RETURN},
+	{"Esc", 27},
+	{"Tab", gc.KEY_TAB},
+	{"BS", 127},
+	{"Space", ' '},
+	{"lt", '<'},
+	{"Bar", '|'},
+	{"Bslash", '\\'},
+	{"Del", gc.KEY_DC},
+	{"Insert", gc.KEY_IC},
+	{"Up", gc.KEY_UP},
+	{"Down", gc.KEY_DOWN},
+	{"Left", gc.KEY_LEFT},
+	{"Right", gc.KEY_RIGHT},
+	{"Home", gc.KEY_HOME},
+	{"End", gc.KEY_END},
+	{"PageUp", gc.KEY_PAGEUP},
+	{"PageDown", gc.KEY_PAGEDOWN},
+	{"F1", gc.KEY_F1},
+	{"F2", gc.KEY_F2},
+	{"F3", gc.KEY_F3},
+	{"F4", gc.KEY_F4},
+	{"F5", gc.KEY_F5},
+	{"F6", gc.KEY_F6},
+	{"F7", gc.KEY_F7},
+	{"F8", gc.KEY_F8},
+	{"F9", gc.KEY_F9},
+	{"F10", gc.KEY_F10},
+	{"F11", gc.KEY_F11},
+	{"F12", gc.KEY_F12},
+}
+
+// Parse keys written in Vim's <> notation, e.g. "<C-w>j" or ":w<CR>". A "<" that doesn't start a
+// known key name is taken literally. "<leader>" is replaced by leader, and "<Nop>" by no keys.
+func parseKeyNotation(notation string, leader string) []gc.Key {
+	keys := []gc.Key{}
+	for i := 0; i < len(notation); i++ {
+		if notation[i] == '<' {
+			if end := strings.IndexByte(notation[i:], '>'); end > 0 {
+				if named, ok := parseKeyName(notation[i+1:i+end], leader); ok {
+					keys = append(keys, named...)
+					i += end
+					continue
+				}
+			}
+		}
+		keys = append(keys, gc.Key(notation[i]))
+	}
+	return keys
+}
+
+// Parse the name between "<" and ">". Returns false if it isn't a known name.
+func parseKeyName(name string, leader string) ([]gc.Key, bool) {
+	switch strings.ToLower(name) {
+	case "leader":
+		return parseKeyNotation(leader, ""), true
+	case "nop":
+		return []gc.Key{}, true
+	}
+	for _, kn := range keyNotationNames {
+		if strings.EqualFold(kn.name, name) {
+			return []gc.Key{kn.key}, true
+		}
+	}
+	// Control chars, e.g. <C-w> or <C-[>.
+	if len(name) == 3 && (name[0] == 'C' || name[0] == 'c') && name[1] == '-' {
+		ch := name[2]
+		if ch >= 'A' && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		if (ch >= 'a' && ch <= 'z') || strings.IndexByte("@[\\]^_", ch) >= 0 {
+			return []gc.Key{gc.Key(ch & 0x1f)}, true
+		}
+	}
+	return nil, false
+}
+
+// Format keys in <> notation, such that parseKeyNotation gives back the same keys.
+func formatKeys(keys []gc.Key) string {
+	formatted := strings.Builder{}
+	for _, key := range keys {
+		formatted.WriteString(formatKey(key))
+	}
+	return formatted.String()
+}
+
+func formatKey(key gc.Key) string {
+	for _, kn := range keyNotationNames {
+		if kn.key == key {
+			return "<" + kn.name + ">"
+		}
+	}
+	switch {
+	case key > 0 && key < 0x20:
+		return fmt.Sprintf("<C-%c>", rune(key|0x60))
+	case key < 0x100:
+		// Bytes of UTF-8 chars arrive as separate keys, so keep them as raw bytes.
+		return string([]byte{byte(key)})
+	}
+	return "<" + gc.KeyString(key) + ">"
+}
+
+// Special keys are stored in registers as chars in Unicode's private use area, so that recorded
+// macros can be put, edited and yanked like any other text.
+const cSpecialKeyRuneBase = 0xE000
+
+// Convert keys to the text that is stored in a register for them.
+func keysToText(keys []gc.Key) string {
+	text := strings.Builder{}
+	for _, key := range keys {
+		if key < 0x100 {
+			text.WriteByte(byte(key))
+			continue
+		}
+		text.WriteRune(rune(cSpecialKeyRuneBase + key))
+	}
+	return text.String()
+}
+
+// Convert the text of a register back to keys, e.g. to run it as a macro.
+func textToKeys(text string) []gc.Key {
+	keys := []gc.Key{}
+	for i := 0; i < len(text); i++ {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r >= cSpecialKeyRuneBase+0x100 && r <= cSpecialKeyRuneBase+0x1FFF {
+			keys = append(keys, gc.Key(r-cSpecialKeyRuneBase))
+			i += size - 1
+			continue
+		}
+		keys = append(keys, gc.Key(text[i]))
+	}
+	return keys
+}
@@ -0,0 +1,650 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omarnabikhan/gim/src/internal/lsp"
+)
+
+// Language servers are started for buffers whose filetype has one, when the buffer is opened. Servers
+// that aren't installed are skipped. :LspServer changes the command for a filetype, e.g. in the
+// config file:
+//
+//	:LspServer go gopls -remote=auto
+//	:LspServer python           (no server for Python)
+//
+// What the server sends is handled between keys (see events.go), so a slow server never holds up
+// typing. With a server running:
+//
+//	K                 show the hover information for what's under the cursor
+//	gd                go to the definition of what's under the cursor
+//	gr                list the references to what's under the cursor
+//	:LspRename {name} rename what's under the cursor everywhere
+//	:LspCodeAction    list the code actions at the cursor, and :LspCodeAction {N} applies one
+//
+// Diagnostics the server publishes are shown like the editor's own. See diagnostics.go.
+
+const (
+	// How long to wait for language servers to exit when quitting, before killing them.
+	cLspShutdownTimeout = 500 * time.Millisecond
+)
+
+// The language server commands by filetype, which :LspServer starts from.
+var defaultLanguageServers = map[string][]string{
+	"go":         {"gopls"},
+	"rust":       {"rust-analyzer"},
+	"c":          {"clangd"},
+	"cpp":        {"clangd"},
+	"python":     {"pylsp"},
+	"javascript": {"typescript-language-server", "--stdio"},
+	"typescript": {"typescript-language-server", "--stdio"},
+}
+
+// Language IDs for the filetypes whose IDs differ from the filetype.
+var lspLanguageIDs = map[string]string{
+	"sh": "shellscript",
+}
+
+// languageServer is a running language server, which serves all buffers of a filetype.
+type languageServer struct {
+	name     string // E.g. "gopls", for messages.
+	filetype string
+	cmd      *exec.Cmd
+	reaped   chan struct{} // Closed once the process has exited and been waited for.
+	client   *lsp.Client
+	ready    bool // Set once the server has responded to "initialize".
+	// How the server wants changes to be sent: 0 not at all, 1 as the whole document, 2 as the lines
+	// that changed.
+	syncKind int
+	buffers  []*buffer // The buffers open in the server, or to be opened once it's ready.
+}
+
+// Set the command for the language server of a filetype, for :LspServer.
+func (e *editorImpl) setLanguageServer(args string) error {
+	fields := splitCommandArgs(args)
+	if len(fields) == 0 {
+		return errors.New("argument required")
+	}
+	if len(fields) == 1 {
+		delete(e.languageServerCmds, fields[0])
+		return nil
+	}
+	e.languageServerCmds[fields[0]] = fields[1:]
+	return nil
+}
+
+// Open buf in the language server for its filetype, starting the server if it isn't running.
+func (e *editorImpl) attachLanguageServer(buf *buffer) {
+	ft := buf.bufOpts.filetype
+	server, ok := e.languageServers[ft]
+	if !ok {
+		args := e.languageServerCmds[ft]
+		if len(args) == 0 {
+			return
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			// Servers that aren't installed are skipped quietly, rather than warning on every file.
+			return
+		}
+		var err error
+		if server, err = e.startLanguageServer(args, projectRoot(buf.filePath)); err != nil {
+			e.reportError(err)
+			return
+		}
+		server.filetype = ft
+		e.languageServers[ft] = server
+	}
+	server.buffers = append(server.buffers, buf)
+	if server.ready {
+		e.lspDidOpen(server, buf)
+	}
+}
+
+// The directory a language server runs in: the nearest one above filePath with a go.mod or .git, or
+// else the file's own directory.
+func projectRoot(filePath string) string {
+	dir := filepath.Dir(filePath)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, marker := range []string{"go.mod", ".git"} {
+			if _, err := os.Stat(filepath.Join(d, marker)); err == nil {
+				return d
+			}
+		}
+		if filepath.Dir(d) == d {
+			return dir
+		}
+	}
+}
+
+// Start the server with the command args in root, and initialize it. The buffers are opened in it
+// once it's ready.
+func (e *editorImpl) startLanguageServer(args []string, root string) (*languageServer, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = root
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	// stderr is left unset, so it goes to the null device rather than over the screen.
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start language server: %w", err)
+	}
+	server := &languageServer{name: filepath.Base(args[0]), cmd: cmd, reaped: make(chan struct{})}
+	server.client = lsp.NewClient(stdout, stdin, e.events)
+	go func() {
+		// Waiting closes the output, so it's read to its end first.
+		<-server.client.Done()
+		cmd.Wait()
+		close(server.reaped)
+	}()
+	e.registerLspHandlers(server)
+
+	params := map[string]any{
+		"processId":  os.Getpid(),
+		"rootUri":    lsp.FileURI(root),
+		"clientInfo": map[string]any{"name": "gim"},
+		"capabilities": map[string]any{
+			"textDocument": map[string]any{
+				"synchronization":    map[string]any{"didSave": true},
+				"hover":              map[string]any{"contentFormat": []string{"plaintext", "markdown"}},
+				"definition":         map[string]any{"linkSupport": true},
+				"references":         map[string]any{},
+				"rename":             map[string]any{},
+				"publishDiagnostics": map[string]any{},
+				"codeAction": map[string]any{
+					"codeActionLiteralSupport": map[string]any{
+						"codeActionKind": map[string]any{"valueSet": []string{
+							"", "quickfix", "refactor", "refactor.extract", "refactor.inline",
+							"refactor.rewrite", "source", "source.organizeImports",
+						}},
+					},
+					"resolveSupport": map[string]any{"properties": []string{"edit"}},
+				},
+			},
+			"workspace": map[string]any{
+				"applyEdit":     true,
+				"workspaceEdit": map[string]any{"documentChanges": true},
+				"configuration": true,
+			},
+		},
+	}
+	server.client.Request("initialize", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			e.reportError(fmt.Errorf("%s: %w", server.name, err))
+			return
+		}
+		server.syncKind = parseSyncKind(result)
+		server.ready = true
+		server.client.Notify("initialized", struct{}{})
+		for _, buf := range server.buffers {
+			e.lspDidOpen(server, buf)
+		}
+	})
+	return server, nil
+}
+
+// Parse how the server wants changes to be sent from the result of "initialize". textDocumentSync
+// may be the kind, or an object that has it.
+func parseSyncKind(result json.RawMessage) int {
+	init := struct {
+		Capabilities struct {
+			TextDocumentSync json.RawMessage `json:"textDocumentSync"`
+		} `json:"capabilities"`
+	}{}
+	json.Unmarshal(result, &init)
+	kind := 0
+	if json.Unmarshal(init.Capabilities.TextDocumentSync, &kind) == nil {
+		return kind
+	}
+	options := struct {
+		Change int `json:"change"`
+	}{}
+	json.Unmarshal(init.Capabilities.TextDocumentSync, &options)
+	return options.Change
+}
+
+// Handle the notifications and requests that the server sends.
+func (e *editorImpl) registerLspHandlers(server *languageServer) {
+	client := server.client
+	client.OnNotification("textDocument/publishDiagnostics", func(params json.RawMessage) {
+		p := lsp.PublishDiagnosticsParams{}
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		if buf := e.findBuffer(lsp.URIPath(p.URI)); buf != nil {
+			buf.diagnostics = p.Diagnostics
+		}
+	})
+	client.OnNotification("window/showMessage", func(params json.RawMessage) {
+		p := struct {
+			Type    int    `json:"type"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		switch p.Type {
+		case 1:
+			e.reportError(fmt.Errorf("%s: %s", server.name, p.Message))
+		case 2:
+			e.warnf("%s: %s", server.name, p.Message)
+		default:
+			e.infof("%s: %s", server.name, p.Message)
+		}
+	})
+	client.OnRequest("workspace/applyEdit", func(params json.RawMessage) (any, error) {
+		p := lsp.ApplyWorkspaceEditParams{}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if err := e.applyWorkspaceEdit(p.Edit); err != nil {
+			return nil, err
+		}
+		return lsp.ApplyWorkspaceEditResult{Applied: true}, nil
+	})
+	client.OnRequest("workspace/configuration", func(params json.RawMessage) (any, error) {
+		// There is no configuration, so each item asked for is null.
+		p := struct {
+			Items []json.RawMessage `json:"items"`
+		}{}
+		json.Unmarshal(params, &p)
+		return make([]any, len(p.Items)), nil
+	})
+	for _, method := range []string{"client/registerCapability", "window/workDoneProgress/create"} {
+		client.OnRequest(method, func(json.RawMessage) (any, error) { return nil, nil })
+	}
+	client.OnExit(func(err error) {
+		if e.languageServers[server.filetype] == server {
+			delete(e.languageServers, server.filetype)
+		}
+		for _, buf := range server.buffers {
+			buf.diagnostics = nil
+		}
+		if err != nil {
+			e.warnf("language server %s exited: %v", server.name, err)
+		} else {
+			e.warnf("language server %s exited", server.name)
+		}
+	})
+}
+
+// Stop the language servers, for quitting. Each is asked to shut down, and told to exit once it has
+// responded, and is killed if it hasn't exited by the deadline, which all of them share.
+func (e *editorImpl) stopLanguageServers() {
+	servers := slices.Collect(maps.Values(e.languageServers))
+	e.languageServers = map[string]*languageServer{}
+	for _, server := range servers {
+		// The exit isn't worth a message when quitting.
+		server.client.OnExit(func(error) {})
+		server.client.Request("shutdown", nil, func(json.RawMessage, error) {
+			// Even a server that failed to shut down is told to exit.
+			server.client.Notify("exit", nil)
+			server.client.Close()
+		})
+	}
+	deadline := time.NewTimer(cLspShutdownTimeout)
+	defer deadline.Stop()
+	expired := false
+	for _, server := range servers {
+		for !expired && !server.exited() {
+			select {
+			case <-server.client.Done():
+			case event := <-e.events:
+				// The responses to "shutdown" come as events, and the servers mustn't wait to send.
+				event()
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		if !server.exited() {
+			server.cmd.Process.Kill()
+		}
+	}
+}
+
+// Whether the server's output has ended, so it has exited or is about to.
+func (s *languageServer) exited() bool {
+	select {
+	case <-s.client.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// The server that buf is open in, or nil if there isn't one that's ready.
+func (e *editorImpl) serverFor(buf *buffer) *languageServer {
+	server, ok := e.languageServers[buf.bufOpts.filetype]
+	if !ok || !server.ready || !slices.Contains(server.buffers, buf) {
+		return nil
+	}
+	return server
+}
+
+// Like serverFor the current buffer, but returns an error to show if there isn't a server.
+func (e *editorImpl) requireLanguageServer() (*languageServer, error) {
+	server, ok := e.languageServers[e.bufOpts.filetype]
+	if !ok {
+		return nil, fmt.Errorf("no language server for filetype %q", e.bufOpts.filetype)
+	}
+	if !server.ready {
+		return nil, fmt.Errorf("language server %s isn't ready yet", server.name)
+	}
+	return server, nil
+}
+
+// The whole text of buf, as it would be written.
+func bufferText(buf *buffer) string {
+	return strings.Join(buf.fileContents, "\n") + "\n"
+}
+
+func (e *editorImpl) lspDidOpen(server *languageServer, buf *buffer) {
+	languageID, ok := lspLanguageIDs[buf.bufOpts.filetype]
+	if !ok {
+		languageID = buf.bufOpts.filetype
+	}
+	buf.lspVersion++
+	server.client.Notify("textDocument/didOpen", lsp.DidOpenTextDocumentParams{TextDocument: lsp.TextDocumentItem{
+		URI:        lsp.FileURI(buf.filePath),
+		LanguageID: languageID,
+		Version:    buf.lspVersion,
+		Text:       bufferText(buf),
+	}})
+}
+
+// Tell the server that the lines [start, end) of the buffer were replaced with lines. Called once the
+// lines have been replaced.
+func (e *editorImpl) lspDidChange(start int, end int, lines []string) {
+	server := e.serverFor(e.buffer)
+	if server == nil || server.syncKind == 0 {
+		return
+	}
+	change := lsp.TextDocumentContentChangeEvent{Text: bufferText(e.buffer)}
+	if server.syncKind == 2 {
+		// Whole lines are replaced, so the range is from the start of the first line to the start of
+		// the line after the last. The document ends with a '\n', so there is always such a line.
+		text := strings.Builder{}
+		for _, line := range lines {
+			text.WriteString(line)
+			text.WriteByte('\n')
+		}
+		change = lsp.TextDocumentContentChangeEvent{
+			Range: &lsp.Range{Start: lsp.Position{Line: start}, End: lsp.Position{Line: end}},
+			Text:  text.String(),
+		}
+	}
+	e.lspVersion++
+	server.client.Notify("textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{URI: lsp.FileURI(e.filePath), Version: e.lspVersion},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{change},
+	})
+}
+
+func (e *editorImpl) lspDidSave() {
+	if server := e.serverFor(e.buffer); server != nil {
+		server.client.Notify("textDocument/didSave", lsp.DidSaveTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: lsp.FileURI(e.filePath)},
+		})
+	}
+}
+
+// The protocol's position of pos in the current buffer.
+func (e *editorImpl) lspPosition(pos position) lsp.Position {
+	line := e.fileContents[pos.line]
+	return lsp.Position{Line: pos.line, Character: lsp.UTF16Len(line[:min(pos.col, len(line))])}
+}
+
+// The position in lines of a position from the server, as far as the lines go.
+func bufferPosition(lines []string, p lsp.Position) position {
+	lineInd := max(0, min(p.Line, len(lines)-1))
+	return position{lineInd, lsp.ByteOffset(lines[lineInd], p.Character)}
+}
+
+// The params of a request about the char under the cursor.
+func (e *editorImpl) lspCursorParams() lsp.TextDocumentPositionParams {
+	return lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.FileURI(e.filePath)},
+		Position:     e.lspPosition(e.cursorPosition()),
+	}
+}
+
+// Send a request about the current buffer, and call handler with the result. Errors from the server
+// are shown rather than given to handler.
+func (e *editorImpl) lspRequest(method string, params any, handler func(server *languageServer, result json.RawMessage) error) error {
+	server, err := e.requireLanguageServer()
+	if err != nil {
+		return err
+	}
+	server.client.Request(method, params, func(result json.RawMessage, err error) {
+		if err == nil {
+			err = handler(server, result)
+		}
+		if err != nil {
+			e.reportError(fmt.Errorf("%s: %w", server.name, err))
+		}
+	})
+	return nil
+}
+
+// Show the hover information for what's under the cursor, for "K".
+func (e *editorImpl) lspHover() error {
+	return e.lspRequest("textDocument/hover", e.lspCursorParams(), func(_ *languageServer, result json.RawMessage) error {
+		text := lsp.HoverText(result)
+		if text == "" {
+			e.warnf("no information available")
+			return nil
+		}
+		e.showMessage(severityInfo, text)
+		return nil
+	})
+}
+
+// Go to the definition of what's under the cursor, for "gd".
+func (e *editorImpl) lspDefinition() error {
+	return e.lspRequest("textDocument/definition", e.lspCursorParams(), func(_ *languageServer, result json.RawMessage) error {
+		locs, err := lsp.ParseLocations(result)
+		if err != nil {
+			return err
+		}
+		if len(locs) == 0 {
+			return errors.New("no definition found")
+		}
+		if lsp.URIPath(locs[0].URI) == "" {
+			return fmt.Errorf("can't open %s", locs[0].URI)
+		}
+		return e.jumpTo(e.lspLocation(locs[0]))
+	})
+}
+
+// The location of a location from the server.
+func (e *editorImpl) lspLocation(loc lsp.Location) location {
+	path := lsp.URIPath(loc.URI)
+	pos := position{loc.Range.Start.Line, loc.Range.Start.Character}
+	if lines := e.fileLines(path); len(lines) > 0 {
+		pos = bufferPosition(lines, loc.Range.Start)
+	}
+	return location{path, pos}
+}
+
+// List the references to what's under the cursor, for "gr".
+func (e *editorImpl) lspReferences() error {
+	params := lsp.ReferenceParams{TextDocumentPositionParams: e.lspCursorParams()}
+	params.Context.IncludeDeclaration = true
+	return e.lspRequest("textDocument/references", params, func(_ *languageServer, result json.RawMessage) error {
+		locs, err := lsp.ParseLocations(result)
+		if err != nil {
+			return err
+		}
+		if len(locs) == 0 {
+			return errors.New("no references found")
+		}
+		refs := []location{}
+		for _, loc := range locs {
+			refs = append(refs, e.lspLocation(loc))
+		}
+		return e.selectLocation("References:", refs)
+	})
+}
+
+// Rename what's under the cursor to newName, for :LspRename.
+func (e *editorImpl) lspRename(newName string) error {
+	if newName == "" {
+		return errors.New("argument required")
+	}
+	params := lsp.RenameParams{TextDocumentPositionParams: e.lspCursorParams(), NewName: newName}
+	return e.lspRequest("textDocument/rename", params, func(_ *languageServer, result json.RawMessage) error {
+		if lsp.IsNull(result) {
+			return errors.New("nothing to rename")
+		}
+		edit := lsp.WorkspaceEdit{}
+		if err := json.Unmarshal(result, &edit); err != nil {
+			return err
+		}
+		return e.applyWorkspaceEdit(edit)
+	})
+}
+
+// List the code actions for the cursor's line, for :LspCodeAction. With the number of one from the
+// list, apply it.
+func (e *editorImpl) lspCodeAction(arg string) error {
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(e.codeActions) {
+			return fmt.Errorf("invalid code action: %s", arg)
+		}
+		return e.applyCodeAction(e.codeActions[n-1])
+	}
+	pos := e.cursorPosition()
+	params := lsp.CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.FileURI(e.filePath)},
+		Range:        lsp.Range{Start: e.lspPosition(pos), End: e.lspPosition(pos)},
+	}
+	params.Context.Diagnostics = []lsp.Diagnostic{}
+	for _, d := range e.diagnostics {
+		if d.Range.Start.Line <= pos.line && pos.line <= d.Range.End.Line {
+			params.Context.Diagnostics = append(params.Context.Diagnostics, d)
+		}
+	}
+	return e.lspRequest("textDocument/codeAction", params, func(_ *languageServer, result json.RawMessage) error {
+		actions, err := lsp.ParseCodeActions(result)
+		if err != nil {
+			return err
+		}
+		e.codeActions = actions
+		if len(actions) == 0 {
+			e.warnf("no code actions available")
+			return nil
+		}
+		lines := []string{}
+		for i, action := range actions {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, action.Title))
+		}
+		lines = append(lines, "Apply one with :LspCodeAction {N}")
+		e.showPressEnter(severityInfo, lines)
+		return nil
+	})
+}
+
+// Apply a code action: its edit, then its command. Actions that only have data are resolved first.
+func (e *editorImpl) applyCodeAction(action lsp.CodeAction) error {
+	if action.Edit == nil && action.Command == nil && action.Data != nil {
+		return e.lspRequest("codeAction/resolve", action, func(_ *languageServer, result json.RawMessage) error {
+			resolved := lsp.CodeAction{}
+			if err := json.Unmarshal(result, &resolved); err != nil {
+				return err
+			}
+			resolved.Data = nil
+			return e.applyCodeAction(resolved)
+		})
+	}
+	if action.Edit != nil {
+		if err := e.applyWorkspaceEdit(*action.Edit); err != nil {
+			return err
+		}
+	}
+	if action.Command != nil {
+		// The server makes the changes itself, with "workspace/applyEdit".
+		params := lsp.ExecuteCommandParams{Command: action.Command.Command, Arguments: action.Command.Arguments}
+		return e.lspRequest("workspace/executeCommand", params, func(*languageServer, json.RawMessage) error { return nil })
+	}
+	return nil
+}
+
+// Apply the edits of a workspace edit to the buffers they are for, opening files that aren't open.
+// Each buffer's edits are a single change, and the buffers are left for the user to write.
+func (e *editorImpl) applyWorkspaceEdit(edit lsp.WorkspaceEdit) error {
+	uris, edits := edit.Edits()
+	bufs := make([]*buffer, 0, len(uris))
+	for _, uri := range uris {
+		path := lsp.URIPath(uri)
+		if path == "" {
+			return fmt.Errorf("can't edit %s", uri)
+		}
+		buf, err := e.loadBuffer(path)
+		if err != nil {
+			return err
+		}
+		if !buf.bufOpts.modifiable {
+			// None of the edit is applied, rather than only some of it.
+			return fmt.Errorf("%s: %w", path, errNotModifiable)
+		}
+		bufs = append(bufs, buf)
+	}
+	for i, uri := range uris {
+		e.withBuffer(bufs[i], func() {
+			pos := e.cursorPosition()
+			e.replaceChangedLines(applyTextEdits(e.fileContents, edits[uri]))
+			e.restoreUndoCursor(pos)
+		})
+	}
+	if e.isCommandStart() {
+		// The edit arrived between commands, so it's undone on its own.
+		e.closeUndoStep()
+	}
+	if len(uris) > 1 {
+		e.infof("%d files changed", len(uris))
+	}
+	return nil
+}
+
+// Returns lines with edits applied. The edits' ranges are in lines as they were, and don't overlap.
+func applyTextEdits(lines []string, edits []lsp.TextEdit) []string {
+	// The document ends with a '\n', so there is an empty line after the last one for edits to end
+	// at.
+	lines = append(slices.Clone(lines), "")
+	edits = slices.Clone(edits)
+	slices.SortStableFunc(edits, func(a, b lsp.TextEdit) int {
+		if a.Range.Start.Line != b.Range.Start.Line {
+			return a.Range.Start.Line - b.Range.Start.Line
+		}
+		return a.Range.Start.Character - b.Range.Start.Character
+	})
+	// From the last edit back, so that the edits before it are still where their ranges say.
+	for i := len(edits) - 1; i >= 0; i-- {
+		start, end := bufferPosition(lines, edits[i].Range.Start), bufferPosition(lines, edits[i].Range.End)
+		text := strings.ReplaceAll(edits[i].NewText, "\r\n", "\n")
+		newLines := strings.Split(lines[start.line][:start.col]+text+lines[end.line][end.col:], "\n")
+		lines = slices.Replace(lines, start.line, end.line+1, newLines...)
+	}
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary runs as a fake language server when this is set to how it should behave: "ok"
+// responds as a server should, and "hang" never responds to "shutdown" nor exits.
+const cFakeServerEnv = "GIM_TEST_FAKE_LANGUAGE_SERVER"
+
+// The file the fake server logs the methods it gets to, one per line.
+const cFakeServerLogEnv = "GIM_TEST_FAKE_LANGUAGE_SERVER_LOG"
+
+// How long the fake server takes to respond to "shutdown".
+const cFakeShutdownDelay = 100 * time.Millisecond
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(cFakeServerEnv); mode != "" {
+		runFakeLanguageServer(mode, os.Getenv(cFakeServerLogEnv))
+		return
+	}
+	os.Exit(m.Run())
+}
+
+type fakeServerMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	// When the message was read, which may be well before it's handled.
+	received time.Time
+}
+
+func runFakeLanguageServer(mode string, logPath string) {
+	messages := make(chan fakeServerMessage)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			header, err := textproto.NewReader(reader).ReadMIMEHeader()
+			if err != nil {
+				break
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			body := make([]byte, length)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				break
+			}
+			msg := fakeServerMessage{received: time.Now()}
+			json.Unmarshal(body, &msg)
+			messages <- msg
+		}
+		close(messages)
+	}()
+	respond := func(id *json.RawMessage, result string) {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": %s, "result": %s}`, *id, result)
+		fmt.Printf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	log, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	var shutDown time.Time
+	for msg := range messages {
+		fmt.Fprintln(log, msg.Method)
+		switch {
+		case mode == "hang":
+		case msg.Method == "initialize":
+			respond(msg.ID, `{"capabilities": {}}`)
+		case msg.Method == "shutdown":
+			time.Sleep(cFakeShutdownDelay)
+			shutDown = time.Now()
+			respond(msg.ID, "null")
+		case msg.Method == "exit":
+			if shutDown.IsZero() || msg.received.Before(shutDown) {
+				// As the protocol says, exiting without having shut down is an error.
+				fmt.Fprintln(log, "exit before the shutdown response")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+	// A hung server doesn't notice its input ending either.
+	select {}
+}
+
+// Start the test binary as a fake language server for ft, behaving as mode says. Returns the path of
+// its log.
+func startFakeLanguageServer(t *testing.T, e *editorImpl, ft string, mode string) string {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), ft+".log")
+	t.Setenv(cFakeServerEnv, mode)
+	t.Setenv(cFakeServerLogEnv, logPath)
+	// Built with -race, a program sleeps for a second as it exits, which is longer than the shutdown
+	// deadline.
+	t.Setenv("GORACE", strings.TrimSpace(os.Getenv("GORACE")+" atexit_sleep_ms=0"))
+	server, err := e.startLanguageServer([]string{os.Args[0]}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.filetype = ft
+	e.languageServers[ft] = server
+	return logPath
+}
+
+// Wait for the process to be reaped, e.g. after it was killed.
+func waitForExit(t *testing.T, server *languageServer) {
+	t.Helper()
+	select {
+	case <-server.reaped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("language server %s is still running", server.filetype)
+	}
+}
+
+// Run the editor's events until the server has responded to "initialize", so that starting it,
+// which may be slow, doesn't count against the shutdown deadline.
+func waitForReady(t *testing.T, e *editorImpl, server *languageServer) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for !server.ready {
+		select {
+		case event := <-e.events:
+			event()
+		case <-timeout:
+			t.Fatalf("language server %s didn't respond to initialize", server.filetype)
+		}
+	}
+}
+
+// Servers that don't respond to "shutdown" are all killed once the deadline passes, and the one that
+// does is told to exit only after it has responded.
+func TestStopLanguageServers(t *testing.T) {
+	e := &editorImpl{events: make(chan func(), cEventsLen), languageServers: map[string]*languageServer{}}
+	okLog := startFakeLanguageServer(t, e, "ok", "ok")
+	startFakeLanguageServer(t, e, "hang1", "hang")
+	startFakeLanguageServer(t, e, "hang2", "hang")
+	servers := []*languageServer{e.languageServers["ok"], e.languageServers["hang1"], e.languageServers["hang2"]}
+	waitForReady(t, e, servers[0])
+
+	start := time.Now()
+	e.stopLanguageServers()
+	if elapsed := time.Since(start); elapsed > cLspShutdownTimeout+time.Second {
+		t.Errorf("stopping the language servers took %s", elapsed)
+	}
+	if len(e.languageServers) != 0 {
+		t.Errorf("languageServers = %v after stopping them", e.languageServers)
+	}
+	for _, server := range servers {
+		waitForExit(t, server)
+	}
+	// Reading the state is safe once the process has been reaped.
+	if server := servers[0]; server.cmd.ProcessState == nil || !server.cmd.ProcessState.Success() {
+		t.Errorf("the server that shut down exited with %v", server.cmd.ProcessState)
+	}
+	log, err := os.ReadFile(okLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if want := []string{"initialize", "initialized", "shutdown", "exit"}; !slices.Equal(got, want) {
+		t.Errorf("the server got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// location is a place in a file, e.g. a definition to jump to or a reference to list.
+type location struct {
+	path string
+	pos  position
+}
+
+// The lines of the file at path: its buffer's if it's open, otherwise as it is on disc. Returns nil if
+// it can't be read.
+func (e *editorImpl) fileLines(path string) []string {
+	if buf := e.findBuffer(path); buf != nil {
+		return buf.fileContents
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// A path to show the user: relative to the working directory if it's under it.
+func displayPath(path string) string {
+	if rel, err := filepath.Rel(".", path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// Move the cursor to loc, showing its file if it isn't the current one.
+func (e *editorImpl) jumpTo(loc location) error {
+	if err := e.editFile(loc.path); err != nil {
+		return err
+	}
+	lineInd := max(0, min(loc.pos.line, len(e.fileContents)-1))
+	e.setCursorPosition(position{lineInd, max(0, min(loc.pos.col, len(e.fileContents[lineInd])-1))})
+	return nil
+}
+
+// Show locs as "file:line:col: text" for the user to pick one to jump to. A single location is jumped
+// to straight away.
+func (e *editorImpl) selectLocation(title string, locs []location) error {
+	if len(locs) == 1 {
+		return e.jumpTo(locs[0])
+	}
+	items := []string{}
+	for _, loc := range locs {
+		text := ""
+		if lines := e.fileLines(loc.path); loc.pos.line < len(lines) {
+			text = strings.TrimSpace(lines[loc.pos.line])
+		}
+		items = append(items, fmt.Sprintf("%s:%d:%d: %s", displayPath(loc.path), loc.pos.line+1, loc.pos.col+1, text))
+	}
+	e.selectFromList(title, items, func(i int) error { return e.jumpTo(locs[i]) })
+	return nil
+}
@@ -0,0 +1,300 @@
+// Package lsp is a client for the Language Server Protocol, spoken with JSON-RPC over a server's stdin
+// and stdout.
+//
+// The client never blocks its caller. Messages are written from a goroutine, and everything the
+// server sends is turned into a func that is sent on the events channel given to NewClient. The
+// editor runs those funcs on its own goroutine, between keys, so handlers may use the editor's state
+// without locking.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// ErrClosed is given to the handlers of requests that were waiting when the connection ended.
+var ErrClosed = errors.New("language server connection closed")
+
+// ResponseError is an error that the server responded to a request with.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// message is any JSON-RPC message: a request if it has an ID and a method, a notification if it only
+// has a method, or a response if it only has an ID.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *ResponseError   `json:"error,omitempty"`
+}
+
+// Client is a connection to a language server.
+type Client struct {
+	events chan<- func()
+
+	mu                   sync.Mutex
+	nextID               int
+	pending              map[int]func(result json.RawMessage, err error)
+	notificationHandlers map[string]func(params json.RawMessage)
+	requestHandlers      map[string]func(params json.RawMessage) (any, error)
+	exitHandler          func(err error)
+
+	// Messages waiting to be written, and a signal that there are some.
+	out      io.WriteCloser
+	outQueue [][]byte
+	outReady chan struct{}
+	closed   bool
+
+	done chan struct{} // Closed once the server's output has ended.
+}
+
+// NewClient starts a client that reads the server's messages from r and writes to w. The funcs that
+// handle what the server sends are sent on events, to be run by the caller.
+func NewClient(r io.Reader, w io.WriteCloser, events chan<- func()) *Client {
+	c := &Client{
+		events:               events,
+		pending:              map[int]func(json.RawMessage, error){},
+		notificationHandlers: map[string]func(json.RawMessage){},
+		requestHandlers:      map[string]func(json.RawMessage) (any, error){},
+		out:                  w,
+		outReady:             make(chan struct{}, 1),
+		done:                 make(chan struct{}),
+	}
+	go c.readLoop(r)
+	go c.writeLoop()
+	return c
+}
+
+// Call handler with the params of each notification of method that the server sends.
+func (c *Client) OnNotification(method string, handler func(params json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notificationHandlers[method] = handler
+}
+
+// Call handler for each request of method that the server sends, and respond with what it returns.
+// Requests without a handler are responded to with an error.
+func (c *Client) OnRequest(method string, handler func(params json.RawMessage) (any, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requestHandlers[method] = handler
+}
+
+// Call handler once the connection has ended, e.g. because the server exited.
+func (c *Client) OnExit(handler func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exitHandler = handler
+}
+
+// Send a request, and call handler with the server's result or error once it responds.
+func (c *Client) Request(method string, params any, handler func(result json.RawMessage, err error)) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	closed := c.closed
+	if !closed {
+		c.pending[id] = handler
+	}
+	c.mu.Unlock()
+	if closed {
+		// The caller is what runs events, so this mustn't wait for it.
+		go func() { c.events <- func() { handler(nil, ErrClosed) } }()
+		return
+	}
+	rawID := json.RawMessage(strconv.Itoa(id))
+	c.send(message{ID: &rawID, Method: method, Params: marshalParams(params)})
+}
+
+// Send a notification, which the server doesn't respond to.
+func (c *Client) Notify(method string, params any) {
+	c.send(message{Method: method, Params: marshalParams(params)})
+}
+
+// Done returns a channel that is closed once the server's output has ended, e.g. because it exited.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close the connection once the messages that were sent have been written.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.signalWriter()
+}
+
+func marshalParams(params any) json.RawMessage {
+	if params == nil {
+		return nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		// Params are built by the editor, so this is a bug rather than something to recover from.
+		panic(fmt.Sprintf("lsp: can't marshal params: %v", err))
+	}
+	return data
+}
+
+// Queue msg to be written by the writer goroutine.
+func (c *Client) send(msg message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queueLocked(msg)
+}
+
+// Like send, when c.mu is already held.
+func (c *Client) queueLocked(msg message) {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(fmt.Sprintf("lsp: can't marshal message: %v", err))
+	}
+	if c.closed {
+		return
+	}
+	c.outQueue = append(c.outQueue, data)
+	c.signalWriter()
+}
+
+// Wake the writer goroutine. c.mu must be held.
+func (c *Client) signalWriter() {
+	select {
+	case c.outReady <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) writeLoop() {
+	for range c.outReady {
+		c.mu.Lock()
+		queue, closed := c.outQueue, c.closed
+		c.outQueue = nil
+		c.mu.Unlock()
+		for _, data := range queue {
+			if _, err := fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+				// The reader sees the connection end too, and reports it.
+				break
+			}
+		}
+		if closed {
+			c.out.Close()
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop(r io.Reader) {
+	reader := bufio.NewReader(r)
+	var err error
+	for {
+		var msg *message
+		if msg, err = readMessage(reader); err != nil {
+			break
+		}
+		c.dispatch(msg)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	close(c.done)
+	c.mu.Lock()
+	c.closed = true
+	c.signalWriter()
+	pending, exitHandler := c.pending, c.exitHandler
+	c.pending = map[int]func(json.RawMessage, error){}
+	c.mu.Unlock()
+	for _, handler := range pending {
+		c.events <- func() { handler(nil, ErrClosed) }
+	}
+	if exitHandler != nil {
+		c.events <- func() { exitHandler(err) }
+	}
+}
+
+// Read a message, which has headers like HTTP, of which only Content-Length matters.
+func readMessage(reader *bufio.Reader) (*message, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	msg := &message{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Send the func that handles msg to the events channel.
+func (c *Client) dispatch(msg *message) {
+	if event := c.eventFor(msg); event != nil {
+		// c.mu isn't held here, so the editor may send while this waits for it to take the event.
+		c.events <- event
+	}
+}
+
+// The func that handles msg, or nil if there's nothing to do.
+func (c *Client) eventFor(msg *message) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case msg.ID != nil && msg.Method == "":
+		// A response to a request that was sent.
+		id, _ := strconv.Atoi(string(*msg.ID))
+		handler, ok := c.pending[id]
+		if !ok {
+			return nil
+		}
+		delete(c.pending, id)
+		if msg.Error != nil {
+			return func() { handler(nil, msg.Error) }
+		}
+		return func() { handler(msg.Result, nil) }
+	case msg.ID != nil:
+		// A request from the server, which is responded to once the editor has handled it.
+		handler, ok := c.requestHandlers[msg.Method]
+		if !ok {
+			c.queueLocked(message{ID: msg.ID, Error: &ResponseError{Code: -32601, Message: "method not found"}})
+			return nil
+		}
+		return func() {
+			result, err := handler(msg.Params)
+			if err != nil {
+				c.send(message{ID: msg.ID, Error: &ResponseError{Code: -32603, Message: err.Error()}})
+				return
+			}
+			resp := message{ID: msg.ID, Result: marshalParams(result)}
+			if resp.Result == nil {
+				resp.Result = json.RawMessage("null")
+			}
+			c.send(resp)
+		}
+	default:
+		if handler, ok := c.notificationHandlers[msg.Method]; ok {
+			return func() { handler(msg.Params) }
+		}
+		return nil
+	}
+}
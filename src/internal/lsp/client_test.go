@@ -0,0 +1,304 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeServer is the server's end of a connection to a Client, which a test drives message by message.
+type fakeServer struct {
+	t      *testing.T
+	reader *bufio.Reader
+	writer *io.PipeWriter
+}
+
+// A client connected to a fake server over pipes, and the events channel that the client sends to.
+func newTestClient(t *testing.T) (*Client, *fakeServer, chan func()) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	events := make(chan func(), 16)
+	client := NewClient(clientReader, clientWriter, events)
+	server := &fakeServer{t: t, reader: bufio.NewReader(serverReader), writer: serverWriter}
+	t.Cleanup(func() {
+		serverWriter.Close()
+		serverReader.Close()
+	})
+	return client, server, events
+}
+
+// Read the next message the client wrote.
+func (s *fakeServer) receive() *message {
+	s.t.Helper()
+	received := make(chan *message, 1)
+	go func() {
+		msg, err := readMessage(s.reader)
+		if err != nil {
+			s.t.Errorf("reading a message from the client: %v", err)
+		}
+		received <- msg
+	}()
+	select {
+	case msg := <-received:
+		if msg == nil {
+			s.t.FailNow()
+		}
+		return msg
+	case <-time.After(time.Second):
+		s.t.Fatal("timed out waiting for a message from the client")
+		return nil
+	}
+}
+
+// Read the next message, which must be a request or notification of method.
+func (s *fakeServer) expect(method string) *message {
+	s.t.Helper()
+	msg := s.receive()
+	if msg.Method != method {
+		s.t.Fatalf("got %q from the client, want %q", msg.Method, method)
+	}
+	if msg.JSONRPC != "2.0" {
+		s.t.Errorf("jsonrpc = %q, want \"2.0\"", msg.JSONRPC)
+	}
+	return msg
+}
+
+// Write msg to the client, as a server would.
+func (s *fakeServer) send(msg message) {
+	s.t.Helper()
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	// The client reads all the time, so this doesn't wait for long.
+	if _, err := fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Respond to the request req with result.
+func (s *fakeServer) respond(req *message, result string) {
+	s.send(message{ID: req.ID, Result: json.RawMessage(result)})
+}
+
+func (s *fakeServer) notify(method string, params string) {
+	s.send(message{Method: method, Params: json.RawMessage(params)})
+}
+
+// Run the next event the client sends, as the editor would.
+func runEvent(t *testing.T, events chan func()) {
+	t.Helper()
+	select {
+	case event := <-events:
+		event()
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event from the client")
+	}
+}
+
+func rawID(id int) *json.RawMessage {
+	raw := json.RawMessage(strconv.Itoa(id))
+	return &raw
+}
+
+func TestClientInitialize(t *testing.T) {
+	client, server, events := newTestClient(t)
+	var result struct {
+		Capabilities struct {
+			TextDocumentSync int `json:"textDocumentSync"`
+		} `json:"capabilities"`
+	}
+	initialized := false
+	client.Request("initialize", map[string]any{"processId": 1}, func(raw json.RawMessage, err error) {
+		if err != nil {
+			t.Errorf("initialize: %v", err)
+		}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			t.Errorf("unmarshaling the result of initialize: %v", err)
+		}
+		initialized = true
+		client.Notify("initialized", struct{}{})
+	})
+
+	req := server.expect("initialize")
+	if req.ID == nil {
+		t.Fatal("initialize was sent without an ID")
+	}
+	var params struct {
+		ProcessID int `json:"processId"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.ProcessID != 1 {
+		t.Errorf("initialize params = %s", req.Params)
+	}
+	server.respond(req, `{"capabilities": {"textDocumentSync": 2}}`)
+	runEvent(t, events)
+	if !initialized || result.Capabilities.TextDocumentSync != 2 {
+		t.Errorf("initialized = %v, result = %+v", initialized, result)
+	}
+	if msg := server.expect("initialized"); msg.ID != nil {
+		t.Errorf("the initialized notification has an ID: %s", *msg.ID)
+	}
+}
+
+func TestClientNotifications(t *testing.T) {
+	client, server, events := newTestClient(t)
+	client.Notify("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: "file:///a.go", LanguageID: "go", Version: 1, Text: "package a\n"},
+	})
+	msg := server.expect("textDocument/didOpen")
+	if msg.ID != nil {
+		t.Errorf("a notification was sent with an ID: %s", *msg.ID)
+	}
+	var params DidOpenTextDocumentParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params.TextDocument.Text != "package a\n" {
+		t.Errorf("didOpen params = %s", msg.Params)
+	}
+
+	var logged []string
+	client.OnNotification("window/logMessage", func(params json.RawMessage) {
+		var p struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(params, &p)
+		logged = append(logged, p.Message)
+	})
+	// Notifications without a handler are dropped, rather than sent as events.
+	server.notify("$/progress", `{}`)
+	server.notify("window/logMessage", `{"type": 3, "message": "hello"}`)
+	runEvent(t, events)
+	if len(logged) != 1 || logged[0] != "hello" {
+		t.Errorf("logged = %q, want [\"hello\"]", logged)
+	}
+}
+
+func TestClientDiagnostics(t *testing.T) {
+	client, server, events := newTestClient(t)
+	var published PublishDiagnosticsParams
+	client.OnNotification("textDocument/publishDiagnostics", func(params json.RawMessage) {
+		if err := json.Unmarshal(params, &published); err != nil {
+			t.Errorf("unmarshaling diagnostics: %v", err)
+		}
+	})
+	server.notify("textDocument/publishDiagnostics", `{
+		"uri": "file:///a.go",
+		"diagnostics": [{
+			"range": {"start": {"line": 2, "character": 1}, "end": {"line": 2, "character": 4}},
+			"severity": 1,
+			"source": "compiler",
+			"message": "undefined: x",
+			"code": "UndeclaredName"
+		}]
+	}`)
+	runEvent(t, events)
+	if published.URI != "file:///a.go" || len(published.Diagnostics) != 1 {
+		t.Fatalf("published = %+v", published)
+	}
+	d := published.Diagnostics[0]
+	want := Range{Start: Position{Line: 2, Character: 1}, End: Position{Line: 2, Character: 4}}
+	if d.Range != want || d.Severity != SeverityError || d.Message != "undefined: x" || string(d.Code) != `"UndeclaredName"` {
+		t.Errorf("diagnostic = %+v", d)
+	}
+}
+
+func TestClientResponsesMatchRequests(t *testing.T) {
+	client, server, events := newTestClient(t)
+	results := map[string]string{}
+	var failed error
+	for _, method := range []string{"textDocument/hover", "textDocument/definition", "textDocument/rename"} {
+		client.Request(method, struct{}{}, func(result json.RawMessage, err error) {
+			if err != nil {
+				failed = err
+				return
+			}
+			results[method] = string(result)
+		})
+	}
+	hover, definition, rename := server.expect("textDocument/hover"), server.expect("textDocument/definition"),
+		server.expect("textDocument/rename")
+	if string(*hover.ID) == string(*definition.ID) || string(*definition.ID) == string(*rename.ID) {
+		t.Fatalf("requests share IDs: %s, %s, %s", *hover.ID, *definition.ID, *rename.ID)
+	}
+
+	// Servers may respond in any order, and to requests the client didn't send.
+	server.respond(definition, `"definition"`)
+	runEvent(t, events)
+	server.send(message{ID: rawID(1000), Result: json.RawMessage(`"unknown"`)})
+	server.send(message{ID: rename.ID, Error: &ResponseError{Code: -32803, Message: "can't rename"}})
+	runEvent(t, events)
+	server.respond(hover, `"hover"`)
+	runEvent(t, events)
+
+	if want := map[string]string{"textDocument/hover": `"hover"`, "textDocument/definition": `"definition"`}; !maps.Equal(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+	var respErr *ResponseError
+	if !errors.As(failed, &respErr) || respErr.Code != -32803 || respErr.Error() != "can't rename" {
+		t.Errorf("rename failed with %v, want the server's error", failed)
+	}
+}
+
+func TestClientServerRequests(t *testing.T) {
+	client, server, events := newTestClient(t)
+	client.OnRequest("workspace/configuration", func(params json.RawMessage) (any, error) {
+		return []any{nil}, nil
+	})
+	client.OnRequest("workspace/applyEdit", func(params json.RawMessage) (any, error) {
+		return nil, errors.New("no such file")
+	})
+
+	server.send(message{ID: rawID(7), Method: "workspace/configuration", Params: json.RawMessage(`{"items": [{}]}`)})
+	runEvent(t, events)
+	if resp := server.receive(); string(*resp.ID) != "7" || string(resp.Result) != "[null]" || resp.Error != nil {
+		t.Errorf("response to workspace/configuration = %+v", resp)
+	}
+	server.send(message{ID: rawID(8), Method: "workspace/applyEdit", Params: json.RawMessage(`{}`)})
+	runEvent(t, events)
+	if resp := server.receive(); string(*resp.ID) != "8" || resp.Error == nil || resp.Error.Message != "no such file" {
+		t.Errorf("response to workspace/applyEdit = %+v", resp)
+	}
+	// Requests without a handler are responded to without waiting for the editor.
+	server.send(message{ID: rawID(9), Method: "window/showDocument", Params: json.RawMessage(`{}`)})
+	if resp := server.receive(); string(*resp.ID) != "9" || resp.Error == nil || resp.Error.Code != -32601 {
+		t.Errorf("response to window/showDocument = %+v", resp)
+	}
+}
+
+func TestClientExit(t *testing.T) {
+	client, server, events := newTestClient(t)
+	var requestErr error
+	exited := false
+	client.OnExit(func(err error) {
+		if err != nil {
+			t.Errorf("exit error = %v, want nil when the server closed its output", err)
+		}
+		exited = true
+	})
+	client.Request("shutdown", nil, func(result json.RawMessage, err error) { requestErr = err })
+	server.expect("shutdown")
+	server.writer.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done wasn't closed when the server's output ended")
+	}
+	runEvent(t, events)
+	runEvent(t, events)
+	if !errors.Is(requestErr, ErrClosed) || !exited {
+		t.Errorf("the waiting request failed with %v, and exited = %v", requestErr, exited)
+	}
+	// Requests once the connection has ended fail too, rather than wait forever.
+	requestErr = nil
+	client.Request("textDocument/hover", nil, func(result json.RawMessage, err error) { requestErr = err })
+	runEvent(t, events)
+	if !errors.Is(requestErr, ErrClosed) {
+		t.Errorf("a request after the connection ended failed with %v, want ErrClosed", requestErr)
+	}
+}
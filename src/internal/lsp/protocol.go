@@ -0,0 +1,342 @@
+package lsp
+
+import (
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The parts of the protocol that the editor uses. See
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/.
+
+// Position is a place in a document. Character counts UTF-16 code units, as the protocol asks by
+// default.
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+// locationLink is what servers may give instead of a Location, when the client supports it.
+type locationLink struct {
+	TargetURI            string `json:"targetUri"`
+	TargetSelectionRange Range  `json:"targetSelectionRange"`
+}
+
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type VersionedTextDocumentIdentifier struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+}
+
+type TextDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+type TextDocumentPositionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+type DidOpenTextDocumentParams struct {
+	TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+// TextDocumentContentChangeEvent replaces Range with Text, or the whole document if Range is nil.
+type TextDocumentContentChangeEvent struct {
+	Range *Range `json:"range,omitempty"`
+	Text  string `json:"text"`
+}
+
+type DidChangeTextDocumentParams struct {
+	TextDocument   VersionedTextDocumentIdentifier  `json:"textDocument"`
+	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
+}
+
+type DidSaveTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type DidCloseTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type ReferenceParams struct {
+	TextDocumentPositionParams
+	Context struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type RenameParams struct {
+	TextDocumentPositionParams
+	NewName string `json:"newName"`
+}
+
+type CodeActionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+	Context      struct {
+		Diagnostics []Diagnostic `json:"diagnostics"`
+	} `json:"context"`
+}
+
+type ExecuteCommandParams struct {
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+// Diagnostic severities.
+const (
+	SeverityError       = 1
+	SeverityWarning     = 2
+	SeverityInformation = 3
+	SeverityHint        = 4
+)
+
+type Diagnostic struct {
+	Range    Range  `json:"range"`
+	Severity int    `json:"severity,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Message  string `json:"message"`
+	// Kept as is, to be given back to the server with code actions.
+	Code json.RawMessage `json:"code,omitempty"`
+}
+
+type PublishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// WorkspaceEdit is changes to documents, either by URI in Changes or as DocumentChanges. Operations
+// on files, e.g. renaming them, aren't supported.
+type WorkspaceEdit struct {
+	Changes         map[string][]TextEdit `json:"changes,omitempty"`
+	DocumentChanges []json.RawMessage     `json:"documentChanges,omitempty"`
+}
+
+type textDocumentEdit struct {
+	Kind         string                          `json:"kind"` // Set for file operations.
+	TextDocument VersionedTextDocumentIdentifier `json:"textDocument"`
+	Edits        []TextEdit                      `json:"edits"`
+}
+
+// Edits returns the text edits of the workspace edit by URI, in order.
+func (we *WorkspaceEdit) Edits() (uris []string, edits map[string][]TextEdit) {
+	edits = map[string][]TextEdit{}
+	add := func(uri string, textEdits []TextEdit) {
+		if _, ok := edits[uri]; !ok {
+			uris = append(uris, uri)
+		}
+		edits[uri] = append(edits[uri], textEdits...)
+	}
+	for _, raw := range we.DocumentChanges {
+		change := textDocumentEdit{}
+		if json.Unmarshal(raw, &change) == nil && change.Kind == "" {
+			add(change.TextDocument.URI, change.Edits)
+		}
+	}
+	for uri, textEdits := range we.Changes {
+		add(uri, textEdits)
+	}
+	return uris, edits
+}
+
+type ApplyWorkspaceEditParams struct {
+	Label string        `json:"label,omitempty"`
+	Edit  WorkspaceEdit `json:"edit"`
+}
+
+type ApplyWorkspaceEditResult struct {
+	Applied bool `json:"applied"`
+}
+
+type Command struct {
+	Title     string            `json:"title"`
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+type CodeAction struct {
+	Title   string         `json:"title"`
+	Kind    string         `json:"kind,omitempty"`
+	Edit    *WorkspaceEdit `json:"edit,omitempty"`
+	Command *Command       `json:"command,omitempty"`
+	// Set when the action has to be resolved before it can be applied.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// IsNull returns whether a result is empty, as servers respond with null when they have nothing.
+func IsNull(raw json.RawMessage) bool {
+	s := strings.TrimSpace(string(raw))
+	return s == "" || s == "null"
+}
+
+// ParseLocations parses the result of a definition or references request, which may be a Location, a
+// list of them, or a list of LocationLinks.
+func ParseLocations(raw json.RawMessage) ([]Location, error) {
+	if IsNull(raw) {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		loc := Location{}
+		err := json.Unmarshal(raw, &loc)
+		return []Location{loc}, err
+	}
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	locs := []Location{}
+	for _, item := range items {
+		link := locationLink{}
+		if err := json.Unmarshal(item, &link); err == nil && link.TargetURI != "" {
+			locs = append(locs, Location{URI: link.TargetURI, Range: link.TargetSelectionRange})
+			continue
+		}
+		loc := Location{}
+		if err := json.Unmarshal(item, &loc); err != nil {
+			return nil, err
+		}
+		locs = append(locs, loc)
+	}
+	return locs, nil
+}
+
+// ParseCodeActions parses the result of a code action request. Servers may give bare Commands as well
+// as CodeActions, which are returned as CodeActions that only run the command.
+func ParseCodeActions(raw json.RawMessage) ([]CodeAction, error) {
+	if IsNull(raw) {
+		return nil, nil
+	}
+	items := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	actions := []CodeAction{}
+	for _, item := range items {
+		command := Command{}
+		if err := json.Unmarshal(item, &command); err == nil && command.Command != "" {
+			actions = append(actions, CodeAction{Title: command.Title, Command: &command})
+			continue
+		}
+		action := CodeAction{}
+		if err := json.Unmarshal(item, &action); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// HoverText returns the text of the result of a hover request, which may be MarkupContent, a
+// MarkedString, or a list of MarkedStrings. Markdown code fences are dropped.
+func HoverText(raw json.RawMessage) string {
+	if IsNull(raw) {
+		return ""
+	}
+	hover := struct {
+		Contents json.RawMessage `json:"contents"`
+	}{}
+	if json.Unmarshal(raw, &hover) != nil {
+		return ""
+	}
+	parts := []string{}
+	var addContents func(raw json.RawMessage)
+	addContents = func(raw json.RawMessage) {
+		str := ""
+		if json.Unmarshal(raw, &str) == nil {
+			parts = append(parts, str)
+			return
+		}
+		list := []json.RawMessage{}
+		if json.Unmarshal(raw, &list) == nil {
+			for _, item := range list {
+				addContents(item)
+			}
+			return
+		}
+		// MarkupContent has "value", and so does a MarkedString with a "language".
+		markup := struct {
+			Value string `json:"value"`
+		}{}
+		if json.Unmarshal(raw, &markup) == nil {
+			parts = append(parts, markup.Value)
+		}
+	}
+	addContents(hover.Contents)
+	lines := []string{}
+	for _, line := range strings.Split(strings.Join(parts, "\n\n"), "\n") {
+		if !strings.HasPrefix(line, "```") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// FileURI returns the file:// URI of the file at path.
+func FileURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// URIPath returns the path of the file at a file:// URI, or "" if it isn't one.
+func URIPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// UTF16Len returns the number of UTF-16 code units in s, which is how the protocol counts columns.
+func UTF16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// ByteOffset returns the offset in line of the column at character UTF-16 code units, as far as the
+// line goes.
+func ByteOffset(line string, character int) int {
+	n := 0
+	for i, r := range line {
+		if n >= character {
+			return i
+		}
+		if r == utf8.RuneError {
+			// Bytes that aren't UTF-8, e.g. in a latin1 file, count as one each.
+			n++
+			continue
+		}
+		n += utf16.RuneLen(r)
+	}
+	return len(line)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	gc "github.com/gbin/goncurses"
+)
+
+const (
+	// Max number of times registers may be run as macros for a single typed key. Without a limit, a
+	// recursive macro that never fails would hang the editor, since keys aren't read while it runs.
+	cMaxMacroRuns = 100000
+)
+
+// Start recording the keys typed into register name, for q{register}.
+func (e *editorImpl) startRecording(name byte) error {
+	if name == cUnnamedRegister || validateRegisterName(name) != nil {
+		return fmt.Errorf("invalid register name: %q", name)
+	}
+	e.recordingRegister, e.recordedKeys = name, nil
+	if e.userMsgSeverity != severityError {
+		// Make room for "recording @{register}".
+		e.userMsg = ""
+	}
+	return nil
+}
+
+// Stop recording, and store the recorded keys in the register. The key that stopped the recording
+// (the "q") is the last one recorded, so it's left out.
+func (e *editorImpl) stopRecording() error {
+	keys := e.recordedKeys
+	if len(keys) > 0 {
+		keys = keys[:len(keys)-1]
+	}
+	name := e.recordingRegister
+	e.recordingRegister, e.recordedKeys = 0, nil
+	_, err := e.storeRegister(name, register{text: keysToText(keys)})
+	return err
+}
+
+// Run the contents of a register as typed keys, count times, for @{register}. "@" runs the register
+// that was run last. The keys are handled after the current key, so that a macro may run others, or
+// itself. Any failure stops the rest of the keys from running.
+func (e *editorImpl) runRegister(name byte, count int) error {
+	if name == '@' {
+		if e.lastRunRegister == 0 {
+			return errors.New("no previously used register")
+		}
+		name = e.lastRunRegister
+	}
+	reg, err := e.getRegister(name)
+	if errors.Is(err, errEmptyRegister) {
+		// Like Vim, an empty register does nothing.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.lastRunRegister = name
+	e.macroRuns++
+	if e.macroRuns > cMaxMacroRuns {
+		return errors.New("macro ran too many times")
+	}
+	text := reg.text
+	if reg.linewise {
+		text += "\n"
+	}
+	keys := textToKeys(strings.Repeat(text, count))
+	queued := make([]queuedKey, 0, len(keys)+len(e.inputQueue))
+	for _, key := range keys {
+		queued = append(queued, queuedKey{key: key})
+	}
+	e.inputQueue = append(queued, e.inputQueue...)
+	return nil
+}
+
+// Run keys in NORMAL mode on each line of rng, with the cursor at the start of the line, for
+// :{range}normal. With noremap (":normal!"), mappings aren't used. Like Vim, an incomplete command at
+// the end of the keys is cancelled, as if <Esc> was typed.
+func (e *editorImpl) runNormal(rng *lineRange, keys string, noremap bool) error {
+	if rng == nil {
+		lineInd := e.getCurrLineInd()
+		rng = &lineRange{start: lineInd, end: lineInd}
+	}
+	// Keys are run from their own queue, so that they don't mix with the keys of the command or
+	// mapping that ran :normal.
+	outerQueue := e.inputQueue
+	defer func() { e.inputQueue = outerQueue }()
+	for lineInd := rng.start; lineInd <= rng.end && lineInd < len(e.fileContents); lineInd++ {
+		e.moveCursorToLine(lineInd)
+		e.cursorX = 0
+		e.inputQueue = nil
+		for _, key := range textToKeys(keys) {
+			e.inputQueue = append(e.inputQueue, queuedKey{key: key, noremap: noremap})
+		}
+		err := e.processInput(true /*timedOut*/)
+		if e.mode != NORMAL_MODE {
+			e.activeEditorMode.Handle(gc.Key(27))
+		}
+		// Drop any partly typed command.
+		e.swapEditorMode(NORMAL_MODE)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Map modes, as used by the :map commands and by mode().
+const (
+	cMapModeNormal  = 'n'
+	cMapModeVisual  = 'v'
+	cMapModeInsert  = 'i'
+	cMapModeCommand = 'c'
+)
+
+// keyMapping maps a sequence of keys (lhs) to other keys (rhs) in one map mode.
+type keyMapping struct {
+	lhs     []gc.Key
+	rhs     []gc.Key // Unused for <expr> mappings, where the rhs is evaluated each time.
+	rhsText string   // The rhs as it was given, for <expr> mappings and :map listings.
+	noremap bool     // The rhs isn't mapped again.
+	silent  bool     // The command line isn't shown while the rhs runs.
+	expr    bool     // The rhs is an expression whose value gives the keys.
+}
+
+// queuedKey is a key waiting to be handled, either typed by the user or from the rhs of a mapping.
+type queuedKey struct {
+	key     gc.Key
+	noremap bool   // Set for keys from the rhs of a noremap mapping, which aren't mapped again.
+	silent  bool   // Set for keys from the rhs of a <silent> mapping.
+	paste   string // The text of a cPastedTextKey.
+}
+
+var errRecursiveMapping = errors.New("recursive mapping")
+
+// The map mode of an editor mode.
+func mapModeChar(mode Mode) string {
+	switch mode {
+	case INSERT_MODE:
+		return string(cMapModeInsert)
+	case VISUAL_MODE:
+		return string(cMapModeVisual)
+	case COMMAND_MODE:
+		return string(cMapModeCommand)
+	}
+	return string(cMapModeNormal)
+}
+
+// Resolve mappings for the queued input, and pass the resulting keys to the active mode. When the
+// queued keys could be the start of a mapping, they are left in the queue until more keys are typed or
+// 'timeoutlen' passes. timedOut is set when it has passed, and then the longest mapping that matches
+// is used, if any.
+func (e *editorImpl) processInput(timedOut bool) error {
+	// Every expansion counts towards 'maxmapdepth', until the queue is empty and the next key is
+	// typed. This catches mappings that keep expanding to themselves.
+	expansions := 0
+	for len(e.inputQueue) > 0 {
+		first := e.inputQueue[0]
+		if e.input != nil || e.finder != nil || len(e.pressEnterLines) > 0 || first.noremap || !e.activeEditorMode.AcceptsMappings() {
+			e.inputQueue = e.inputQueue[1:]
+			if err := e.dispatchKey(first); err != nil {
+				return err
+			}
+			continue
+		}
+		m, partial := e.matchMapping()
+		if partial && !timedOut {
+			// Wait for the next key.
+			return nil
+		}
+		if m == nil {
+			e.inputQueue = e.inputQueue[1:]
+			if err := e.dispatchKey(first); err != nil {
+				return err
+			}
+			continue
+		}
+		expansions++
+		if expansions > e.globalOpts.maxmapdepth {
+			return errRecursiveMapping
+		}
+		rhs := m.rhs
+		if m.expr {
+			value, err := e.evalExpr(m.rhsText)
+			if err != nil {
+				return err
+			}
+			rhs = parseKeyNotation(value, e.globalOpts.mapleader)
+		}
+		expanded := make([]queuedKey, 0, len(rhs)+len(e.inputQueue)-len(m.lhs))
+		for _, key := range rhs {
+			expanded = append(expanded, queuedKey{key: key, noremap: m.noremap, silent: m.silent})
+		}
+		e.inputQueue = append(expanded, e.inputQueue[len(m.lhs):]...)
+	}
+	return nil
+}
+
+// Find the longest mapping in the current map mode whose lhs the queued keys start with. partial is
+// set if the queued keys are also the start of a longer mapping, so that more keys could match it.
+func (e *editorImpl) matchMapping() (match *keyMapping, partial bool) {
+	for _, m := range e.mappings[mapModeChar(e.mode)[0]] {
+		n := min(len(m.lhs), len(e.inputQueue))
+		matches := true
+		for i := 0; i < n; i++ {
+			if m.lhs[i] != e.inputQueue[i].key || (i > 0 && e.inputQueue[i].noremap) {
+				matches = false
+				break
+			}
+		}
+		switch {
+		case !matches:
+		case len(m.lhs) > len(e.inputQueue):
+			partial = true
+		case match == nil || len(m.lhs) > len(match.lhs):
+			match = m
+		}
+	}
+	return match, partial
+}
+
+// Pass a key to the active mode, or to the question, finder or output waiting for the user.
+func (e *editorImpl) dispatchKey(qk queuedKey) error {
+	if e.input != nil {
+		return e.handleInputKey(qk.key)
+	}
+	if e.finder != nil {
+		return e.handleFinderKey(qk.key)
+	}
+	if e.listSelection != nil {
+		return e.handleListSelectionKey(qk.key)
+	}
+	if len(e.pressEnterLines) > 0 && e.handlePressEnter(qk.key) {
+		return nil
+	}
+	if qk.key == cPastedTextKey {
+		// A paste repeated by ".", which is inserted as it was the first time.
+		e.insertPaste(qk.paste)
+		return nil
+	}
+	e.silent = qk.silent
+	defer func() { e.silent = false }()
+	e.trackChangeKey(qk.key)
+	err := e.activeEditorMode.Handle(qk.key)
+	if e.isCommandStart() {
+		// Everything the command changed is undone at once.
+		e.closeUndoStep()
+	}
+	if err != nil {
+		e.currentChange = change{}
+		return err
+	}
+	e.finishChange()
+	return nil
+}
+
+// Add a mapping to each of the map modes, replacing any with the same lhs.
+func (e *editorImpl) addMapping(modes string, m *keyMapping) {
+	if e.mappings == nil {
+		e.mappings = map[byte][]*keyMapping{}
+	}
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		e.removeMapping(mode, m.lhs)
+		e.mappings[mode] = append(e.mappings[mode], m)
+	}
+}
+
+// Remove the mapping for lhs from a map mode. Returns false if there wasn't one.
+func (e *editorImpl) removeMapping(mode byte, lhs []gc.Key) bool {
+	for i, m := range e.mappings[mode] {
+		if formatKeys(m.lhs) == formatKeys(lhs) {
+			e.mappings[mode] = append(e.mappings[mode][:i], e.mappings[mode][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// mapCommand describes one of the :map family of commands.
+type mapCommand struct {
+	modes   string // The map modes it applies to.
+	noremap bool
+	unmap   bool
+	clear   bool
+}
+
+var mapCommands = map[string]mapCommand{}
+
+func init() {
+	// The commands are prefixed by the map mode they apply to, and without a prefix apply to NORMAL and
+	// VISUAL mode. Like Vim, "x" is accepted for VISUAL mode too.
+	for prefix, modes := range map[string]string{"": "nv", "n": "n", "v": "v", "x": "v", "i": "i", "c": "c"} {
+		mapCommands[prefix+"map"] = mapCommand{modes: modes}
+		mapCommands[prefix+"noremap"] = mapCommand{modes: modes, noremap: true}
+		mapCommands[prefix+"unmap"] = mapCommand{modes: modes, unmap: true}
+		mapCommands[prefix+"mapclear"] = mapCommand{modes: modes, clear: true}
+	}
+	// Short names, and the "!" variants which apply to INSERT and COMMAND mode.
+	for name, cmd := range map[string]mapCommand{
+		"nm": {modes: "n"}, "vm": {modes: "v"}, "xm": {modes: "v"}, "im": {modes: "i"}, "cm": {modes: "c"},
+		"no": {modes: "nv", noremap: true}, "nn": {modes: "n", noremap: true},
+		"vn": {modes: "v", noremap: true}, "xn": {modes: "v", noremap: true},
+		"ino": {modes: "i", noremap: true}, "cno": {modes: "c", noremap: true},
+		"unm": {modes: "nv", unmap: true}, "nun": {modes: "n", unmap: true},
+		"vu": {modes: "v", unmap: true}, "xu": {modes: "v", unmap: true},
+		"iu": {modes: "i", unmap: true}, "cu": {modes: "c", unmap: true},
+		"mapc": {modes: "nv", clear: true}, "nmapc": {modes: "n", clear: true},
+		"vmapc": {modes: "v", clear: true}, "xmapc": {modes: "v", clear: true},
+		"imapc": {modes: "i", clear: true}, "cmapc": {modes: "c", clear: true},
+		"map!": {modes: "ic"}, "noremap!": {modes: "ic", noremap: true}, "no!": {modes: "ic", noremap: true},
+		"unmap!": {modes: "ic", unmap: true}, "unm!": {modes: "ic", unmap: true},
+		"mapclear!": {modes: "ic", clear: true}, "mapc!": {modes: "ic", clear: true},
+	} {
+		mapCommands[name] = cmd
+	}
+}
+
+// Run one of the :map family of commands. args is of the form "[<silent>] [<expr>] {lhs} {rhs}". With
+// no rhs, the mappings starting with lhs are listed, and with no args all of them are.
+func (e *editorImpl) runMapCommand(cmd mapCommand, args string) error {
+	if cmd.clear {
+		for i := 0; i < len(cmd.modes); i++ {
+			delete(e.mappings, cmd.modes[i])
+		}
+		return nil
+	}
+	m := &keyMapping{noremap: cmd.noremap}
+	for flagsDone := false; !flagsDone; {
+		switch lower := strings.ToLower(args); {
+		case strings.HasPrefix(lower, "<silent>"):
+			m.silent = true
+			args = strings.TrimSpace(args[len("<silent>"):])
+		case strings.HasPrefix(lower, "<expr>"):
+			m.expr = true
+			args = strings.TrimSpace(args[len("<expr>"):])
+		default:
+			flagsDone = true
+		}
+	}
+	lhsText, rhsText, _ := strings.Cut(args, " ")
+	rhsText = strings.TrimLeft(rhsText, " \t")
+	lhs := parseKeyNotation(lhsText, e.globalOpts.mapleader)
+	if cmd.unmap {
+		if lhsText == "" {
+			return errors.New("argument required")
+		}
+		found := false
+		for i := 0; i < len(cmd.modes); i++ {
+			if e.removeMapping(cmd.modes[i], lhs) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no such mapping: %s", lhsText)
+		}
+		return nil
+	}
+	if rhsText == "" {
+		e.listMappings(cmd.modes, lhs)
+		return nil
+	}
+	if len(lhs) == 0 {
+		return fmt.Errorf("invalid mapping: %s", lhsText)
+	}
+	m.lhs, m.rhsText = lhs, rhsText
+	if !m.expr {
+		m.rhs = parseKeyNotation(rhsText, e.globalOpts.mapleader)
+	}
+	e.addMapping(cmd.modes, m)
+	return nil
+}
+
+// Show the mappings of the map modes whose lhs starts with prefix, like Vim:
+//
+//	n  <Space>w    * :w<CR>
+//
+// where "*" marks noremap mappings.
+func (e *editorImpl) listMappings(modes string, prefix []gc.Key) {
+	lines := []string{}
+	for i := 0; i < len(modes); i++ {
+		for _, m := range e.mappings[modes[i]] {
+			lhs := formatKeys(m.lhs)
+			if !strings.HasPrefix(lhs, formatKeys(prefix)) {
+				continue
+			}
+			flags := " "
+			if m.noremap {
+				flags = "*"
+			}
+			attrs := ""
+			if m.silent {
+				attrs += "<silent> "
+			}
+			if m.expr {
+				attrs += "<expr> "
+			}
+			lines = append(lines, fmt.Sprintf("%c  %-12s %s %s%s", modes[i], lhs, flags, attrs, m.rhsText))
+		}
+	}
+	if len(lines) == 0 {
+		e.infof("No mapping found")
+		return
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i][3:] < lines[j][3:] })
+	e.infof("%s", strings.Join(lines, "\n"))
+}
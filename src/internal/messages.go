@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	gc "github.com/gbin/goncurses"
+)
+
+const (
+	// How many messages are kept for :messages.
+	cMessageHistoryLen = 200
+
+	cPressEnterPrompt = "Press ENTER or type command to continue"
+	cMorePrompt       = "-- More -- SPACE/d/j: down, q: quit"
+)
+
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityWarning
+	severityError
+)
+
+type message struct {
+	severity severity
+	text     string
+}
+
+// Show an informational message to the user, and record it in the message history.
+func (e *editorImpl) infof(format string, args ...any) {
+	e.showMessage(severityInfo, fmt.Sprintf(format, args...))
+}
+
+// Show a warning to the user, and record it in the message history.
+func (e *editorImpl) warnf(format string, args ...any) {
+	e.showMessage(severityWarning, fmt.Sprintf(format, args...))
+}
+
+// Show an error to the user, and record it in the message history.
+func (e *editorImpl) reportError(err error) {
+	e.showMessage(severityError, err.Error())
+}
+
+// Messages that fit on the bottom row are shown there. Longer ones, or ones with several lines, are
+// shown above the bottom row and wait for the user to press ENTER.
+func (e *editorImpl) showMessage(sev severity, text string) {
+	e.messageHistory = append(e.messageHistory, message{severity: sev, text: text})
+	if len(e.messageHistory) > cMessageHistoryLen {
+		e.messageHistory = e.messageHistory[len(e.messageHistory)-cMessageHistoryLen:]
+	}
+	_, maxX := e.screen.MaxYX()
+	if strings.Contains(text, "\n") || len(text) >= maxX {
+		e.userMsg = ""
+		e.showPressEnter(sev, strings.Split(text, "\n"))
+		return
+	}
+	e.userMsg, e.userMsgSeverity = text, sev
+}
+
+// Show lines of output that wait for the user to press ENTER before the screen is redrawn.
+func (e *editorImpl) showPressEnter(sev severity, lines []string) {
+	_, maxX := e.screen.MaxYX()
+	for _, line := range lines {
+		// Wrap long lines, since the rows are printed without wrapping.
+		for len(line) > maxX {
+			e.pressEnterLines = append(e.pressEnterLines, message{severity: sev, text: line[:maxX]})
+			line = line[maxX:]
+		}
+		e.pressEnterLines = append(e.pressEnterLines, message{severity: sev, text: line})
+	}
+}
+
+// Show the message history, for :messages.
+func (e *editorImpl) showMessageHistory() {
+	for _, msg := range e.messageHistory {
+		e.showPressEnter(msg.severity, strings.Split(msg.text, "\n"))
+	}
+}
+
+// Handle a key while output is waiting for ENTER. Returns true if the key was consumed, otherwise it
+// should be handled as usual once the output is dismissed.
+func (e *editorImpl) handlePressEnter(key gc.Key) bool {
+	maxY, _ := e.screen.MaxYX()
+	page := maxY - 1
+	if len(e.pressEnterLines) > page {
+		// Still paging through output that is taller than the screen.
+		switch gc.KeyString(key) {
+		case " ":
+			e.pressEnterLines = e.pressEnterLines[page:]
+		case "d":
+			e.pressEnterLines = e.pressEnterLines[page/2:]
+		case "j", "enter", "down":
+			e.pressEnterLines = e.pressEnterLines[1:]
+		case "q", ESC_KEY:
+			e.pressEnterLines = nil
+		}
+		return true
+	}
+	e.pressEnterLines = nil
+	switch gc.KeyString(key) {
+	case "enter", " ", ESC_KEY:
+		return true
+	}
+	// Like Vim, any other key is handled as a command, e.g. ":" starts a new command.
+	return false
+}
+
+// Draw the output that is waiting for ENTER over the bottom of the screen.
+func (e *editorImpl) drawPressEnter(window *gc.Window) {
+	maxY, maxX := window.MaxYX()
+	lines, prompt := e.pressEnterLines, e.pressEnterPrompt()
+	if len(lines) > maxY-1 {
+		lines = lines[:maxY-1]
+		if e.listSelection == nil {
+			prompt = cMorePrompt
+		}
+	}
+	top := maxY - 1 - len(lines)
+	for i, line := range lines {
+		window.Move(top+i, 0)
+		window.ClearToEOL()
+		e.printMessage(window, top+i, line)
+	}
+	window.Move(maxY-1, 0)
+	window.ClearToEOL()
+	window.AttrOn(gc.A_BOLD)
+	window.MovePrint(maxY-1, 0, prompt[:min(len(prompt), maxX-1)])
+	window.AttrOff(gc.A_BOLD)
+}
+
+// Print a message at the start of row y, colored by its severity.
+func (e *editorImpl) printMessage(window *gc.Window, y int, msg message) {
+	pair := int16(0)
+	switch msg.severity {
+	case severityWarning:
+		pair = COLOR_PAIR_WARNING
+	case severityError:
+		pair = COLOR_PAIR_ERROR
+	}
+	if pair != 0 {
+		window.ColorOn(pair)
+		defer window.ColorOff(pair)
+	}
+	window.MovePrint(y, 0, msg.text)
+}
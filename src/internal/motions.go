@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+)
+
+// position is a place in the buffer. Unlike the cursor's y-pos, line is the index of the file line
+// rather than an offset from the top of the screen.
+type position struct {
+	line, col int
+}
+
+func (p position) before(other position) bool {
+	return p.line < other.line || (p.line == other.line && p.col < other.col)
+}
+
+// How much text an operator applies to when it's used with a motion, like Vim's:
+//   - exclusive: from the start up to, but not including, the end.
+//   - inclusive: from the start up to and including the end.
+//   - linewise: all lines from the start's line to the end's line.
+//   - blockwise: the columns between the start and the end, on each line between them. Only VISUAL
+//     block mode selects text like this.
+type motionKind int
+
+const (
+	exclusive motionKind = iota
+	inclusive
+	linewise
+	blockwise
+)
+
+var errUnknownMotion = errors.New("unknown motion")
+
+// Where the cursor is in the buffer.
+func (e *editorImpl) cursorPosition() position {
+	_, x := e.activeEditorMode.GetCursorYX()
+	return position{line: e.getCurrLineInd(), col: x}
+}
+
+// Move the cursor to pos.
+func (e *editorImpl) setCursorPosition(pos position) {
+	e.moveCursorToLine(pos.line)
+	e.cursorX = pos.col
+}
+
+// Returns where the motion for keys k takes the cursor. count is 0 if none was typed. Returns
+// errUnknownMotion if k isn't a motion, and errBell if the motion can't be done, e.g. "fx" when there
+// is no "x" after the cursor. Supported are:
+//
+//	h l 0 ^ $        within the line
+//	j k G gg         between lines
+//	w b e W B E      words
+//	f t F T {char}   to a char in the line
+func (e *editorImpl) motion(k string, count int) (position, motionKind, error) {
+	from := e.cursorPosition()
+	n := max(count, 1)
+	line := e.fileContents[from.line]
+	switch k {
+	case "h", "left":
+		if from.col == 0 {
+			return from, exclusive, errBell
+		}
+		return position{from.line, max(from.col-n, 0)}, exclusive, nil
+	case "l", "right", " ":
+		if from.col >= len(line)-1 {
+			// "dl" on the last char still deletes it.
+			return position{from.line, len(line)}, exclusive, nil
+		}
+		return position{from.line, min(from.col+n, len(line))}, exclusive, nil
+	case "0":
+		return position{from.line, 0}, exclusive, nil
+	case "^":
+		return position{from.line, len(leadingWhitespace(line))}, exclusive, nil
+	case "$":
+		lineInd := min(from.line+n-1, len(e.fileContents)-1)
+		return position{lineInd, max(len(e.fileContents[lineInd])-1, 0)}, inclusive, nil
+	case "j", "down", "k", "up":
+		lineInd := from.line + n
+		if k == "k" || k == "up" {
+			lineInd = from.line - n
+		}
+		if lineInd < 0 || lineInd >= len(e.fileContents) {
+			return from, linewise, errBell
+		}
+		return position{lineInd, from.col}, linewise, nil
+	case "G", "gg":
+		lineInd := len(e.fileContents) - 1
+		if k == "gg" {
+			lineInd = 0
+		}
+		if count > 0 {
+			lineInd = min(count, len(e.fileContents)) - 1
+		}
+		return position{lineInd, len(leadingWhitespace(e.fileContents[lineInd]))}, linewise, nil
+	case "w", "W", "b", "B", "e", "E":
+		pos := from
+		for i := 0; i < n; i++ {
+			switch k {
+			case "w", "W":
+				pos = e.nextWordStart(pos, k == "W")
+			case "b", "B":
+				pos = e.prevWordStart(pos, k == "B")
+			default:
+				pos = e.nextWordEnd(pos, k == "E")
+			}
+		}
+		if pos == from {
+			return from, exclusive, errBell
+		}
+		if k == "e" || k == "E" {
+			return pos, inclusive, nil
+		}
+		return pos, exclusive, nil
+	}
+	if len(k) == 2 && strings.IndexByte("ftFT", k[0]) >= 0 {
+		return e.findCharMotion(from, k[0], k[1], n)
+	}
+	return from, exclusive, errUnknownMotion
+}
+
+// Find the count'th occurrence of ch in the line, for f, t, F and T.
+func (e *editorImpl) findCharMotion(from position, cmd byte, ch byte, count int) (position, motionKind, error) {
+	line := e.fileContents[from.line]
+	col := from.col
+	forward := cmd == 'f' || cmd == 't'
+	for found := 0; found < count; {
+		if forward {
+			col++
+		} else {
+			col--
+		}
+		if col < 0 || col >= len(line) {
+			return from, exclusive, errBell
+		}
+		if line[col] == ch {
+			found++
+		}
+	}
+	switch cmd {
+	case 'f':
+		return position{from.line, col}, inclusive, nil
+	case 't':
+		return position{from.line, col - 1}, inclusive, nil
+	case 'T':
+		return position{from.line, col + 1}, exclusive, nil
+	}
+	return position{from.line, col}, exclusive, nil
+}
+
+// Classes of chars for word motions. A word is a run of chars of the same class, other than blanks.
+// For WORD motions (W, B, E), all non-blank chars are one class.
+const (
+	blankClass = iota
+	punctClass
+	wordClass
+)
+
+func charClass(ch byte, bigWord bool) int {
+	switch {
+	case ch == ' ' || ch == '\t' || ch == '\n':
+		return blankClass
+	case bigWord:
+		return wordClass
+	case ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch >= 0x80:
+		return wordClass
+	}
+	return punctClass
+}
+
+// The char at pos. The end of each line counts as a "\n".
+func (e *editorImpl) charAt(pos position) byte {
+	line := e.fileContents[pos.line]
+	if pos.col >= len(line) {
+		return '\n'
+	}
+	return line[pos.col]
+}
+
+// The position after pos, counting the end of each line as a char. Returns false at the end of the
+// file.
+func (e *editorImpl) nextPosition(pos position) (position, bool) {
+	if pos.col < len(e.fileContents[pos.line]) {
+		return position{pos.line, pos.col + 1}, true
+	}
+	if pos.line+1 >= len(e.fileContents) {
+		return pos, false
+	}
+	return position{pos.line + 1, 0}, true
+}
+
+// The position before pos, counting the end of each line as a char. Returns false at the start of
+// the file.
+func (e *editorImpl) prevPosition(pos position) (position, bool) {
+	if pos.col > 0 {
+		return position{pos.line, pos.col - 1}, true
+	}
+	if pos.line == 0 {
+		return pos, false
+	}
+	return position{pos.line - 1, len(e.fileContents[pos.line-1])}, true
+}
+
+// Like Vim, an empty line counts as a word.
+func (e *editorImpl) isEmptyLine(pos position) bool {
+	return pos.col == 0 && len(e.fileContents[pos.line]) == 0
+}
+
+// The start of the next word, for "w". At the end of the file, this is the end of the last line.
+func (e *editorImpl) nextWordStart(pos position, bigWord bool) position {
+	class := charClass(e.charAt(pos), bigWord)
+	ok := true
+	// Skip the rest of the current word.
+	for ok && class != blankClass && charClass(e.charAt(pos), bigWord) == class {
+		pos, ok = e.nextPosition(pos)
+	}
+	// Skip blanks, stopping at an empty line.
+	for ok && charClass(e.charAt(pos), bigWord) == blankClass {
+		next, nextOk := e.nextPosition(pos)
+		if !nextOk {
+			break
+		}
+		pos = next
+		if e.isEmptyLine(pos) {
+			break
+		}
+	}
+	return pos
+}
+
+// The end of the word at or after the position after pos, for "e".
+func (e *editorImpl) nextWordEnd(pos position, bigWord bool) position {
+	start := pos
+	pos, ok := e.nextPosition(pos)
+	for ok && charClass(e.charAt(pos), bigWord) == blankClass {
+		pos, ok = e.nextPosition(pos)
+	}
+	if !ok {
+		return start
+	}
+	class := charClass(e.charAt(pos), bigWord)
+	for {
+		next, nextOk := e.nextPosition(pos)
+		if !nextOk || charClass(e.charAt(next), bigWord) != class {
+			return pos
+		}
+		pos = next
+	}
+}
+
+// The start of the word before pos, for "b".
+func (e *editorImpl) prevWordStart(pos position, bigWord bool) position {
+	start := pos
+	pos, ok := e.prevPosition(pos)
+	for ok && charClass(e.charAt(pos), bigWord) == blankClass && !e.isEmptyLine(pos) {
+		pos, ok = e.prevPosition(pos)
+	}
+	if !ok {
+		return start
+	}
+	class := charClass(e.charAt(pos), bigWord)
+	for class != blankClass {
+		prev, prevOk := e.prevPosition(pos)
+		if !prevOk || charClass(e.charAt(prev), bigWord) != class {
+			break
+		}
+		pos = prev
+	}
+	return pos
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// The mouse is used when 'mouse' is set. Like Vim, 'mouse' is a set of flags for the modes it's used
+// in: "n" for NORMAL, "v" for VISUAL, "i" for INSERT, "c" for COMMAND, or "a" for all of them.
+//
+//	click            move the cursor there, ending any VISUAL selection
+//	drag             select from where the button was pressed
+//	double-click     select the word
+//	wheel            scroll the window, keeping the cursor on screen
+//	click status     focus the window the status line belongs to
+//	click tab line   go to the tab page clicked
+
+const (
+	cMouseScrollLines = 3
+	// Two presses at the same place within this long are a double-click.
+	cDoubleClickTime = 400 * time.Millisecond
+)
+
+// ncurses doesn't name the events of button 5, which the wheel uses to scroll down. Each button's
+// events are shifted along from the last one's, so button 5's are as far along from button 4's as
+// button 4's are from button 3's.
+var (
+	mouseWheelUp   = gc.MouseButton(gc.M_B4_PRESSED)
+	mouseWheelDown = gc.MouseButton(gc.M_B4_PRESSED * (gc.M_B4_PRESSED / gc.M_B3_PRESSED))
+)
+
+// mouseState is what's kept between mouse events, to tell clicks from drags and double-clicks.
+type mouseState struct {
+	dragStart   *position // Where button 1 was pressed, while it's held. nil otherwise.
+	lastPress   time.Time
+	lastPressYX [2]int
+}
+
+// Returns an error if value isn't a valid 'mouse'.
+func validateMouse(value any) error {
+	for _, flag := range value.(string) {
+		if !strings.ContainsRune("anvic", flag) {
+			return fmt.Errorf("invalid argument: %s", value)
+		}
+	}
+	return nil
+}
+
+// Ask the terminal for mouse events if 'mouse' is set, and stop asking if it isn't.
+func (e *editorImpl) updateMouseMask() {
+	if e.globalOpts.mouse == "" {
+		gc.MouseMask(0, nil)
+		return
+	}
+	// Presses and releases are reported as they happen, rather than held back to be merged into
+	// clicks, so that drags are seen. Double-clicks are detected here instead.
+	gc.MouseInterval(0)
+	gc.MouseMask(gc.M_B1_PRESSED|gc.M_B1_RELEASED|gc.M_POSITION|mouseWheelUp|mouseWheelDown, nil)
+}
+
+// Whether 'mouse' has the flag for the current mode.
+func (e *editorImpl) mouseEnabled() bool {
+	flag, ok := map[Mode]string{NORMAL_MODE: "n", VISUAL_MODE: "v", INSERT_MODE: "i", COMMAND_MODE: "c"}[e.mode]
+	if !ok {
+		// E.g. TERMINAL mode, where even "a" doesn't use the mouse.
+		return false
+	}
+	return strings.Contains(e.globalOpts.mouse, "a") || strings.Contains(e.globalOpts.mouse, flag)
+}
+
+// Handle a mouse event. Mouse events aren't recorded into macros or mapped, and they don't count as
+// changes for ".".
+func (e *editorImpl) handleMouse() error {
+	event := gc.GetMouse()
+	if event == nil || !e.mouseEnabled() || e.mode == COMMAND_MODE || len(e.pressEnterLines) > 0 || e.finder != nil || e.input != nil {
+		return nil
+	}
+	var err error
+	switch {
+	case event.State&mouseWheelUp != 0:
+		e.scrollLines(-cMouseScrollLines)
+	case event.State&mouseWheelDown != 0:
+		e.scrollLines(cMouseScrollLines)
+	case event.State&gc.M_B1_PRESSED != 0:
+		err = e.mousePress(event.Y, event.X)
+	case event.State&gc.M_B1_RELEASED != 0:
+		err = e.mouseDrag(event.Y, event.X)
+		e.mouseState.dragStart = nil
+	case event.State&gc.M_POSITION != 0:
+		err = e.mouseDrag(event.Y, event.X)
+	}
+	if err == errBell {
+		gc.Beep()
+	} else if err != nil {
+		e.reportError(err)
+	}
+	e.sync()
+	return nil
+}
+
+// Button 1 was pressed at the screen row y and column x.
+func (e *editorImpl) mousePress(y int, x int) error {
+	now := time.Now()
+	doubleClick := now.Sub(e.mouseState.lastPress) < cDoubleClickTime && e.mouseState.lastPressYX == [2]int{y, x}
+	e.mouseState.lastPress, e.mouseState.lastPressYX = now, [2]int{y, x}
+
+	if y < e.tabLineRows() {
+		i := e.tabPageAt(x)
+		if i < 0 || i == e.tabIndex {
+			return nil
+		}
+		if e.mode == VISUAL_MODE {
+			e.swapEditorMode(NORMAL_MODE)
+		}
+		if e.mode != NORMAL_MODE {
+			return nil
+		}
+		e.gotoTabPage(i)
+		return nil
+	}
+	w, onStatusLine := e.windowAt(y)
+	if w == nil {
+		return nil
+	}
+	if onStatusLine || w != e.window {
+		// Focus the window, which ends a selection in the one that was focused.
+		if e.mode == VISUAL_MODE {
+			e.swapEditorMode(NORMAL_MODE)
+		}
+		if e.mode != NORMAL_MODE {
+			return nil
+		}
+		e.setCurrentWindow(w)
+		if onStatusLine {
+			return nil
+		}
+	}
+	pos, ok := e.screenToBuffer(y-e.top, x)
+	if !ok {
+		return nil
+	}
+	if e.mode == VISUAL_MODE {
+		e.swapEditorMode(NORMAL_MODE)
+	}
+	e.setCursorPosition(pos)
+	if doubleClick && e.mode == NORMAL_MODE {
+		e.swapEditorMode(VISUAL_MODE)
+		e.mouseState.dragStart = nil
+		return e.activeEditorMode.(*visualModeEditor).selectTextObject("iw", 0)
+	}
+	e.mouseState.dragStart = &pos
+	return nil
+}
+
+// The mouse moved to the screen row y and column x, or button 1 was released there. While button 1
+// is held, this selects from where it was pressed.
+func (e *editorImpl) mouseDrag(y int, x int) error {
+	start := e.mouseState.dragStart
+	if start == nil {
+		return nil
+	}
+	pos, ok := e.screenToBuffer(y-e.top, x)
+	if !ok || pos == *start && e.mode != VISUAL_MODE {
+		return nil
+	}
+	if e.mode == NORMAL_MODE {
+		e.setCursorPosition(*start)
+		e.swapEditorMode(VISUAL_MODE)
+	}
+	e.setCursorPosition(pos)
+	return nil
+}
+
+// Scroll the window by n lines, down if n is positive. Like Vim, the cursor moves only if it would
+// go off screen.
+func (e *editorImpl) scrollLines(n int) {
+	lineInd := e.getCurrLineInd()
+	e.fileLineOffset = max(0, min(e.fileLineOffset+n, len(e.fileContents)-1))
+	lineInd = max(lineInd, e.fileLineOffset)
+	if rows, _ := e.getDisplayLines(); len(rows) > 0 {
+		lineInd = min(lineInd, rows[len(rows)-1].lineInd)
+	}
+	e.moveCursorToLine(lineInd)
+}
@@ -1,7 +1,7 @@
 package internal
 
 import (
-	"fmt"
+	"strings"
 
 	gc "github.com/gbin/goncurses"
 )
@@ -12,26 +12,167 @@ func newNormalEditorMode(baseEditor *editorImpl) *normalModeEditor {
 
 type normalModeEditor struct {
 	*editorImpl
+
+	// Keys of a multi-key command typed so far, e.g. "g" while waiting for "gj".
+	pendingKeys string
+	// The count typed before the command, e.g. 3 for "3j". 0 if none was typed.
+	count int
+	// The register given with "{register} before the command, or 0 for the unnamed register.
+	register byte
+	// The operator waiting for a motion, e.g. "d" after "d" is typed for "dw". See operators.go.
+	operator string
+	// The count typed after the operator, e.g. 3 for "d3w". 0 if none was typed.
+	motionCount int
+}
+
+// Commands that are short for an operator and a motion.
+var operatorAliases = map[string]string{
+	"x": "dl",
+	"X": "dh",
+	"D": "d$",
+	"C": "c$",
+	"s": "cl",
+	"S": "cc",
+	"Y": "yy",
 }
 
 func (ne *normalModeEditor) Handle(key gc.Key) error {
-	switch k := gc.KeyString(key); k {
+	k := gc.KeyString(key)
+	switch ne.pendingKeys {
+	case "":
+		if ne.addToCount(k) {
+			return nil
+		}
+	case `"`, "q", "@", "f", "t", "F", "T", "i", "a":
+		// These commands take a char, e.g. a register name, the char to find, or the kind of text
+		// object after an operator.
+		cmd := ne.pendingKeys
+		ne.pendingKeys = ""
+		if key >= 0x100 || k == ESC_KEY {
+			ne.resetCommand()
+			return nil
+		}
+		if strings.Contains("ftFTia", cmd) {
+			k = cmd + string(byte(key))
+			break
+		}
+		return ne.handleRegisterCommand(cmd, byte(key))
+	default:
+		k = ne.pendingKeys + k
+		ne.pendingKeys = ""
+	}
+	if ne.operator != "" {
+		return ne.handleOperatorMotion(k)
+	}
+	if ne.dir != nil {
+		// A key of a directory's buffer. See directory.go.
+		if handled, err := ne.directoryKey(k); handled {
+			ne.resetCommand()
+			return err
+		}
+	}
+	if ne.term != nil {
+		// A key of a terminal buffer. See terminal.go.
+		if handled, err := ne.terminalKey(k); handled {
+			ne.resetCommand()
+			return err
+		}
+	}
+	switch k {
+	case "g", "[", "]", CTRL_W_KEY, `"`, "@", "f", "t", "F", "T":
+		// Wait for the rest of the command.
+		ne.pendingKeys = k
+		return nil
+	case "d", "c", "y", "=", "!":
+		// Wait for the motion to apply the operator to.
+		ne.operator = k
+		return nil
+	case "q":
+		if ne.recordingRegister != 0 {
+			// Stop recording a macro.
+			ne.resetCommand()
+			return ne.stopRecording()
+		}
+		// Wait for the register to record into.
+		ne.pendingKeys = k
+		return nil
+	}
+	if alias, ok := operatorAliases[k]; ok {
+		ne.operator = alias[:1]
+		return ne.handleOperatorMotion(alias[1:])
+	}
+	// The command is complete, so it takes the count and register.
+	rawCount, count, reg := ne.count, max(ne.count, 1), ne.register
+	ne.resetCommand()
+	if cmd, ok := strings.CutPrefix(k, CTRL_W_KEY); ok {
+		// A window command. See window.go.
+		return ne.windowCommand(cmd)
+	}
+	if k == "enter" && ne.buffer == ne.quickfix.buffer {
+		// Go to the entry under the cursor in the quickfix window. See quickfix.go.
+		return ne.gotoQuickfixEntry(ne.getCurrLineInd())
+	}
+	switch k {
+	case "gj", "gdown":
+		// Move the cursor down one display line.
+		return ne.repeatMotion(count, func() { ne.moveCursorDisplayVertical(1) })
+	case "gk", "gup":
+		// Move the cursor up one display line.
+		return ne.repeatMotion(count, func() { ne.moveCursorDisplayVertical(-1) })
+	case CTRL_P_KEY:
+		// Open the fuzzy finder on the files under the working directory. See finder.go.
+		return ne.openFinder(".")
+	case "gt":
+		// Go to the next tab page, or the count'th one. See tabs.go.
+		return ne.tabPageKey(true, rawCount)
+	case "gT":
+		// Go to the previous tab page.
+		return ne.tabPageKey(false, rawCount)
+	case "gv":
+		// Select the last selection again.
+		return ne.reselect()
+	case "K":
+		// Show the language server's information about what's under the cursor.
+		return ne.lspHover()
+	case "gd":
+		// Go to the definition of what's under the cursor.
+		return ne.gotoDefinition()
+	case "gr":
+		// List the references to what's under the cursor.
+		return ne.listReferences()
+	case "]d":
+		// Go to the next diagnostic.
+		return ne.jumpToDiagnostic(count, true)
+	case "[d":
+		// Go to the previous diagnostic.
+		return ne.jumpToDiagnostic(count, false)
 	case "j", "down":
 		// Move the cursor down.
-		ne.moveCursorVertical(1)
-		return nil
+		return ne.repeatMotion(count, func() { ne.moveCursorVertical(1) })
 	case "k", "up":
 		// Move the cursor up.
-		ne.moveCursorVertical(-1)
-		return nil
+		return ne.repeatMotion(count, func() { ne.moveCursorVertical(-1) })
 	case "l", "right":
 		// Move the cursor right.
-		ne.moveCursorHorizontal(1, false /*pastLastCharAllowed*/)
-		return nil
+		return ne.repeatMotion(count, func() { ne.moveCursorHorizontal(1, false /*pastLastCharAllowed*/) })
 	case "h", "left":
 		// Move the cursor left.
-		ne.moveCursorHorizontal(-1, false /*pastLastCharAllowed*/)
-		return nil
+		return ne.repeatMotion(count, func() { ne.moveCursorHorizontal(-1, false /*pastLastCharAllowed*/) })
+	case "u":
+		// Undo the last change.
+		return ne.undo(count)
+	case CTRL_R_KEY:
+		// Redo the last change that was undone.
+		return ne.redo(count)
+	case ".":
+		// Repeat the last change.
+		return ne.repeatLastChange(rawCount)
+	case "p":
+		// Put the register's text after the cursor.
+		return ne.put(reg, count, true /*after*/)
+	case "P":
+		// Put the register's text before the cursor.
+		return ne.put(reg, count, false /*after*/)
 	case "0":
 		// Move the cursor to the beginning of the current line.
 		ne.cursorX = 0
@@ -42,63 +183,284 @@ func (ne *normalModeEditor) Handle(key gc.Key) error {
 		return nil
 	case "M":
 		// Move the cursor to the middle of the screen without scrolling.
-		ne.cursorY = ne.normalizeCursorY(ne.getMaxYForContent() / 2)
+		rows, _ := ne.getDisplayLines()
+		ne.cursorY = rows[len(rows)/2].lineInd - ne.fileLineOffset
 		return nil
 	case "L":
 		// Move the cursor to the lowest valid position without scrolling.
-		ne.cursorY = ne.normalizeCursorY(ne.getMaxYForContent())
+		rows, _ := ne.getDisplayLines()
+		ne.cursorY = ne.normalizeCursorY(rows[len(rows)-1].lineInd - ne.fileLineOffset)
 		return nil
 	case "o":
 		// Insert an empty line after the current line, and swap to INSERT mode.
-		currLineInd := ne.getCurrLineInd()
-		ne.fileContents = append(
-			ne.fileContents[:currLineInd+1],
-			append(
-				[]string{""},
-				ne.fileContents[currLineInd+1:]...,
-			)...,
-		)
-		ne.moveCursorVertical(1)
-		ne.cursorX = 0
-		ne.swapEditorMode(INSERT_MODE)
-		return nil
+		return ne.openLine(ne.getCurrLineInd()+1, count)
 	case "O":
 		// Insert an empty line before the current line, and swap to INSERT mode.
-		currLineInd := ne.getCurrLineInd()
-		ne.fileContents = append(
-			ne.fileContents[:currLineInd],
-			append(
-				[]string{""},
-				ne.fileContents[currLineInd:]...,
-			)...,
-		)
-		ne.cursorX = 0
-		ne.swapEditorMode(INSERT_MODE)
-		return nil
+		return ne.openLine(ne.getCurrLineInd(), count)
 	case "a":
 		// Swap to INSERT mode, and increment the cursor's x-pos.
-		ne.swapEditorMode(INSERT_MODE)
+		if err := ne.startInsert(count, false /*newLine*/); err != nil {
+			return err
+		}
 		// pastLastChar is allowed since we're now in INSERT mode.
 		ne.moveCursorHorizontal(1, true /*pastLastCharAllowed*/)
 		return nil
 	case "i":
 		// Swap to INSERT mode.
-		ne.swapEditorMode(INSERT_MODE)
-		return nil
-	case "v":
-		// Swap to VISUAL mode.
+		return ne.startInsert(count, false /*newLine*/)
+	case "v", "V", CTRL_V_KEY:
+		// Swap to VISUAL mode, selecting chars, whole lines or a block.
 		ne.swapEditorMode(VISUAL_MODE)
+		ne.activeEditorMode.(*visualModeEditor).kind = visualKinds[k]
 		return nil
 	case ":":
-		// Swap to COMMAND mode.
-		ne.userMsg = ""
+		// Swap to COMMAND mode. The command line isn't shown for <silent> mappings.
+		if !ne.silent {
+			ne.userMsg, ne.userMsgSeverity = ":", severityInfo
+		}
 		ne.swapEditorMode(COMMAND_MODE)
 		return nil
-	default:
-		// Do nothing.
-		ne.userMsg = fmt.Sprintf("unrecognized key %s", k)
+	}
+	// Otherwise, it may be a motion that moves the cursor, e.g. "w".
+	to, _, err := ne.motion(k, rawCount)
+	if err == errUnknownMotion {
+		ne.warnf("unrecognized key %s", k)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ne.setCursorPosition(to)
+	return nil
+}
+
+// Handle the motion after an operator, e.g. the "w" of "dw", and apply the operator. Doubling the
+// operator, e.g. "dd", applies it to whole lines.
+func (ne *normalModeEditor) handleOperatorMotion(k string) error {
+	switch k {
+	case "g", "f", "t", "F", "T", "i", "a":
+		// Wait for the rest of the motion or text object.
+		ne.pendingKeys = k
 		return nil
 	}
+	op, reg := ne.operator, ne.register
+	// Like Vim, counts before the operator and before the motion multiply.
+	count := 0
+	if ne.count > 0 || ne.motionCount > 0 {
+		count = max(ne.count, 1) * max(ne.motionCount, 1)
+	}
+	ne.resetCommand()
+	from := ne.cursorPosition()
+	if k == op {
+		end := min(from.line+max(count, 1), len(ne.fileContents)) - 1
+		return ne.applyOperator(op, reg, from, position{end, 0}, linewise)
+	}
+	if objStart, objEnd, kind, err := ne.textObject(k, count); err != errUnknownMotion {
+		if err != nil {
+			return err
+		}
+		return ne.applyOperator(op, reg, objStart, objEnd, kind)
+	}
+	if op == "c" && (k == "w" || k == "W") && charClass(ne.charAt(from), false) != blankClass {
+		// Like Vim, "cw" changes to the end of the word, like "ce".
+		if k == "W" {
+			k = "E"
+		} else {
+			k = "e"
+		}
+	}
+	to, kind, err := ne.motion(k, count)
+	if err == errUnknownMotion {
+		return errBell
+	}
+	if err != nil {
+		return err
+	}
+	if (k == "w" || k == "W") && to.line > from.line {
+		// Like Vim, when the last word moved over is at the end of a line, the operator stops there
+		// rather than at the first word on the next line.
+		to = position{to.line - 1, len(ne.fileContents[to.line-1])}
+	}
+	return ne.applyOperator(op, reg, from, to, kind)
+}
+
+// Swap to INSERT mode. The text typed is inserted count times in all, on new lines if newLine is set.
+func (ne *normalModeEditor) startInsert(count int, newLine bool) error {
+	if err := ne.enterInsertMode(); err != nil {
+		return err
+	}
+	ie := ne.activeEditorMode.(*insertModeEditor)
+	ie.count, ie.newLine = count, newLine
+	return nil
+}
+
+// Insert an empty line at lineInd, indented as per 'autoindent', and swap to INSERT mode on it, for
+// "o" and "O".
+func (ne *normalModeEditor) openLine(lineInd int, count int) error {
+	if !ne.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	ne.replaceLines(lineInd, lineInd, "")
+	indent := ne.newLineIndent(lineInd)
+	if indent != "" {
+		ne.replaceLines(lineInd, lineInd+1, indent)
+	}
+	ne.moveCursorToLine(lineInd)
+	ne.cursorX = len(indent)
+	if err := ne.startInsert(count, true /*newLine*/); err != nil {
+		return err
+	}
+	ne.activeEditorMode.(*insertModeEditor).autoIndented = indent != ""
+	return nil
+}
+
+// Forget a partly typed command.
+func (ne *normalModeEditor) resetCommand() {
+	ne.pendingKeys, ne.operator = "", ""
+	ne.count, ne.motionCount, ne.register = 0, 0, 0
+}
+
+// Add a digit to the count, or to the motion's count after an operator, unless the key isn't one.
+func (ne *normalModeEditor) addToCount(k string) bool {
+	if !ne.isCountKey(k) {
+		return false
+	}
+	count := &ne.count
+	if ne.operator != "" {
+		count = &ne.motionCount
+	}
+	*count = *count*10 + int(k[0]-'0')
+	return true
+}
+
+// Whether k is a digit of a count. "0" is only part of a count after another digit, since on its own
+// it moves to the start of the line.
+func (ne *normalModeEditor) isCountKey(k string) bool {
+	if len(k) != 1 || k[0] < '0' || k[0] > '9' {
+		return false
+	}
+	return k != "0" || (ne.operator == "" && ne.count > 0) || (ne.operator != "" && ne.motionCount > 0)
+}
+
+// Handle a command that takes a register name: "{register}, q{register} or @{register}.
+func (ne *normalModeEditor) handleRegisterCommand(cmd string, name byte) error {
+	switch cmd {
+	case `"`:
+		// Use the register for the next command. The count is kept, so that both "3"ap and "a3p work.
+		if err := validateRegisterName(name); err != nil {
+			ne.resetCommand()
+			return err
+		}
+		ne.register = name
+		return nil
+	case "q":
+		ne.resetCommand()
+		return ne.startRecording(name)
+	}
+	count := max(ne.count, 1)
+	ne.resetCommand()
+	return ne.runRegister(name, count)
+}
+
+// Run a motion count times. Like Vim, it fails if the cursor can't move at all, and otherwise moves as
+// far as it can.
+func (ne *normalModeEditor) repeatMotion(count int, motion func()) error {
+	lineInd, x := ne.getCurrLineInd(), ne.normalizeCursorX()
+	for i := 0; i < count; i++ {
+		motion()
+	}
+	if ne.getCurrLineInd() == lineInd && ne.normalizeCursorX() == x {
+		return errBell
+	}
+	return nil
+}
+
+// Put the text of a register count times, after or before the cursor. Whole lines are put below or
+// above the current line.
+func (ne *normalModeEditor) put(reg byte, count int, after bool) error {
+	if !ne.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	r, err := ne.getRegister(reg)
+	if err != nil {
+		return err
+	}
+	if r.text == "" && !r.linewise {
+		// Nothing to put. An empty linewise register is an empty line.
+		return errBell
+	}
+	lineInd := ne.getCurrLineInd()
+	if r.linewise {
+		lines := []string{}
+		for i := 0; i < count; i++ {
+			lines = append(lines, r.lines()...)
+		}
+		if after {
+			lineInd++
+		}
+		ne.replaceLines(lineInd, lineInd, lines...)
+		ne.moveCursorToLine(lineInd)
+		ne.cursorX = len(leadingWhitespace(lines[0]))
+		return nil
+	}
+	if r.blockwise {
+		ne.putBlock(r, count, after)
+		return nil
+	}
+	line := ne.fileContents[lineInd]
+	x := ne.normalizeCursorX()
+	if after && len(line) > 0 {
+		x++
+	}
+	text := strings.Repeat(r.text, count)
+	newLines := strings.Split(line[:x]+text+line[x:], "\n")
+	ne.replaceLines(lineInd, lineInd+1, newLines...)
+	// The cursor ends on the last char of the text, or at its start if it has several lines.
+	ne.cursorX = x
+	if len(newLines) == 1 {
+		ne.cursorX = x + len(text) - 1
+	}
+	return nil
+}
+
+// Put the lines of a block count times into the column of the cursor, on the current line and the
+// ones below it. Like Vim, lines are added at the end of the file as needed, and the block is padded
+// with spaces so that the text after it stays lined up.
+func (ne *normalModeEditor) putBlock(r register, count int, after bool) {
+	lineInd := ne.getCurrLineInd()
+	col := ne.normalizeCursorX()
+	if after && len(ne.fileContents[lineInd]) > 0 {
+		col++
+	}
+	pieces := r.lines()
+	width := 0
+	for _, piece := range pieces {
+		width = max(width, len(piece))
+	}
+	newLines := make([]string, len(pieces))
+	for i, piece := range pieces {
+		line := ""
+		if lineInd+i < len(ne.fileContents) {
+			line = ne.fileContents[lineInd+i]
+		}
+		if len(line) < col {
+			line += strings.Repeat(" ", col-len(line))
+		}
+		padded := piece + strings.Repeat(" ", width-len(piece))
+		text := strings.Repeat(padded, count)
+		if col == len(line) {
+			// Nothing comes after the block on this line, so it isn't padded at the end.
+			text = strings.Repeat(padded, count-1) + piece
+		}
+		newLines[i] = line[:col] + text + line[col:]
+	}
+	ne.replaceLines(lineInd, min(lineInd+len(pieces), len(ne.fileContents)), newLines...)
+	ne.setCursorPosition(position{lineInd, col})
+}
+
+func (ne *normalModeEditor) AcceptsMappings() bool {
+	// There are no operator-pending mappings, so the motion after an operator isn't mapped.
+	return ne.pendingKeys == "" && ne.operator == ""
 }
 
 func (ne *normalModeEditor) GetCursorYX() (int, int) {
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Apply an operator to the text between from and to, as given by a motion of the given kind. The
+// operators are:
+//
+//	d  delete the text into the register
+//	c  delete the text into the register, and swap to INSERT mode
+//	y  yank the text into the register
+//	=  reindent the lines, as per 'autoindent' and 'smartindent'
+//	!  start a command to filter the lines through a shell command, see shell.go
+func (e *editorImpl) applyOperator(op string, reg byte, from position, to position, kind motionKind) error {
+	if to.before(from) {
+		from, to = to, from
+	}
+	if op != "y" && !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	if op == "=" {
+		// Like Vim, "=" always works on whole lines, and puts the cursor on the first of them.
+		e.reindentLines(from.line, to.line)
+		e.moveCursorToLine(from.line)
+		e.cursorX = len(leadingWhitespace(e.fileContents[from.line]))
+		return nil
+	}
+	if op == "!" {
+		// Like "=", "!" always works on whole lines.
+		e.startFilterCommand(from.line, to.line)
+		return nil
+	}
+	if kind == linewise {
+		return e.applyLinewiseOperator(op, reg, from.line, to.line)
+	}
+	if kind == exclusive && to.col == 0 && to.line > from.line {
+		// Like Vim, an exclusive motion that ends at the start of a line ends at the end of the line
+		// before it instead, so that e.g. "dw" on the last word of a line doesn't join the lines.
+		to = position{to.line - 1, len(e.fileContents[to.line-1])}
+	} else if kind == inclusive {
+		to.col++
+	}
+	to.col = min(to.col, len(e.fileContents[to.line]))
+	if from == to && op != "c" {
+		// Nothing to operate on.
+		return errBell
+	}
+	first, last := e.fileContents[from.line], e.fileContents[to.line]
+	text := ""
+	if from.line == to.line {
+		text = first[from.col:to.col]
+	} else {
+		parts := []string{first[from.col:]}
+		parts = append(parts, e.fileContents[from.line+1:to.line]...)
+		parts = append(parts, last[:to.col])
+		text = strings.Join(parts, "\n")
+	}
+	if op == "y" {
+		e.setCursorPosition(from)
+		return e.setRegister(reg, register{text: text}, true /*yank*/)
+	}
+	if err := e.setRegister(reg, register{text: text}, false /*yank*/); err != nil {
+		return err
+	}
+	e.replaceLines(from.line, to.line+1, first[:from.col]+last[to.col:])
+	e.setCursorPosition(from)
+	if op == "c" {
+		return e.enterInsertMode()
+	}
+	return nil
+}
+
+// Apply an operator to the lines [start, end], e.g. for "dd" or "yj".
+func (e *editorImpl) applyLinewiseOperator(op string, reg byte, start int, end int) error {
+	lines := register{text: strings.Join(e.fileContents[start:end+1], "\n"), linewise: true}
+	if op == "y" {
+		e.moveCursorToLine(start)
+		return e.setRegister(reg, lines, true /*yank*/)
+	}
+	if err := e.setRegister(reg, lines, false /*yank*/); err != nil {
+		return err
+	}
+	if op == "c" {
+		// The lines are replaced by one to insert into, which keeps the first one's indent as per
+		// 'autoindent'. Like after "o", the indent goes again if nothing is typed after it.
+		indent := ""
+		if e.bufOpts.autoindent {
+			indent = leadingWhitespace(e.fileContents[start])
+		}
+		e.replaceLines(start, end+1, indent)
+		e.moveCursorToLine(start)
+		e.cursorX = len(indent)
+		if err := e.enterInsertMode(); err != nil {
+			return err
+		}
+		e.activeEditorMode.(*insertModeEditor).autoIndented = indent != ""
+		return nil
+	}
+	if end-start+1 == len(e.fileContents) {
+		// The file always has at least one line.
+		e.replaceLines(start, end+1, "")
+	} else {
+		e.replaceLines(start, end+1)
+	}
+	lineInd := min(start, len(e.fileContents)-1)
+	e.moveCursorToLine(lineInd)
+	e.cursorX = len(leadingWhitespace(e.fileContents[lineInd]))
+	return nil
+}
+
+// The number of columns that ">" and "<" shift lines by. Like Vim, 'shiftwidth' 0 uses 'tabstop'.
+func (e *editorImpl) shiftWidth() int {
+	if e.bufOpts.shiftwidth == 0 {
+		return e.bufOpts.tabstop
+	}
+	return e.bufOpts.shiftwidth
+}
+
+// The number of columns that tab and backspace count for in INSERT mode, or 0 if they insert and
+// delete single chars. Like Vim, a negative 'softtabstop' uses the 'shiftwidth'.
+func (e *editorImpl) softTabStop() int {
+	if e.bufOpts.softtabstop < 0 {
+		return e.shiftWidth()
+	}
+	return e.bufOpts.softtabstop
+}
+
+// The number of columns that indent takes up, with tabs going to the next multiple of 'tabstop'.
+func (e *editorImpl) indentWidth(indent string) int {
+	return e.displayCol(indent, len(indent))
+}
+
+// Whitespace that indents a line by width columns. See makeWhitespace.
+func (e *editorImpl) makeIndent(width int) string {
+	return e.makeWhitespace(0, width)
+}
+
+// Whitespace that goes from the display column from to the column to. With 'expandtab' it's all
+// spaces, otherwise it uses as many tabs as it can.
+func (e *editorImpl) makeWhitespace(from int, to int) string {
+	if e.bufOpts.expandtab {
+		return strings.Repeat(" ", max(to-from, 0))
+	}
+	ws := strings.Builder{}
+	ts := e.bufOpts.tabstop
+	for col := from; col < to; {
+		if next := (col/ts + 1) * ts; next <= to {
+			ws.WriteByte('\t')
+			col = next
+		} else {
+			ws.WriteByte(' ')
+			col++
+		}
+	}
+	return ws.String()
+}
+
+// Redo the whitespace in the lines of rng for a new 'tabstop', and set it, for :retab. Runs of
+// whitespace that have a tab, or with bang any run of more than one space, are replaced with
+// whitespace that takes up the same columns with the new 'tabstop', as per 'expandtab'.
+func (e *editorImpl) retab(rng lineRange, tabstop int, bang bool) error {
+	if !e.bufOpts.modifiable {
+		// Neither the lines nor 'tabstop' change, since the one is only right with the other.
+		return errNotModifiable
+	}
+	type run struct{ start, end, startCol, endCol int }
+	lineRuns := make([][]run, 0, rng.end-rng.start+1)
+	for _, line := range e.fileContents[rng.start : rng.end+1] {
+		runs := []run{}
+		for i := 0; i < len(line); i++ {
+			if line[i] != ' ' && line[i] != '\t' {
+				continue
+			}
+			j := i
+			for j < len(line) && (line[j] == ' ' || line[j] == '\t') {
+				j++
+			}
+			if strings.Contains(line[i:j], "\t") || (bang && j-i > 1) {
+				runs = append(runs, run{i, j, e.displayCol(line, i), e.displayCol(line, j)})
+			}
+			i = j
+		}
+		lineRuns = append(lineRuns, runs)
+	}
+	e.bufOpts.tabstop = tabstop
+	newLines := make([]string, 0, len(lineRuns))
+	changed := false
+	for i, runs := range lineRuns {
+		line := e.fileContents[rng.start+i]
+		newLine := strings.Builder{}
+		prev := 0
+		for _, r := range runs {
+			newLine.WriteString(line[prev:r.start])
+			newLine.WriteString(e.makeWhitespace(r.startCol, r.endCol))
+			prev = r.end
+		}
+		newLine.WriteString(line[prev:])
+		changed = changed || newLine.String() != line
+		newLines = append(newLines, newLine.String())
+	}
+	if changed {
+		e.replaceLines(rng.start, rng.end+1, newLines...)
+	}
+	return nil
+}
+
+// Shift the lines [start, end] right by amount 'shiftwidth's, or left if amount is negative. Like Vim,
+// empty lines aren't shifted right, and lines can't be shifted left past their start.
+func (e *editorImpl) shiftLines(start int, end int, amount int) {
+	newLines := make([]string, 0, end-start+1)
+	for _, line := range e.fileContents[start : end+1] {
+		indent := leadingWhitespace(line)
+		if amount > 0 && len(line) == 0 {
+			newLines = append(newLines, line)
+			continue
+		}
+		width := max(e.indentWidth(indent)+amount*e.shiftWidth(), 0)
+		newLines = append(newLines, e.makeIndent(width)+line[len(indent):])
+	}
+	e.replaceLines(start, end+1, newLines...)
+}
+
+// Join the lines [start, end] into one, for "J". Like Vim, the indent of each joined line is removed,
+// and one space goes between the lines, unless the line is empty or starts with ")", or the line
+// before ends with a space. The cursor is left where the last lines were joined.
+func (e *editorImpl) joinLines(start int, end int) error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	if end >= len(e.fileContents) {
+		return errBell
+	}
+	joined := e.fileContents[start]
+	col := 0
+	for _, line := range e.fileContents[start+1 : end+1] {
+		line = strings.TrimLeft(line, " \t")
+		col = len(joined)
+		if line != "" && line[0] != ')' && joined != "" && !strings.HasSuffix(joined, " ") {
+			joined += " "
+		}
+		joined += line
+	}
+	e.replaceLines(start, end+1, joined)
+	e.setCursorPosition(position{start, col})
+	return nil
+}
+
+// Switch the case of the letters in text, for "~".
+func switchCase(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, text)
+}
@@ -0,0 +1,461 @@
+package internal
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type optionScope int
+
+const (
+	globalScope optionScope = iota // One value for the whole editor.
+	bufferScope                    // Each buffer has its own value.
+	windowScope                    // Each window has its own value.
+)
+
+// globalOptions have a single value for the whole editor.
+type globalOptions struct {
+	showbreak  string // Shown at the start of wrapped rows.
+	sidescroll int    // Min columns to scroll horizontally when not wrapping. 0 re-centers the cursor.
+	laststatus int    // When the last window has a status line: 0 never, 1 if there are several windows, 2 always.
+	ignorecase bool   // Ignore case in search patterns.
+	smartcase  bool   // Override 'ignorecase' when the pattern has upper case chars.
+
+	mapleader   string // Replaces <leader> in mappings, when they are defined.
+	timeout     bool   // Stop waiting for the rest of a mapping after 'timeoutlen'.
+	timeoutlen  int    // Milliseconds to wait for the rest of a mapping.
+	maxmapdepth int    // Max number of times a mapping may expand before it's an error.
+
+	mouse        string // The modes the mouse is used in. See mouse.go.
+	shell        string // The shell :terminal and :! run. See terminal.go and shell.go.
+	shelltimeout int    // Milliseconds a :! command may run before it's stopped, or 0 for no limit.
+
+	// The quickfix list. See quickfix.go.
+	makeprg     string // The program :make runs.
+	errorformat string // How to read the output of 'makeprg'.
+	grepprg     string // The program :grep runs, or empty to search in-process.
+	grepformat  string // How to read the output of 'grepprg'.
+}
+
+// bufferOptions are local to a buffer. The editor keeps a global copy, which new buffers start with.
+type bufferOptions struct {
+	tabstop      int    // Number of spaces a tab counts for.
+	shiftwidth   int    // Number of spaces ">", "<" and indenting use. 0 uses 'tabstop'.
+	softtabstop  int    // Number of spaces tab and backspace count for when inserting. 0 is off.
+	expandtab    bool   // Insert spaces rather than a tab char when tab is pressed.
+	autoindent   bool   // Indent a new line like the line before it.
+	smartindent  bool   // Indent new lines by the filetype's rules, e.g. for Go's blocks. See indent.go.
+	formatonsave bool   // Format the buffer before writing it. See format.go.
+	formatprg    string // A shell command to format the buffer with, instead of the filetype's formatter.
+	readonly     bool   // Set if the file can't be opened for writing.
+	modifiable   bool   // Unset for buffers whose lines mustn't be changed, e.g. lists the editor made.
+	filetype     string // E.g. "go". Empty if it isn't recognized.
+	fileencoding string // "utf-8", or "latin1" if the file isn't valid UTF-8.
+	fileformat   string // "unix" for '\n' line endings, or "dos" for "\r\n".
+}
+
+// windowOptions are local to a window. The editor keeps a global copy, which new windows start with.
+type windowOptions struct {
+	wrap           bool   // Wrap lines longer than the screen width onto the following rows.
+	linebreak      bool   // When wrapping, break lines at 'breakat' chars instead of mid-word.
+	breakindent    bool   // Indent wrapped rows to match the start of the line.
+	number         bool   // Show line numbers in front of each line.
+	relativenumber bool   // Show line numbers relative to the cursor's line.
+	signcolumn     string // When to show the sign column for diagnostics. See diagnostics.go.
+	statusline     string // The format of the status line. See statusline.go.
+}
+
+func defaultGlobalOptions() globalOptions {
+	return globalOptions{
+		laststatus:  2,
+		mapleader:   `\`,
+		timeout:     true,
+		timeoutlen:  1000,
+		maxmapdepth: 1000,
+		makeprg:     "go build ./...",
+		errorformat: "%f:%l:%c: %m,%f:%l: %m",
+		grepformat:  "%f:%l:%c:%m,%f:%l:%m",
+		shell:       cmp.Or(os.Getenv("SHELL"), "sh"),
+	}
+}
+
+func defaultBufferOptions() bufferOptions {
+	return bufferOptions{
+		tabstop:      4,
+		expandtab:    true,
+		modifiable:   true,
+		autoindent:   true,
+		smartindent:  true,
+		fileencoding: "utf-8",
+		fileformat:   "unix",
+	}
+}
+
+func defaultWindowOptions() windowOptions {
+	return windowOptions{wrap: true, signcolumn: "auto", statusline: cDefaultStatusLine}
+}
+
+// optionDef describes an option that may be changed with :set.
+type optionDef struct {
+	name, short string
+	scope       optionScope
+	// Returns a pointer (*bool, *int or *string) to the option's value. When local is set, the value
+	// for the current buffer or window is returned, otherwise the global value.
+	value func(e *editorImpl, local bool) any
+	// Optional. Returns an error if the new value isn't allowed.
+	validate func(value any) error
+	// Optional. Called after the value is changed.
+	onSet func(e *editorImpl)
+}
+
+func globalOption(name, short string, field func(o *globalOptions) any) *optionDef {
+	return &optionDef{name: name, short: short, scope: globalScope, value: func(e *editorImpl, _ bool) any {
+		return field(&e.globalOpts)
+	}}
+}
+
+func bufferOption(name, short string, field func(o *bufferOptions) any) *optionDef {
+	return &optionDef{name: name, short: short, scope: bufferScope, value: func(e *editorImpl, local bool) any {
+		if local {
+			return field(&e.bufOpts)
+		}
+		return field(&e.defaultBufOpts)
+	}}
+}
+
+func windowOption(name, short string, field func(o *windowOptions) any) *optionDef {
+	return &optionDef{name: name, short: short, scope: windowScope, value: func(e *editorImpl, local bool) any {
+		if local {
+			return field(&e.winOpts)
+		}
+		return field(&e.defaultWinOpts)
+	}}
+}
+
+func (def *optionDef) withValidate(validate func(value any) error) *optionDef {
+	def.validate = validate
+	return def
+}
+
+func (def *optionDef) withOnSet(onSet func(e *editorImpl)) *optionDef {
+	def.onSet = onSet
+	return def
+}
+
+// Returns an error for negative numbers.
+func validateNonNegative(value any) error {
+	if value.(int) < 0 {
+		return fmt.Errorf("argument must be positive: %d", value)
+	}
+	return nil
+}
+
+// Returns an error for numbers less than 1.
+func validatePositive(value any) error {
+	if value.(int) < 1 {
+		return fmt.Errorf("argument must be positive: %d", value)
+	}
+	return nil
+}
+
+func validateOneOf(allowed ...string) func(value any) error {
+	return func(value any) error {
+		for _, a := range allowed {
+			if value.(string) == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid argument: %s", value)
+	}
+}
+
+// All options, sorted by name.
+var optionDefs = []*optionDef{
+	bufferOption("autoindent", "ai", func(o *bufferOptions) any { return &o.autoindent }),
+	windowOption("breakindent", "bri", func(o *windowOptions) any { return &o.breakindent }),
+	globalOption("errorformat", "efm", func(o *globalOptions) any { return &o.errorformat }).
+		withValidate(validateErrorFormat),
+	bufferOption("expandtab", "et", func(o *bufferOptions) any { return &o.expandtab }),
+	bufferOption("fileencoding", "fenc", func(o *bufferOptions) any { return &o.fileencoding }).
+		withValidate(validateOneOf("utf-8", "latin1")),
+	bufferOption("fileformat", "ff", func(o *bufferOptions) any { return &o.fileformat }).
+		withValidate(validateOneOf("unix", "dos")),
+	bufferOption("filetype", "ft", func(o *bufferOptions) any { return &o.filetype }),
+	bufferOption("formatonsave", "fos", func(o *bufferOptions) any { return &o.formatonsave }),
+	bufferOption("formatprg", "fp", func(o *bufferOptions) any { return &o.formatprg }),
+	globalOption("grepformat", "gfm", func(o *globalOptions) any { return &o.grepformat }).
+		withValidate(validateErrorFormat),
+	globalOption("grepprg", "gp", func(o *globalOptions) any { return &o.grepprg }),
+	globalOption("ignorecase", "ic", func(o *globalOptions) any { return &o.ignorecase }),
+	globalOption("laststatus", "ls", func(o *globalOptions) any { return &o.laststatus }).
+		withValidate(func(value any) error {
+			if n := value.(int); n < 0 || n > 2 {
+				return fmt.Errorf("invalid argument: %d", n)
+			}
+			return nil
+		}),
+	windowOption("linebreak", "lbr", func(o *windowOptions) any { return &o.linebreak }),
+	globalOption("makeprg", "mp", func(o *globalOptions) any { return &o.makeprg }),
+	globalOption("mapleader", "", func(o *globalOptions) any { return &o.mapleader }),
+	bufferOption("modifiable", "ma", func(o *bufferOptions) any { return &o.modifiable }),
+	globalOption("maxmapdepth", "mmd", func(o *globalOptions) any { return &o.maxmapdepth }).
+		withValidate(validatePositive),
+	globalOption("mouse", "", func(o *globalOptions) any { return &o.mouse }).
+		withValidate(validateMouse).
+		withOnSet(func(e *editorImpl) { e.updateMouseMask() }),
+	windowOption("number", "nu", func(o *windowOptions) any { return &o.number }),
+	bufferOption("readonly", "ro", func(o *bufferOptions) any { return &o.readonly }),
+	windowOption("relativenumber", "rnu", func(o *windowOptions) any { return &o.relativenumber }),
+	bufferOption("shiftwidth", "sw", func(o *bufferOptions) any { return &o.shiftwidth }).
+		withValidate(validateNonNegative),
+	globalOption("shell", "sh", func(o *globalOptions) any { return &o.shell }),
+	globalOption("shelltimeout", "stmo", func(o *globalOptions) any { return &o.shelltimeout }).
+		withValidate(validateNonNegative),
+	globalOption("showbreak", "sbr", func(o *globalOptions) any { return &o.showbreak }),
+	globalOption("sidescroll", "ss", func(o *globalOptions) any { return &o.sidescroll }).
+		withValidate(validateNonNegative),
+	windowOption("signcolumn", "scl", func(o *windowOptions) any { return &o.signcolumn }).
+		withValidate(validateOneOf("auto", "yes", "no")),
+	globalOption("smartcase", "scs", func(o *globalOptions) any { return &o.smartcase }),
+	bufferOption("smartindent", "si", func(o *bufferOptions) any { return &o.smartindent }),
+	bufferOption("softtabstop", "sts", func(o *bufferOptions) any { return &o.softtabstop }),
+	windowOption("statusline", "stl", func(o *windowOptions) any { return &o.statusline }).
+		withValidate(func(value any) error {
+			_, err := parseStatusLine(value.(string))
+			return err
+		}),
+	bufferOption("tabstop", "ts", func(o *bufferOptions) any { return &o.tabstop }).
+		withValidate(validatePositive),
+	globalOption("timeout", "to", func(o *globalOptions) any { return &o.timeout }),
+	globalOption("timeoutlen", "tm", func(o *globalOptions) any { return &o.timeoutlen }).
+		withValidate(validateNonNegative),
+	windowOption("wrap", "", func(o *windowOptions) any { return &o.wrap }).
+		withOnSet(func(e *editorImpl) { e.leftCol = 0 }),
+}
+
+// Returns the option with the given full or short name, or nil if there isn't one.
+func lookupOption(name string) *optionDef {
+	for _, def := range optionDefs {
+		if def.name == name || (def.short != "" && def.short == name) {
+			return def
+		}
+	}
+	return nil
+}
+
+// Which values a :set command changes.
+type setCommandKind int
+
+const (
+	setBoth   setCommandKind = iota // :set changes the local and global value.
+	setLocal                        // :setlocal changes only the local value.
+	setGlobal                       // :setglobal changes only the global value.
+)
+
+// Run a :set, :setlocal or :setglobal command with the given args. Supports the same forms as Vim:
+//
+//	:set             show options that differ from their default
+//	:set all         show all options
+//	:set {opt}?      show the value
+//	:set {opt}       turn a bool on, or show any other value
+//	:set no{opt}     turn a bool off
+//	:set {opt}!      invert a bool (also inv{opt})
+//	:set {opt}&      reset to the default
+//	:set {opt}={val} set the value (also {opt}:{val})
+//	:set {opt}+={val}, {opt}-={val}, {opt}^={val}
+//	                 add, subtract or multiply a number; or append, remove or prepend to a string
+func (e *editorImpl) setOptions(args string, kind setCommandKind) error {
+	fields := splitCommandArgs(args)
+	if len(fields) == 0 || (len(fields) == 1 && fields[0] == "all") {
+		lines := []string{}
+		for _, def := range optionDefs {
+			if len(fields) == 1 || !e.isOptionDefault(def, kind) {
+				lines = append(lines, e.formatOption(def, kind != setGlobal && e.window != nil))
+			}
+		}
+		sort.Strings(lines)
+		e.showPressEnter(severityInfo, append([]string{"--- Options ---"}, lines...))
+		return nil
+	}
+	shown := []string{}
+	for _, arg := range fields {
+		msg, err := e.setOption(arg, kind)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, arg)
+		}
+		if msg != "" {
+			shown = append(shown, msg)
+		}
+	}
+	if len(shown) > 0 {
+		e.infof("%s", strings.Join(shown, " "))
+	}
+	return nil
+}
+
+// Apply a single arg of a :set command. Returns the text to show, if the arg was a query.
+func (e *editorImpl) setOption(arg string, kind setCommandKind) (string, error) {
+	nameEnd := 0
+	for nameEnd < len(arg) && (arg[nameEnd] >= 'a' && arg[nameEnd] <= 'z') {
+		nameEnd++
+	}
+	name, rest := arg[:nameEnd], arg[nameEnd:]
+
+	def := lookupOption(name)
+	prefixValue := (*bool)(nil)
+	if def == nil {
+		// Maybe a bool with a "no" or "inv" prefix.
+		for prefix, value := range map[string]bool{"no": false, "inv": true} {
+			if trimmed, ok := strings.CutPrefix(name, prefix); ok && lookupOption(trimmed) != nil {
+				def, name = lookupOption(trimmed), trimmed
+				v := value
+				prefixValue = &v
+				if prefix == "inv" {
+					rest = "!" + rest
+				}
+			}
+		}
+	}
+	if def == nil {
+		return "", fmt.Errorf("unknown option")
+	}
+
+	// While the config is loaded there is no buffer or window yet, so only global values are set.
+	hasWindow := e.window != nil
+	local := kind != setGlobal && hasWindow
+	ptr := def.value(e, local)
+	_, isBool := ptr.(*bool)
+	if prefixValue != nil && !isBool {
+		return "", fmt.Errorf("invalid argument")
+	}
+	if rest == "?" || (rest == "" && !isBool) {
+		return e.formatOption(def, local), nil
+	}
+
+	var newValue any
+	switch {
+	case rest == "&":
+		newValue = defaultOptionValue(def)
+	case rest == "!":
+		if !isBool {
+			return "", fmt.Errorf("invalid argument")
+		}
+		newValue = !*ptr.(*bool)
+	case rest == "":
+		newValue = prefixValue == nil || *prefixValue
+	case isBool:
+		return "", fmt.Errorf("invalid argument")
+	default:
+		op, value := rest[:1], rest[1:]
+		if op != "=" && op != ":" {
+			if len(rest) < 2 || rest[1] != '=' {
+				return "", fmt.Errorf("invalid argument")
+			}
+			op, value = rest[:1], rest[2:]
+		}
+		var err error
+		if newValue, err = applyOptionOp(ptr, op, value); err != nil {
+			return "", err
+		}
+	}
+	if def.validate != nil {
+		if err := def.validate(newValue); err != nil {
+			return "", err
+		}
+	}
+	if local || def.scope == globalScope {
+		setOptionValue(def.value(e, true), newValue)
+	}
+	if kind != setLocal || !hasWindow {
+		setOptionValue(def.value(e, false), newValue)
+	}
+	if def.onSet != nil && hasWindow {
+		def.onSet(e)
+	}
+	return "", nil
+}
+
+// Compute the new value for an assignment like "+=4". The op is one of "=", ":", "+", "-" or "^".
+func applyOptionOp(ptr any, op string, value string) (any, error) {
+	switch p := ptr.(type) {
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("number required after =")
+		}
+		switch op {
+		case "+":
+			return *p + n, nil
+		case "-":
+			return *p - n, nil
+		case "^":
+			return *p * n, nil
+		}
+		return n, nil
+	case *string:
+		switch op {
+		case "+":
+			return *p + value, nil
+		case "-":
+			return strings.Replace(*p, value, "", 1), nil
+		case "^":
+			return value + *p, nil
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("invalid argument")
+}
+
+func setOptionValue(ptr any, value any) {
+	switch p := ptr.(type) {
+	case *bool:
+		*p = value.(bool)
+	case *int:
+		*p = value.(int)
+	case *string:
+		*p = value.(string)
+	}
+}
+
+// The value an option has before any config is applied.
+func defaultOptionValue(def *optionDef) any {
+	defaults := &editorImpl{
+		globalOpts:     defaultGlobalOptions(),
+		defaultBufOpts: defaultBufferOptions(),
+		defaultWinOpts: defaultWindowOptions(),
+	}
+	return optionValue(def.value(defaults, false))
+}
+
+func optionValue(ptr any) any {
+	switch p := ptr.(type) {
+	case *bool:
+		return *p
+	case *int:
+		return *p
+	case *string:
+		return *p
+	}
+	return nil
+}
+
+func (e *editorImpl) isOptionDefault(def *optionDef, kind setCommandKind) bool {
+	return optionValue(def.value(e, kind != setGlobal && e.window != nil)) == defaultOptionValue(def)
+}
+
+// Format an option the way :set shows it, e.g. "nowrap" or "tabstop=4".
+func (e *editorImpl) formatOption(def *optionDef, local bool) string {
+	switch v := optionValue(def.value(e, local)).(type) {
+	case bool:
+		if v {
+			return "  " + def.name
+		}
+		return "no" + def.name
+	default:
+		return fmt.Sprintf("  %s=%v", def.name, v)
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"strings"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Text pasted into the terminal is sent wrapped in these, once bracketed paste is turned on. This lets
+// a paste be inserted at once and verbatim, rather than as typed keys, which would be mapped, indented
+// and redrawn one at a time.
+const (
+	cPasteStart = "\x1b[200~"
+	cPasteEnd   = "\x1b[201~"
+
+	cEnableBracketedPaste  = "\x1b[?2004h"
+	cDisableBracketedPaste = "\x1b[?2004l"
+
+	// How long to wait for the rest of cPasteStart after a key that starts it, e.g. <Esc>. The keys of
+	// a paste arrive together, so this only delays an <Esc> that was really typed.
+	cPasteStartTimeoutMs = 10
+
+	// Stands for pasted text among the keys of a change, so that "." inserts the text again rather
+	// than typing it, which would indent and expand tabs. No key that's typed has this value.
+	cPastedTextKey gc.Key = -2
+)
+
+// pasteState is the progress of reading a paste.
+type pasteState struct {
+	matched string           // Keys typed so far that may be the start of cPasteStart.
+	text    *strings.Builder // The text pasted so far, while reading a paste. nil otherwise.
+}
+
+// Ask the terminal to wrap pasted text, or to stop.
+func setBracketedPaste(enable bool) {
+	if enable {
+		terminalOutput().WriteString(cEnableBracketedPaste)
+	} else {
+		terminalOutput().WriteString(cDisableBracketedPaste)
+	}
+}
+
+// Look for pasted text in the typed keys. Returns the keys to handle as typed, which are held back
+// while they may be the start of a paste. Once a whole paste has been read, it's inserted.
+func (e *editorImpl) filterPaste(key gc.Key) []gc.Key {
+	if e.paste.text != nil {
+		if key >= 0x100 {
+			// Part of the paste was read as a special key, e.g. an arrow key. It can't be inserted.
+			return nil
+		}
+		e.paste.text.WriteByte(byte(key))
+		if text := e.paste.text.String(); strings.HasSuffix(text, cPasteEnd) {
+			e.paste.text = nil
+			e.insertPaste(strings.TrimSuffix(text, cPasteEnd))
+		}
+		return nil
+	}
+	if key < 0x100 && byte(key) == cPasteStart[len(e.paste.matched)] {
+		e.paste.matched += string(byte(key))
+		if e.paste.matched == cPasteStart {
+			e.paste.matched = ""
+			e.paste.text = &strings.Builder{}
+		}
+		return nil
+	}
+	keys := e.flushPasteKeys()
+	if key == gc.Key(cPasteStart[0]) {
+		// The key may start a paste itself.
+		e.paste.matched = string(byte(key))
+		return keys
+	}
+	return append(keys, key)
+}
+
+// Returns the keys held back as the start of a paste, which turned out not to be one.
+func (e *editorImpl) flushPasteKeys() []gc.Key {
+	keys := []gc.Key{}
+	for i := 0; i < len(e.paste.matched); i++ {
+		keys = append(keys, gc.Key(e.paste.matched[i]))
+	}
+	e.paste.matched = ""
+	return keys
+}
+
+// Insert pasted text as one change, which is undone at once. In INSERT mode it's inserted at the
+// cursor, like typed text but without 'expandtab' or mappings, and the cursor ends after it. In NORMAL
+// mode it's put before the cursor, like "P". In COMMAND mode, its first line is added to the command.
+func (e *editorImpl) insertPaste(text string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	switch e.mode {
+	case INSERT_MODE:
+		ie := e.activeEditorMode.(*insertModeEditor)
+		e.closeUndoStep()
+		e.setCursorPosition(e.insertTextAt(e.cursorPosition(), text))
+		e.closeUndoStep()
+		ie.inserted.WriteString(text)
+		// "." repeats the paste as part of the insert.
+		e.currentChange.keys = append(e.currentChange.keys, cPastedTextKey)
+		e.currentChange.pastes = append(e.currentChange.pastes, text)
+	case NORMAL_MODE:
+		if !e.isCommandStart() || !e.bufOpts.modifiable {
+			gc.Beep()
+			return
+		}
+		end := e.insertTextAt(e.cursorPosition(), text)
+		// The cursor ends on the last char pasted.
+		end.col = max(end.col-1, 0)
+		e.setCursorPosition(end)
+		e.closeUndoStep()
+	case COMMAND_MODE:
+		ce := e.activeEditorMode.(*commandModeEditor)
+		first, _, _ := strings.Cut(text, "\n")
+		ce.commandBuffer.WriteString(first)
+		ce.updateUserMsg()
+	default:
+		gc.Beep()
+	}
+}
+
+// Insert text at pos as a single change, and return the position after it.
+func (e *editorImpl) insertTextAt(pos position, text string) position {
+	line := e.fileContents[pos.line]
+	col := min(pos.col, len(line))
+	newLines := strings.Split(line[:col]+text+line[col:], "\n")
+	e.replaceLines(pos.line, pos.line+1, newLines...)
+	last := len(newLines) - 1
+	return position{pos.line + last, len(newLines[last]) - len(line[col:])}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Input that a command asks the user for, like Vim's input() and confirm(), e.g. the name of a file
+// to create. The prompt and what has been typed are shown on the bottom row. <Enter> takes the input
+// and <Esc> cancels. A confirmation takes a single key, and anything but "y" is no.
+
+// inputPrompt is a question waiting for the user to answer it.
+type inputPrompt struct {
+	prompt  string
+	text    string
+	confirm bool // Only a single key is read, for a yes or no question.
+	onDone  func(text string) error
+}
+
+// Ask for a line of input after prompt, starting with text, and call onDone with it.
+func (e *editorImpl) askInput(prompt string, text string, onDone func(text string) error) {
+	e.input = &inputPrompt{prompt: prompt, text: text, onDone: onDone}
+}
+
+// Ask a yes or no question, and call onYes if the answer is yes.
+func (e *editorImpl) askConfirm(question string, onYes func() error) {
+	e.input = &inputPrompt{
+		prompt:  question + " (y/n) ",
+		confirm: true,
+		onDone:  func(string) error { return onYes() },
+	}
+}
+
+// Handle a key while a question is waiting for its answer.
+func (e *editorImpl) handleInputKey(key gc.Key) error {
+	in := e.input
+	k := gc.KeyString(key)
+	if in.confirm {
+		e.input = nil
+		if k == "y" || k == "Y" {
+			return in.onDone("y")
+		}
+		return nil
+	}
+	switch k {
+	case ESC_KEY:
+		e.input = nil
+	case "enter":
+		e.input = nil
+		return in.onDone(in.text)
+	case DELETE_KEY, "backspace":
+		if in.text == "" {
+			e.input = nil
+			return nil
+		}
+		_, size := utf8.DecodeLastRuneInString(in.text)
+		in.text = in.text[:len(in.text)-size]
+	case CTRL_U_KEY:
+		in.text = ""
+	default:
+		if key < ' ' || key >= 0x100 || key == 0x7f {
+			return errBell
+		}
+		in.text += string(byte(key))
+	}
+	return nil
+}
+
+// The text of the bottom row while a question is waiting.
+func (in *inputPrompt) line() string {
+	return in.prompt + in.text
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package internal
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Pseudo-terminals for terminal buffers, made with the ioctls of Linux's /dev/ptmx. See terminal.go.
+
+// Start argv in a new session whose controlling terminal is a new pseudo-terminal of rows and cols.
+// Returns the pseudo-terminal's master side, which reads what the program writes and writes what it
+// reads.
+func startInPty(argv []string, env []string, rows int, cols int) (*os.File, *exec.Cmd, error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Unlock the terminal side, and find its name.
+	unlock, n := int32(0), uint32(0)
+	if err := ioctl(ptm, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	if err := ioctl(ptm, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	pts, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	defer pts.Close()
+	if err := setPtySize(ptm, rows, cols); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.Env = env
+	// The program leads its own session, so that job control and CTRL-C work in it. Ctty is stdin.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, cmd, nil
+}
+
+// Kill the program started by startInPty, and everything it started. That's every process in its
+// session, as a shell with job control puts each job in a process group of its own.
+func killPtySession(cmd *exec.Cmd) {
+	sid := cmd.Process.Pid
+	syscall.Kill(-sid, syscall.SIGKILL)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			// The process has exited since the directory was read.
+			continue
+		}
+		// The fields after the name, which is in parens and may have any chars, start with the state,
+		// parent, process group and session.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 3 && fields[3] == strconv.Itoa(sid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// Tell the program in the pseudo-terminal its size, which sends it SIGWINCH.
+func setPtySize(ptm *os.File, rows int, cols int) error {
+	size := struct{ rows, cols, xPixels, yPixels uint16 }{uint16(rows), uint16(cols), 0, 0}
+	return ioctl(ptm, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+}
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
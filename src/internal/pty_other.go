@@ -0,0 +1,23 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Terminal buffers need a pseudo-terminal, which is only made on Linux. See pty_linux.go.
+
+func startInPty(argv []string, env []string, rows int, cols int) (*os.File, *exec.Cmd, error) {
+	return nil, nil, errors.New("terminals aren't supported on this system")
+}
+
+func killPtySession(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func setPtySize(ptm *os.File, rows int, cols int) error {
+	return nil
+}
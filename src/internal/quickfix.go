@@ -0,0 +1,468 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The quickfix list is a list of places in files, e.g. the errors of a build or the matches of a
+// search, to go through one by one. Like Vim:
+//
+//	:make [args]    run 'makeprg' with args, and make the list from its output with 'errorformat'
+//	:grep {pattern} [paths]
+//	                search the files under paths like :vimgrep (see search.go), or run 'grepprg' with
+//	                the args and read its output with 'grepformat'
+//	:copen [height] open the quickfix window, where <Enter> goes to the entry under the cursor
+//	:cclose         close the quickfix window
+//	:cnext, :cn     go to the next entry, or the count'th one after it with a count, e.g. :cn 3
+//	:cprev, :cp     go to the previous entry (also :cNext and :cN)
+//	:cfirst, :clast go to the first or last entry
+//	:cc [N]         go to the Nth entry, or the current one again
+//	:clist, :cl     list the entries
+//
+// 'errorformat' and 'grepformat' are comma separated patterns that a line of output must match in
+// full, with these items:
+//
+//	%f  the file name        %l  the line number      %c  the column number
+//	%m  the message          %t  the type, e.g. "e" for an error or "w" for a warning
+//	%%  a "%"                \,  a ","
+//
+// Lines that don't match any pattern are kept in the list as text.
+
+const (
+	cQuickfixBufferName   = "[Quickfix List]"
+	cQuickfixWindowHeight = 10
+)
+
+// quickfixEntry is an item of the quickfix list: a place in a file with a message, or only a line of
+// text for output that wasn't recognized.
+type quickfixEntry struct {
+	loc   location
+	valid bool   // Whether the entry has a place to go to.
+	kind  string // The type of the entry, e.g. "e" for an error, if the format has it.
+	text  string
+}
+
+type quickfixList struct {
+	title   string // The command that made the list, e.g. ":make".
+	entries []quickfixEntry
+	index   int     // The current entry.
+	buffer  *buffer // Shown in the quickfix window, or nil if it hasn't been opened.
+}
+
+// errorFormat is a pattern of 'errorformat' or 'grepformat', compiled to a regexp.
+type errorFormat struct {
+	re    *regexp.Regexp
+	items []byte // The item of each of the regexp's groups, e.g. 'f' for %f.
+}
+
+// Compile the comma separated patterns of an 'errorformat'.
+func parseErrorFormat(format string) ([]errorFormat, error) {
+	formats := []errorFormat{}
+	pattern, items := strings.Builder{}, []byte{}
+	addFormat := func() error {
+		if pattern.Len() == 0 {
+			return nil
+		}
+		re, err := regexp.Compile("^" + pattern.String() + "$")
+		if err != nil {
+			return err
+		}
+		formats = append(formats, errorFormat{re, items})
+		pattern.Reset()
+		items = nil
+		return nil
+	}
+	for i := 0; i < len(format); i++ {
+		switch ch := format[i]; {
+		case ch == ',':
+			if err := addFormat(); err != nil {
+				return nil, err
+			}
+		case ch == '\\' && i+1 < len(format) && format[i+1] == ',':
+			i++
+			pattern.WriteString(",")
+		case ch == '%' && i+1 < len(format):
+			i++
+			item := format[i]
+			switch item {
+			case 'f':
+				pattern.WriteString(`(.+?)`)
+			case 'l', 'c':
+				pattern.WriteString(`(\d+)`)
+			case 'm':
+				pattern.WriteString(`(.*)`)
+			case 't':
+				pattern.WriteString(`(\w)`)
+			case '%':
+				pattern.WriteString("%")
+				continue
+			default:
+				return nil, fmt.Errorf("invalid item in format: %%%c", item)
+			}
+			items = append(items, item)
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	if err := addFormat(); err != nil {
+		return nil, err
+	}
+	return formats, nil
+}
+
+// Returns an error if value isn't a valid 'errorformat'.
+func validateErrorFormat(value any) error {
+	_, err := parseErrorFormat(value.(string))
+	return err
+}
+
+// The entries of the lines of output, by the first format that each matches.
+func parseQuickfixOutput(output string, formats []errorFormat) []quickfixEntry {
+	entries := []quickfixEntry{}
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		entry := quickfixEntry{text: line}
+		for _, format := range formats {
+			m := format.re.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			entry = quickfixEntry{valid: true}
+			for i, item := range format.items {
+				value := m[i+1]
+				switch item {
+				case 'f':
+					entry.loc.path = filepath.Clean(value)
+				case 'l':
+					n, _ := strconv.Atoi(value)
+					entry.loc.pos.line = max(n-1, 0)
+				case 'c':
+					n, _ := strconv.Atoi(value)
+					entry.loc.pos.col = max(n-1, 0)
+				case 'm':
+					entry.text = value
+				case 't':
+					entry.kind = strings.ToLower(value)
+				}
+			}
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Run :make with args.
+func (e *editorImpl) makeCommand(args string) error {
+	return e.runQuickfixProgram(":make", joinProgramArgs(e.globalOpts.makeprg, args), e.globalOpts.errorformat)
+}
+
+// Run :grep with args.
+func (e *editorImpl) grepCommand(args string) error {
+	if e.globalOpts.grepprg != "" {
+		return e.runQuickfixProgram(":grep", joinProgramArgs(e.globalOpts.grepprg, args), e.globalOpts.grepformat)
+	}
+	fields := splitCommandArgs(args)
+	if len(fields) == 0 {
+		return errors.New("argument required")
+	}
+	return e.startProjectSearch(":grep "+args, fields[0], fields[1:], false)
+}
+
+// The shell command line of a program and args. Like Vim, "$*" in the program is replaced with the
+// args if it's there, otherwise they go at the end.
+func joinProgramArgs(prg string, args string) string {
+	if strings.Contains(prg, "$*") {
+		return strings.ReplaceAll(prg, "$*", args)
+	}
+	if args == "" {
+		return prg
+	}
+	return prg + " " + args
+}
+
+// Run the shell command line prg in the background, and make the quickfix list from its output with
+// format.
+func (e *editorImpl) runQuickfixProgram(title string, prg string, format string) error {
+	formats, err := parseErrorFormat(format)
+	if err != nil {
+		return err
+	}
+	e.infof("running %s", prg)
+	e.runInBackground(func() func() {
+		cmd := exec.Command("sh", "-c", prg)
+		// A build that fails exits with an error, so its output matters more than how it exited.
+		out, err := cmd.CombinedOutput()
+		return func() {
+			entries := parseQuickfixOutput(string(out), formats)
+			var exitErr *exec.ExitError
+			if err != nil && !errors.As(err, &exitErr) {
+				e.reportError(err)
+				return
+			}
+			e.setQuickfixList(title, entries)
+		}
+	})
+	return nil
+}
+
+// Replace the quickfix list, and go to its first entry with a place, if there is one.
+func (e *editorImpl) setQuickfixList(title string, entries []quickfixEntry) {
+	e.stopProjectSearch()
+	e.quickfix.title, e.quickfix.entries, e.quickfix.index = title, entries, 0
+	e.updateQuickfixBuffer()
+	for i, entry := range entries {
+		if entry.valid {
+			if err := e.gotoQuickfixEntry(i); err != nil {
+				e.reportError(err)
+			}
+			return
+		}
+	}
+	if len(entries) == 0 {
+		e.infof("%s: nothing found", title)
+	} else {
+		e.infof("%s: %d lines, none with a place to go to", title, len(entries))
+	}
+}
+
+// The lines of the quickfix window, one for each entry.
+func (e *editorImpl) quickfixLines() []string {
+	lines := []string{}
+	for _, entry := range e.quickfix.entries {
+		lines = append(lines, quickfixLine(entry))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// The line of the quickfix window for entry.
+func quickfixLine(entry quickfixEntry) string {
+	if !entry.valid {
+		return "|| " + entry.text
+	}
+	place := strconv.Itoa(entry.loc.pos.line + 1)
+	if entry.loc.pos.col > 0 {
+		place += fmt.Sprintf(" col %d", entry.loc.pos.col+1)
+	}
+	switch entry.kind {
+	case "e":
+		place += " error"
+	case "w":
+		place += " warning"
+	}
+	return fmt.Sprintf("%s|%s| %s", displayPath(entry.loc.path), place, entry.text)
+}
+
+// Add entries to the end of the quickfix list, e.g. as a search finds them, leaving the cursor of the
+// quickfix window where it is.
+func (e *editorImpl) appendQuickfixEntries(entries []quickfixEntry) {
+	if len(e.quickfix.entries) == 0 && e.quickfix.buffer != nil {
+		e.quickfix.buffer.fileContents = nil
+	}
+	e.quickfix.entries = append(e.quickfix.entries, entries...)
+	if buf := e.quickfix.buffer; buf != nil {
+		for _, entry := range entries {
+			buf.fileContents = append(buf.fileContents, quickfixLine(entry))
+		}
+		buf.changedTick++
+	}
+}
+
+// Show the quickfix list in its buffer, with the cursor of its window on the current entry.
+func (e *editorImpl) updateQuickfixBuffer() {
+	buf := e.quickfix.buffer
+	if buf == nil {
+		return
+	}
+	// The buffer isn't a file's, so it's replaced rather than changed, and has no undo history.
+	buf.fileContents = e.quickfixLines()
+	buf.undoSteps, buf.undoIndex, buf.pendingUndo = nil, 0, nil
+	buf.changedTick++
+	if w := e.quickfixWindow(); w != nil {
+		e.withWindow(w, func() {
+			e.moveCursorToLine(min(e.quickfix.index, len(buf.fileContents)-1))
+			e.cursorX = 0
+		})
+	}
+}
+
+// The window showing the quickfix list, or nil if it isn't open.
+func (e *editorImpl) quickfixWindow() *window {
+	for _, w := range e.windows {
+		if w.buffer == e.quickfix.buffer && w.buffer != nil {
+			return w
+		}
+	}
+	return nil
+}
+
+// Open the quickfix window at the bottom of the screen, height rows high (0 for the default), and go
+// to it. If it's open, just go to it.
+func (e *editorImpl) openQuickfixWindow(height int) error {
+	if w := e.quickfixWindow(); w != nil {
+		e.setCurrentWindow(w)
+		return nil
+	}
+	if e.quickfix.buffer == nil {
+		opts := e.defaultBufOpts
+		// Its lines are the entries, which Enter goes to by their index.
+		opts.filetype, opts.readonly, opts.modifiable = "qf", true, false
+		e.quickfix.buffer = &buffer{filePath: cQuickfixBufferName, fileContents: e.quickfixLines(), bufOpts: opts}
+	}
+	if height == 0 {
+		height = cQuickfixWindowHeight
+	}
+	from := e.window
+	// Like Vim, the window spans the whole width, below all the others.
+	e.setCurrentWindow(e.windows[len(e.windows)-1])
+	if err := e.splitWindow(e.quickfix.buffer, height, true); err != nil {
+		e.setCurrentWindow(from)
+		return err
+	}
+	e.previousWindow = from
+	e.updateQuickfixBuffer()
+	return nil
+}
+
+// Close the quickfix window, if it's open.
+func (e *editorImpl) closeQuickfixWindow() error {
+	if w := e.quickfixWindow(); w != nil {
+		return e.closeWindow(w)
+	}
+	return nil
+}
+
+// Go to the place of the ith entry, in the window the quickfix window was opened from if the cursor
+// is in it.
+func (e *editorImpl) gotoQuickfixEntry(i int) error {
+	if i < 0 || i >= len(e.quickfix.entries) {
+		return errors.New("no such entry")
+	}
+	entry := e.quickfix.entries[i]
+	if !entry.valid {
+		return errors.New("the entry has no place to go to")
+	}
+	if qfw := e.quickfixWindow(); qfw != nil && e.window == qfw {
+		target := e.previousWindow
+		if target == nil || target == qfw || e.windowIndex(target) < 0 {
+			// Any other window, or a new one above the quickfix window if it's the only one.
+			target = nil
+			for _, w := range e.windows {
+				if w != qfw {
+					target = w
+				}
+			}
+		}
+		if target == nil {
+			if err := e.splitWindow(e.buffer, 0, false); err != nil {
+				return err
+			}
+		} else {
+			e.setCurrentWindow(target)
+		}
+	}
+	e.quickfix.index = i
+	e.updateQuickfixBuffer()
+	if err := e.jumpTo(entry.loc); err != nil {
+		return err
+	}
+	e.infof("(%d of %d): %s", i+1, len(e.quickfix.entries), entry.text)
+	return nil
+}
+
+// Go to the count'th entry with a place after the current one, or before it if count is negative.
+// Stops at the last one there is.
+func (e *editorImpl) moveQuickfix(count int) error {
+	step := 1
+	if count < 0 {
+		step, count = -1, -count
+	}
+	target := -1
+	for i := e.quickfix.index + step; i >= 0 && i < len(e.quickfix.entries) && count > 0; i += step {
+		if e.quickfix.entries[i].valid {
+			target = i
+			count--
+		}
+	}
+	if target < 0 {
+		return errors.New("no more items")
+	}
+	return e.gotoQuickfixEntry(target)
+}
+
+// Go to the first entry with a place from the start, or the last one from the end if last is set.
+func (e *editorImpl) gotoQuickfixEnd(last bool) error {
+	for n := range e.quickfix.entries {
+		i := n
+		if last {
+			i = len(e.quickfix.entries) - 1 - n
+		}
+		if e.quickfix.entries[i].valid {
+			return e.gotoQuickfixEntry(i)
+		}
+	}
+	return errors.New("no items")
+}
+
+// Show the entries of the quickfix list, with the current one marked.
+func (e *editorImpl) listQuickfix() {
+	lines := []string{e.quickfix.title}
+	for i, line := range e.quickfixLines() {
+		if len(e.quickfix.entries) == 0 {
+			break
+		}
+		marker := " "
+		if i == e.quickfix.index {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s%3d %s", marker, i+1, line))
+	}
+	e.showPressEnter(severityInfo, lines)
+}
+
+// Run a quickfix command, e.g. :cnext. count is the command's argument, or 0 if it has none.
+func (e *editorImpl) quickfixCommand(name string, args string) error {
+	count := 0
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid argument: %s", args)
+		}
+		count = n
+	}
+	switch name {
+	case "copen", "cope":
+		return e.openQuickfixWindow(count)
+	case "cclose", "ccl":
+		return e.closeQuickfixWindow()
+	case "cnext", "cn":
+		return e.moveQuickfix(max(count, 1))
+	case "cprevious", "cprev", "cp", "cNext", "cN":
+		return e.moveQuickfix(-max(count, 1))
+	case "cfirst", "cfir":
+		return e.gotoQuickfixEnd(false)
+	case "clast", "cla":
+		return e.gotoQuickfixEnd(true)
+	case "cc":
+		if count == 0 {
+			return e.gotoQuickfixEntry(e.quickfix.index)
+		}
+		return e.gotoQuickfixEntry(count - 1)
+	case "clist", "cl":
+		e.listQuickfix()
+		return nil
+	}
+	return fmt.Errorf("unrecognized command: %s", name)
+}
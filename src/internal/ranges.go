@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lineRange is a range of lines given before an Ex command, e.g. the "1,5" of ":1,5normal x". The
+// line indices are 0-based and inclusive.
+type lineRange struct {
+	start, end int
+}
+
+// Parse the range at the start of an Ex command, and return the rest of the command after it. The
+// range is nil if the command doesn't have one. Like Vim, a range is one or two addresses separated by
+// "," and "%" is the whole file. Addresses are:
+//
+//	N  line N    .  the current line    $  the last line
+//	'<  the first line of the last VISUAL selection    '>  its last line
+//
+// each optionally followed by "+N" or "-N" offsets. A "+N" or "-N" on its own is relative to the
+// current line.
+func (e *editorImpl) parseRange(command string) (*lineRange, string, error) {
+	if command != "" && command[0] == '%' {
+		return &lineRange{start: 0, end: len(e.fileContents) - 1}, command[1:], nil
+	}
+	start, rest, ok, err := e.parseAddress(command)
+	if err != nil || !ok {
+		return nil, command, err
+	}
+	rng := &lineRange{start: start, end: start}
+	if rest != "" && (rest[0] == ',' || rest[0] == ';') {
+		end, afterEnd, ok, err := e.parseAddress(rest[1:])
+		if err != nil {
+			return nil, command, err
+		}
+		if ok {
+			rng.end, rest = end, afterEnd
+		}
+	}
+	if rng.start > rng.end {
+		return nil, command, fmt.Errorf("backwards range given")
+	}
+	return rng, rest, nil
+}
+
+// Parse a single address, returning its line index and the rest of the command. ok is false if the
+// command doesn't start with an address.
+func (e *editorImpl) parseAddress(command string) (lineInd int, rest string, ok bool, err error) {
+	i := 0
+	switch {
+	case command == "":
+		return 0, command, false, nil
+	case command[0] == '.':
+		lineInd, i = e.getCurrLineInd(), 1
+	case command[0] == '$':
+		lineInd, i = len(e.fileContents)-1, 1
+	case command[0] >= '0' && command[0] <= '9':
+		var n int
+		n, i = parseNumberAt(command, 0)
+		lineInd = n - 1
+	case command[0] == '+' || command[0] == '-':
+		lineInd = e.getCurrLineInd()
+	case strings.HasPrefix(command, "'<") || strings.HasPrefix(command, "'>"):
+		if e.lastVisual == nil {
+			return 0, command, false, fmt.Errorf("mark not set: %s", command[:2])
+		}
+		start, end := e.lastVisual.start.line, e.lastVisual.end.line
+		lineInd, i = min(start, end), 2
+		if command[1] == '>' {
+			lineInd = max(start, end)
+		}
+		lineInd = min(lineInd, len(e.fileContents)-1)
+	default:
+		return 0, command, false, nil
+	}
+	// Offsets, e.g. ".+3" or "$-1". A sign without a number is an offset of 1.
+	for i < len(command) && (command[i] == '+' || command[i] == '-') {
+		sign := 1
+		if command[i] == '-' {
+			sign = -1
+		}
+		n, end := parseNumberAt(command, i+1)
+		if end == i+1 {
+			n = 1
+		}
+		lineInd += sign * n
+		i = end
+	}
+	if lineInd < 0 || lineInd >= len(e.fileContents) {
+		return 0, command, false, fmt.Errorf("invalid range: %q", command[:i])
+	}
+	return lineInd, command[i:], true, nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// The unnamed register, which is used when no register is given and always has the last yank or
+	// delete.
+	cUnnamedRegister = '"'
+	// The register that has the last yank.
+	cYankRegister = '0'
+)
+
+// register holds text that was yanked, deleted or recorded. Lines are separated by "\n".
+type register struct {
+	text      string
+	linewise  bool // Put as whole lines, rather than into the current line.
+	blockwise bool // Put as a block, with each line going into the column of the next line down.
+}
+
+// Lines of the register's text.
+func (r register) lines() []string {
+	return strings.Split(r.text, "\n")
+}
+
+var errEmptyRegister = errors.New("nothing in register")
+
+// Registers a-z, 0-9 and the unnamed register may be used. A-Z append to a-z.
+func validateRegisterName(name byte) error {
+	switch {
+	case name >= 'a' && name <= 'z', name >= 'A' && name <= 'Z', name >= '0' && name <= '9':
+		return nil
+	case name == cUnnamedRegister:
+		return nil
+	}
+	return fmt.Errorf("invalid register name: %q", name)
+}
+
+// Returns the contents of a register. name 0 is the unnamed register.
+func (e *editorImpl) getRegister(name byte) (register, error) {
+	if name == 0 {
+		name = cUnnamedRegister
+	}
+	if err := validateRegisterName(name); err != nil {
+		return register{}, err
+	}
+	if name >= 'A' && name <= 'Z' {
+		name += 'a' - 'A'
+	}
+	reg, ok := e.registers[name]
+	if !ok {
+		return register{}, errEmptyRegister
+	}
+	return reg, nil
+}
+
+// Store text in a register. name 0 is the unnamed register, and a yank to it is also stored in "0.
+// Like Vim, the unnamed register always gets the text too.
+func (e *editorImpl) setRegister(name byte, reg register, yank bool) error {
+	if name == 0 {
+		name = cUnnamedRegister
+	}
+	reg, err := e.storeRegister(name, reg)
+	if err != nil {
+		return err
+	}
+	e.registers[cUnnamedRegister] = reg
+	if yank && name == cUnnamedRegister {
+		e.registers[cYankRegister] = reg
+	}
+	return nil
+}
+
+// Store text in only the named register. A-Z append to a-z. Returns what the register holds after.
+func (e *editorImpl) storeRegister(name byte, reg register) (register, error) {
+	if err := validateRegisterName(name); err != nil {
+		return register{}, err
+	}
+	if e.registers == nil {
+		e.registers = map[byte]register{}
+	}
+	if name >= 'A' && name <= 'Z' {
+		name += 'a' - 'A'
+		if prev, ok := e.registers[name]; ok {
+			sep := ""
+			if prev.linewise || reg.linewise || prev.blockwise || reg.blockwise {
+				// Appending to or with whole lines gives whole lines. Appending to or with a block
+				// adds lines to the block.
+				sep = "\n"
+			}
+			reg = register{
+				text:      prev.text + sep + reg.text,
+				linewise:  prev.linewise || reg.linewise,
+				blockwise: !prev.linewise && !reg.linewise && (prev.blockwise || reg.blockwise),
+			}
+		}
+	}
+	e.registers[name] = reg
+	return reg, nil
+}
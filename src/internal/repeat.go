@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"strconv"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// change is a command that changed the buffer, kept so that "." can repeat it. It's kept as the keys
+// that were typed for it, from the start of the command in NORMAL mode until NORMAL mode is back to
+// waiting for a new command. So an insert, e.g. "ihello<Esc>", is one change with the text typed, and
+// so is an operator with its motion, e.g. "d2w", or a VISUAL mode operation.
+type change struct {
+	keys   []gc.Key
+	pastes []string // The text of each cPastedTextKey in keys, in order.
+	count  int      // The count typed before the command, which "." may replace. 0 if none was typed.
+	tick   int      // The buffer's changedTick when the command started.
+}
+
+// Whether NORMAL mode is waiting for a new command, with nothing typed for it yet.
+func (e *editorImpl) isCommandStart() bool {
+	ne, ok := e.activeEditorMode.(*normalModeEditor)
+	return ok && ne.pendingKeys == "" && ne.operator == "" && ne.count == 0 && ne.register == 0
+}
+
+// Add a key to the command being typed, before it's handled. The count before the command isn't
+// kept as a key, so that "." can replace it.
+func (e *editorImpl) trackChangeKey(key gc.Key) {
+	if e.isCommandStart() {
+		e.currentChange = change{tick: e.changedTick}
+	}
+	if ne, ok := e.activeEditorMode.(*normalModeEditor); ok && ne.pendingKeys == "" && ne.operator == "" &&
+		ne.isCountKey(gc.KeyString(key)) {
+		return
+	}
+	e.currentChange.keys = append(e.currentChange.keys, key)
+}
+
+// Once a command is complete, keep it as the last change if it changed the buffer. Like in Vim, Ex
+// commands, undo and redo aren't repeated.
+func (e *editorImpl) finishChange() {
+	if ne, ok := e.activeEditorMode.(*normalModeEditor); ok && ne.count > 0 {
+		e.currentChange.count = ne.count
+	}
+	keys := e.currentChange.keys
+	if !e.isCommandStart() || len(keys) == 0 || e.changedTick == e.currentChange.tick {
+		return
+	}
+	if keys[0] != ':' && keys[0] != 'u' && gc.KeyString(keys[0]) != CTRL_R_KEY {
+		e.lastChange = e.currentChange
+	}
+	e.currentChange = change{}
+}
+
+// Repeat the last change at the cursor, for ".". A count replaces the change's count.
+func (e *editorImpl) repeatLastChange(count int) error {
+	if len(e.lastChange.keys) == 0 {
+		return errBell
+	}
+	if count == 0 {
+		count = e.lastChange.count
+	}
+	keys := []gc.Key{}
+	if count > 0 {
+		for _, digit := range strconv.Itoa(count) {
+			keys = append(keys, gc.Key(digit))
+		}
+	}
+	keys = append(keys, e.lastChange.keys...)
+	// The keys are handled next, without mappings, as they were when the change was made.
+	queued := make([]queuedKey, 0, len(keys)+len(e.inputQueue))
+	pastes := e.lastChange.pastes
+	for _, key := range keys {
+		qk := queuedKey{key: key, noremap: true}
+		if key == cPastedTextKey {
+			qk.paste, pastes = pastes[0], pastes[1:]
+		}
+		queued = append(queued, qk)
+	}
+	e.inputQueue = append(queued, e.inputQueue...)
+	return nil
+}
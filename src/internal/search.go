@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Searching the files of the project, for :vimgrep and for :grep when 'grepprg' isn't set. Files are
+// found by walking the directories, skipping what .gitignore files ignore (see gitignore.go), and are
+// searched by a pool of workers. Files that look binary are skipped, and open buffers are searched as
+// they are rather than as they're on disc. Matches are added to the quickfix list as they're found,
+// with the quickfix window open to show them, where <Enter> goes to a match.
+//
+//	:vimgrep /{pattern}/[g] [paths]
+//	:vimgrep {pattern} [paths]
+//	                search the files under paths (default the working directory) for the Go regexp
+//	                pattern; with the g flag, every match is listed rather than each matching line
+//
+// Starting another search, or replacing the quickfix list, stops the search.
+
+const (
+	// How many files found by the walk may wait to be searched.
+	cSearchQueueLen = 256
+	// Files are only checked for being binary in this many bytes at their start.
+	cBinaryCheckLen = 8000
+)
+
+// projectSearch is a search of the files under roots, which may be stopped while it runs.
+type projectSearch struct {
+	re         *regexp.Regexp
+	allMatches bool // List every match, rather than only the first of each line.
+	roots      []string
+	overlays   map[string][]string // The lines of open buffers, by absolute path.
+
+	stop     chan struct{} // Closed to stop the search.
+	stopOnce sync.Once
+
+	// Counted on the editor's goroutine, as results come in.
+	matches, files int
+}
+
+// Run :vimgrep with args.
+func (e *editorImpl) vimgrepCommand(name string, args string) error {
+	pattern, rest, allMatches, err := parseVimgrepArgs(args)
+	if err != nil {
+		return err
+	}
+	return e.startProjectSearch(":"+name+" "+args, pattern, splitCommandArgs(rest), allMatches)
+}
+
+// Split the args of :vimgrep into the pattern, the rest, and whether the g flag is given. Like Vim, the
+// pattern may be enclosed in any non-word char, e.g. /foo bar/, and is otherwise the first arg.
+func parseVimgrepArgs(args string) (pattern string, rest string, allMatches bool, err error) {
+	if args == "" {
+		return "", "", false, errors.New("argument required")
+	}
+	if delim := args[0]; charClass(delim, false) != punctClass || delim == '\\' || delim == '"' || delim == '|' {
+		pattern, rest, _ := strings.Cut(args, " ")
+		return pattern, strings.TrimSpace(rest), false, nil
+	}
+	delim := args[0]
+	end := 1
+	for end < len(args) && args[end] != delim {
+		if args[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(args) {
+		return "", "", false, fmt.Errorf("missing %c after pattern", delim)
+	}
+	pattern = strings.ReplaceAll(args[1:end], `\`+string(delim), string(delim))
+	flags, rest, _ := strings.Cut(args[end+1:], " ")
+	for _, flag := range flags {
+		switch flag {
+		case 'g':
+			allMatches = true
+		case 'j':
+			// Don't jump to the first match, which a search never does.
+		default:
+			return "", "", false, fmt.Errorf("invalid flag: %c", flag)
+		}
+	}
+	return pattern, strings.TrimSpace(rest), allMatches, nil
+}
+
+// Compile a pattern to search for, ignoring case as per 'ignorecase' and 'smartcase'.
+func (e *editorImpl) compileSearchPattern(pattern string) (*regexp.Regexp, error) {
+	if e.globalOpts.ignorecase && !(e.globalOpts.smartcase && strings.ToLower(pattern) != pattern) {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// Start searching the files under paths for pattern, with the quickfix list and window showing the
+// matches as they're found.
+func (e *editorImpl) startProjectSearch(title string, pattern string, paths []string, allMatches bool) error {
+	re, err := e.compileSearchPattern(pattern)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	s := &projectSearch{re: re, allMatches: allMatches, roots: paths, overlays: map[string][]string{}, stop: make(chan struct{})}
+	for _, buf := range e.buffers {
+		if abs, err := filepath.Abs(buf.filePath); err == nil {
+			s.overlays[abs] = slices.Clone(buf.fileContents)
+		}
+	}
+	e.stopProjectSearch()
+	e.quickfix.title, e.quickfix.entries, e.quickfix.index = title, nil, 0
+	e.updateQuickfixBuffer()
+	if err := e.openQuickfixWindow(0); err != nil {
+		return err
+	}
+	e.search = s
+	e.infof("searching for %s", pattern)
+	e.runInBackground(func() func() {
+		s.run(func(entries []quickfixEntry) {
+			e.events <- func() {
+				if e.search == s {
+					s.matches += len(entries)
+					s.files++
+					e.appendQuickfixEntries(entries)
+				}
+			}
+		})
+		return func() {
+			if e.search != s {
+				return
+			}
+			e.search = nil
+			if s.matches == 0 {
+				e.infof("%s: nothing found", title)
+			} else {
+				e.infof("%s: %s in %s", title, plural(s.matches, "match", "matches"), plural(s.files, "file", "files"))
+			}
+		}
+	})
+	return nil
+}
+
+// Stop the project search that is running, if there is one. What it found stays in the quickfix list.
+func (e *editorImpl) stopProjectSearch() {
+	if e.search != nil {
+		e.search.stopOnce.Do(func() { close(e.search.stop) })
+		e.search = nil
+	}
+}
+
+// Search the files, calling found with the matches of each file that has some. found is called from
+// the workers' goroutines.
+func (s *projectSearch) run(found func(entries []quickfixEntry)) {
+	paths := make(chan string, cSearchQueueLen)
+	go func() {
+		defer close(paths)
+		for _, root := range s.roots {
+			walkFiles(root, nil, s.stop, paths)
+		}
+	}()
+	wg := sync.WaitGroup{}
+	for range runtime.GOMAXPROCS(0) {
+		wg.Go(func() {
+			for path := range paths {
+				if entries := s.searchFile(path); len(entries) > 0 && !isClosed(s.stop) {
+					found(entries)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Send the files under path that aren't ignored to paths, until stop is closed. rules are the
+// .gitignore rules of the directories above path.
+func walkFiles(path string, rules []ignoreRule, stop <-chan struct{}, paths chan<- string) {
+	info, err := os.Stat(path)
+	if err != nil || isClosed(stop) {
+		return
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			select {
+			case paths <- path:
+			case <-stop:
+			}
+		}
+		return
+	}
+	// Each directory's rules are added to a copy, so that they don't apply to its siblings.
+	rules = append(slices.Clip(rules), readGitignore(path)...)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		if entry.Name() == ".git" || isIgnored(rules, child, entry.IsDir()) {
+			continue
+		}
+		if entry.IsDir() || entry.Type().IsRegular() {
+			walkFiles(child, rules, stop, paths)
+		}
+	}
+}
+
+// Whether ch has been closed, without waiting.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// The matches in the file at path.
+func (s *projectSearch) searchFile(path string) []quickfixEntry {
+	lines, ok := []string(nil), false
+	if abs, err := filepath.Abs(path); err == nil {
+		lines, ok = s.overlays[abs]
+	}
+	if !ok {
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(data[:min(len(data), cBinaryCheckLen)], 0) >= 0 {
+			return nil
+		}
+		lines = strings.Split(string(data), "\n")
+	}
+	entries := []quickfixEntry{}
+	for lineInd, line := range lines {
+		n := 1
+		if s.allMatches {
+			n = -1
+		}
+		for _, match := range s.re.FindAllStringIndex(line, n) {
+			entries = append(entries, quickfixEntry{
+				loc:   location{path, position{lineInd, match[0]}},
+				valid: true,
+				text:  strings.TrimSpace(line),
+			})
+		}
+	}
+	return entries
+}
+
+// n and the noun for it, e.g. "1 file" or "2 files".
+func plural(n int, one string, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// A list of items shown over the bottom of the screen, like Vim's :tselect, for the user to pick one
+// of by typing its number and ENTER. Anything else cancels it.
+
+const cSelectListPrompt = "Type number and <Enter> (empty cancels): "
+
+// listSelection is a list waiting for the user to pick from it.
+type listSelection struct {
+	numItems int
+	typed    string // The digits typed so far.
+	onSelect func(i int) error
+}
+
+// Show items under a title, and call onSelect with the index of the one the user picks.
+func (e *editorImpl) selectFromList(title string, items []string, onSelect func(i int) error) {
+	lines := []string{title}
+	width := len(strconv.Itoa(len(items)))
+	for i, item := range items {
+		lines = append(lines, fmt.Sprintf("%*d %s", width, i+1, item))
+	}
+	e.pressEnterLines = nil
+	e.showPressEnter(severityInfo, lines)
+	e.listSelection = &listSelection{numItems: len(items), onSelect: onSelect}
+}
+
+// Handle a key while a list is waiting for the user to pick from it.
+func (e *editorImpl) handleListSelectionKey(key gc.Key) error {
+	sel := e.listSelection
+	maxY, _ := e.screen.MaxYX()
+	switch k := gc.KeyString(key); {
+	case len(k) == 1 && k[0] >= '0' && k[0] <= '9':
+		sel.typed += k
+		return nil
+	case k == DELETE_KEY || k == "backspace":
+		if sel.typed != "" {
+			sel.typed = sel.typed[:len(sel.typed)-1]
+		}
+		return nil
+	case (k == " " || k == "j" || k == "down") && len(e.pressEnterLines) > maxY-1:
+		// Scroll through a list that is taller than the screen.
+		e.pressEnterLines = e.pressEnterLines[1:]
+		return nil
+	case k == "enter" && sel.typed != "":
+		e.listSelection, e.pressEnterLines = nil, nil
+		n, _ := strconv.Atoi(sel.typed)
+		if n < 1 || n > sel.numItems {
+			return errBell
+		}
+		return sel.onSelect(n - 1)
+	default:
+		e.listSelection, e.pressEnterLines = nil, nil
+		return nil
+	}
+}
+
+// The prompt at the bottom of output that is waiting for the user.
+func (e *editorImpl) pressEnterPrompt() string {
+	if e.listSelection != nil {
+		return cSelectListPrompt + e.listSelection.typed
+	}
+	return cPressEnterPrompt
+}
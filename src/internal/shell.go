@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Shell commands are run with 'shell', like Vim's:
+//
+//	:!{cmd}          run cmd, and show what it writes
+//	:{range}!{cmd}   filter the lines through cmd, replacing them with what it writes to stdout
+//	:r !{cmd}        insert what cmd writes to stdout below the cursor's line, or the range's last
+//	:r {file}        insert the file below the cursor's line, or the range's last
+//	!{motion}        start a :{range}! command for the lines the motion moves over, e.g. "!ip", or
+//	                 "!!" for the cursor's line and count-1 more
+//	{Visual}!        start a :'<,'>! command for the selected lines
+//
+// In cmd, "%" is the file's name and "!" is the previous command, e.g. ":!!" runs it again. "\%" and
+// "\!" are the chars themselves. While a command runs, CTRL-C stops it, and so does 'shelltimeout'
+// passing if it isn't 0. If a command fails, the lines are left as they were, and what it wrote to
+// stderr is shown with its exit status.
+
+// Run an Ex command starting with "!": a command to run, or a filter for the lines of rng.
+func (e *editorImpl) bangCommand(rng *lineRange, args string) error {
+	cmdline, err := e.expandShellCommand(args)
+	if err != nil {
+		return err
+	}
+	if rng != nil {
+		return e.filterLines(rng.start, rng.end, cmdline)
+	}
+	// Like Vim, what the command writes to stdout and stderr is shown together, in the order written.
+	var out bytes.Buffer
+	err = e.runShell(cmdline, "", &out, &out)
+	e.showPressEnter(severityInfo, []string{":!" + cmdline})
+	if text := strings.TrimSuffix(out.String(), "\n"); text != "" {
+		e.showPressEnter(severityInfo, strings.Split(text, "\n"))
+	}
+	if err != nil {
+		e.showPressEnter(severityError, []string{shellError(err, "").Error()})
+	}
+	return nil
+}
+
+// Replace the lines [start, end] with what cmdline writes to stdout, given them on stdin.
+func (e *editorImpl) filterLines(start int, end int, cmdline string) error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	var stdout, stderr bytes.Buffer
+	input := strings.Join(e.fileContents[start:end+1], "\n") + "\n"
+	if err := e.runShell(cmdline, input, &stdout, &stderr); err != nil {
+		return shellError(err, stderr.String())
+	}
+	lines := splitOutputLines(stdout.String())
+	if len(lines) == 0 && end-start+1 == len(e.fileContents) {
+		// The file always has at least one line.
+		lines = []string{""}
+	}
+	e.replaceLines(start, end+1, lines...)
+	lineInd := min(start, len(e.fileContents)-1)
+	e.moveCursorToLine(lineInd)
+	e.cursorX = len(leadingWhitespace(e.fileContents[lineInd]))
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		e.warnf("%s", msg)
+	} else {
+		e.infof("%s filtered", plural(end-start+1, "line", "lines"))
+	}
+	return nil
+}
+
+// Run :r with args, inserting the output of a command or a file's lines below the line at lineInd.
+func (e *editorImpl) readCommand(lineInd int, args string) error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	var lines []string
+	if cmd, ok := strings.CutPrefix(args, "!"); ok {
+		cmdline, err := e.expandShellCommand(cmd)
+		if err != nil {
+			return err
+		}
+		var stdout, stderr bytes.Buffer
+		if err := e.runShell(cmdline, "", &stdout, &stderr); err != nil {
+			return shellError(err, stderr.String())
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			e.warnf("%s", msg)
+		}
+		lines = splitOutputLines(stdout.String())
+	} else {
+		if args == "" {
+			return errors.New("argument required")
+		}
+		content, err := os.ReadFile(args)
+		if err != nil {
+			return err
+		}
+		lines = splitOutputLines(string(content))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	e.replaceLines(lineInd+1, lineInd+1, lines...)
+	e.moveCursorToLine(lineInd + 1)
+	e.cursorX = len(leadingWhitespace(e.fileContents[lineInd+1]))
+	return nil
+}
+
+// Start a command line to filter the lines [start, end], for the "!" operator.
+func (e *editorImpl) startFilterCommand(start int, end int) {
+	e.moveCursorToLine(start)
+	e.swapEditorMode(COMMAND_MODE)
+	ce := e.activeEditorMode.(*commandModeEditor)
+	if end == start {
+		ce.commandBuffer.WriteString(".!")
+	} else {
+		fmt.Fprintf(&ce.commandBuffer, ".,.+%d!", end-start)
+	}
+	ce.updateUserMsg()
+}
+
+// Replace "%" in cmd with the file's name and "!" with the previous command, which cmd then becomes.
+func (e *editorImpl) expandShellCommand(cmd string) (string, error) {
+	expanded := strings.Builder{}
+	for i := 0; i < len(cmd); i++ {
+		switch {
+		case cmd[i] == '\\' && i+1 < len(cmd) && (cmd[i+1] == '%' || cmd[i+1] == '!'):
+			i++
+			expanded.WriteByte(cmd[i])
+		case cmd[i] == '%':
+			if e.window == nil || e.file == nil {
+				return "", errors.New("no file name to substitute for \"%\"")
+			}
+			expanded.WriteString(e.filePath)
+		case cmd[i] == '!':
+			if e.lastShellCommand == "" {
+				return "", errors.New("no previous command")
+			}
+			expanded.WriteString(e.lastShellCommand)
+		default:
+			expanded.WriteByte(cmd[i])
+		}
+	}
+	if strings.TrimSpace(expanded.String()) == "" {
+		return "", errors.New("argument required")
+	}
+	e.lastShellCommand = expanded.String()
+	return expanded.String(), nil
+}
+
+// Run cmdline with 'shell', with input on its stdin, and wait for it to finish. Keys are read while
+// it runs: CTRL-C stops it, and the others are handled after it.
+func (e *editorImpl) runShell(cmdline string, input string, stdout *bytes.Buffer, stderr *bytes.Buffer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeout := time.Duration(e.globalOpts.shelltimeout) * time.Millisecond
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	cmd := exec.CommandContext(ctx, e.globalOpts.shell, "-c", cmdline)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = strings.NewReader(input), stdout, stderr
+	// Something the command started in the background may keep its output open after it's stopped.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	e.userMsg, e.userMsgSeverity = fmt.Sprintf("running %s (CTRL-C to stop)", cmdline), severityInfo
+	e.sync()
+	// CTRL-C is read as a key rather than raising SIGINT, which would quit the editor.
+	setRawInput(true)
+	defer setRawInput(false)
+	defer e.updateInputTimeout()
+	e.screen.Timeout(cEventPollMs)
+	interrupted := false
+	for {
+		select {
+		case err := <-done:
+			e.userMsg = ""
+			switch {
+			case interrupted:
+				return errors.New("interrupted")
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				return fmt.Errorf("timed out after %s", timeout)
+			}
+			return err
+		default:
+		}
+		switch key := e.screen.GetChar(); {
+		case key == 0:
+		case gc.KeyString(key) == CTRL_C_KEY:
+			interrupted = true
+			cancel()
+		default:
+			e.typeKeys([]gc.Key{key})
+		}
+	}
+}
+
+// The error for a command that failed, with what it wrote to stderr before its exit status.
+func shellError(err error, stderr string) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("shell returned %d", exitErr.ExitCode())
+	}
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return fmt.Errorf("%s\n%w", msg, err)
+	}
+	return err
+}
+
+// The lines of a command's output, without the newline at the end of the last.
+func splitOutputLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The default 'statusline'. See parseStatusLine for the items that may be used.
+	cDefaultStatusLine = " %{mode} | %f %m%r%=%y %{fileencoding} %{fileformat} | %l:%c | %p%% "
+)
+
+// statusItem is a single element of a parsed 'statusline'. Like Vim's, a format is literal text
+// mixed with %-items of the form %-0{minwid}.{maxwid}{item}.
+type statusItem struct {
+	literal string // Set for literal text, in which case the other fields are unused.
+
+	item      byte   // The item char, e.g. 'f' for the file name. '{' for a named value.
+	name      string // The name of the value for %{name} items.
+	leftAlign bool   // Pad on the right rather than the left ("-" flag).
+	zeroPad   bool   // Pad numbers with zeros rather than spaces ("0" flag).
+	minWidth  int
+	maxWidth  int // 0 means no limit.
+}
+
+// Items that are supported in a 'statusline', and what they are replaced with:
+//
+//	%f  file path, as given     %F  full file path          %t  file name without directories
+//	%m  "[+]" if modified       %M  ",+" if modified        %r  "[RO]" if readonly
+//	%R  ",RO" if readonly       %y  "[filetype]"            %Y  "FILETYPE"
+//	%l  line number             %L  number of lines         %c  column number (bytes)
+//	%v  display column number   %p  percentage through file %P  "Top", "Bot", "All" or "NN%"
+//	%n  buffer number           %=  separation point        %<  where to truncate if too long
+//	%%  a literal "%"           %{name}  one of the named values below
+//
+// %m and %M are "[-]" and ",-" instead if 'modifiable' is off. Named values: mode, fileencoding
+// (fenc), fileformat (ff) and filetype (ft).
+const cStatusItems = "fFtmMrRyYlLcvpPn=<"
+
+// Parse a 'statusline' format string.
+func parseStatusLine(format string) ([]statusItem, error) {
+	items := []statusItem{}
+	literal := strings.Builder{}
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			items = append(items, statusItem{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		item := statusItem{}
+		for ; i < len(format) && (format[i] == '-' || format[i] == '0'); i++ {
+			if format[i] == '-' {
+				item.leftAlign = true
+			} else {
+				item.zeroPad = true
+			}
+		}
+		item.minWidth, i = parseNumberAt(format, i)
+		if i < len(format) && format[i] == '.' {
+			item.maxWidth, i = parseNumberAt(format, i+1)
+		}
+		if i >= len(format) {
+			return nil, fmt.Errorf("missing item after %% at end of statusline")
+		}
+		item.item = format[i]
+		switch {
+		case item.item == '{':
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("missing } in statusline: %s", format[i:])
+			}
+			item.name = format[i+1 : i+end]
+			if _, ok := statusNamedValues[item.name]; !ok {
+				return nil, fmt.Errorf("unknown statusline value: %%{%s}", item.name)
+			}
+			i += end
+		case strings.IndexByte(cStatusItems, item.item) < 0:
+			return nil, fmt.Errorf("unknown statusline item: %%%c", item.item)
+		}
+		flushLiteral()
+		items = append(items, item)
+	}
+	flushLiteral()
+	return items, nil
+}
+
+// Parses the digits at s[i:], returning the number and the index after it.
+func parseNumberAt(s string, i int) (int, int) {
+	start := i
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[start:i])
+	return n, i
+}
+
+// Values for %{name} items, with their short aliases.
+var statusNamedValues = map[string]func(e *editorImpl) string{
+	"mode":         func(e *editorImpl) string { return string(e.mode) },
+	"fileencoding": func(e *editorImpl) string { return e.bufOpts.fileencoding },
+	"fenc":         func(e *editorImpl) string { return e.bufOpts.fileencoding },
+	"fileformat":   func(e *editorImpl) string { return e.bufOpts.fileformat },
+	"ff":           func(e *editorImpl) string { return e.bufOpts.fileformat },
+	"filetype":     func(e *editorImpl) string { return e.bufOpts.filetype },
+	"ft":           func(e *editorImpl) string { return e.bufOpts.filetype },
+}
+
+// Render the status line to exactly width columns.
+func (e *editorImpl) renderStatusLine(width int) string {
+	items, err := parseStatusLine(e.winOpts.statusline)
+	if err != nil {
+		// The format is validated when it's set, so this is only reachable for the default.
+		return err.Error()
+	}
+	// Sections are separated by %= items, and the free space is shared between the separators.
+	sections := []string{""}
+	truncateAt := -1
+	for _, item := range items {
+		if item.literal != "" {
+			sections[len(sections)-1] += item.literal
+			continue
+		}
+		switch item.item {
+		case '=':
+			sections = append(sections, "")
+			continue
+		case '<':
+			if len(sections) == 1 {
+				truncateAt = len(sections[0])
+			}
+			continue
+		}
+		sections[len(sections)-1] += item.format(e.statusItemValue(item))
+	}
+
+	total := 0
+	for _, s := range sections {
+		total += len(s)
+	}
+	if total > width {
+		// Too long: drop chars from the truncation point (or the start) and mark it with "<".
+		line := strings.Join(sections, "")
+		if truncateAt < 0 {
+			truncateAt = 0
+		}
+		cut := total - width + 1
+		if truncateAt+cut > len(line) {
+			return line[:width]
+		}
+		return line[:truncateAt] + "<" + line[truncateAt+cut:]
+	}
+	line := strings.Builder{}
+	free, gaps := width-total, len(sections)-1
+	for i, s := range sections {
+		line.WriteString(s)
+		if i < gaps {
+			// Earlier gaps take any remainder.
+			fill := free / gaps
+			if i < free%gaps {
+				fill++
+			}
+			line.WriteString(strings.Repeat(" ", fill))
+		}
+	}
+	if gaps == 0 {
+		line.WriteString(strings.Repeat(" ", free))
+	}
+	return line.String()
+}
+
+// The text a %-item expands to, before padding and truncation.
+func (e *editorImpl) statusItemValue(item statusItem) string {
+	numLines := len(e.fileContents)
+	lineNum := e.getCurrLineInd() + 1
+	switch item.item {
+	case '{':
+		return statusNamedValues[item.name](e)
+	case 'f':
+		return e.filePath
+	case 'F':
+		if abs, err := filepath.Abs(e.filePath); err == nil {
+			return abs
+		}
+		return e.filePath
+	case 't':
+		return filepath.Base(e.filePath)
+	case 'm':
+		if !e.bufOpts.modifiable {
+			return "[-]"
+		}
+		return flagIf(e.modified, "[+]")
+	case 'M':
+		if !e.bufOpts.modifiable {
+			return ",-"
+		}
+		return flagIf(e.modified, ",+")
+	case 'r':
+		return flagIf(e.bufOpts.readonly, "[RO]")
+	case 'R':
+		return flagIf(e.bufOpts.readonly, ",RO")
+	case 'y':
+		return flagIf(e.bufOpts.filetype != "", "["+e.bufOpts.filetype+"]")
+	case 'Y':
+		return strings.ToUpper(e.bufOpts.filetype)
+	case 'l':
+		return strconv.Itoa(lineNum)
+	case 'L':
+		return strconv.Itoa(numLines)
+	case 'c':
+		_, x := e.activeEditorMode.GetCursorYX()
+		return strconv.Itoa(x + 1)
+	case 'v':
+		_, x := e.activeEditorMode.GetCursorYX()
+		return strconv.Itoa(e.displayCol(e.fileContents[e.getCurrLineInd()], x) + 1)
+	case 'p':
+		return strconv.Itoa(lineNum * 100 / max(numLines, 1))
+	case 'P':
+		rows, truncated := e.getDisplayLines()
+		atTop := e.fileLineOffset == 0
+		atBottom := !truncated && (len(rows) == 0 || rows[len(rows)-1].lineInd == numLines-1)
+		switch {
+		case atTop && atBottom:
+			return "All"
+		case atTop:
+			return "Top"
+		case atBottom:
+			return "Bot"
+		}
+		return fmt.Sprintf("%d%%", e.fileLineOffset*100/max(numLines, 1))
+	case 'n':
+		n := slices.Index(e.buffers, e.buffer)
+		if n < 0 {
+			// The quickfix list's buffer isn't one of the editor's buffers, so it has no number.
+			return ""
+		}
+		return strconv.Itoa(n + 1)
+	}
+	return ""
+}
+
+// Apply the item's width flags to its value.
+func (item statusItem) format(value string) string {
+	if item.maxWidth > 0 && len(value) > item.maxWidth {
+		// Like Vim, truncate on the left and mark it with "<".
+		value = "<" + value[len(value)-item.maxWidth+1:]
+	}
+	if len(value) >= item.minWidth {
+		return value
+	}
+	pad := item.minWidth - len(value)
+	if item.leftAlign {
+		return value + strings.Repeat(" ", pad)
+	}
+	if _, err := strconv.Atoi(value); err == nil && item.zeroPad {
+		return strings.Repeat("0", pad) + value
+	}
+	return strings.Repeat(" ", pad) + value
+}
+
+func flagIf(set bool, flag string) string {
+	if set {
+		return flag
+	}
+	return ""
+}
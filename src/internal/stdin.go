@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// `gim -` edits text read from stdin, like `vim -`, e.g. `git log | gim -`. Keys are then read from
+// the terminal, which cmd.Main opens itself. The buffer has no file until `:w {file}` writes it to
+// one, which it then shows. When stdout isn't a terminal, e.g. in `ls | gim - | sort`, `:w` writes
+// the buffer to stdout instead, once gim quits, so the last one written goes on down the pipeline.
+// :cq quits without writing anything to stdout.
+
+const (
+	cStdinPath       = "-"
+	cStdinBufferName = "[stdin]"
+)
+
+// Read stdin into a new buffer, starting with the given options. The filetype is guessed from the
+// text, since there is no file name.
+func newStdinBuffer(opts bufferOptions) (*buffer, error) {
+	contents, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	fileContents, lengthBytes, encoding := splitFileContents(contents)
+	fileContents, fileFormat := detectFileFormat(fileContents)
+	b := &buffer{
+		filePath:     cStdinBufferName,
+		fileContents: fileContents,
+		lengthBytes:  lengthBytes,
+		stdin:        true,
+		bufOpts:      opts,
+	}
+	b.bufOpts.filetype = detectContentFiletype(fileContents)
+	if setOptions, ok := filetypeOptions[b.bufOpts.filetype]; ok {
+		setOptions(&b.bufOpts)
+	}
+	b.bufOpts.fileencoding = encoding
+	b.bufOpts.fileformat = fileFormat
+	return b, nil
+}
+
+// Whether stdout is a terminal, rather than e.g. a pipe or a file.
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// The terminal the screen is drawn on, for escape sequences that ncurses doesn't send: stdout, unless
+// it isn't a terminal, when the screen is drawn on /dev/tty instead.
+var terminalOutput = sync.OnceValue(func() *os.File {
+	if stdoutIsTerminal() {
+		return os.Stdout
+	}
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		return tty
+	}
+	return os.Stdout
+})
+
+// Keep the stdin buffer's text to write to stdout when quitting, for :w.
+func (e *editorImpl) writeToStdout() error {
+	if stdoutIsTerminal() {
+		return errors.New("no file name")
+	}
+	e.stdoutText = e.bufferBytes()
+	e.markWritten()
+	e.infof("%d bytes written to stdout when quitting", len(e.stdoutText))
+	return nil
+}
+
+// Write what :w last wrote from the stdin buffer to stdout.
+func (e *editorImpl) flushStdout() {
+	if e.stdoutText != nil {
+		os.Stdout.Write(e.stdoutText)
+		e.stdoutText = nil
+	}
+}
+
+// Write the buffer to the file at path, for `:w {file}`. The stdin buffer then shows the file, while
+// other buffers are only copied to it.
+func (e *editorImpl) writeToFile(path string) error {
+	if buf := e.findBuffer(path); buf == e.buffer {
+		return e.writeToDisc()
+	}
+	if !e.stdin {
+		contents := e.bufferBytes()
+		if err := os.WriteFile(path, contents, cReadWriteFileMode); err != nil {
+			return err
+		}
+		e.infof("%d bytes written to %s", len(contents), path)
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, cReadWriteFileMode)
+	if err != nil {
+		return err
+	}
+	e.file, e.filePath, e.stdin = file, path, false
+	if e.bufOpts.filetype == "" {
+		e.bufOpts.filetype = detectFiletype(path)
+	}
+	return e.writeToDisc()
+}
+
+// Guess the filetype of text that has no file name, e.g. a diff piped from git.
+func detectContentFiletype(lines []string) string {
+	if strings.HasPrefix(lines[0], "diff ") || strings.HasPrefix(lines[0], "--- ") {
+		return cDiffFiletype
+	}
+	return ""
+}
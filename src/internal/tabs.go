@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// Tab pages each have their own windows, laid out as in window.go. Only the current tab page is shown,
+// and while there are several, a tab line at the top of the screen lists them.
+//
+//	:tabnew [file], :tabedit [file], :tabe [file]
+//	                     open a new tab page after the current one, showing the file (default the
+//	                     current buffer)
+//	:tabclose, :tabc     close the tab page
+//	:tabonly, :tabo      close all other tab pages
+//	:tabnext, :tabn      go to the next tab page, wrapping around
+//	:tabprevious, :tabp  go to the previous tab page (also :tabNext and :tabN)
+//	gt, gT               like :tabnext and :tabprevious; {count}gt goes to the count'th tab page
+//	:q                   in the last window of a tab page, close the tab page
+
+// tabPage is the windows of a tab page, as they were left when it stopped being the current one. The
+// current tab page's windows are the editor's.
+type tabPage struct {
+	windows        []*window
+	window         *window
+	previousWindow *window
+}
+
+// The number of rows at the top of the screen that the tab line takes.
+func (e *editorImpl) tabLineRows() int {
+	if len(e.tabs) > 1 {
+		return 1
+	}
+	return 0
+}
+
+// Keep the windows of the current tab page in its tabPage, before another becomes current.
+func (e *editorImpl) saveTabPage() {
+	tab := e.tabs[e.tabIndex]
+	tab.windows, tab.window, tab.previousWindow = e.windows, e.window, e.previousWindow
+}
+
+// Make the ith tab page the current one.
+func (e *editorImpl) gotoTabPage(i int) {
+	if i == e.tabIndex {
+		return
+	}
+	e.closeUndoStep()
+	e.saveTabPage()
+	e.tabIndex = i
+	tab := e.tabs[i]
+	e.windows, e.window, e.previousWindow = tab.windows, tab.window, tab.previousWindow
+	e.clampCursor()
+	e.layoutWindows()
+}
+
+// Open a tab page after the current one with a window showing buf, and go to it.
+func (e *editorImpl) newTabPage(buf *buffer) {
+	e.closeUndoStep()
+	e.saveTabPage()
+	w := newWindow(buf, e.winOpts)
+	if buf == e.buffer {
+		w.cursorY, w.cursorX, w.fileLineOffset, w.leftCol = e.cursorY, e.cursorX, e.fileLineOffset, e.leftCol
+	}
+	e.tabIndex++
+	e.tabs = append(e.tabs[:e.tabIndex], append([]*tabPage{{}}, e.tabs[e.tabIndex:]...)...)
+	e.windows, e.window, e.previousWindow = []*window{w}, w, nil
+	// The window takes all rows, which layoutWindows works out now that the tab line may be shown.
+	e.layoutWindows()
+	e.scrollToCursor()
+}
+
+// Close the ith tab page. The one after it becomes current if it was, or the one before if it was the
+// last.
+func (e *editorImpl) closeTabPage(i int) error {
+	if len(e.tabs) == 1 {
+		return errors.New("can't close the last tab page")
+	}
+	if i == e.tabIndex {
+		next := i + 1
+		if next == len(e.tabs) {
+			next = i - 1
+		}
+		e.gotoTabPage(next)
+	}
+	e.tabs = append(e.tabs[:i], e.tabs[i+1:]...)
+	if e.tabIndex > i {
+		e.tabIndex--
+	}
+	e.layoutWindows()
+	return nil
+}
+
+// Close all tab pages but the current one.
+func (e *editorImpl) onlyTabPage() {
+	e.tabs = []*tabPage{e.tabs[e.tabIndex]}
+	e.tabIndex = 0
+	e.layoutWindows()
+}
+
+// Go to the tab page n after the current one, or before it if n is negative, wrapping around.
+func (e *editorImpl) moveToTabPage(n int) {
+	e.gotoTabPage(((e.tabIndex+n)%len(e.tabs) + len(e.tabs)) % len(e.tabs))
+}
+
+// Handle gt and gT. With a count, gt goes to that tab page, and gT goes back that many.
+func (e *editorImpl) tabPageKey(forward bool, rawCount int) error {
+	switch {
+	case forward && rawCount > 0:
+		if rawCount > len(e.tabs) {
+			return errBell
+		}
+		e.gotoTabPage(rawCount - 1)
+	case forward:
+		e.moveToTabPage(1)
+	default:
+		e.moveToTabPage(-max(rawCount, 1))
+	}
+	return nil
+}
+
+// Run a tab page command, e.g. :tabnew.
+func (e *editorImpl) tabPageCommand(name string, args string) error {
+	switch name {
+	case "tabnew", "tabedit", "tabe":
+		buf := e.buffer
+		if args != "" {
+			var err error
+			if buf, err = e.loadBuffer(args); err != nil {
+				return err
+			}
+		}
+		e.newTabPage(buf)
+		return nil
+	case "tabclose", "tabc":
+		return e.closeTabPage(e.tabIndex)
+	case "tabonly", "tabo":
+		e.onlyTabPage()
+		return nil
+	case "tabnext", "tabn":
+		if args != "" {
+			n, err := strconv.Atoi(args)
+			if err != nil || n < 1 || n > len(e.tabs) {
+				return errors.New("invalid argument: " + args)
+			}
+			e.gotoTabPage(n - 1)
+			return nil
+		}
+		e.moveToTabPage(1)
+		return nil
+	case "tabprevious", "tabp", "tabNext", "tabN":
+		n := 1
+		if args != "" {
+			var err error
+			if n, err = strconv.Atoi(args); err != nil || n < 1 {
+				return errors.New("invalid argument: " + args)
+			}
+		}
+		e.moveToTabPage(-n)
+		return nil
+	}
+	return errors.New("unrecognized command: " + name)
+}
+
+// Draw the tab line, with a label for each tab page naming the buffer of its current window. The
+// current tab page's label is bold, and the others are reversed like the rest of the line.
+func (e *editorImpl) drawTabLine(screen *gc.Window) {
+	e.saveTabPage()
+	_, maxX := screen.MaxYX()
+	screen.Move(0, 0)
+	screen.AttrOn(gc.A_REVERSE)
+	screen.Print(strings.Repeat(" ", maxX))
+	screen.AttrOff(gc.A_REVERSE)
+	screen.Move(0, 0)
+	col := 0
+	for i := range e.tabs {
+		label := e.tabLabel(i)
+		if col+len(label) > maxX {
+			label = label[:maxX-col]
+		}
+		attrs := gc.Char(gc.A_REVERSE)
+		if i == e.tabIndex {
+			attrs = gc.A_BOLD
+		}
+		screen.AttrOn(attrs)
+		screen.Print(label)
+		screen.AttrOff(attrs)
+		col += len(label)
+		if col >= maxX {
+			break
+		}
+	}
+}
+
+// The label of the ith tab page on the tab line: its number and the file of its current window.
+func (e *editorImpl) tabLabel(i int) string {
+	w := e.tabs[i].window
+	label := " " + strconv.Itoa(i+1) + " " + displayPath(w.filePath)
+	if w.modified {
+		label += " +"
+	}
+	return label + " "
+}
+
+// The tab page whose label is at column x of the tab line, or -1 if there is none there.
+func (e *editorImpl) tabPageAt(x int) int {
+	e.saveTabPage()
+	col := 0
+	for i := range e.tabs {
+		col += len(e.tabLabel(i))
+		if x < col {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// A terminal buffer runs a program in a pseudo-terminal, and shows its screen, like Vim's :terminal.
+// What the program writes is interpreted by a terminal emulator (see vt.go), and the buffer's lines
+// are the emulator's scrollback followed by its screen.
+//
+//	:terminal [cmd], :term [cmd]
+//	                 run cmd with 'shell', or 'shell' itself, in a new window, in TERMINAL mode
+//
+// In TERMINAL mode keys are sent to the program, except:
+//
+//	CTRL-\ CTRL-N    go to NORMAL mode, to scroll through the output, search it and yank from it
+//	CTRL-W {cmd}     a window command, e.g. CTRL-W w to go to the next window
+//	CTRL-W .         send CTRL-W to the program
+//
+// In NORMAL mode, i, a, I and A go back to TERMINAL mode. When the program exits, the buffer keeps
+// what was last shown. The window's size is the terminal's, and a resized window resizes it.
+
+const cTerminalFiletype = "terminal"
+
+// terminal is the state of a terminal buffer's program.
+type terminal struct {
+	pty    *os.File // The pseudo-terminal's master side.
+	cmd    *exec.Cmd
+	vt     *vtScreen
+	exited bool
+}
+
+// Run command with 'shell' in a terminal buffer, shown in a new window above the current one, or run
+// 'shell' itself if command is empty.
+func (e *editorImpl) openTerminal(command string) error {
+	argv, name := []string{e.globalOpts.shell}, e.globalOpts.shell
+	if command != "" {
+		argv, name = append(argv, "-c", command), command
+	}
+	opts := e.defaultBufOpts
+	// The lines are the emulator's, which would write over any changes.
+	opts.filetype, opts.readonly, opts.modifiable = cTerminalFiletype, true, false
+	buf := &buffer{filePath: "!" + name, fileContents: []string{""}, bufOpts: opts}
+	if err := e.splitWindow(buf, 0, false); err != nil {
+		return err
+	}
+	t := &terminal{}
+	rows, cols := e.height, e.getTextWidth()
+	t.vt = newVTScreen(rows, cols, func(s string) { t.pty.WriteString(s) })
+	// Programs are told the terminal is an xterm, which is what the emulator understands.
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "TERM=") {
+			env = append(env, kv)
+		}
+	}
+	pty, cmd, err := startInPty(argv, append(env, "TERM=xterm"), rows, cols)
+	if err != nil {
+		e.closeWindow(e.window)
+		return err
+	}
+	t.pty, t.cmd = pty, cmd
+	buf.term = t
+	e.buffers = append(e.buffers, buf)
+	e.swapEditorMode(TERMINAL_MODE)
+
+	e.runInBackground(func() func() {
+		chunk := make([]byte, 4096)
+		for {
+			n, err := pty.Read(chunk)
+			if n > 0 {
+				data := bytes.Clone(chunk[:n])
+				e.events <- func() { e.terminalOutput(buf, data) }
+			}
+			if err != nil {
+				// EIO once the program, and anything it started, closed the terminal.
+				break
+			}
+		}
+		err := cmd.Wait()
+		return func() { e.terminalExited(buf, err) }
+	})
+	return nil
+}
+
+// Show what a terminal buffer's program wrote.
+func (e *editorImpl) terminalOutput(buf *buffer, data []byte) {
+	buf.term.vt.write(data)
+	e.updateTerminalBuffer(buf)
+}
+
+// Set a terminal buffer's lines from its emulator. The windows showing it follow its cursor, except
+// the current window outside of TERMINAL mode, where the user may be looking through the output.
+func (e *editorImpl) updateTerminalBuffer(buf *buffer) {
+	v := buf.term.vt
+	lines := make([]string, 0, len(v.scrollback)+v.rows)
+	lines = append(append(lines, v.scrollback...), v.lines()...)
+	// Like the quickfix buffer, the buffer is replaced rather than changed, and has no undo history.
+	buf.fileContents = lines
+	buf.undoSteps, buf.undoIndex, buf.pendingUndo = nil, 0, nil
+	buf.changedTick++
+	current := e.window
+	for _, w := range e.windows {
+		if w.buffer != buf {
+			continue
+		}
+		e.withWindow(w, func() {
+			if w == current && e.mode != TERMINAL_MODE {
+				e.clampCursor()
+				return
+			}
+			e.followTerminal()
+		})
+	}
+}
+
+// Put the current window's view and cursor where the terminal's screen and cursor are.
+func (e *editorImpl) followTerminal() {
+	v := e.term.vt
+	e.fileLineOffset, e.cursorY = len(v.scrollback), v.cursor.row
+	line := e.fileContents[e.getCurrLineInd()]
+	x := 0
+	for range v.cursor.col {
+		_, size := utf8.DecodeRuneInString(line[x:])
+		x += size
+	}
+	e.cursorX = min(x, len(line))
+}
+
+// A terminal buffer's program exited.
+func (e *editorImpl) terminalExited(buf *buffer, err error) {
+	t := buf.term
+	t.exited = true
+	t.pty.Close()
+	if e.buffer == buf && e.mode == TERMINAL_MODE {
+		e.swapEditorMode(NORMAL_MODE)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		e.infof("%s finished", buf.filePath)
+	case errors.As(err, &exitErr):
+		e.infof("%s exited with status %d", buf.filePath, exitErr.ExitCode())
+	default:
+		e.reportError(err)
+	}
+}
+
+// Resize the terminals of the windows that changed size. A terminal shown in several windows takes
+// the size of the smallest.
+func (e *editorImpl) resizeTerminals() {
+	sizes := map[*buffer][2]int{}
+	for _, w := range e.windows {
+		if w.term == nil || w.term.exited {
+			continue
+		}
+		size := [2]int{w.height, 0}
+		e.withWindow(w, func() { size[1] = e.getTextWidth() })
+		if other, ok := sizes[w.buffer]; ok {
+			size = [2]int{min(size[0], other[0]), min(size[1], other[1])}
+		}
+		sizes[w.buffer] = size
+	}
+	for buf, size := range sizes {
+		t := buf.term
+		if size == [2]int{t.vt.rows, t.vt.cols} {
+			continue
+		}
+		t.vt.resize(size[0], size[1])
+		if err := setPtySize(t.pty, t.vt.rows, t.vt.cols); err != nil {
+			e.reportError(err)
+		}
+		e.updateTerminalBuffer(buf)
+	}
+}
+
+// The attributes of the char at the byte offset x of the line at lineInd of a terminal buffer, as the
+// program last drew it. Lines in the scrollback have none.
+func (b *buffer) terminalAttrs(lineInd int, x int) gc.Char {
+	line := b.fileContents[lineInd]
+	return b.term.vt.attrsAt(lineInd-len(b.term.vt.scrollback), utf8.RuneCountInString(line[:min(x, len(line))]))
+}
+
+// Stop the programs of terminal buffers, when quitting.
+func (e *editorImpl) stopTerminals() {
+	for _, buf := range e.buffers {
+		if t := buf.term; t != nil && !t.exited {
+			// Closing the terminal hangs up on the program, but it, or the jobs it started, may not listen.
+			t.pty.Close()
+			killPtySession(t.cmd)
+		}
+	}
+}
+
+// Send what a key types to a terminal's program.
+func (t *terminal) send(s string) error {
+	_, err := t.pty.WriteString(s)
+	return err
+}
+
+// Read keys raw, so that e.g. CTRL-C and CTRL-Z go to a terminal's program rather than signal the
+// editor, or read them as usual.
+func setRawInput(raw bool) {
+	gc.Raw(raw)
+	if !raw {
+		gc.CBreak(true)
+	}
+}
+
+// Handle a key in NORMAL mode in a terminal buffer. Returns false if it isn't one of the terminal's
+// keys, so it should be handled as usual.
+func (e *editorImpl) terminalKey(k string) (bool, error) {
+	switch k {
+	case "i", "a", "I", "A":
+		if e.term.exited {
+			return false, nil
+		}
+		e.followTerminal()
+		e.swapEditorMode(TERMINAL_MODE)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	gc "github.com/gbin/goncurses"
+)
+
+func newTerminalEditorMode(baseEditor *editorImpl) *terminalModeEditor {
+	return &terminalModeEditor{editorImpl: baseEditor}
+}
+
+// terminalModeEditor sends keys to the program of the current window's terminal buffer. See
+// terminal.go.
+type terminalModeEditor struct {
+	*editorImpl
+
+	// CTRL-\ or CTRL-W, while waiting for the key after it.
+	pendingKey string
+}
+
+// The bytes that xterm sends for special keys. Cursor keys send ESC O rather than ESC [ when the
+// program asks for application cursor keys.
+var terminalKeySequences = map[gc.Key]string{
+	gc.KEY_RETURN:    "\r",
+	gc.KEY_BACKSPACE: DELETE_KEY,
+	gc.KEY_UP:        "\x1b[A",
+	gc.KEY_DOWN:      "\x1b[B",
+	gc.KEY_RIGHT:     "\x1b[C",
+	gc.KEY_LEFT:      "\x1b[D",
+	gc.KEY_HOME:      "\x1b[H",
+	gc.KEY_END:       "\x1b[F",
+	gc.KEY_IC:        "\x1b[2~",
+	gc.KEY_DC:        "\x1b[3~",
+	gc.KEY_PAGEUP:    "\x1b[5~",
+	gc.KEY_PAGEDOWN:  "\x1b[6~",
+	gc.KEY_F1:        "\x1bOP",
+	gc.KEY_F2:        "\x1bOQ",
+	gc.KEY_F3:        "\x1bOR",
+	gc.KEY_F4:        "\x1bOS",
+	gc.KEY_F5:        "\x1b[15~",
+	gc.KEY_F6:        "\x1b[17~",
+	gc.KEY_F7:        "\x1b[18~",
+	gc.KEY_F8:        "\x1b[19~",
+	gc.KEY_F9:        "\x1b[20~",
+	gc.KEY_F10:       "\x1b[21~",
+	gc.KEY_F11:       "\x1b[23~",
+	gc.KEY_F12:       "\x1b[24~",
+}
+
+func (te *terminalModeEditor) Handle(key gc.Key) error {
+	k := gc.KeyString(key)
+	t := te.term
+	pending := te.pendingKey
+	te.pendingKey = ""
+	switch pending {
+	case CTRL_BACKSLASH_KEY:
+		if k == CTRL_N_KEY {
+			te.swapEditorMode(NORMAL_MODE)
+			return nil
+		}
+		if err := t.send(CTRL_BACKSLASH_KEY); err != nil {
+			return err
+		}
+	case CTRL_W_KEY:
+		if k == "." {
+			return t.send(CTRL_W_KEY)
+		}
+		err := te.windowCommand(k)
+		if te.term == nil || te.term.exited {
+			// The window command went to another window.
+			te.swapEditorMode(NORMAL_MODE)
+		} else {
+			te.followTerminal()
+		}
+		return err
+	default:
+		if k == CTRL_BACKSLASH_KEY || k == CTRL_W_KEY {
+			te.pendingKey = k
+			return nil
+		}
+	}
+	if seq, ok := terminalKeySequences[key]; ok {
+		if t.vt.appCursorKeys && len(seq) == 3 && seq[1] == '[' && seq[2] >= 'A' && seq[2] <= 'D' {
+			seq = "\x1bO" + seq[2:]
+		}
+		return t.send(seq)
+	}
+	if key >= 0x100 {
+		return errBell
+	}
+	return t.send(string([]byte{byte(key)}))
+}
+
+func (te *terminalModeEditor) GetCursorYX() (int, int) {
+	// The cursor may be past the end of the line, where the program will write next.
+	return te.cursorY, min(te.cursorX, len(te.fileContents[te.getCurrLineInd()]))
+}
+
+func (te *terminalModeEditor) AcceptsMappings() bool {
+	// Every key goes to the program as it was typed.
+	return false
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Returns the text selected by the text object for keys k, e.g. "iw", around the cursor. An "i"
+// object is the inner text, and an "a" object includes the surrounding white space or delimiters.
+// count selects more words, sentences or paragraphs, or outer brackets and tags. Supported are:
+//
+//	iw aw iW aW   words                 is as   sentences      ip ap   paragraphs
+//	i" a" i' a'   quoted strings        i` a`                  it at   tag blocks
+//	i( a( ib ab   () blocks             i[ a[   [] blocks      i< a<   <> blocks
+//	i{ a{ iB aB   {} blocks
+//
+// Returns errUnknownMotion if k isn't a text object, and errBell if there is no such object around
+// the cursor.
+func (e *editorImpl) textObject(k string, count int) (position, position, motionKind, error) {
+	pos := e.cursorPosition()
+	count = max(count, 1)
+	if len(k) != 2 || (k[0] != 'i' && k[0] != 'a') {
+		return pos, pos, exclusive, errUnknownMotion
+	}
+	inner := k[0] == 'i'
+	switch obj := k[1]; obj {
+	case 'w', 'W':
+		return e.wordObject(pos, inner, obj == 'W', count)
+	case 's':
+		return e.sentenceObject(pos, inner, count)
+	case 'p':
+		return e.paragraphObject(pos, inner, count)
+	case '"', '\'', '`':
+		return e.quoteObject(pos, obj, inner, count)
+	case 't':
+		return e.tagObject(pos, inner, count)
+	}
+	for _, pair := range []string{"()b", "[]", "{}B", "<>"} {
+		if strings.IndexByte(pair, k[1]) >= 0 {
+			return e.bracketObject(pos, pair[0], pair[1], inner, count)
+		}
+	}
+	return pos, pos, exclusive, errUnknownMotion
+}
+
+// The first and last index of the run of chars of the same class as line[col].
+func classRun(line string, col int, bigWord bool) (int, int) {
+	class := charClass(line[col], bigWord)
+	start, end := col, col
+	for start > 0 && charClass(line[start-1], bigWord) == class {
+		start--
+	}
+	for end+1 < len(line) && charClass(line[end+1], bigWord) == class {
+		end++
+	}
+	return start, end
+}
+
+// Words within the cursor's line. White space between words counts as a word for iw, and aw adds the
+// white space after the word, or before it if there is none after.
+func (e *editorImpl) wordObject(pos position, inner bool, bigWord bool, count int) (position, position, motionKind, error) {
+	line := e.fileContents[pos.line]
+	if len(line) == 0 {
+		return pos, pos, exclusive, errBell
+	}
+	start, end := classRun(line, pos.col, bigWord)
+	startsBlank := charClass(line[pos.col], bigWord) == blankClass
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			if end+1 >= len(line) {
+				break
+			}
+			_, end = classRun(line, end+1, bigWord)
+		}
+		if inner {
+			continue
+		}
+		// Add the white space, or the word after it when starting on white space.
+		switch {
+		case end+1 < len(line) && (startsBlank || charClass(line[end+1], bigWord) == blankClass):
+			_, end = classRun(line, end+1, bigWord)
+		case i == 0 && !startsBlank && start > 0 && charClass(line[start-1], bigWord) == blankClass:
+			start, _ = classRun(line, start-1, bigWord)
+		}
+	}
+	return position{pos.line, start}, position{pos.line, end}, inclusive, nil
+}
+
+func isBlankLine(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// The first and last line of the run of lines around lineInd that are all blank, or all not blank.
+func (e *editorImpl) lineBlock(lineInd int) (int, int) {
+	blank := isBlankLine(e.fileContents[lineInd])
+	start, end := lineInd, lineInd
+	for start > 0 && isBlankLine(e.fileContents[start-1]) == blank {
+		start--
+	}
+	for end+1 < len(e.fileContents) && isBlankLine(e.fileContents[end+1]) == blank {
+		end++
+	}
+	return start, end
+}
+
+// Paragraphs are separated by blank lines. For ip, a run of blank lines counts as a paragraph too, and
+// ap adds the blank lines after the paragraph, or before it if there are none after.
+func (e *editorImpl) paragraphObject(pos position, inner bool, count int) (position, position, motionKind, error) {
+	start, end := e.lineBlock(pos.line)
+	startsBlank := isBlankLine(e.fileContents[pos.line])
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			if end+1 >= len(e.fileContents) {
+				return pos, pos, linewise, errBell
+			}
+			_, end = e.lineBlock(end + 1)
+		}
+		if inner {
+			continue
+		}
+		switch {
+		case end+1 < len(e.fileContents):
+			_, end = e.lineBlock(end + 1)
+		case i == 0 && !startsBlank && start > 0:
+			start, _ = e.lineBlock(start - 1)
+		}
+	}
+	return position{start, 0}, position{end, 0}, linewise, nil
+}
+
+// sentence is a sentence in a paragraph, as offsets into the paragraph's text.
+type sentence struct {
+	start, end int // The first and last char of the sentence.
+	blankEnd   int // The last char of the white space after it. blankEnd == end if there is none.
+}
+
+// A sentence ends at a '.', '!' or '?' that is followed by the end of the line or white space, with
+// any closing brackets or quotes in between. Paragraphs also end sentences.
+func (e *editorImpl) sentenceObject(pos position, inner bool, count int) (position, position, motionKind, error) {
+	if isBlankLine(e.fileContents[pos.line]) {
+		return pos, pos, exclusive, errBell
+	}
+	// Sentences are found in the text of the paragraph, with a "\n" between lines.
+	first, last := e.lineBlock(pos.line)
+	text := strings.Join(e.fileContents[first:last+1], "\n")
+	toPosition := func(offset int) position {
+		line := first
+		for offset > len(e.fileContents[line]) {
+			offset -= len(e.fileContents[line]) + 1
+			line++
+		}
+		return position{line, offset}
+	}
+	cursor := pos.col
+	for line := first; line < pos.line; line++ {
+		cursor += len(e.fileContents[line]) + 1
+	}
+
+	isBlank := func(i int) bool { return charClass(text[i], false) == blankClass }
+	sentences := []sentence{}
+	for i := 0; i < len(text); {
+		for i < len(text) && isBlank(i) {
+			i++
+		}
+		if i == len(text) {
+			break
+		}
+		s := sentence{start: i, end: len(text) - 1}
+		for j := i; j < len(text); j++ {
+			if strings.IndexByte(".!?", text[j]) < 0 {
+				continue
+			}
+			k := j + 1
+			for k < len(text) && strings.IndexByte(`)]"'`, text[k]) >= 0 {
+				k++
+			}
+			if k == len(text) || isBlank(k) {
+				s.end = k - 1
+				break
+			}
+		}
+		s.blankEnd = s.end
+		for s.blankEnd+1 < len(text) && isBlank(s.blankEnd+1) {
+			s.blankEnd++
+		}
+		sentences = append(sentences, s)
+		i = s.blankEnd + 1
+	}
+
+	ind := 0
+	for ind+1 < len(sentences) && sentences[ind].blankEnd < cursor {
+		ind++
+	}
+	lastInd := min(ind+count-1, len(sentences)-1)
+	start, end := sentences[ind].start, sentences[lastInd].end
+	if !inner {
+		if sentences[lastInd].blankEnd > end {
+			end = sentences[lastInd].blankEnd
+		} else if ind > 0 {
+			// No white space after the sentence, so take the white space before it.
+			start = sentences[ind-1].end + 1
+		}
+	}
+	return toPosition(start), toPosition(end), inclusive, nil
+}
+
+// Quoted strings within the cursor's line. A quote escaped by a backslash doesn't count. If the cursor
+// isn't inside quotes, the first quoted string after it is used. a" adds the white space after the
+// closing quote, or before the opening quote if there is none after. With a count of 2 or more, i"
+// includes the quotes but no white space.
+func (e *editorImpl) quoteObject(pos position, quote byte, inner bool, count int) (position, position, motionKind, error) {
+	line := e.fileContents[pos.line]
+	quotes := []int{}
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == quote {
+			quotes = append(quotes, i)
+		}
+	}
+	open, close := -1, -1
+	for i, q := range quotes {
+		if q == pos.col {
+			// On a quote, it's an opening or a closing quote depending on how many come before it.
+			if i%2 == 0 && i+1 < len(quotes) {
+				open, close = q, quotes[i+1]
+			} else if i%2 == 1 {
+				open, close = quotes[i-1], q
+			}
+			break
+		}
+		if q > pos.col {
+			if i > 0 {
+				open, close = quotes[i-1], q
+			} else if i+1 < len(quotes) {
+				open, close = q, quotes[i+1]
+			}
+			break
+		}
+	}
+	if open < 0 {
+		return pos, pos, exclusive, errBell
+	}
+	if inner && count < 2 {
+		return position{pos.line, open + 1}, position{pos.line, close}, exclusive, nil
+	}
+	start, end := open, close
+	if !inner {
+		if end+1 < len(line) && charClass(line[end+1], false) == blankClass {
+			_, end = classRun(line, end+1, false)
+		} else if start > 0 && charClass(line[start-1], false) == blankClass {
+			start, _ = classRun(line, start-1, false)
+		}
+	}
+	return position{pos.line, start}, position{pos.line, end}, inclusive, nil
+}
+
+// Blocks between open and close brackets, which may span lines and be nested. count selects outer
+// blocks. Like Vim, when the open bracket ends its line and the close bracket starts its line, the
+// inner block is the whole lines between them.
+func (e *editorImpl) bracketObject(pos position, open byte, close byte, inner bool, count int) (position, position, motionKind, error) {
+	start := pos
+	if e.charAt(pos) == close {
+		// Start inside the block that the bracket closes.
+		if prev, ok := e.prevPosition(pos); ok {
+			start = prev
+		}
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			// The next outer block starts before this one.
+			prev, ok := e.prevPosition(start)
+			if !ok {
+				return pos, pos, exclusive, errBell
+			}
+			start = prev
+		}
+		openPos, ok := e.findUnmatched(start, open, close, false /*forward*/)
+		if !ok {
+			return pos, pos, exclusive, errBell
+		}
+		start = openPos
+	}
+	openPos := start
+	afterOpen, _ := e.nextPosition(openPos)
+	closePos, ok := e.findUnmatched(afterOpen, close, open, true /*forward*/)
+	if !ok {
+		return pos, pos, exclusive, errBell
+	}
+	if !inner {
+		return openPos, closePos, inclusive, nil
+	}
+	openEndsLine := openPos.col == len(e.fileContents[openPos.line])-1
+	closeStartsLine := strings.TrimSpace(e.fileContents[closePos.line][:closePos.col]) == ""
+	if openEndsLine && closeStartsLine && closePos.line > openPos.line {
+		if closePos.line == openPos.line+1 {
+			// Nothing between the brackets.
+			return afterOpen, afterOpen, exclusive, nil
+		}
+		return position{openPos.line + 1, 0}, position{closePos.line - 1, 0}, linewise, nil
+	}
+	if openEndsLine {
+		afterOpen = position{openPos.line + 1, 0}
+	}
+	return afterOpen, closePos, exclusive, nil
+}
+
+// Search from pos for a target bracket that isn't matched by an other bracket on the way, e.g. the
+// "(" that a block starts with, searching backward from inside the block. pos itself is included.
+func (e *editorImpl) findUnmatched(pos position, target byte, other byte, forward bool) (position, bool) {
+	depth := 0
+	for {
+		switch e.charAt(pos) {
+		case target:
+			if depth == 0 {
+				return pos, true
+			}
+			depth--
+		case other:
+			depth++
+		}
+		var ok bool
+		if forward {
+			pos, ok = e.nextPosition(pos)
+		} else {
+			pos, ok = e.prevPosition(pos)
+		}
+		if !ok {
+			return pos, false
+		}
+	}
+}
+
+// Matches an open or close tag, e.g. `<div class="x">` or `</div>`. Self-closing tags end with "/>".
+var tagRegexp = regexp.MustCompile(`<(/?)([A-Za-z][^\s>/]*)[^>]*?(/?)>`)
+
+// tagBlock is a pair of matching tags, as offsets into the file's text.
+type tagBlock struct {
+	openStart, openEnd   int // The offsets of the open tag's "<" and ">".
+	closeStart, closeEnd int // The offsets of the close tag's "<" and ">".
+}
+
+// Blocks between matching tags, e.g. "<b>bold</b>", which may span lines and be nested. count selects
+// outer blocks.
+func (e *editorImpl) tagObject(pos position, inner bool, count int) (position, position, motionKind, error) {
+	text := strings.Join(e.fileContents, "\n")
+	lineStarts := make([]int, len(e.fileContents))
+	for i := 1; i < len(e.fileContents); i++ {
+		lineStarts[i] = lineStarts[i-1] + len(e.fileContents[i-1]) + 1
+	}
+	toPosition := func(offset int) position {
+		line := len(lineStarts) - 1
+		for lineStarts[line] > offset {
+			line--
+		}
+		return position{line, offset - lineStarts[line]}
+	}
+	cursor := lineStarts[pos.line] + pos.col
+
+	// Pair the tags. An open tag without a close tag is dropped once an outer close tag is found.
+	type openTag struct {
+		name       string
+		start, end int
+	}
+	blocks := []tagBlock{}
+	stack := []openTag{}
+	for _, m := range tagRegexp.FindAllStringSubmatchIndex(text, -1) {
+		name := strings.ToLower(text[m[4]:m[5]])
+		switch {
+		case m[7] > m[6]:
+			// Self-closing.
+		case m[3] == m[2]:
+			stack = append(stack, openTag{name: name, start: m[0], end: m[1] - 1})
+		default:
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].name == name {
+					blocks = append(blocks, tagBlock{stack[i].start, stack[i].end, m[0], m[1] - 1})
+					stack = stack[:i]
+					break
+				}
+			}
+		}
+	}
+
+	// Blocks are added as their close tags are found, so inner blocks come before outer ones.
+	found := 0
+	for _, b := range blocks {
+		if b.openStart > cursor || b.closeEnd < cursor {
+			continue
+		}
+		found++
+		if found < count {
+			continue
+		}
+		if !inner {
+			return toPosition(b.openStart), toPosition(b.closeEnd), inclusive, nil
+		}
+		return toPosition(b.openEnd + 1), toPosition(b.closeStart), exclusive, nil
+	}
+	return pos, pos, exclusive, errBell
+}
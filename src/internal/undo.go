@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+)
+
+const (
+	// Max number of undo steps kept for each buffer. Older steps are dropped.
+	cMaxUndoSteps = 1000
+)
+
+// undoEntry is a single call to replaceLines: the lines from start that were replaced, and the lines
+// that replaced them.
+type undoEntry struct {
+	start    int
+	oldLines []string
+	newLines []string
+}
+
+// undoStep is everything that one command changed, which "u" undoes at once. Like ".", a command runs
+// from the start of a command in NORMAL mode until NORMAL mode is back to waiting for a new one. So an
+// insert is one step, and so is a :normal or a pasted block of text.
+type undoStep struct {
+	entries []undoEntry
+	cursor  position // Where the cursor was before the first change.
+}
+
+var (
+	errOldestChange = errors.New("already at oldest change")
+	errNewestChange = errors.New("already at newest change")
+)
+
+// Keep a change to the lines of the buffer in the step being built, so that it can be undone.
+func (e *editorImpl) recordUndo(start int, oldLines []string, newLines []string) {
+	if e.pendingUndo == nil {
+		e.pendingUndo = &undoStep{cursor: e.cursorPosition()}
+	}
+	e.pendingUndo.entries = append(e.pendingUndo.entries, undoEntry{
+		start:    start,
+		oldLines: slices.Clone(oldLines),
+		newLines: slices.Clone(newLines),
+	})
+}
+
+// Finish the step being built, if any, and add it to the undo history. Steps that were undone can no
+// longer be redone.
+func (e *editorImpl) closeUndoStep() {
+	if e.pendingUndo == nil {
+		return
+	}
+	if e.savedUndoIndex > e.undoIndex {
+		// The state that was written can no longer be reached.
+		e.savedUndoIndex = -1
+	}
+	e.undoSteps = append(e.undoSteps[:e.undoIndex], *e.pendingUndo)
+	e.pendingUndo = nil
+	if len(e.undoSteps) > cMaxUndoSteps {
+		e.undoSteps = e.undoSteps[1:]
+		e.savedUndoIndex--
+	}
+	e.undoIndex = len(e.undoSteps)
+}
+
+// Undo the last count steps, for "u".
+func (e *editorImpl) undo(count int) error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	e.closeUndoStep()
+	for i := 0; i < count; i++ {
+		if e.undoIndex == 0 {
+			if i == 0 {
+				return errOldestChange
+			}
+			break
+		}
+		e.undoIndex--
+		step := e.undoSteps[e.undoIndex]
+		for j := len(step.entries) - 1; j >= 0; j-- {
+			entry := step.entries[j]
+			e.spliceLines(entry.start, entry.start+len(entry.newLines), entry.oldLines)
+		}
+		e.restoreUndoCursor(step.cursor)
+	}
+	e.modified = e.undoIndex != e.savedUndoIndex
+	return nil
+}
+
+// Redo the next count steps that were undone, for "<C-r>".
+func (e *editorImpl) redo(count int) error {
+	if !e.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	e.closeUndoStep()
+	for i := 0; i < count; i++ {
+		if e.undoIndex == len(e.undoSteps) {
+			if i == 0 {
+				return errNewestChange
+			}
+			break
+		}
+		step := e.undoSteps[e.undoIndex]
+		e.undoIndex++
+		for _, entry := range step.entries {
+			e.spliceLines(entry.start, entry.start+len(entry.oldLines), entry.newLines)
+		}
+		e.restoreUndoCursor(position{step.entries[0].start, step.cursor.col})
+	}
+	e.modified = e.undoIndex != e.savedUndoIndex
+	return nil
+}
+
+// Move the cursor to pos after undoing or redoing, as far as the lines that are left allow.
+func (e *editorImpl) restoreUndoCursor(pos position) {
+	pos.line = min(pos.line, len(e.fileContents)-1)
+	pos.col = min(pos.col, max(len(e.fileContents[pos.line])-1, 0))
+	e.setCursorPosition(pos)
+}
@@ -1,45 +1,346 @@
 package internal
 
 import (
+	"math"
+	"strings"
+
 	gc "github.com/gbin/goncurses"
 )
 
-func newVisualModeEditor(baseEditor *editorImpl, startY int, startX int) *visualModeEditor {
-	return &visualModeEditor{editorImpl: baseEditor, cursorStartY: startY, cursorStartX: startX}
+func newVisualModeEditor(baseEditor *editorImpl, start position) *visualModeEditor {
+	return &visualModeEditor{editorImpl: baseEditor, start: start, kind: inclusive}
+}
+
+// The kinds of selection, by the key that starts VISUAL mode with it: chars ("v"), whole lines ("V")
+// or a block ("<C-v>").
+var visualKinds = map[string]motionKind{
+	"v":        inclusive,
+	"V":        linewise,
+	CTRL_V_KEY: blockwise,
 }
 
 type visualModeEditor struct {
 	*editorImpl
-	cursorStartY, cursorStartX int
+	// Where the selection started. The selection is between here and the cursor.
+	start position
+	// What's selected between the start and the cursor: chars (inclusive), whole lines (linewise) or
+	// a block (blockwise).
+	kind motionKind
+	// In a block, whether each line is selected to its end, after "$".
+	toLineEnd bool
+
+	// Keys of a multi-key command typed so far, e.g. "i" while waiting for "iw".
+	pendingKeys string
+	// The count typed before the command, e.g. 3 for "3j". 0 if none was typed.
+	count int
+	// The register given with "{register} before the operator, or 0 for the unnamed register.
+	register byte
+}
+
+// visualSelection is a selection kept after leaving VISUAL mode, for "gv" and the '< and '> marks.
+type visualSelection struct {
+	start, end position
+	kind       motionKind
+	toLineEnd  bool
+}
+
+// The current selection, as it would be kept.
+func (ve *visualModeEditor) visualSelection() visualSelection {
+	return visualSelection{start: ve.start, end: ve.cursorPosition(), kind: ve.kind, toLineEnd: ve.toLineEnd}
+}
+
+// Select the last selection again, for "gv". Lines that no longer exist aren't selected.
+func (e *editorImpl) reselect() error {
+	if e.lastVisual == nil {
+		return errBell
+	}
+	sel := *e.lastVisual
+	lastLine := len(e.fileContents) - 1
+	sel.start.line, sel.end.line = min(sel.start.line, lastLine), min(sel.end.line, lastLine)
+	e.swapEditorMode(VISUAL_MODE)
+	ve := e.activeEditorMode.(*visualModeEditor)
+	ve.start, ve.kind, ve.toLineEnd = sel.start, sel.kind, sel.toLineEnd
+	e.setCursorPosition(sel.end)
+	return nil
 }
 
 func (ve *visualModeEditor) Handle(key gc.Key) error {
-	switch k := gc.KeyString(key); k {
-	// TODO(omar): Lot's to reuse here. The movement commands for visual mode are the same as normal.
-	// Let's consider a refactor where we have the movements share common code.
+	k := gc.KeyString(key)
+	switch ve.pendingKeys {
+	case "":
+		if len(k) == 1 && k[0] >= '0' && k[0] <= '9' && (k != "0" || ve.count > 0) {
+			ve.count = ve.count*10 + int(k[0]-'0')
+			return nil
+		}
+	case "f", "t", "F", "T", "i", "a", "r", `"`:
+		// These commands take a char, e.g. the char to find, the kind of text object, or a register
+		// name.
+		cmd := ve.pendingKeys
+		ve.pendingKeys = ""
+		if key >= 0x100 || k == ESC_KEY {
+			ve.count, ve.register = 0, 0
+			return nil
+		}
+		if cmd == `"` {
+			// Use the register for the next operator.
+			if err := validateRegisterName(byte(key)); err != nil {
+				return err
+			}
+			ve.register = byte(key)
+			return nil
+		}
+		k = cmd + string(byte(key))
+	default:
+		k = ve.pendingKeys + k
+		ve.pendingKeys = ""
+	}
+	switch k {
+	case "g", "f", "t", "F", "T", "i", "a", "r", `"`:
+		// Wait for the rest of the command.
+		ve.pendingKeys = k
+		return nil
+	}
+	count := ve.count
+	ve.count = 0
+	switch k {
 	case ESC_KEY:
 		ve.swapEditorMode(NORMAL_MODE)
 		return nil
-	case "j", "down":
-		// Move the cursor down.
-		ve.moveCursorVertical(1)
+	case "v", "V", CTRL_V_KEY:
+		// Swap to another kind of selection, keeping its start. Typing the key for the current kind
+		// swaps back to NORMAL mode, like <Esc>.
+		if visualKinds[k] == ve.kind {
+			ve.swapEditorMode(NORMAL_MODE)
+			return nil
+		}
+		ve.kind = visualKinds[k]
+		return nil
+	case "o":
+		// Move the cursor to the other end of the selection.
+		cursor := ve.cursorPosition()
+		ve.setCursorPosition(ve.start)
+		ve.start = cursor
+		return nil
+	case "O":
+		// In a block, move the cursor to the other end of its line. Otherwise, like "o".
+		cursor := ve.cursorPosition()
+		if ve.kind != blockwise {
+			ve.setCursorPosition(ve.start)
+			ve.start = cursor
+			return nil
+		}
+		ve.setCursorPosition(position{cursor.line, ve.start.col})
+		ve.start.col = cursor.col
 		return nil
-	case "k", "up":
-		// Move the cursor up.
-		ve.moveCursorVertical(-1)
+	case "gv":
+		// Swap with the previous selection.
+		prev := ve.visualSelection()
+		if err := ve.reselect(); err != nil {
+			return err
+		}
+		ve.lastVisual = &prev
 		return nil
-	case "l", "right":
-		// Move the cursor right.
-		ve.moveCursorHorizontal(1, false /*pastLastCharAllowed*/)
+	case ":":
+		// Swap to COMMAND mode, with the range of the selected lines.
+		ve.swapEditorMode(COMMAND_MODE)
+		ce := ve.activeEditorMode.(*commandModeEditor)
+		ce.commandBuffer.WriteString("'<,'>")
+		ce.updateUserMsg()
 		return nil
-	case "h", "left":
-		// Move the cursor left.
-		ve.moveCursorHorizontal(-1, false /*pastLastCharAllowed*/)
+	case "!":
+		// Swap to COMMAND mode, to filter the selected lines through a shell command. See shell.go.
+		ve.swapEditorMode(COMMAND_MODE)
+		ce := ve.activeEditorMode.(*commandModeEditor)
+		ce.commandBuffer.WriteString("'<,'>!")
+		ce.updateUserMsg()
+		return nil
+	}
+	if ve.kind == blockwise {
+		if handled, err := ve.handleBlockCommand(k); handled {
+			return err
+		}
+	}
+	if handled, err := ve.handleOperator(k, count); handled {
+		return err
+	}
+	if strings.HasPrefix(k, "i") || strings.HasPrefix(k, "a") {
+		return ve.selectTextObject(k, count)
+	}
+	// Otherwise, it may be a motion that moves the cursor, e.g. "w". These are the same as in NORMAL
+	// mode.
+	to, _, err := ve.motion(k, count)
+	if err == errUnknownMotion {
+		ve.warnf("unrecognized key %s", k)
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	ve.setCursorPosition(to)
+	switch k {
+	case "$":
+		ve.toLineEnd = true
+	case "j", "down", "k", "up", "G", "gg":
+		// Moving between lines keeps the block going to the end of each line.
+	default:
+		ve.toLineEnd = false
+	}
 	return nil
 }
 
+// Operators that work on the whole lines of the selection, whatever its kind, and the operator that
+// they're the same as in VISUAL LINE mode. In a block, "D" and "C" instead work to the end of each
+// line.
+var visualLineOperators = map[string]string{
+	"X": "d",
+	"D": "d",
+	"Y": "y",
+	"C": "c",
+	"S": "c",
+	"R": "c",
+}
+
+// Apply an operator to the selection, and swap to NORMAL mode. Returns false if k isn't one.
+//
+//	d x y c s   delete, yank or change the selection
+//	> <         shift the lines right or left by count 'shiftwidth's
+//	=           reindent the lines
+//	~ u U       switch the case of the chars, or make them lower or upper case
+//	J           join the lines
+//	r{char}     replace each selected char with char
+func (ve *visualModeEditor) handleOperator(k string, count int) (bool, error) {
+	reg := ve.register
+	kind := ve.kind
+	if op, ok := visualLineOperators[k]; ok {
+		if kind == blockwise && (k == "D" || k == "C") {
+			ve.toLineEnd = true
+		} else {
+			kind = linewise
+		}
+		k = op
+	}
+	from, to := ve.getOrderedBounds()
+	spans := ve.selectedSpans(kind)
+	top, bottom := from.line, to.line
+	switch {
+	case k == "d", k == "x", k == "y", k == "c", k == "s":
+		if kind == blockwise {
+			return true, ve.applyBlockOperator(k, reg)
+		}
+		ve.swapEditorMode(NORMAL_MODE)
+		return true, ve.applyOperator(k[:1], reg, from, to, kind)
+	case k == ">", k == "<":
+		if !ve.bufOpts.modifiable {
+			return true, errNotModifiable
+		}
+		ve.swapEditorMode(NORMAL_MODE)
+		amount := max(count, 1)
+		if k == "<" {
+			amount = -amount
+		}
+		ve.shiftLines(top, bottom, amount)
+		ve.moveCursorToLine(top)
+		ve.cursorX = len(leadingWhitespace(ve.fileContents[top]))
+		return true, nil
+	case k == "=":
+		ve.swapEditorMode(NORMAL_MODE)
+		return true, ve.applyOperator(k, reg, from, to, linewise)
+	case k == "~", k == "u", k == "U", len(k) == 2 && k[0] == 'r':
+		if !ve.bufOpts.modifiable {
+			return true, errNotModifiable
+		}
+		var convert func(string) string
+		switch k {
+		case "~":
+			convert = switchCase
+		case "u":
+			convert = strings.ToLower
+		case "U":
+			convert = strings.ToUpper
+		default:
+			convert = func(text string) string { return strings.Repeat(k[1:], len(text)) }
+		}
+		ve.swapEditorMode(NORMAL_MODE)
+		newLines := make([]string, 0, len(spans))
+		for _, span := range spans {
+			line := ve.fileContents[span.line]
+			newLines = append(newLines, line[:span.start]+convert(line[span.start:span.end])+line[span.end:])
+		}
+		ve.replaceLines(top, bottom+1, newLines...)
+		ve.setCursorPosition(position{top, spans[0].start})
+		return true, nil
+	case k == "J":
+		ve.swapEditorMode(NORMAL_MODE)
+		// Like Vim, a single line is joined with the next one.
+		return true, ve.joinLines(top, max(bottom, top+1))
+	}
+	return false, nil
+}
+
+// Select a text object, e.g. "iw". When only one char is selected, the selection becomes the object.
+// Otherwise the selection is extended, like in Vim: words, sentences and paragraphs add the next ones,
+// and blocks select the block around the selection.
+func (ve *visualModeEditor) selectTextObject(k string, count int) error {
+	from, to := ve.getOrderedBounds()
+	objStart, objEnd, err := ve.selectionForObject(k, count)
+	if err != nil {
+		return err
+	}
+	if from == to && (objStart != from || objEnd != to) {
+		ve.start = objStart
+		ve.setCursorPosition(objEnd)
+		return nil
+	}
+	if strings.IndexByte("wWsp", k[1]) >= 0 {
+		next, ok := ve.nextPosition(to)
+		if !ok {
+			return errBell
+		}
+		ve.start = from
+		ve.setCursorPosition(next)
+		if _, objEnd, err = ve.selectionForObject(k, count); err != nil {
+			ve.setCursorPosition(to)
+			return err
+		}
+		ve.setCursorPosition(objEnd)
+		return nil
+	}
+	// Find the first block that is bigger than the selection.
+	for n := count; ; n++ {
+		objStart, objEnd, err := ve.selectionForObject(k, n)
+		if err != nil {
+			return err
+		}
+		if !from.before(objStart) && !objEnd.before(to) && (objStart != from || objEnd != to) {
+			ve.start = objStart
+			ve.setCursorPosition(objEnd)
+			return nil
+		}
+	}
+}
+
+// The first and last char that the text object at the cursor selects.
+func (ve *visualModeEditor) selectionForObject(k string, count int) (position, position, error) {
+	objStart, objEnd, kind, err := ve.textObject(k, count)
+	if err == errUnknownMotion {
+		ve.warnf("unrecognized key %s", k)
+		return objStart, objEnd, errBell
+	}
+	if err != nil {
+		return objStart, objEnd, err
+	}
+	switch kind {
+	case exclusive:
+		// The selection includes its last char, so it ends on the char before.
+		if prev, ok := ve.prevPosition(objEnd); ok && objStart.before(objEnd) {
+			objEnd = prev
+		}
+	case linewise:
+		objEnd.col = max(len(ve.fileContents[objEnd.line])-1, 0)
+	}
+	return objStart, objEnd, nil
+}
+
 func (ve *visualModeEditor) GetCursorYX() (int, int) {
 	return ve.cursorY, ve.normalizeCursorX()
 }
@@ -50,7 +351,7 @@ func (ve *visualModeEditor) GetChar(ch rune, y int, x int) gc.Char {
 		// In bounds, apply special UI.
 		return gc.A_UNDERLINE | gc.Char(ch)
 	}
-	return gc.Char(ch)
+	return ve.editorImpl.GetChar(ch, y, x)
 }
 
 func (ve *visualModeEditor) normalizeCursorX() int {
@@ -66,37 +367,186 @@ func (ve *visualModeEditor) normalizeCursorX() int {
 	return x
 }
 
+// Whether the char at y (relative to the top of the screen, like the cursor's y-pos) and x is selected.
 func (ve *visualModeEditor) isSelected(y int, x int) bool {
-	startY, startX, endY, endX := ve.getOrderedBounds()
-	if y < startY || y > endY {
-		// Not in the y bounds.
-		return false
-	}
-	// Satisfies the y-bounds, so check the x-bounds are satisfied.
-	if y == startY && x < startX {
-		// On the starting line, must be AFTER the x-pos.
-		return false
-	}
-	if y == endY && x > endX {
-		// On the ending line, must be BEFORE the x-pos.
-		return false
-	}
-	// Satisfies both y-bounds and x-bounds.
-	return true
-}
-
-func (ve *visualModeEditor) getOrderedBounds() (
-	int /*startY*/, int, /*startX*/
-	int /*endY*/, int, /*endY*/
-) {
-	if ve.cursorStartY < ve.cursorY {
-		return ve.cursorStartY, ve.cursorStartX, ve.cursorY, ve.cursorX
-	} else if ve.cursorStartY > ve.cursorY {
-		return ve.cursorY, ve.cursorX, ve.cursorStartY, ve.cursorStartX
-	}
-	// Otherwise, sort on x-pos.
-	if ve.cursorStartX < ve.cursorX {
-		return ve.cursorStartY, ve.cursorStartX, ve.cursorY, ve.cursorX
-	}
-	return ve.cursorY, ve.cursorX, ve.cursorStartY, ve.cursorStartX
+	from, to := ve.getOrderedBounds()
+	pos := position{line: y + ve.fileLineOffset, col: x}
+	switch ve.kind {
+	case linewise:
+		return pos.line >= from.line && pos.line <= to.line
+	case blockwise:
+		top, bottom, left, right := ve.getBlockBounds()
+		return pos.line >= top && pos.line <= bottom && x >= left && x <= right
+	}
+	return !pos.before(from) && !to.before(pos)
+}
+
+// The start and end of the selection, in order.
+func (ve *visualModeEditor) getOrderedBounds() (position, position) {
+	cursor := ve.cursorPosition()
+	if cursor.before(ve.start) {
+		return cursor, ve.start
+	}
+	return ve.start, cursor
+}
+
+// The lines and columns of a block selection, inclusive. After "$", right is past the end of every
+// line.
+func (ve *visualModeEditor) getBlockBounds() (top int, bottom int, left int, right int) {
+	cursor := ve.cursorPosition()
+	top, bottom = min(ve.start.line, cursor.line), max(ve.start.line, cursor.line)
+	left, right = min(ve.start.col, cursor.col), max(ve.start.col, cursor.col)
+	if ve.toLineEnd {
+		right = math.MaxInt - 1
+	}
+	return top, bottom, left, right
+}
+
+// lineSpan is the selected part of a line, from start up to, but not including, end.
+type lineSpan struct {
+	line, start, end int
+}
+
+// The selected part of each line, if the selection is of the given kind.
+func (ve *visualModeEditor) selectedSpans(kind motionKind) []lineSpan {
+	from, to := ve.getOrderedBounds()
+	_, _, left, right := ve.getBlockBounds()
+	spans := []lineSpan{}
+	for lineInd := from.line; lineInd <= to.line; lineInd++ {
+		line := ve.fileContents[lineInd]
+		start, end := 0, len(line)
+		switch kind {
+		case blockwise:
+			start, end = left, right+1
+		case inclusive:
+			if lineInd == from.line {
+				start = from.col
+			}
+			if lineInd == to.line {
+				end = to.col + 1
+			}
+		}
+		spans = append(spans, lineSpan{lineInd, min(start, len(line)), min(end, len(line))})
+	}
+	return spans
+}
+
+// The lines between top and bottom that end before col, so that they don't reach the block.
+func (ve *visualModeEditor) shortLines(top int, bottom int, col int) map[int]bool {
+	short := map[int]bool{}
+	for lineInd := top; lineInd <= bottom; lineInd++ {
+		if len(ve.fileContents[lineInd]) <= col {
+			short[lineInd] = true
+		}
+	}
+	return short
+}
+
+// Delete, yank or change a block, for "d", "y" and "c" in VISUAL block mode. The block's text is put
+// in the register as a block.
+func (ve *visualModeEditor) applyBlockOperator(op string, reg byte) error {
+	if op != "y" && !ve.bufOpts.modifiable {
+		return errNotModifiable
+	}
+	top, bottom, left, _ := ve.getBlockBounds()
+	short := ve.shortLines(top, bottom, left)
+	cut, rest := []string{}, []string{}
+	for _, span := range ve.selectedSpans(blockwise) {
+		line := ve.fileContents[span.line]
+		cut = append(cut, line[span.start:span.end])
+		rest = append(rest, line[:span.start]+line[span.end:])
+	}
+	ve.swapEditorMode(NORMAL_MODE)
+	ve.setCursorPosition(position{top, left})
+	block := register{text: strings.Join(cut, "\n"), blockwise: true}
+	if op == "y" {
+		return ve.setRegister(reg, block, true /*yank*/)
+	}
+	if err := ve.setRegister(reg, block, false /*yank*/); err != nil {
+		return err
+	}
+	ve.replaceLines(top, bottom+1, rest...)
+	ve.setCursorPosition(position{top, left})
+	if op == "c" || op == "s" {
+		return ve.startBlockInsert(blockInsert{top: top, bottom: bottom, col: left, skip: short})
+	}
+	return nil
+}
+
+// Handle a command that only works on a block. Returns false if k isn't one.
+//
+//	I   insert text before the block on each line
+//	A   append text after the block on each line
+func (ve *visualModeEditor) handleBlockCommand(k string) (bool, error) {
+	top, bottom, left, right := ve.getBlockBounds()
+	if (k == "I" || k == "A") && !ve.bufOpts.modifiable {
+		return true, errNotModifiable
+	}
+	switch k {
+	case "I":
+		short := ve.shortLines(top, bottom, left)
+		ve.swapEditorMode(NORMAL_MODE)
+		ve.setCursorPosition(position{top, left})
+		return true, ve.startBlockInsert(blockInsert{top: top, bottom: bottom, col: left, skip: short})
+	case "A":
+		b := blockInsert{top: top, bottom: bottom, col: right + 1, pad: true, toLineEnd: ve.toLineEnd}
+		if b.toLineEnd {
+			b.col = len(ve.fileContents[top])
+		}
+		ve.swapEditorMode(NORMAL_MODE)
+		ve.setCursorPosition(position{top, b.col})
+		if len(ve.fileContents[top]) < b.col {
+			ve.replaceLines(top, top+1, ve.fileContents[top]+strings.Repeat(" ", b.col-len(ve.fileContents[top])))
+		}
+		return true, ve.startBlockInsert(b)
+	}
+	return false, nil
+}
+
+// blockInsert is text typed on the first line of a block, for "I", "A" and "c" in VISUAL block mode.
+// When INSERT mode is left, the text is inserted on the other lines of the block too, unless it has
+// several lines.
+type blockInsert struct {
+	top, bottom int
+	// The column the text is inserted at on each line.
+	col int
+	// Short lines are padded with spaces up to col, for "A".
+	pad bool
+	// Lines that are left alone because they don't reach the block, for "I" and "c".
+	skip map[int]bool
+	// The text goes at the end of each line, after "$A".
+	toLineEnd bool
+}
+
+// Swap to INSERT mode at the cursor, to insert text on each line of a block.
+func (e *editorImpl) startBlockInsert(b blockInsert) error {
+	if err := e.enterInsertMode(); err != nil {
+		return err
+	}
+	e.activeEditorMode.(*insertModeEditor).block = &b
+	return nil
+}
+
+// Insert text on the lines of the block after the first, where it was typed.
+func (e *editorImpl) insertIntoBlock(b blockInsert, text string) {
+	if text == "" || strings.Contains(text, "\n") || b.bottom == b.top {
+		return
+	}
+	newLines := make([]string, 0, b.bottom-b.top)
+	for lineInd := b.top + 1; lineInd <= b.bottom; lineInd++ {
+		line := e.fileContents[lineInd]
+		col := b.col
+		if b.toLineEnd {
+			col = len(line)
+		}
+		switch {
+		case b.skip[lineInd]:
+		case len(line) >= col:
+			line = line[:col] + text + line[col:]
+		case b.pad:
+			line += strings.Repeat(" ", col-len(line)) + text
+		}
+		newLines = append(newLines, line)
+	}
+	e.replaceLines(b.top+1, b.bottom+1, newLines...)
 }
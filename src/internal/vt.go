@@ -0,0 +1,615 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// A VT100/xterm terminal emulator, which turns what a program in a terminal buffer writes into a grid
+// of cells, e.g. moving the cursor and clearing lines as it asks. See terminal.go. It understands
+// what shells and most programs use:
+//
+//	controls      BS, HT, LF, VT, FF and CR; BEL is ignored
+//	ESC 7, ESC 8  save and restore the cursor
+//	ESC D, E, M   index, next line and reverse index
+//	ESC c         reset
+//	CSI           moving the cursor (A-H, d, f, `, a, e), erasing (J, K, X), inserting and deleting
+//	              chars and lines (@, P, L, M), scrolling (S, T, r), attributes (m), modes (h, l),
+//	              saving the cursor (s, u), and status and attribute reports (n, c)
+//	OSC, DCS      e.g. window titles, which are skipped
+//
+// Of the attributes, bold, dim, underline and reverse are shown, and colors aren't. The modes are
+// showing the cursor (?25), application cursor keys (?1), autowrap (?7), and the alternate screen
+// (?47, ?1047 and ?1049) that full screen programs draw on. Lines that scroll off the top of the
+// main screen are kept in the scrollback.
+
+// The number of lines of scrollback that are kept.
+const cTerminalScrollback = 10000
+
+type vtState int
+
+const (
+	vtGround       vtState = iota
+	vtEscape               // After ESC.
+	vtCharset              // After ESC and e.g. "(", which selects a charset with the next byte.
+	vtCSI                  // After ESC [, reading the parameters.
+	vtString               // In an OSC or DCS string, until BEL or ST.
+	vtStringEscape         // After ESC in a string, which ends it if "\" follows.
+)
+
+// vtCell is a char on the terminal's screen, with its attributes.
+type vtCell struct {
+	ch    rune
+	attrs gc.Char
+}
+
+// vtCursor is where the next char goes, and the attributes it gets.
+type vtCursor struct {
+	row, col int
+	attrs    gc.Char
+}
+
+// vtScreen is the state of a terminal: its grid of cells, cursor and modes.
+type vtScreen struct {
+	rows, cols int
+	grid       [][]vtCell
+	cursor     vtCursor
+	saved      vtCursor
+	// Set when a char was put in the last column, so that the next one wraps onto the next line.
+	wrapPending bool
+	// The rows that scrolling moves, inclusive.
+	scrollTop, scrollBottom int
+
+	autowrap      bool
+	cursorVisible bool
+	appCursorKeys bool // Cursor keys send ESC O rather than ESC [.
+
+	// While the alternate screen is shown, the main screen and its cursor, to show again after.
+	mainGrid   [][]vtCell
+	mainCursor vtCursor
+
+	scrollback []string // Lines that scrolled off the top of the main screen, oldest first.
+	deleting   bool     // Set while rows are deleted, so they don't go to the scrollback.
+
+	// Parser state.
+	state   vtState
+	params  []int
+	private byte   // A "?", ">" or "=" at the start of a CSI's parameters.
+	partial []byte // The start of a UTF-8 char that hasn't all been written yet.
+
+	reply func(s string) // Sends reports, e.g. of the cursor position, back to the program.
+}
+
+func newVTScreen(rows int, cols int, reply func(s string)) *vtScreen {
+	v := &vtScreen{reply: reply}
+	v.reset(rows, cols)
+	return v
+}
+
+// Clear the screen and go back to the initial modes.
+func (v *vtScreen) reset(rows int, cols int) {
+	v.rows, v.cols = max(rows, 1), max(cols, 1)
+	v.grid = resizeGrid(nil, v.rows, v.cols)
+	v.cursor, v.saved, v.wrapPending = vtCursor{}, vtCursor{}, false
+	v.scrollTop, v.scrollBottom = 0, v.rows-1
+	v.autowrap, v.cursorVisible, v.appCursorKeys = true, true, false
+	v.mainGrid = nil
+	v.state = vtGround
+}
+
+func (v *vtScreen) blankRow() []vtCell {
+	return blankRow(v.cols)
+}
+
+func blankRow(cols int) []vtCell {
+	row := make([]vtCell, cols)
+	for i := range row {
+		row[i] = vtCell{ch: ' '}
+	}
+	return row
+}
+
+// grid cut or padded with blanks to rows and cols.
+func resizeGrid(grid [][]vtCell, rows int, cols int) [][]vtCell {
+	grid = grid[:min(len(grid), rows)]
+	for i, row := range grid {
+		if len(row) > cols {
+			grid[i] = row[:cols]
+		}
+		for len(grid[i]) < cols {
+			grid[i] = append(grid[i], vtCell{ch: ' '})
+		}
+	}
+	for len(grid) < rows {
+		grid = append(grid, blankRow(cols))
+	}
+	return grid
+}
+
+// Change the size of the screen. Rows that no longer fit above the cursor go to the scrollback, so
+// that the cursor stays on screen.
+func (v *vtScreen) resize(rows int, cols int) {
+	rows, cols = max(rows, 1), max(cols, 1)
+	if rows == v.rows && cols == v.cols {
+		return
+	}
+	if shift := v.cursor.row - rows + 1; shift > 0 {
+		for _, row := range v.grid[:shift] {
+			v.addScrollback(row)
+		}
+		v.grid = v.grid[shift:]
+		v.cursor.row -= shift
+		v.saved.row = max(v.saved.row-shift, 0)
+	}
+	v.rows, v.cols = rows, cols
+	v.grid = resizeGrid(v.grid, rows, cols)
+	if v.mainGrid != nil {
+		// The main screen is shown again at the new size.
+		v.mainGrid = resizeGrid(v.mainGrid, rows, cols)
+		v.mainCursor = v.clamped(v.mainCursor)
+	}
+	v.scrollTop, v.scrollBottom = 0, rows-1
+	v.cursor, v.saved = v.clamped(v.cursor), v.clamped(v.saved)
+	v.wrapPending = false
+}
+
+// c moved onto the screen, if it's past its last row or column.
+func (v *vtScreen) clamped(c vtCursor) vtCursor {
+	c.row, c.col = min(c.row, v.rows-1), min(c.col, v.cols-1)
+	return c
+}
+
+// Keep a row that scrolled off the top of the main screen.
+func (v *vtScreen) addScrollback(row []vtCell) {
+	if v.mainGrid != nil || v.deleting {
+		// The alternate screen has no scrollback, and deleted rows aren't kept.
+		return
+	}
+	v.scrollback = append(v.scrollback, strings.TrimRight(rowText(row), " "))
+	if len(v.scrollback) > cTerminalScrollback {
+		v.scrollback = slices.Delete(v.scrollback, 0, len(v.scrollback)-cTerminalScrollback)
+	}
+}
+
+func rowText(row []vtCell) string {
+	text := strings.Builder{}
+	for _, cell := range row {
+		text.WriteRune(cell.ch)
+	}
+	return text.String()
+}
+
+// The lines of the screen, without trailing blanks. Blank rows below the cursor are left out, and the
+// cursor's row is long enough for the cursor to be on it.
+func (v *vtScreen) lines() []string {
+	last := v.cursor.row
+	for i := v.rows - 1; i > last; i-- {
+		if strings.TrimRight(rowText(v.grid[i]), " ") != "" {
+			last = i
+			break
+		}
+	}
+	lines := make([]string, 0, last+1)
+	for i, row := range v.grid[:last+1] {
+		end := len(row)
+		for end > 0 && row[end-1].ch == ' ' && row[end-1].attrs == 0 {
+			end--
+		}
+		if i == v.cursor.row {
+			end = max(end, v.cursor.col)
+		}
+		lines = append(lines, rowText(row[:end]))
+	}
+	return lines
+}
+
+// The attributes of the cell at row and col, e.g. gc.A_BOLD.
+func (v *vtScreen) attrsAt(row int, col int) gc.Char {
+	if row < 0 || row >= v.rows || col < 0 || col >= v.cols {
+		return 0
+	}
+	return v.grid[row][col].attrs
+}
+
+// Interpret what the program wrote.
+func (v *vtScreen) write(data []byte) {
+	for _, b := range data {
+		v.writeByte(b)
+	}
+}
+
+func (v *vtScreen) writeByte(b byte) {
+	switch v.state {
+	case vtEscape:
+		v.escape(b)
+		return
+	case vtCharset:
+		v.state = vtGround
+		return
+	case vtCSI:
+		v.csiByte(b)
+		return
+	case vtString:
+		switch b {
+		case 0x07:
+			v.state = vtGround
+		case 0x1b:
+			v.state = vtStringEscape
+		}
+		return
+	case vtStringEscape:
+		// ESC \ ends the string, and any other ESC starts a new sequence.
+		v.state = vtGround
+		if b != '\\' {
+			v.escape(b)
+		}
+		return
+	}
+	if b < 0x20 || b == 0x7f {
+		v.partial = nil
+		v.control(b)
+		return
+	}
+	if b < 0x80 && v.partial == nil {
+		v.put(rune(b))
+		return
+	}
+	v.partial = append(v.partial, b)
+	if utf8.FullRune(v.partial) {
+		r, _ := utf8.DecodeRune(v.partial)
+		v.partial = nil
+		v.put(r)
+	}
+}
+
+// Handle a control char.
+func (v *vtScreen) control(b byte) {
+	switch b {
+	case 0x08:
+		v.cursor.col = max(v.cursor.col-1, 0)
+		v.wrapPending = false
+	case 0x09:
+		v.cursor.col = min((v.cursor.col/8+1)*8, v.cols-1)
+	case 0x0a, 0x0b, 0x0c:
+		v.lineFeed()
+	case 0x0d:
+		v.cursor.col = 0
+		v.wrapPending = false
+	case 0x1b:
+		v.state = vtEscape
+	}
+}
+
+// Put a char at the cursor, and move the cursor on.
+func (v *vtScreen) put(r rune) {
+	if v.wrapPending {
+		v.wrapPending = false
+		if v.autowrap {
+			v.cursor.col = 0
+			v.lineFeed()
+		}
+	}
+	v.grid[v.cursor.row][v.cursor.col] = vtCell{ch: r, attrs: v.cursor.attrs}
+	if v.cursor.col == v.cols-1 {
+		v.wrapPending = true
+	} else {
+		v.cursor.col++
+	}
+}
+
+// Move the cursor down a row, scrolling if it's at the bottom of the scroll region.
+func (v *vtScreen) lineFeed() {
+	v.wrapPending = false
+	switch {
+	case v.cursor.row == v.scrollBottom:
+		v.scrollUp(1)
+	case v.cursor.row < v.rows-1:
+		v.cursor.row++
+	}
+}
+
+// Scroll the rows of the scroll region up n rows, with blank rows at the bottom.
+func (v *vtScreen) scrollUp(n int) {
+	n = min(n, v.scrollBottom-v.scrollTop+1)
+	for i := 0; i < n; i++ {
+		if v.scrollTop == 0 {
+			v.addScrollback(v.grid[v.scrollTop])
+		}
+		copy(v.grid[v.scrollTop:v.scrollBottom], v.grid[v.scrollTop+1:v.scrollBottom+1])
+		v.grid[v.scrollBottom] = v.blankRow()
+	}
+}
+
+// Scroll the rows of the scroll region down n rows, with blank rows at the top.
+func (v *vtScreen) scrollDown(n int) {
+	n = min(n, v.scrollBottom-v.scrollTop+1)
+	for i := 0; i < n; i++ {
+		copy(v.grid[v.scrollTop+1:v.scrollBottom+1], v.grid[v.scrollTop:v.scrollBottom])
+		v.grid[v.scrollTop] = v.blankRow()
+	}
+}
+
+// Handle the byte after ESC.
+func (v *vtScreen) escape(b byte) {
+	v.state = vtGround
+	switch b {
+	case '[':
+		v.state, v.params, v.private = vtCSI, []int{0}, 0
+	case ']', 'P', 'X', '^', '_':
+		v.state = vtString
+	case '(', ')', '*', '+', '#', '%':
+		v.state = vtCharset
+	case '7':
+		v.saved = v.cursor
+	case '8':
+		v.cursor = v.clamped(v.saved)
+		v.wrapPending = false
+	case 'D':
+		v.lineFeed()
+	case 'E':
+		v.cursor.col = 0
+		v.lineFeed()
+	case 'M':
+		v.wrapPending = false
+		if v.cursor.row == v.scrollTop {
+			v.scrollDown(1)
+		} else {
+			v.cursor.row = max(v.cursor.row-1, 0)
+		}
+	case 'c':
+		v.reset(v.rows, v.cols)
+	case 0x1b:
+		v.state = vtEscape
+	}
+}
+
+// Handle a byte of a CSI sequence.
+func (v *vtScreen) csiByte(b byte) {
+	switch {
+	case b >= '0' && b <= '9':
+		last := len(v.params) - 1
+		v.params[last] = min(v.params[last]*10+int(b-'0'), 1<<16)
+	case b == ';' || b == ':':
+		v.params = append(v.params, 0)
+	case b == '?' || b == '>' || b == '=' || b == '<':
+		v.private = b
+	case b >= 0x20 && b <= 0x2f:
+		// Intermediate bytes, which none of the sequences that are handled have.
+	case b >= 0x40 && b <= 0x7e:
+		v.state = vtGround
+		v.csi(b)
+	case b == 0x1b:
+		v.state = vtEscape
+	case b < 0x20:
+		v.control(b)
+	default:
+		v.state = vtGround
+	}
+}
+
+// The ith parameter of the CSI sequence, or def if it's missing or 0.
+func (v *vtScreen) param(i int, def int) int {
+	if i < len(v.params) && v.params[i] > 0 {
+		return v.params[i]
+	}
+	return def
+}
+
+// Run a CSI sequence, whose final byte is final.
+func (v *vtScreen) csi(final byte) {
+	if v.private != 0 && final != 'h' && final != 'l' && final != 'c' {
+		// E.g. xterm's key modifier options, which don't change what's shown.
+		return
+	}
+	n := v.param(0, 1)
+	v.wrapPending = false
+	switch final {
+	case 'A':
+		v.cursor.row = max(v.cursor.row-n, 0)
+	case 'B', 'e':
+		v.cursor.row = min(v.cursor.row+n, v.rows-1)
+	case 'C', 'a':
+		v.cursor.col = min(v.cursor.col+n, v.cols-1)
+	case 'D':
+		v.cursor.col = max(v.cursor.col-n, 0)
+	case 'E':
+		v.cursor.row, v.cursor.col = min(v.cursor.row+n, v.rows-1), 0
+	case 'F':
+		v.cursor.row, v.cursor.col = max(v.cursor.row-n, 0), 0
+	case 'G', '`':
+		v.cursor.col = min(n, v.cols) - 1
+	case 'd':
+		v.cursor.row = min(n, v.rows) - 1
+	case 'H', 'f':
+		v.cursor.row, v.cursor.col = min(n, v.rows)-1, min(v.param(1, 1), v.cols)-1
+	case 'J':
+		v.eraseDisplay(v.param(0, 0))
+	case 'K':
+		v.eraseLine(v.param(0, 0))
+	case 'X':
+		v.clearCells(v.cursor.row, v.cursor.col, min(v.cursor.col+n, v.cols))
+	case '@':
+		row := v.grid[v.cursor.row]
+		n = min(n, v.cols-v.cursor.col)
+		copy(row[v.cursor.col+n:], row[v.cursor.col:])
+		v.clearCells(v.cursor.row, v.cursor.col, v.cursor.col+n)
+	case 'P':
+		row := v.grid[v.cursor.row]
+		n = min(n, v.cols-v.cursor.col)
+		copy(row[v.cursor.col:], row[v.cursor.col+n:])
+		v.clearCells(v.cursor.row, v.cols-n, v.cols)
+	case 'L', 'M':
+		if v.cursor.row < v.scrollTop || v.cursor.row > v.scrollBottom {
+			return
+		}
+		// Lines are inserted or deleted by scrolling the region from the cursor's row down.
+		top := v.scrollTop
+		v.scrollTop = v.cursor.row
+		if final == 'L' {
+			v.scrollDown(n)
+		} else {
+			v.withoutScrollback(func() { v.scrollUp(n) })
+		}
+		v.scrollTop = top
+		v.cursor.col = 0
+	case 'S':
+		v.withoutScrollback(func() { v.scrollUp(n) })
+	case 'T':
+		v.scrollDown(n)
+	case 'r':
+		top, bottom := v.param(0, 1)-1, min(v.param(1, v.rows), v.rows)-1
+		if top < bottom {
+			v.scrollTop, v.scrollBottom = top, bottom
+			v.cursor.row, v.cursor.col = 0, 0
+		}
+	case 'm':
+		v.setAttributes()
+	case 'h', 'l':
+		v.setModes(final == 'h')
+	case 's':
+		v.saved = v.cursor
+	case 'u':
+		v.cursor = v.clamped(v.saved)
+	case 'n':
+		switch v.param(0, 0) {
+		case 5:
+			v.reply("\x1b[0n")
+		case 6:
+			v.reply(fmt.Sprintf("\x1b[%d;%dR", v.cursor.row+1, v.cursor.col+1))
+		}
+	case 'c':
+		switch v.private {
+		case 0:
+			// A VT100 with advanced video.
+			v.reply("\x1b[?1;2c")
+		case '>':
+			v.reply("\x1b[>0;0;0c")
+		}
+	}
+}
+
+// Run f, which scrolls up, without the rows that go off the top going to the scrollback, as they're
+// deleted rather than scrolled off.
+func (v *vtScreen) withoutScrollback(f func()) {
+	v.deleting = true
+	defer func() { v.deleting = false }()
+	f()
+}
+
+// Clear the cells [from, to) of row.
+func (v *vtScreen) clearCells(row int, from int, to int) {
+	for col := from; col < to; col++ {
+		v.grid[row][col] = vtCell{ch: ' '}
+	}
+}
+
+// Handle CSI J: erase below the cursor (0), above it (1), or all of the screen (2), and the
+// scrollback too (3).
+func (v *vtScreen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		v.clearCells(v.cursor.row, v.cursor.col, v.cols)
+		for row := v.cursor.row + 1; row < v.rows; row++ {
+			v.grid[row] = v.blankRow()
+		}
+	case 1:
+		v.clearCells(v.cursor.row, 0, v.cursor.col+1)
+		for row := 0; row < v.cursor.row; row++ {
+			v.grid[row] = v.blankRow()
+		}
+	case 2, 3:
+		for row := range v.grid {
+			v.grid[row] = v.blankRow()
+		}
+		if mode == 3 {
+			v.scrollback = nil
+		}
+	}
+}
+
+// Handle CSI K: erase the line after the cursor (0), before it (1), or all of it (2).
+func (v *vtScreen) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		v.clearCells(v.cursor.row, v.cursor.col, v.cols)
+	case 1:
+		v.clearCells(v.cursor.row, 0, v.cursor.col+1)
+	case 2:
+		v.clearCells(v.cursor.row, 0, v.cols)
+	}
+}
+
+// Handle SGR, CSI m, setting the attributes of the chars that come next.
+func (v *vtScreen) setAttributes() {
+	for i := 0; i < len(v.params); i++ {
+		switch p := v.params[i]; p {
+		case 0:
+			v.cursor.attrs = 0
+		case 1:
+			v.cursor.attrs |= gc.A_BOLD
+		case 2:
+			v.cursor.attrs |= gc.A_DIM
+		case 4:
+			v.cursor.attrs |= gc.A_UNDERLINE
+		case 7:
+			v.cursor.attrs |= gc.A_REVERSE
+		case 22:
+			v.cursor.attrs &^= gc.A_BOLD | gc.A_DIM
+		case 24:
+			v.cursor.attrs &^= gc.A_UNDERLINE
+		case 27:
+			v.cursor.attrs &^= gc.A_REVERSE
+		case 38, 48, 58:
+			// An extended color, which takes 2 more parameters for one of 256 colors, or 4 for RGB.
+			if i+1 < len(v.params) && v.params[i+1] == 5 {
+				i += 2
+			} else if i+1 < len(v.params) && v.params[i+1] == 2 {
+				i += 4
+			}
+		}
+	}
+}
+
+// Handle CSI h and CSI l, which set and reset modes.
+func (v *vtScreen) setModes(set bool) {
+	if v.private != '?' {
+		// ANSI modes, e.g. insert mode, which programs rarely use.
+		return
+	}
+	for _, mode := range v.params {
+		switch mode {
+		case 1:
+			v.appCursorKeys = set
+		case 7:
+			v.autowrap = set
+		case 25:
+			v.cursorVisible = set
+		case 47, 1047, 1049:
+			v.setAlternateScreen(set, mode == 1049)
+		}
+	}
+}
+
+// Switch to the alternate screen, or back to the main one. With saveCursor, the cursor is saved
+// before switching to the alternate screen, and restored after switching back.
+func (v *vtScreen) setAlternateScreen(alternate bool, saveCursor bool) {
+	if alternate == (v.mainGrid != nil) {
+		return
+	}
+	if alternate {
+		v.mainGrid, v.mainCursor = v.grid, v.cursor
+		v.grid = resizeGrid(nil, v.rows, v.cols)
+		if saveCursor {
+			v.cursor.row, v.cursor.col = 0, 0
+		}
+		return
+	}
+	v.grid, v.mainGrid = v.mainGrid, nil
+	if saveCursor {
+		v.cursor = v.clamped(v.mainCursor)
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+
+	gc "github.com/gbin/goncurses"
+)
+
+// A terminal of the given size, with what it replies to the program kept in replies.
+func testVTScreen(rows int, cols int, replies *[]string) *vtScreen {
+	return newVTScreen(rows, cols, func(s string) {
+		if replies != nil {
+			*replies = append(*replies, s)
+		}
+	})
+}
+
+func TestVTScreenWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		rows, cols int
+		input      string
+		lines      []string
+		scrollback []string
+		cursor     [2]int
+	}{
+		{
+			name: "text and newlines", rows: 3, cols: 10,
+			input: "abc\r\ndef",
+			lines: []string{"abc", "def"}, cursor: [2]int{1, 3},
+		},
+		{
+			name: "autowrap", rows: 3, cols: 4,
+			input: "abcdef",
+			lines: []string{"abcd", "ef"}, cursor: [2]int{1, 2},
+		},
+		{
+			name: "the last column waits for the next char to wrap", rows: 3, cols: 4,
+			input: "abcd\r\nx",
+			lines: []string{"abcd", "x"}, cursor: [2]int{1, 1},
+		},
+		{
+			name: "scrolling to the scrollback", rows: 2, cols: 10,
+			input: "1\r\n2\r\n3\r\n4",
+			lines: []string{"3", "4"}, scrollback: []string{"1", "2"}, cursor: [2]int{1, 1},
+		},
+		{
+			name: "cursor position", rows: 3, cols: 10,
+			input: "\x1b[2;3Hx\x1b[1;1Hy",
+			lines: []string{"y", "  x"}, cursor: [2]int{0, 1},
+		},
+		{
+			name: "cursor movement is kept on the screen", rows: 3, cols: 5,
+			input: "\x1b[99B\x1b[99Cx\x1b[99A\x1b[99Dy",
+			lines: []string{"y", "", "    x"}, cursor: [2]int{0, 1},
+		},
+		{
+			name: "erase line", rows: 2, cols: 10,
+			input: "abcdef\x1b[3D\x1b[K",
+			lines: []string{"abc"}, cursor: [2]int{0, 3},
+		},
+		{
+			name: "erase display", rows: 3, cols: 10,
+			input: "a\r\nb\r\nc\x1b[2J\x1b[H",
+			lines: []string{""}, cursor: [2]int{0, 0},
+		},
+		{
+			name: "insert and delete chars", rows: 2, cols: 10,
+			input: "abcd\x1b[3G\x1b[2@xy\x1b[1G\x1b[P",
+			lines: []string{"bxycd"}, cursor: [2]int{0, 0},
+		},
+		{
+			name: "delete lines don't go to the scrollback", rows: 3, cols: 10,
+			input: "a\r\nb\r\nc\x1b[1;1H\x1b[M",
+			lines: []string{"b", "c"}, cursor: [2]int{0, 0},
+		},
+		{
+			name: "scroll region", rows: 4, cols: 10,
+			input: "a\r\nb\r\nc\r\nd\x1b[2;3r\x1b[3;1H\nx",
+			lines: []string{"a", "c", "x", "d"}, cursor: [2]int{2, 1},
+		},
+		{
+			name: "save and restore the cursor", rows: 3, cols: 10,
+			input: "ab\x1b7\r\ncd\x1b8x\x1b[s\x1b[3;1H\x1b[uy",
+			lines: []string{"abxy", "cd"}, cursor: [2]int{0, 4},
+		},
+		{
+			name: "UTF-8 split across writes", rows: 2, cols: 10,
+			input: "é\xe2\x82\xac",
+			lines: []string{"é€"}, cursor: [2]int{0, 2},
+		},
+		{
+			name: "OSC strings are skipped", rows: 2, cols: 10,
+			input: "\x1b]0;title\x07a\x1b]0;title\x1b\\b",
+			lines: []string{"ab"}, cursor: [2]int{0, 2},
+		},
+		{
+			name: "alternate screen", rows: 3, cols: 10,
+			input: "main\x1b[?1049h\x1b[Halt\x1b[?1049l",
+			lines: []string{"main"}, cursor: [2]int{0, 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := testVTScreen(test.rows, test.cols, nil)
+			// Written a byte at a time, as reading the pty may split sequences anywhere.
+			for _, b := range []byte(test.input) {
+				v.write([]byte{b})
+			}
+			if got := v.lines(); !slices.Equal(got, test.lines) {
+				t.Errorf("lines() = %q, want %q", got, test.lines)
+			}
+			if !slices.Equal(v.scrollback, test.scrollback) {
+				t.Errorf("scrollback = %q, want %q", v.scrollback, test.scrollback)
+			}
+			if got := [2]int{v.cursor.row, v.cursor.col}; got != test.cursor {
+				t.Errorf("cursor = %v, want %v", got, test.cursor)
+			}
+		})
+	}
+}
+
+func TestVTScreenAttributes(t *testing.T) {
+	v := testVTScreen(2, 10, nil)
+	v.write([]byte("a\x1b[1;4mb\x1b[38;5;196mc\x1b[22md\x1b[0me"))
+	want := []gc.Char{0, gc.A_BOLD | gc.A_UNDERLINE, gc.A_BOLD | gc.A_UNDERLINE, gc.A_UNDERLINE, 0}
+	for col, attrs := range want {
+		if got := v.attrsAt(0, col); got != attrs {
+			t.Errorf("attrsAt(0, %d) = %v, want %v", col, got, attrs)
+		}
+	}
+}
+
+func TestVTScreenModes(t *testing.T) {
+	v := testVTScreen(2, 10, nil)
+	v.write([]byte("\x1b[?1h\x1b[?25l"))
+	if !v.appCursorKeys || v.cursorVisible {
+		t.Errorf("appCursorKeys = %v, cursorVisible = %v after setting them", v.appCursorKeys, v.cursorVisible)
+	}
+	v.write([]byte("\x1b[?7labcdefghijklm"))
+	if got := v.lines(); !slices.Equal(got, []string{"abcdefghim"}) {
+		t.Errorf("lines() without autowrap = %q", got)
+	}
+}
+
+func TestVTScreenReplies(t *testing.T) {
+	var replies []string
+	v := testVTScreen(5, 10, &replies)
+	v.write([]byte("\x1b[3;4H\x1b[6n\x1b[5n"))
+	if want := []string{"\x1b[3;4R", "\x1b[0n"}; !slices.Equal(replies, want) {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+}
+
+func TestVTScreenResize(t *testing.T) {
+	v := testVTScreen(4, 10, nil)
+	v.write([]byte("1\r\n2\r\n3\r\n4"))
+	v.resize(2, 5)
+	if got := v.lines(); !slices.Equal(got, []string{"3", "4"}) {
+		t.Errorf("lines() = %q after shrinking", got)
+	}
+	if want := []string{"1", "2"}; !slices.Equal(v.scrollback, want) {
+		t.Errorf("scrollback = %q after shrinking, want %q", v.scrollback, want)
+	}
+	if v.cursor.row != 1 || v.cursor.col != 1 {
+		t.Errorf("cursor = %v after shrinking", v.cursor)
+	}
+}
+
+// A cursor saved before the terminal shrinks is restored on the smaller screen, rather than past it.
+func TestVTScreenResizeSavedCursor(t *testing.T) {
+	for _, restore := range []string{"\x1b8", "\x1b[u"} {
+		v := testVTScreen(10, 20, nil)
+		v.write([]byte("\x1b[10;20H\x1b7\x1b[s\x1b[1;1H"))
+		v.resize(5, 10)
+		v.write([]byte(restore + "x"))
+		if v.cursor.row >= v.rows || v.cursor.col >= v.cols {
+			t.Errorf("cursor = %v after restoring with %q on a %dx%d screen", v.cursor, restore, v.rows, v.cols)
+		}
+	}
+
+	v := testVTScreen(10, 20, nil)
+	v.write([]byte("\x1b[10;20H\x1b[?1049h"))
+	v.resize(5, 10)
+	v.write([]byte("\x1b[?1049lx"))
+	if v.cursor.row >= v.rows || v.cursor.col >= v.cols {
+		t.Errorf("cursor = %v after leaving the alternate screen on a %dx%d screen", v.cursor, v.rows, v.cols)
+	}
+}
@@ -0,0 +1,257 @@
+package internal
+
+import "errors"
+
+// Windows are laid out top to bottom, each the full width of the screen, between the tab line, if
+// there is one (see tabs.go), and the 2 rows for messages. A window has a status line below it,
+// except that the last one only has one if 'laststatus' is 2, or 1 and there are several windows.
+//
+//	:split [file], :sp  split the window in two, showing the file in the new one
+//	:close, :clo        close the window
+//	:only, :on          close all other windows
+//	:q                  close the window, or quit if it's the last one (see tabs.go)
+//	CTRL-W s            split the window
+//	CTRL-W w, CTRL-W W  go to the window below or above, wrapping around
+//	CTRL-W j, CTRL-W k  go to the window below or above
+//	CTRL-W p            go to the window that was current before
+//	CTRL-W c, CTRL-W q  close the window
+//	CTRL-W o            close all other windows
+//	CTRL-W =            make the windows the same height
+
+// window is a view onto a buffer. It has its own cursor and scroll position, so the same buffer may
+// be viewed at different places.
+type window struct {
+	*buffer
+
+	// The cursorX is not necessarily the column which the cursor occupies. See the moveCursorHorizontal
+	// function for more details.
+	// The cursorY is the line the cursor is on, relative to fileLineOffset. It is not necessarily the
+	// row of the screen, since long lines may wrap. See display_lines.go for the mapping to screen rows.
+	cursorY, cursorX int
+	fileLineOffset   int // Which line of the file is being shown at the top of the screen.
+	leftCol          int // The first display column shown when not wrapping.
+
+	// Where the window is on screen, as set by layoutWindows: the row of its first line of text, and
+	// its number of rows of text, which don't include its status line.
+	top, height int
+
+	winOpts windowOptions
+}
+
+func newWindow(buf *buffer, opts windowOptions) *window {
+	return &window{buffer: buf, winOpts: opts}
+}
+
+// Whether w has a status line below it.
+func (e *editorImpl) hasStatusLine(w *window) bool {
+	if w != e.windows[len(e.windows)-1] {
+		return true
+	}
+	return e.globalOpts.laststatus == 2 || (e.globalOpts.laststatus == 1 && len(e.windows) > 1)
+}
+
+// The number of rows the windows may take, for their text and status lines.
+func (e *editorImpl) windowRows() int {
+	maxY, _ := e.screen.MaxYX()
+	// The bottom 2 rows are for debug and user messages.
+	return maxY - 2 - e.tabLineRows()
+}
+
+// Set where each window is on screen. If the windows' heights don't add up to the rows there are,
+// e.g. because the screen was resized or a status line was added, the last window takes the
+// difference, or if it would be too small, all windows are made the same height.
+func (e *editorImpl) layoutWindows() {
+	rows := e.windowRows()
+	for _, w := range e.windows {
+		if e.hasStatusLine(w) {
+			rows--
+		}
+		rows -= w.height
+	}
+	last := e.windows[len(e.windows)-1]
+	if last.height+rows >= 1 {
+		last.height += rows
+	} else {
+		e.equalizeWindows()
+	}
+	top := e.tabLineRows()
+	for _, w := range e.windows {
+		w.top = top
+		top += w.height
+		if e.hasStatusLine(w) {
+			top++
+		}
+	}
+}
+
+// Make all windows the same height, as far as the rows divide. Earlier windows take any remainder.
+func (e *editorImpl) equalizeWindows() {
+	rows := e.windowRows()
+	for _, w := range e.windows {
+		if e.hasStatusLine(w) {
+			rows--
+		}
+	}
+	for i, w := range e.windows {
+		w.height = max(1, rows/len(e.windows))
+		if i < rows%len(e.windows) {
+			w.height++
+		}
+	}
+}
+
+// The window shown at the screen row y, and whether y is its status line. nil if no window is there.
+func (e *editorImpl) windowAt(y int) (*window, bool) {
+	for _, w := range e.windows {
+		if y >= w.top && y < w.top+w.height {
+			return w, false
+		}
+		if y == w.top+w.height && e.hasStatusLine(w) {
+			return w, true
+		}
+	}
+	return nil, false
+}
+
+// Split the current window, showing buf in a new window of height rows (0 for half) above it, or
+// below it if below is set. The new window becomes the current one, with the same view of the buffer
+// if it's the same buffer.
+func (e *editorImpl) splitWindow(buf *buffer, height int, below bool) error {
+	// The new window's status line takes a row too.
+	available := e.height - 1
+	if height == 0 {
+		height = available / 2
+	}
+	height = min(height, available-1)
+	if height < 1 {
+		return errors.New("not enough room")
+	}
+	w := newWindow(buf, e.winOpts)
+	if buf == e.buffer {
+		w.cursorY, w.cursorX, w.fileLineOffset, w.leftCol = e.cursorY, e.cursorX, e.fileLineOffset, e.leftCol
+	}
+	w.height = height
+	e.height = available - height
+	i := e.windowIndex(e.window)
+	if below {
+		i++
+	}
+	e.windows = append(e.windows[:i], append([]*window{w}, e.windows[i:]...)...)
+	e.setCurrentWindow(w)
+	e.layoutWindows()
+	return nil
+}
+
+// Close w, giving its rows to the window above it, or below it if it's the first. If it's the current
+// window, that window becomes the current one.
+func (e *editorImpl) closeWindow(w *window) error {
+	if len(e.windows) == 1 {
+		return errors.New("can't close the last window")
+	}
+	i := e.windowIndex(w)
+	neighbor := e.windows[max(i-1, 0)]
+	if i == 0 {
+		neighbor = e.windows[1]
+	}
+	neighbor.height += w.height + 1
+	e.windows = append(e.windows[:i], e.windows[i+1:]...)
+	if e.previousWindow == w {
+		e.previousWindow = nil
+	}
+	if e.window == w {
+		e.setCurrentWindow(neighbor)
+		e.previousWindow = nil
+	}
+	e.layoutWindows()
+	return nil
+}
+
+// Close all windows but the current one, which takes the whole screen.
+func (e *editorImpl) onlyWindow() {
+	e.windows = []*window{e.window}
+	e.previousWindow = nil
+	e.height = e.windowRows()
+	e.layoutWindows()
+}
+
+// Make w the current window.
+func (e *editorImpl) setCurrentWindow(w *window) {
+	if w == e.window {
+		return
+	}
+	e.closeUndoStep()
+	e.previousWindow = e.window
+	e.window = w
+	e.clampCursor()
+}
+
+// The index of w in the windows, or -1 if it isn't one of them.
+func (e *editorImpl) windowIndex(w *window) int {
+	for i, other := range e.windows {
+		if other == w {
+			return i
+		}
+	}
+	return -1
+}
+
+// Go to the window n below the current one, or above it if n is negative. With wrap, going past the
+// last window goes on from the first.
+func (e *editorImpl) moveToWindow(n int, wrap bool) error {
+	i := e.windowIndex(e.window) + n
+	if wrap {
+		i = ((i % len(e.windows)) + len(e.windows)) % len(e.windows)
+	}
+	i = max(0, min(i, len(e.windows)-1))
+	e.setCurrentWindow(e.windows[i])
+	return nil
+}
+
+// Run f with w as the current window, e.g. to draw it.
+func (e *editorImpl) withWindow(w *window, f func()) {
+	saved := e.window
+	e.window = w
+	defer func() { e.window = saved }()
+	f()
+}
+
+// Keep the cursor on a line of the buffer, which may have lost lines while it was shown in another
+// window.
+func (e *editorImpl) clampCursor() {
+	if lineInd := e.getCurrLineInd(); lineInd >= len(e.fileContents) || e.fileLineOffset >= len(e.fileContents) {
+		e.fileLineOffset = min(e.fileLineOffset, len(e.fileContents)-1)
+		e.moveCursorToLine(min(lineInd, len(e.fileContents)-1))
+	}
+}
+
+// Handle a window command, the key after CTRL-W.
+func (e *editorImpl) windowCommand(key string) error {
+	switch key {
+	case "s", "S":
+		return e.splitWindow(e.buffer, 0, false)
+	case "w", CTRL_W_KEY:
+		return e.moveToWindow(1, true)
+	case "W":
+		return e.moveToWindow(-1, true)
+	case "j", "down":
+		return e.moveToWindow(1, false)
+	case "k", "up":
+		return e.moveToWindow(-1, false)
+	case "p":
+		if e.previousWindow == nil {
+			return errBell
+		}
+		e.setCurrentWindow(e.previousWindow)
+		return nil
+	case "c", "q":
+		return e.closeWindow(e.window)
+	case "o":
+		e.onlyWindow()
+		return nil
+	case "=":
+		e.equalizeWindows()
+		e.layoutWindows()
+		return nil
+	}
+	return errBell
+}